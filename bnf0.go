@@ -258,7 +258,7 @@ func (ls *bnf0LexerState) NextToken() (Token, error) {
 	}
 	ls.skipWhitespace()
 	pre, err := ls.in.Peek(2)
-	if err != nil {
+	if err != nil && (err != io.EOF || len(pre) == 0) {
 		return nil, err
 	}
 	k := string(pre)
@@ -300,12 +300,16 @@ func (ls *bnf0LexerState) NextToken() (Token, error) {
 						return nil, errors.New("expected token")
 					}
 					tok = ls.makeToken(ls.lexer.id, string(id))
+					ls.pos += len(id)
+					ls.col += len(id)
 					return tok, nil
 				}
 			}
 		}
 	}
-	//ls.in.Discard(len(tok.Literal()))
+	ls.in.Discard(len(tok.Literal()))
+	ls.pos += len(tok.Literal())
+	ls.col += len(tok.Literal())
 	return tok, nil
 }
 
@@ -329,7 +333,7 @@ func (ls *bnf0LexerState) makeToken(term Term, literal string) Token {
 	ipos, iline, icol := ls.pos, ls.line, ls.col
 	epos, eline, ecol := ipos, iline, icol
 	if literal != "" {
-		for c := range []byte(literal[1:]) {
+		for _, c := range []byte(literal[1:]) {
 			if c == '\n' {
 				eline++
 				ecol = 1
@@ -444,6 +448,31 @@ func GetGrammarFromBnf0Ast(bnf0 ParseTreeNode) (Grammar, error) {
 	return gb.Build()
 }
 
+// ParseBnf0 reads a grammar written in bnf0 notation.
+func ParseBnf0(in io.Reader) (Grammar, error) {
+	lexer, err := NewBnf0Lexer()
+	if err != nil {
+		return nil, err
+	}
+	p, err := GenerateEarleyParser(lexer.Grammar())
+	if err != nil {
+		return nil, err
+	}
+	lex, err := lexer.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := p.Open(lex)
+	if err != nil {
+		return nil, err
+	}
+	ast, err := ps.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return GetGrammarFromBnf0Ast(ast)
+}
+
 /*
 	<bnf0> 	:= <decl>
 	       	|  <decl> <bnf0>
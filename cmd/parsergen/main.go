@@ -0,0 +1,65 @@
+// Command parsergen generates a standalone Go parser package from a bnf0
+// grammar file and, optionally, a lexr0 domain file for its lexer.  It is
+// intended to be run from go:generate:
+//
+//	//go:generate parsergen -grammar expr.bnf -domain expr.lexr -package expr -o expr_parser.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dtromb/parser"
+	"github.com/dtromb/parser/lexr"
+	"github.com/dtromb/parser/parsergen"
+)
+
+func main() {
+	grammarFile := flag.String("grammar", "", "bnf0 grammar file")
+	domainFile := flag.String("domain", "", "lexr0 domain file (optional)")
+	pkgName := flag.String("package", "", "package name of the generated source")
+	outFile := flag.String("o", "", "output file (default standard output)")
+	flag.Parse()
+	if *grammarFile == "" || *pkgName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*grammarFile, *domainFile, *pkgName, *outFile); err != nil {
+		fmt.Fprintln(os.Stderr, "parsergen: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(grammarFile, domainFile, pkgName, outFile string) error {
+	f, err := os.Open(grammarFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	g, err := parser.ParseBnf0(f)
+	if err != nil {
+		return err
+	}
+	var domain lexr.Domain
+	if domainFile != "" {
+		df, err := os.Open(domainFile)
+		if err != nil {
+			return err
+		}
+		defer df.Close()
+		if domain, err = lexr.ParseLexr0ForGrammar(g, df); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err = parsergen.GenerateParserSource(g, domain, pkgName, &buf); err != nil {
+		return err
+	}
+	if outFile != "" {
+		return os.WriteFile(outFile, buf.Bytes(), 0644)
+	}
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
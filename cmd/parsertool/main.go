@@ -0,0 +1,372 @@
+// Command parsertool is a grammar development tool.
+//
+//	parsertool check  -grammar g.bnf
+//	parsertool sets   -grammar g.bnf
+//	parsertool states -grammar g.bnf [-dot]
+//	parsertool lex    -domain d.lexr [-stats] [file]
+//	parsertool parse  [-grammar g.bnf -domain d.lexr [-context-aware]] [-format json|sexpr|xml|dot] [file]
+//	parsertool gen    -grammar g.bnf -package name [-domain d.lexr] [-scanner] [-o out.go]
+//	parsertool repl   [-grammar g.bnf -domain d.lexr [-context-aware]] [-backend earley|earley-tables]
+//
+// Grammars are bnf0 files.  A domain is a lexr0 file, or "lexr0" for the
+// built-in lexr0 domain.  parse without -grammar parses bnf0 input with the built-in bnf0
+// lexer; otherwise tokens from the domain lexer are matched to grammar
+// terminals by name, and -context-aware restricts the lexer to the terminals
+// the parser expects.  Input is read from standard input if no file is given.
+// repl reads input lines from standard input and parses each one as a
+// complete input; see :help for its commands.  Its only parser is Earley;
+// the earley-tables backend round-trips the Earley tables through
+// MarshalBinary and LoadEarleyParser before parsing.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dtromb/parser"
+	"github.com/dtromb/parser/lexr"
+	"github.com/dtromb/parser/parsergen"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = []*command{
+	{"check", "validate a bnf0 grammar", runCheck},
+	{"sets", "print nullable nonterminals and FIRST/FOLLOW sets", runSets},
+	{"states", "dump the Earley parser LR(0) item sets", runStates},
+	{"lex", "tokenize input with a lexr domain", runLex},
+	{"parse", "parse input and print the parse tree", runParse},
+	{"gen", "generate Go source for a parser or scanner", runGen},
+	{"repl", "interactively lex and parse input lines", runRepl},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: parsertool <command> [flags] [file]")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+			if err := cmd.run(fs, os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "parsertool %s: %s\n", cmd.name, err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+}
+
+func loadGrammar(filename string) (parser.Grammar, error) {
+	if filename == "" {
+		return nil, errors.New("a -grammar file is required")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parser.ParseBnf0(f)
+}
+
+// loadDomain loads the built-in lexr0 domain or a lexr0 file.  A file domain
+// is read over the terminals of g if g is not nil.
+func loadDomain(name string, g parser.Grammar) (lexr.Domain, error) {
+	switch name {
+	case "":
+		return nil, errors.New("a -domain is required")
+	case "lexr0":
+		return lexr.GenerateLexr0Domain(lexr.GenerateLexr0Grammar()), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if g != nil {
+		return lexr.ParseLexr0ForGrammar(g, f)
+	}
+	return lexr.ParseLexr0(f)
+}
+
+func openInput(fs *flag.FlagSet) (io.ReadCloser, error) {
+	switch fs.NArg() {
+	case 0:
+		return io.NopCloser(os.Stdin), nil
+	case 1:
+		return os.Open(fs.Arg(0))
+	}
+	return nil, errors.New("too many input files")
+}
+
+func runCheck(fs *flag.FlagSet, args []string) error {
+	grammarFile := fs.String("grammar", "", "bnf0 grammar file")
+	fs.Parse(args)
+	g, err := loadGrammar(*grammarFile)
+	if err != nil {
+		return err
+	}
+	defined := make(map[uint32]bool)
+	used := make(map[uint32]bool)
+	for i := 0; i < g.NumProductionRule(); i++ {
+		pr := g.ProductionRule(i)
+		defined[pr.Lhs().Id()] = true
+		for j := 0; j < pr.RhsLen(); j++ {
+			used[pr.Rhs(j).Id()] = true
+		}
+	}
+	problems := 0
+	for i := 0; i < g.NumNonterminal(); i++ {
+		nt := g.Nonterminal(i)
+		if nt.Special() {
+			continue
+		}
+		if !defined[nt.Id()] {
+			fmt.Printf("undefined nonterminal %s\n", parser.TermToString(nt))
+			problems++
+		} else if !used[nt.Id()] {
+			fmt.Printf("unused nonterminal %s\n", parser.TermToString(nt))
+		}
+	}
+	if _, err = parser.GenerateEarleyParser(g); err != nil {
+		return err
+	}
+	fmt.Printf("%d terminals, %d nonterminals, %d rules\n", g.NumTerminal(), g.NumNonterminal(), g.NumProductionRule())
+	if problems > 0 {
+		return errors.New(fmt.Sprintf("%d problems found", problems))
+	}
+	return nil
+}
+
+func runSets(fs *flag.FlagSet, args []string) error {
+	grammarFile := fs.String("grammar", "", "bnf0 grammar file")
+	fs.Parse(args)
+	g, err := loadGrammar(*grammarFile)
+	if err != nil {
+		return err
+	}
+	return writeSets(g, nil, os.Stdout)
+}
+
+// writeSets prints the nullable nonterminals and the FIRST/FOLLOW sets of
+// each nonterminal of g, or only those of nonterminal only if it is not nil.
+func writeSets(g parser.Grammar, only parser.Term, out io.Writer) error {
+	ig := parser.GetIndexedGrammar(g)
+	idxIf, err := ig.GetIndex(parser.GrammarIndexTypeNullability)
+	if err != nil {
+		return err
+	}
+	nullIndex := idxIf.(parser.NullabilityGrammarIndex)
+	idxIf, err = ig.GetIndex(parser.GrammarIndexTypeFirstFollow)
+	if err != nil {
+		return err
+	}
+	ffIndex := idxIf.(parser.FirstFollowGrammarIndex)
+	var nullable []string
+	for _, nt := range nullIndex.GetNullableNonterminals() {
+		nullable = append(nullable, parser.TermToString(nt))
+	}
+	sort.Strings(nullable)
+	fmt.Fprintf(out, "nullable: %s\n", strings.Join(nullable, " "))
+	nts := []parser.Term{ig.Asterisk()}
+	for i := 0; i < ig.NumNonterminal(); i++ {
+		if !ig.Nonterminal(i).Special() {
+			nts = append(nts, ig.Nonterminal(i))
+		}
+	}
+	for _, nt := range nts {
+		if only != nil && nt.Id() != only.Id() {
+			continue
+		}
+		fmt.Fprintf(out, "%s\n    FIRST  = { %s }\n    FOLLOW = { %s }\n", parser.TermToString(nt),
+			termList(ffIndex.First(nt)), termList(ffIndex.Follow(nt)))
+	}
+	return nil
+}
+
+func termList(terms []parser.Term) string {
+	names := make([]string, len(terms))
+	for i, t := range terms {
+		names[i] = parser.TermToString(t)
+	}
+	return strings.Join(names, " ")
+}
+
+func runStates(fs *flag.FlagSet, args []string) error {
+	grammarFile := fs.String("grammar", "", "bnf0 grammar file")
+	dot := fs.Bool("dot", false, "write a GraphViz DOT graph")
+	fs.Parse(args)
+	g, err := loadGrammar(*grammarFile)
+	if err != nil {
+		return err
+	}
+	p, err := parser.GenerateEarleyParser(g)
+	if err != nil {
+		return err
+	}
+	if *dot {
+		return parser.WriteEarleyParserDot(p, os.Stdout)
+	}
+	return parser.WriteEarleyParserStates(p, os.Stdout)
+}
+
+func runLex(fs *flag.FlagSet, args []string) error {
+	domainName := fs.String("domain", "", "lexr domain")
+	stats := fs.Bool("stats", false, "print DFA state counts before and after minimization")
+	fs.Parse(args)
+	domain, err := loadDomain(*domainName, nil)
+	if err != nil {
+		return err
+	}
+	lexer, err := lexr.CreateLexrLexer(domain)
+	if err != nil {
+		return err
+	}
+	if *stats {
+		unminimized, minimized := lexer.(lexr.DfaStatistics).StateCounts()
+		fmt.Fprintf(os.Stderr, "%d dfa states, %d before minimization\n", minimized, unminimized)
+	}
+	in, err := openInput(fs)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	lex, err := lexer.Open(in)
+	if err != nil {
+		return err
+	}
+	for {
+		more, err := lex.HasMoreTokens()
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+		tok, err := lex.NextToken()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d:%d\t%s\t%q\n", tok.FirstLine(), tok.FirstColumn(), parser.TermToString(tok.Terminal()), tok.Literal())
+	}
+}
+
+func runParse(fs *flag.FlagSet, args []string) error {
+	grammarFile := fs.String("grammar", "", "bnf0 grammar file (default: parse bnf0)")
+	domainName := fs.String("domain", "", "lexr domain")
+	contextAware := fs.Bool("context-aware", false, "lex only the terminals the parser expects")
+	format := fs.String("format", "json", "output format: json, sexpr, xml or dot")
+	fs.Parse(args)
+	var open func(in io.Reader) (parser.ParserState, error)
+	if *grammarFile == "" {
+		lexer, err := parser.NewBnf0Lexer()
+		if err != nil {
+			return err
+		}
+		p, err := parser.GenerateEarleyParser(lexer.Grammar())
+		if err != nil {
+			return err
+		}
+		open = func(in io.Reader) (parser.ParserState, error) {
+			lex, err := lexer.Open(in)
+			if err != nil {
+				return nil, err
+			}
+			return p.Open(lex)
+		}
+	} else {
+		g, err := loadGrammar(*grammarFile)
+		if err != nil {
+			return err
+		}
+		domain, err := loadDomain(*domainName, g)
+		if err != nil {
+			return err
+		}
+		pl, err := lexr.NewPipeline(domain, g)
+		if err != nil {
+			return err
+		}
+		pl.Lexer().(lexr.ContextAwareLexer).SetContextAware(*contextAware)
+		open = pl.Open
+	}
+	in, err := openInput(fs)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	ps, err := open(in)
+	if err != nil {
+		return err
+	}
+	ast, err := ps.Parse()
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		return parser.WriteTreeJSON(ast, os.Stdout)
+	case "sexpr":
+		return parser.WriteTreeSexpr(ast, os.Stdout)
+	case "xml":
+		return parser.WriteTreeXML(ast, os.Stdout)
+	case "dot":
+		return parser.WriteTreeDot(ast, os.Stdout)
+	}
+	return errors.New("unknown output format '" + *format + "'")
+}
+
+func runGen(fs *flag.FlagSet, args []string) error {
+	grammarFile := fs.String("grammar", "", "bnf0 grammar file")
+	domainName := fs.String("domain", "", "lexr domain")
+	pkgName := fs.String("package", "", "package name of the generated source")
+	scanner := fs.Bool("scanner", false, "generate a switch-based scanner for the domain only")
+	outFile := fs.String("o", "", "output file (default standard output)")
+	fs.Parse(args)
+	if *pkgName == "" {
+		return errors.New("a -package name is required")
+	}
+	var g parser.Grammar
+	var domain lexr.Domain
+	var err error
+	if *grammarFile != "" || !*scanner {
+		if g, err = loadGrammar(*grammarFile); err != nil {
+			return err
+		}
+	}
+	if *domainName != "" || *scanner {
+		if domain, err = loadDomain(*domainName, g); err != nil {
+			return err
+		}
+	}
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if *scanner {
+		return parsergen.GenerateScannerSource(domain, *pkgName, out)
+	}
+	return parsergen.GenerateParserSource(g, domain, *pkgName, out)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dtromb/parser"
+	"github.com/dtromb/parser/lexr"
+)
+
+// backends maps the names accepted by -backend and :backend to parser
+// constructors.  Every backend is driven only through the Parser interface.
+// Earley is the only parsing algorithm; earley-tables is the same parser
+// reloaded from its binary tables, to check that they round-trip.
+var backends = map[string]func(g parser.Grammar) (parser.Parser, error){
+	"earley":        parser.GenerateEarleyParser,
+	"earley-tables": loadTableParser,
+}
+
+// loadTableParser builds an Earley parser and reloads it from its binary
+// tables, as a program shipping precomputed tables would.
+func loadTableParser(g parser.Grammar) (parser.Parser, error) {
+	p, err := parser.GenerateEarleyParser(g)
+	if err != nil {
+		return nil, err
+	}
+	data, err := p.(interface{ MarshalBinary() ([]byte, error) }).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return parser.LoadEarleyParser(g, data)
+}
+
+func backendNames() string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+type replSession struct {
+	grammarFile string
+	domainName  string
+	aware       bool
+	backend     string
+	grammar     parser.Grammar
+	lexer       parser.Lexer
+	parser      parser.Parser
+	pipeline    lexr.Pipeline
+	tracer      parser.Tracer
+	out         io.Writer
+}
+
+const replHelp = `input lines are lexed and parsed; commands are:
+  :reload          re-read the grammar and domain
+  :trace on|off    trace lexer and parser steps
+  :rule NAME       show the productions of a nonterminal
+  :sets [NAME]     show nullability and FIRST/FOLLOW sets
+  :backend [NAME]  show or select the parser backend (earley-tables
+                   reloads the Earley parser from its binary tables)
+  :help            show this message
+  :quit            leave the repl
+`
+
+func runRepl(fs *flag.FlagSet, args []string) error {
+	grammarFile := fs.String("grammar", "", "bnf0 grammar file (default: parse bnf0)")
+	domainName := fs.String("domain", "", "lexr domain")
+	contextAware := fs.Bool("context-aware", false, "lex only the terminals the parser expects")
+	backend := fs.String("backend", "earley", "parser backend: "+backendNames())
+	fs.Parse(args)
+	rs := &replSession{
+		grammarFile: *grammarFile,
+		domainName:  *domainName,
+		aware:       *contextAware,
+		backend:     *backend,
+		out:         os.Stdout,
+	}
+	if err := rs.load(); err != nil {
+		return err
+	}
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(rs.out, "> ")
+		if !in.Scan() {
+			fmt.Fprintln(rs.out)
+			return in.Err()
+		}
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, ":") {
+			rs.parseLine(line)
+			continue
+		}
+		fields := strings.Fields(line)
+		var err error
+		switch fields[0] {
+		case ":quit", ":q":
+			return nil
+		case ":help", ":h":
+			fmt.Fprint(rs.out, replHelp)
+		case ":reload":
+			err = rs.load()
+		case ":trace":
+			err = rs.setTrace(fields[1:])
+		case ":rule":
+			err = rs.showRule(fields[1:])
+		case ":sets":
+			err = rs.showSets(fields[1:])
+		case ":backend":
+			err = rs.selectBackend(fields[1:])
+		default:
+			err = errors.New("unknown command '" + fields[0] + "' (try :help)")
+		}
+		if err != nil {
+			fmt.Fprintf(rs.out, "error: %s\n", err.Error())
+		}
+	}
+}
+
+// load (re)builds the grammar, lexer and parser.  The session is left
+// unchanged if any of them fails.
+func (rs *replSession) load() error {
+	var g parser.Grammar
+	var lexer parser.Lexer
+	var pl lexr.Pipeline
+	var err error
+	if rs.grammarFile == "" {
+		if lexer, err = parser.NewBnf0Lexer(); err != nil {
+			return err
+		}
+		g = lexer.Grammar()
+	} else {
+		if g, err = loadGrammar(rs.grammarFile); err != nil {
+			return err
+		}
+		domain, err := loadDomain(rs.domainName, g)
+		if err != nil {
+			return err
+		}
+		if pl, err = lexr.NewPipeline(domain, g); err != nil {
+			return err
+		}
+		pl.Lexer().(lexr.ContextAwareLexer).SetContextAware(rs.aware)
+		lexer = pl.Lexer()
+	}
+	newParser, has := backends[rs.backend]
+	if !has {
+		return errors.New("unknown backend '" + rs.backend + "' (one of: " + backendNames() + ")")
+	}
+	p, err := newParser(g)
+	if err != nil {
+		return err
+	}
+	if pl != nil {
+		if err = pl.SetParser(p); err != nil {
+			return err
+		}
+	}
+	rs.grammar, rs.lexer, rs.parser, rs.pipeline = g, lexer, p, pl
+	rs.applyTracer()
+	fmt.Fprintf(rs.out, "%d terminals, %d nonterminals, %d rules (%s backend)\n",
+		g.NumTerminal(), g.NumNonterminal(), g.NumProductionRule(), rs.backend)
+	return nil
+}
+
+func (rs *replSession) applyTracer() {
+	for _, x := range []interface{}{rs.lexer, rs.parser} {
+		if tr, ok := x.(parser.Traceable); ok {
+			tr.SetTracer(rs.tracer)
+		}
+	}
+}
+
+// openParser opens the session parser over input, through the pipeline
+// when the tokens come from a lexr domain.
+func (rs *replSession) openParser(input string) (parser.ParserState, error) {
+	if rs.pipeline != nil {
+		return rs.pipeline.Open(strings.NewReader(input))
+	}
+	lex, err := rs.lexer.Open(strings.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+	return rs.parser.Open(lex)
+}
+
+func (rs *replSession) parseLine(line string) {
+	// The trace is only wanted for the parse, so lex the tokens untraced.
+	lex, err := rs.lexer.Open(strings.NewReader(line))
+	if err != nil {
+		fmt.Fprintf(rs.out, "error: %s\n", err.Error())
+		return
+	}
+	if tr, ok := lex.(parser.Traceable); ok {
+		tr.SetTracer(nil)
+	}
+	fmt.Fprint(rs.out, "tokens:")
+	for {
+		more, err := lex.HasMoreTokens()
+		if err == nil && more {
+			var tok parser.Token
+			if tok, err = lex.NextToken(); err == nil {
+				fmt.Fprintf(rs.out, " %s(%q)", parser.TermToString(tok.Terminal()), tok.Literal())
+				continue
+			}
+		}
+		fmt.Fprintln(rs.out)
+		if err != nil {
+			fmt.Fprintf(rs.out, "lex error: %s\n", err.Error())
+			return
+		}
+		break
+	}
+	ps, err := rs.openParser(line)
+	if err != nil {
+		fmt.Fprintf(rs.out, "error: %s\n", err.Error())
+		return
+	}
+	ast, err := ps.Parse()
+	switch e := err.(type) {
+	case nil:
+		parser.WriteTreeSexpr(ast, rs.out)
+	case *parser.ParseError:
+		if e.Token != nil {
+			fmt.Fprintf(rs.out, "syntax error at %d:%d: unexpected %s %q\n", e.Token.FirstLine(), e.Token.FirstColumn(),
+				parser.TermToString(e.Token.Terminal()), e.Token.Literal())
+		} else {
+			fmt.Fprintln(rs.out, "syntax error: unexpected end of input")
+		}
+		fmt.Fprintf(rs.out, "expected: %s\n", termList(e.Expected))
+	case *parser.AmbiguityError:
+		fmt.Fprintf(rs.out, "ambiguous: %s has more than one derivation\n", parser.TermToString(e.Nonterminal))
+		for _, pr := range e.Rules {
+			fmt.Fprintf(rs.out, "    %s\n", parser.ProductionRuleToString(pr))
+		}
+	default:
+		fmt.Fprintf(rs.out, "error: %s\n", err.Error())
+	}
+}
+
+func (rs *replSession) setTrace(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: :trace on|off")
+	}
+	switch args[0] {
+	case "on":
+		rs.tracer = parser.NewTextTracer(rs.out)
+	case "off":
+		rs.tracer = nil
+	default:
+		return errors.New("usage: :trace on|off")
+	}
+	rs.applyTracer()
+	return nil
+}
+
+// lookupNonterminal finds a nonterminal by name, with or without the angle
+// brackets TermToString adds.
+func (rs *replSession) lookupNonterminal(name string) (parser.Term, error) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "<"), ">")
+	if name == "`*" {
+		return rs.grammar.Asterisk(), nil
+	}
+	for i := 0; i < rs.grammar.NumNonterminal(); i++ {
+		if nt := rs.grammar.Nonterminal(i); nt.Name() == name && !nt.Special() {
+			return nt, nil
+		}
+	}
+	return nil, errors.New("no nonterminal named '" + name + "'")
+}
+
+func (rs *replSession) showRule(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: :rule NAME")
+	}
+	nt, err := rs.lookupNonterminal(args[0])
+	if err != nil {
+		return err
+	}
+	var uses []parser.ProductionRule
+	for i := 0; i < rs.grammar.NumProductionRule(); i++ {
+		pr := rs.grammar.ProductionRule(i)
+		if pr.Lhs().Id() == nt.Id() {
+			fmt.Fprintf(rs.out, "%s\n", parser.ProductionRuleToString(pr))
+		}
+		for j := 0; j < pr.RhsLen(); j++ {
+			if pr.Rhs(j).Id() == nt.Id() {
+				uses = append(uses, pr)
+				break
+			}
+		}
+	}
+	if len(uses) > 0 {
+		fmt.Fprintln(rs.out, "used in:")
+		for _, pr := range uses {
+			fmt.Fprintf(rs.out, "    %s\n", parser.ProductionRuleToString(pr))
+		}
+	}
+	return nil
+}
+
+func (rs *replSession) showSets(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: :sets [NAME]")
+	}
+	var only parser.Term
+	if len(args) == 1 {
+		var err error
+		if only, err = rs.lookupNonterminal(args[0]); err != nil {
+			return err
+		}
+	}
+	return writeSets(rs.grammar, only, rs.out)
+}
+
+func (rs *replSession) selectBackend(args []string) error {
+	switch len(args) {
+	case 0:
+		fmt.Fprintf(rs.out, "%s (available: %s)\n", rs.backend, backendNames())
+		return nil
+	case 1:
+		old := rs.backend
+		rs.backend = args[0]
+		if err := rs.load(); err != nil {
+			rs.backend = old
+			return err
+		}
+		return nil
+	}
+	return errors.New("usage: :backend [NAME]")
+}
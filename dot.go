@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// DotQuote returns s as a double-quoted GraphViz DOT string.
+func DotQuote(s string) string {
+	var buf []byte
+	buf = append(buf, '"')
+	for _, c := range []byte(s) {
+		switch c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+		default:
+			buf = append(buf, c)
+		}
+	}
+	buf = append(buf, '"')
+	return string(buf)
+}
+
+// dotQuoteLeftLines quotes lines as a single Graphviz label, ending each
+// line with a left-justifying \l break.
+func dotQuoteLeftLines(lines []string) string {
+	buf := []byte{'"'}
+	for _, line := range lines {
+		q := DotQuote(line)
+		buf = append(buf, q[1:len(q)-1]...)
+		buf = append(buf, '\\', 'l')
+	}
+	buf = append(buf, '"')
+	return string(buf)
+}
+
+// WriteGrammarDot writes the dependency graph of g: an edge A -> B for
+// every term B appearing on the right hand side of some production of A.
+func WriteGrammarDot(g Grammar, out io.Writer) error {
+	bout := bufio.NewWriter(out)
+	bout.WriteString("digraph grammar {\n")
+	names := make(map[uint32]string)
+	nodeName := func(t Term) string {
+		if n, has := names[t.Id()]; has {
+			return n
+		}
+		n := fmt.Sprintf("t%d", t.Id())
+		names[t.Id()] = n
+		shape := "box"
+		if !t.Terminal() {
+			shape = "ellipse"
+		}
+		if t.Special() {
+			shape = "plaintext"
+		}
+		bout.WriteString(fmt.Sprintf("  %s [label=%s shape=%s];\n", n, DotQuote(TermToString(t)), shape))
+		return n
+	}
+	prods := sortedprods(make([]ProductionRule, g.NumProductionRule()))
+	for i := 0; i < g.NumProductionRule(); i++ {
+		prods[i] = g.ProductionRule(i)
+	}
+	sort.Sort(prods)
+	seen := make(map[uint64]bool)
+	for _, pr := range prods {
+		lhs := nodeName(pr.Lhs())
+		for i := 0; i < pr.RhsLen(); i++ {
+			rt := pr.Rhs(i)
+			key := (uint64(pr.Lhs().Id()) << 32) | uint64(rt.Id())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			bout.WriteString(fmt.Sprintf("  %s -> %s;\n", lhs, nodeName(rt)))
+		}
+	}
+	bout.WriteString("}\n")
+	return bout.Flush()
+}
+
+// WriteTreeDot writes a parse tree as a DOT graph, one graph node per tree
+// node, with leaves labelled by their terminal and token literal.
+func WriteTreeDot(node ParseTreeNode, out io.Writer) error {
+	bout := bufio.NewWriter(out)
+	bout.WriteString("digraph tree {\n")
+	bout.WriteString("  ordering=out;\n")
+	nextId := 0
+	var writeNode func(n ParseTreeNode) string
+	writeNode = func(n ParseTreeNode) string {
+		id := fmt.Sprintf("n%d", nextId)
+		nextId++
+		name := "?"
+		if t := parseTreeNodeTerm(n); t != nil {
+			name = TermToString(t)
+		}
+		if n.Production() != nil {
+			bout.WriteString(fmt.Sprintf("  %s [label=%s];\n", id, DotQuote(name)))
+			for _, c := range parseTreeNodeChildren(n) {
+				cid := writeNode(c)
+				bout.WriteString(fmt.Sprintf("  %s -> %s;\n", id, cid))
+			}
+		} else {
+			label := name
+			if n.Token() != nil {
+				label = name + "\n" + n.Token().Literal()
+			}
+			bout.WriteString(fmt.Sprintf("  %s [label=%s shape=box];\n", id, DotQuote(label)))
+		}
+		return id
+	}
+	writeNode(node)
+	bout.WriteString("}\n")
+	return bout.Flush()
+}
+
+// WriteEarleyParserDot writes the LR(0) item-state automaton underlying a
+// parser created by GenerateEarleyParser.  Kernel states are drawn solid
+// and their nonkernel (`e) successors dashed.
+func WriteEarleyParserDot(p Parser, out io.Writer) error {
+	ep, ok := p.(*earleyParser)
+	if !ok {
+		return errors.New("parser was not created by GenerateEarleyParser")
+	}
+	if ep.generator == nil {
+		return errors.New("parser item states are not retained by loaded parser tables")
+	}
+	bout := bufio.NewWriter(out)
+	bout.WriteString("digraph earley {\n")
+	bout.WriteString("  node [shape=box fontname=monospace];\n")
+	for _, st := range ep.generator.states {
+		var label []string
+		kmark := "k"
+		style := "solid"
+		if !st.kernel {
+			kmark = "nk"
+			style = "dashed"
+		}
+		label = append(label, fmt.Sprintf("[%d] %s", st.id, kmark))
+		for _, lr := range st.itemSet.items {
+			label = append(label, lr.String())
+		}
+		if st.id == ep.acceptStateIndex {
+			style += ",bold"
+		}
+		bout.WriteString(fmt.Sprintf("  s%d [label=%s style=%s];\n", st.id,
+			dotQuoteLeftLines(label), DotQuote(style)))
+		terms := make([]Term, 0, len(st.transitions))
+		for t, _ := range st.transitions {
+			terms = append(terms, t)
+		}
+		sort.Sort(dotTermsById(terms))
+		for _, t := range terms {
+			ns := st.transitions[t]
+			if t.Id() == ep.grammar.Epsilon().Id() {
+				bout.WriteString(fmt.Sprintf("  s%d -> s%d [style=dashed];\n", st.id, ns.id))
+			} else {
+				bout.WriteString(fmt.Sprintf("  s%d -> s%d [label=%s];\n", st.id, ns.id, DotQuote(TermToString(t))))
+			}
+		}
+	}
+	bout.WriteString("}\n")
+	return bout.Flush()
+}
+
+type dotTermsById []Term
+
+func (ts dotTermsById) Len() int           { return len(ts) }
+func (ts dotTermsById) Less(i, j int) bool { return ts[i].Id() < ts[j].Id() }
+func (ts dotTermsById) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// dotTestToken is a token with a literal the bnf0 lexer cannot produce.
+type dotTestToken struct {
+	Token
+	term    Term
+	literal string
+}
+
+func (dt *dotTestToken) Terminal() Term  { return dt.term }
+func (dt *dotTestToken) Literal() string { return dt.literal }
+
+type dotTestLeaf struct {
+	token *dotTestToken
+}
+
+func (dl *dotTestLeaf) Parser() Parser              { return nil }
+func (dl *dotTestLeaf) Token() Token                { return dl.token }
+func (dl *dotTestLeaf) Production() ProductionRule  { return nil }
+func (dl *dotTestLeaf) NumChildren() int            { return 0 }
+func (dl *dotTestLeaf) Child(idx int) ParseTreeNode { return nil }
+func (dl *dotTestLeaf) Children() []ParseTreeNode   { return nil }
+
+func TestDot(t *testing.T) {
+	for s, expect := range map[string]string{
+		"plain":         `"plain"`,
+		`a "quoted" id`: `"a \"quoted\" id"`,
+		`back\slash`:    `"back\\slash"`,
+		"two\r\nlines":  `"two\nlines"`,
+	} {
+		if actual := DotQuote(s); actual != expect {
+			t.Errorf("DotQuote(%q) gave %s, expected %s", s, actual, expect)
+		}
+	}
+	if actual, expect := dotQuoteLeftLines([]string{`a\nb`, "c"}), `"a\\nb\lc\l"`; actual != expect {
+		t.Errorf("dotQuoteLeftLines gave %s, expected %s", actual, expect)
+	}
+
+	ast, err := parseBnf0Text("<a> := B <c> | D\n<c> := E\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	g := ast.Production().Grammar()
+	var buf bytes.Buffer
+	if err := WriteGrammarDot(g, &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	out := buf.String()
+	for _, line := range []string{"digraph grammar {\n", "[label=\"<decl>\" shape=ellipse];\n", "[label=\"EQDEF\" shape=box];\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("grammar graph does not contain %q:\n%s", line, out)
+		}
+	}
+	// One edge per distinct term on the right hand side of each nonterminal.
+	if n := strings.Count(out, " -> "); n != 21 {
+		t.Errorf("grammar graph has %d edges, expected 21:\n%s", n, out)
+	}
+
+	buf.Reset()
+	if err := WriteTreeDot(ast, &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	out = buf.String()
+	nodes, edges := strings.Count(out, "[label="), strings.Count(out, " -> ")
+	if nodes != 38 || edges != nodes-1 {
+		t.Errorf("tree graph has %d nodes and %d edges:\n%s", nodes, edges, out)
+	}
+	if !strings.Contains(out, "[label=\"ID\\nB\" shape=box];\n") {
+		t.Errorf("tree graph does not label the leaf B:\n%s", out)
+	}
+	buf.Reset()
+	leaf := &dotTestLeaf{&dotTestToken{term: g.Terminal(0), literal: "say \"\\x\"\n"}}
+	if err := WriteTreeDot(leaf, &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(buf.String(), `\nsay \"\\x\"\n" shape=box];`) {
+		t.Errorf("tree graph did not escape the leaf literal:\n%s", buf.String())
+	}
+
+	p, err := GenerateEarleyParser(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buf.Reset()
+	if err := WriteEarleyParserDot(p, &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	out = buf.String()
+	if !strings.HasPrefix(out, "digraph earley {\n") || !strings.Contains(out, "s0 [label=\"[0] k\\l") ||
+		!strings.Contains(out, "[style=dashed];\n") || !strings.Contains(out, "[label=\"EQDEF\"];\n") {
+		t.Errorf("earley parser graph is missing states or transitions:\n%s", out)
+	}
+}
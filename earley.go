@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"reflect"
 	"sort"
 )
@@ -37,6 +36,7 @@ type earleyParserGenerator struct {
 	prodIndex ProductionGrammarIndex
 	nullIndex NullabilityGrammarIndex
 	states    []*earleyItemState
+	tracer    Tracer
 }
 
 type earleyParserDfaState struct {
@@ -51,6 +51,8 @@ type earleyParser struct {
 	dfa              []earleyParserDfaState
 	acceptStateIndex int
 	epsNt            map[int]Term
+	tracer           Tracer
+	filter           CompletionFilter
 }
 
 type earleyParserStateLink struct {
@@ -74,6 +76,9 @@ type earlyParserState struct {
 	state  []*earleyParserEntryList
 	lexer  LexerState
 	parser *earleyParser
+	tracer Tracer
+	filter CompletionFilter
+	tokens []Token
 }
 
 func (lr *lr0Item) String() string {
@@ -114,7 +119,6 @@ func (lr *lr0Item) Equals(a interface{}) bool {
 		return lr.CompareTo(&lra) == 0
 	}
 	panic("TYPE: " + reflect.TypeOf(a).String())
-	return false
 }
 
 func (lr *lr0Item) CompareTo(a *lr0Item) int {
@@ -189,7 +193,6 @@ func (is *lr0ItemSet) Equals(o interface{}) bool {
 		}
 		for i, x := range is.items {
 			if !iso.items[i].Equals(x) {
-				fmt.Printf("%s != %s\n", iso.items[i].String(), x.String())
 				return false
 			}
 		}
@@ -215,34 +218,23 @@ func (ep *earleyParserGenerator) isInitialForm(lr *lr0Item) bool {
 }
 
 func (ep *earleyParserGenerator) ItemSetClosure(seed *lr0ItemSet) (*earleyItemState, *earleyItemState, error) {
-
-	fmt.Println("=======\nCLOSURE START")
 	expandedNt := NewHashSet()
 	kStack := []*lr0Item{}
 	nkStack := []*lr0Item{}
 	for _, item := range seed.items {
 		if item.caretPos == 0 && !ep.isInitialForm(item) {
-			fmt.Println("NK: " + item.String())
 			nkStack = append(nkStack, item)
 		} else {
-			fmt.Println("K: " + item.String())
 			kStack = append(kStack, item)
 		}
 	}
 	kSet := NewHashSet()  // of *lr0Item
 	nkSet := NewHashSet() // of *lr0Item
 	for len(nkStack) > 0 || len(kStack) > 0 {
-		fmt.Printf("   (loop klen = %d, nklen=%d)\n", len(kStack), len(nkStack))
 		//var kItem bool
 		var citem *lr0Item = nil
 		if len(kStack) > 0 {
 			//kItem = true
-			if len(kStack) > 0 {
-				fmt.Printf("   (kStack[0] == %s)\n", kStack[0])
-			}
-			if len(kStack) > 1 {
-				fmt.Printf("   (kStack[1] == %s)\n", kStack[1])
-			}
 			citem = kStack[len(kStack)-1]
 			kStack = kStack[0 : len(kStack)-1]
 			kSet.Add(citem)
@@ -252,25 +244,19 @@ func (ep *earleyParserGenerator) ItemSetClosure(seed *lr0ItemSet) (*earleyItemSt
 			nkStack = nkStack[0 : len(nkStack)-1]
 			nkSet.Add(citem)
 		}
-		fmt.Println("CITEM: " + citem.String())
-		fmt.Printf("   (new klen = %d, nklen=%d)\n", len(kStack), len(nkStack))
 		if citem.caretPos < citem.rule.RhsLen() {
 			nextTerm := citem.rule.Rhs(citem.caretPos)
-			fmt.Println("Next term is " + TermToString(nextTerm))
 			if !nextTerm.Terminal() {
 				if _, has := expandedNt.Has(nextTerm); has {
-					fmt.Println("skipping already expanded term")
 					continue
 				}
 				expandedNt.Add(nextTerm)
-				fmt.Printf("%d productions for %s\n", len(ep.prodIndex.GetProductions(nextTerm)), TermToString(nextTerm))
 				for _, np := range ep.prodIndex.GetProductions(nextTerm) {
 
 					newItem := &lr0Item{rule: np}
 					if _, has := nkSet.Has(newItem); has {
 						continue
 					}
-					fmt.Println("Adding item " + newItem.String())
 					nkStack = append(nkStack, newItem)
 				}
 			}
@@ -328,9 +314,31 @@ func (ep *earleyParserGenerator) ItemSetClosure(seed *lr0ItemSet) (*earleyItemSt
 //
 //}
 
+func (ep *earleyParserGenerator) addState(st *earleyItemState) {
+	ep.states = append(ep.states, st)
+	if ep.tracer != nil {
+		items := make([]string, len(st.itemSet.items))
+		for i, lr := range st.itemSet.items {
+			items[i] = lr.String()
+		}
+		ep.tracer.Trace(&TraceEvent{
+			Type:  TraceItemSet,
+			State: st.id,
+			Items: items,
+		})
+	}
+}
+
 func GenerateEarleyParser(g Grammar) (Parser, error) {
+	return GenerateEarleyParserWithTracer(g, nil)
+}
+
+// GenerateEarleyParserWithTracer generates an Earley parser for g, reporting
+// each LR(0) item state created to tracer.  The tracer is retained by the
+// parser and inherited by the states it opens.
+func GenerateEarleyParserWithTracer(g Grammar, tracer Tracer) (Parser, error) {
 	ig := GetIndexedGrammar(g)
-	parserGen := &earleyParserGenerator{grammar: ig}
+	parserGen := &earleyParserGenerator{grammar: ig, tracer: tracer}
 	idxIf, err := ig.GetIndex(GrammarIndexTypeProduction)
 	if err != nil {
 		return nil, err
@@ -341,12 +349,10 @@ func GenerateEarleyParser(g Grammar) (Parser, error) {
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println(reflect.TypeOf(idxIf).String())
 	parserGen.nullIndex = idxIf.(NullabilityGrammarIndex)
 	initialItem := &lr0Item{
 		rule: parserGen.prodIndex.GetInitialProduction(),
 	}
-	initialItem = initialItem
 	initialItemSet := &lr0ItemSet{
 		items: sortedLR0ItemSet([]*lr0Item{initialItem}),
 	}
@@ -357,8 +363,8 @@ func GenerateEarleyParser(g Grammar) (Parser, error) {
 	allStates := NewHashSet()
 	stateStack := []*earleyItemState{nk, k}
 	allStates.Add(nk, k)
-	parserGen.states = append(parserGen.states, k)
-	parserGen.states = append(parserGen.states, nk)
+	parserGen.addState(k)
+	parserGen.addState(nk)
 	for len(stateStack) > 0 {
 		cs := stateStack[len(stateStack)-1]
 		transitionSeeds := make(map[Term]Hashset)
@@ -396,7 +402,7 @@ func GenerateEarleyParser(g Grammar) (Parser, error) {
 				trKState = cState.(*earleyItemState)
 			} else {
 				trKState.id = len(parserGen.states)
-				parserGen.states = append(parserGen.states, trKState)
+				parserGen.addState(trKState)
 				allStates.Add(trKState)
 				stateStack = append(stateStack, trKState)
 				//fmt.Println("NEW STATE")
@@ -409,7 +415,7 @@ func GenerateEarleyParser(g Grammar) (Parser, error) {
 					trNkState = cState.(*earleyItemState)
 				} else {
 					trNkState.id = len(parserGen.states)
-					parserGen.states = append(parserGen.states, trNkState)
+					parserGen.addState(trNkState)
 					allStates.Add(trNkState)
 					stateStack = append(stateStack, trNkState)
 					//fmt.Println("NEW STATE")
@@ -417,20 +423,14 @@ func GenerateEarleyParser(g Grammar) (Parser, error) {
 					//fmt.Println()
 				}
 				trKState.transitions[parserGen.grammar.Epsilon()] = trNkState
-			} else {
-				fmt.Printf("nk state of %d empty\n", trKState.id)
 			}
 		}
 	}
-	for i, st := range parserGen.states {
-		fmt.Printf("State #%d:\n", i)
-		st.writeStateInfo(os.Stdout)
-		fmt.Println("-----\n")
-	}
 	parser := &earleyParser{
 		grammar:   g,
 		generator: parserGen,
 		dfa:       make([]earleyParserDfaState, len(parserGen.states)),
+		tracer:    tracer,
 	}
 	for i := 0; i < len(parser.dfa); i++ {
 		parser.dfa[i].transitions = make(map[int]int)
@@ -443,7 +443,6 @@ func GenerateEarleyParser(g Grammar) (Parser, error) {
 			pr := parserGen.states[i].reductions[j]
 			parser.dfa[i].reductions[j] = pr
 			if pr.Lhs().Id() == parser.grammar.Asterisk().Id() {
-				fmt.Printf("ACCEPT STATE IS %d\n", i)
 				parser.acceptStateIndex = i
 			}
 			if _, has := parser.dfa[i].reductionIndex[int(pr.Lhs().Id())]; !has {
@@ -471,10 +470,36 @@ func (p *earleyParser) Open(lexState LexerState) (ParserState, error) {
 	ps := &earlyParserState{
 		parser: p,
 		lexer:  lexState,
+		tracer: p.tracer,
+		filter: p.filter,
 	}
 	return ps, nil
 }
 
+func (p *earleyParser) SetCompletionFilter(filter CompletionFilter) {
+	p.filter = filter
+}
+
+func (p *earleyParser) CompletionFilter() CompletionFilter {
+	return p.filter
+}
+
+func (p *earleyParser) SetTracer(tracer Tracer) {
+	p.tracer = tracer
+}
+
+func (p *earleyParser) Tracer() Tracer {
+	return p.tracer
+}
+
+func (ps *earlyParserState) SetTracer(tracer Tracer) {
+	ps.tracer = tracer
+}
+
+func (ps *earlyParserState) Tracer() Tracer {
+	return ps.tracer
+}
+
 func (ps *earlyParserState) Parser() Parser {
 	return ps.parser
 }
@@ -483,6 +508,58 @@ func (ps *earlyParserState) LexerState() LexerState {
 	return ps.lexer
 }
 
+// expectedTerminals returns the terminals that can be scanned from S_i,
+// ordered by id.  S_i is closed under completion first without modifying it,
+// since at the end of input the parse loop has not completed it.
+func (ps *earlyParserState) expectedTerminals(i int) []Term {
+	eps := ps.parser.grammar.Epsilon().Id()
+	bottom := ps.parser.grammar.Bottom().Id()
+	terms := grammarTermsById(ps.parser.grammar)
+	seen := make(map[uint64]bool)
+	expected := make(map[uint32]Term)
+	var work []uint64
+	push := func(state, parent uint32) {
+		key := (uint64(state) << 32) | uint64(parent)
+		if !seen[key] {
+			seen[key] = true
+			work = append(work, key)
+		}
+	}
+	for _, entry := range ps.state[i].entries {
+		push(entry.dfaStateId, entry.parentIndex)
+	}
+	for len(work) > 0 {
+		key := work[len(work)-1]
+		work = work[0 : len(work)-1]
+		state := &ps.parser.dfa[key>>32]
+		parentId := uint32(key)
+		for tid := range state.transitions {
+			if t, has := terms[uint32(tid)]; has && (t.Terminal() || t.Id() == bottom) {
+				expected[t.Id()] = t
+			}
+		}
+		if nk, has := state.transitions[int(eps)]; has {
+			push(uint32(nk), uint32(i))
+		}
+		if parentId == uint32(i) {
+			continue
+		}
+		for _, pr := range state.reductions {
+			for _, pitem := range ps.state[parentId].entries {
+				if k, has := ps.parser.dfa[pitem.dfaStateId].transitions[int(pr.Lhs().Id())]; has {
+					push(uint32(k), pitem.parentIndex)
+				}
+			}
+		}
+	}
+	res := make([]Term, 0, len(expected))
+	for _, t := range expected {
+		res = append(res, t)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Id() < res[b].Id() })
+	return res
+}
+
 func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 	// Create the state array and inital state.
 	ps.state = make([]*earleyParserEntryList, 1, 64)
@@ -491,13 +568,13 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 		index:   make(map[uint64]int),
 	}
 	ps.state[0].entries[0] = &earleyParserEntry{}
+	ps.tokens = nil
 	ps.state[0].index[0] = 0
 	i := 0
 	eps := ps.parser.grammar.Epsilon().Id()
 
 	// First eps transition must be done manually.
 	if nk, has := ps.parser.dfa[0].transitions[int(eps)]; has {
-		fmt.Printf("Will add (%d,0) to [0]\n", nk)
 		ns := &earleyParserEntry{
 			dfaStateId: uint32(nk),
 			links:      []*earleyParserStateLink{},
@@ -509,19 +586,23 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 
 	canAccept := false
 	for {
+		if cl, ok := ps.lexer.(ContextAwareLexerState); ok && cl.ContextAware() {
+			cl.SetExpectTokens(ps.expectedTerminals(i))
+		}
 		hasMore, err := ps.lexer.HasMoreTokens()
 		if err != nil {
 			return nil, err
 		}
 		if hasMore {
-			fmt.Printf("HAS MORE (%d)\n", i)
 			canAccept = false
 			// Get the next token.
 			nextTok, err := ps.lexer.NextToken()
 			if err != nil {
 				return nil, err
 			}
-			fmt.Printf("Token %d is: %s(%s)\n", i+1, TermToString(nextTok.Terminal()), nextTok.Literal())
+			if ps.filter != nil {
+				ps.tokens = append(ps.tokens, nextTok)
+			}
 			// Setup S_{x+1}
 			nsl := &earleyParserEntryList{
 				entries: []*earleyParserEntry{},
@@ -532,7 +613,6 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 			/** foreach item in S_i: */
 			cs := ps.state[i]
 			for j := 0; j < len(cs.entries); j++ {
-				fmt.Printf(" Considering [%d]:%d\n", i, j)
 				item := cs.entries[j]
 				/** (state,parent) <- item */
 				state := &ps.parser.dfa[item.dfaStateId]
@@ -543,14 +623,12 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 				/** if k != nil: */
 				if has {
 					canContinue = true
-					fmt.Printf("  goto(%d,%s) = %d\n", item.dfaStateId, TermToString(nextTok.Terminal()), k)
 					/** add(k,parent) to S_{i+1} */
 					var ns *earleyParserEntry
 					key := (uint64(k) << 32) | uint64(parentId)
 					if ent, has := nsl.index[key]; has {
 						ns = nsl.entries[ent]
 					} else {
-						fmt.Printf("  Will add (%d,%d) to [%d]\n", k, parentId, i+1)
 						ns = &earleyParserEntry{
 							dfaStateId:  uint32(k),
 							parentIndex: parentId,
@@ -562,7 +640,6 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 						nsl.entries = append(nsl.entries, ns)
 					}
 					/** add link(&item, nil) to (k, parent) in S_{i+1} */
-					fmt.Printf("  Will link <[%d]:%d(%d,%d),nil> from [%d]:%d(%d,%d)\n", i, j, item.dfaStateId, item.parentIndex, i+1, len(nsl.entries)-1, k, parentId)
 					link := &earleyParserStateLink{
 						pred: item,
 					}
@@ -572,17 +649,34 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 						ns.linkIndex[0] = []int{len(ns.links)}
 					}
 					ns.links = append(ns.links, link)
+					if ps.tracer != nil {
+						ps.tracer.Trace(&TraceEvent{
+							Type:      TraceScan,
+							Set:       i,
+							State:     int(item.dfaStateId),
+							NextState: k,
+							Parent:    int(parentId),
+							Token:     nextTok,
+						})
+					}
 					/** nk <- goto(k,`e) */
 					nk, has := ps.parser.dfa[k].transitions[int(eps)]
 					/** if nk != nil: */
 					if has {
-						fmt.Printf("  goto(%d,`e) = %d\n", k, nk)
+						if ps.tracer != nil {
+							ps.tracer.Trace(&TraceEvent{
+								Type:      TracePredict,
+								Set:       i + 1,
+								State:     k,
+								NextState: nk,
+								Parent:    i + 1,
+							})
+						}
 						/** add(nk,i+1) to S_{i+1} */
 						key = (uint64(nk) << 32) | uint64(i+1)
 						if ent, has := nsl.index[key]; has {
 							ns = nsl.entries[ent]
 						} else {
-							fmt.Printf("  Will add (%d,%d) to [%d]\n", nk, i+1, i+1)
 							ns = &earleyParserEntry{
 								dfaStateId:  uint32(nk),
 								parentIndex: uint32(i + 1),
@@ -600,15 +694,16 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 				}
 				/** foreach A->a in completed(state): */
 				for _, pr := range state.reductions {
-					fmt.Println(" Can reduce via " + ProductionRuleToString(pr))
+					// The rule derived tokens parent..i-1 and is followed by token i.
+					if ps.filter != nil && ps.filter.Reject(pr, ps.tokens[parentId:i], nextTok) {
+						continue
+					}
 					a := pr.Lhs().Id()
 					/** foreach pitem in S_{parent}: */
 					for k := 0; k < len(parent.entries); k++ {
 						pitem := parent.entries[k]
-						fmt.Printf(" Reduce considering [%d]:%d(%d,%d)\n", parentId, k, pitem.dfaStateId, pitem.parentIndex)
 						// record accept input condition
 						if parentId == 0 && k == 0 {
-							fmt.Println("ACCEPT OK")
 							canAccept = true
 						}
 						/** (pstate,pparent) <- pitem */
@@ -620,13 +715,11 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 						/** if k != nil: */
 						var ns *earleyParserEntry
 						if has {
-							fmt.Printf("  goto(%d,%s) = %d\n", pitem.dfaStateId, TermToString(pr.Lhs()), k)
 							/** add (k,pparent) to S_i */
 							key := (uint64(k) << 32) | uint64(pparentId)
 							if ent, has := cs.index[key]; has {
 								ns = cs.entries[ent]
 							} else {
-								fmt.Printf("  Will add (%d,%d) to [%d]\n", k, pparentId, i)
 								ns = &earleyParserEntry{
 									dfaStateId:  uint32(k),
 									parentIndex: uint32(pparentId),
@@ -637,9 +730,6 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 								cs.entries = append(cs.entries, ns)
 							}
 							/** add link (&pitem,&item) to (k,pparent) in S_i */
-							fmt.Printf("  Will link <[%d]:%d(%d,%d),[%d]:%d(%d,%d)> from [%d]:%d(%d,%d)\n", parentId, k, pitem.dfaStateId, pitem.parentIndex, i+1,
-								i, j, item.dfaStateId, item.parentIndex,
-								len(cs.entries)-1, k, pparentId)
 							link := &earleyParserStateLink{
 								pred:  pitem,
 								cause: item,
@@ -651,17 +741,34 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 								ns.linkIndex[linkKey] = []int{len(ns.links)}
 							}
 							ns.links = append(ns.links, link)
+							if ps.tracer != nil {
+								ps.tracer.Trace(&TraceEvent{
+									Type:      TraceComplete,
+									Set:       i,
+									State:     int(item.dfaStateId),
+									NextState: k,
+									Parent:    int(pparentId),
+									Rule:      pr,
+								})
+							}
 							/** nk <- goto(k,`e) */
 							nk, has := ps.parser.dfa[k].transitions[int(eps)]
 							/** if nk != nil: */
 							if has {
-								fmt.Printf("  goto(%d,`e) = %d\n", k, nk)
+								if ps.tracer != nil {
+									ps.tracer.Trace(&TraceEvent{
+										Type:      TracePredict,
+										Set:       i,
+										State:     k,
+										NextState: nk,
+										Parent:    i,
+									})
+								}
 								/** add (nk,i) to S_i */
 								key := (uint64(nk) << 32) | uint64(i)
 								if ent, has := cs.index[key]; has {
 									ns = cs.entries[ent]
 								} else {
-									fmt.Printf("  Will add (%d,%d) to [%d]\n", nk, i, i)
 									ns = &earleyParserEntry{
 										dfaStateId:  uint32(nk),
 										parentIndex: uint32(i),
@@ -676,27 +783,20 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 				}
 			}
 			if !canContinue {
-				return nil, errors.New(fmt.Sprintf("parse error at token %d\n", i+1))
+				return nil, &ParseError{
+					Position: i + 1,
+					Token:    nextTok,
+					Expected: ps.expectedTerminals(i),
+				}
 			}
 			i++
 		} else {
 			if canAccept {
 				break
 			}
-			return nil, errors.New("unexpected end of input")
-		}
-	}
-
-	for idx, el := range ps.state {
-		fmt.Printf("<%d>\n", idx)
-		for _, ent := range el.entries {
-			fmt.Printf("  (%d,%d)\n", ent.dfaStateId, ent.parentIndex)
-			for _, ln := range ent.links {
-				if ln.cause != nil {
-					fmt.Printf("      -><(%d,%d),(%d,%d)>\n", ln.pred.dfaStateId, ln.pred.parentIndex, ln.cause.dfaStateId, ln.cause.parentIndex)
-				} else {
-					fmt.Printf("      -><(%d,%d),nil>\n", ln.pred.dfaStateId, ln.pred.parentIndex)
-				}
+			return nil, &ParseError{
+				Position: i + 1,
+				Expected: ps.expectedTerminals(i),
 			}
 		}
 	}
@@ -716,7 +816,12 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 		}
 	}
 	if initialEntry == nil {
-		return nil, errors.New("no initial entry found in final state after successful parse")
+		// canAccept only records that some rule from S_0 was completed; the
+		// input ended before the initial rule was.
+		return nil, &ParseError{
+			Position: i + 1,
+			Expected: ps.expectedTerminals(i),
+		}
 	}
 
 	var ast *earleyParseTreeNode
@@ -742,7 +847,7 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 				return nil, errors.New(fmt.Sprintf("missing reduction in state after successful parse (%d,%d)\n", ce.entry.dfaStateId, ce.entry.parentIndex))
 			}
 			if len(prs) > 1 {
-				return nil, errors.New("R/R ambiguity encountered after successful parse, ambiguity resolution not yet implemented")
+				return nil, &AmbiguityError{Nonterminal: ce.nt, Rules: prs}
 			}
 			ce.pr = prs[0]
 			ce.x = &earleyParseTreeNode{
@@ -751,7 +856,6 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 				rule:     ce.pr,
 				children: make([]*earleyParseTreeNode, ce.pr.RhsLen()),
 			}
-			fmt.Printf("Select PR: %s\n", ProductionRuleToString(ce.pr))
 		}
 		if ce.n == ce.pr.RhsLen() {
 			*ce.target = ce.x
@@ -761,8 +865,8 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 		//sym := ce.pr.Rhs(ce.n)
 		ce.n++
 		sym := ce.pr.Rhs(ce.pr.RhsLen() - ce.n)
-		fmt.Printf("SYM: %s\n", TermToString(sym))
-		if sym.Terminal() {
+		// The bottom term is scanned like a terminal.
+		if sym.Terminal() || sym.Id() == ps.parser.grammar.Bottom().Id() {
 			nx := &earleyParseTreeNode{
 				parser: ps.parser,
 				term:   sym,
@@ -784,21 +888,19 @@ func (ps *earlyParserState) Parse() (ParseTreeNode, error) {
 					continue
 				}
 				if causeLink != nil {
-					return nil, errors.New("causal ambiguity encountered after successful parse - amgiuity resolution not yet implemented")
+					return nil, &AmbiguityError{Nonterminal: sym}
 				}
 				causeLink = link
 			}
 			if causeLink == nil {
 				return nil, errors.New(fmt.Sprintf("missing causal link after successful parse (%d,%d)\n", ce.entry.dfaStateId, ce.entry.parentIndex))
 			}
-			fmt.Printf("rhslen: %d, children len: %d, index: %d\n", ce.pr.RhsLen(), len(ce.x.children), ce.pr.RhsLen()-ce.n)
 			ne := &earleyParseRecord{
 				nt:     sym,
 				entry:  causeLink.cause,
 				target: &ce.x.children[ce.pr.RhsLen()-ce.n],
 			}
 			ce.entry = causeLink.pred
-			fmt.Printf("Push <%s,(%d,%d)>\n", TermToString(sym), causeLink.cause.dfaStateId, causeLink.cause.parentIndex)
 			stack = append(stack, ne)
 		}
 	}
@@ -856,3 +958,43 @@ func (pn *earleyParseTreeNode) Children() []ParseTreeNode {
 	}
 	return ret
 }
+
+// WriteEarleyParserStates writes the LR(0) item sets of a parser created by
+// GenerateEarleyParser, one block per state listing its items, transitions
+// and reductions.
+func WriteEarleyParserStates(p Parser, out io.Writer) error {
+	ep, ok := p.(*earleyParser)
+	if !ok {
+		return errors.New("parser was not created by GenerateEarleyParser")
+	}
+	if ep.generator == nil {
+		return errors.New("parser item states are not retained by loaded parser tables")
+	}
+	for _, st := range ep.generator.states {
+		kmark := "k"
+		if !st.kernel {
+			kmark = "nk"
+		}
+		if st.id == ep.acceptStateIndex {
+			kmark += " accept"
+		}
+		if _, err := fmt.Fprintf(out, "[%d] %s\n", st.id, kmark); err != nil {
+			return err
+		}
+		for _, lr := range st.itemSet.items {
+			fmt.Fprintf(out, "    %s\n", lr.String())
+		}
+		terms := make([]Term, 0, len(st.transitions))
+		for t := range st.transitions {
+			terms = append(terms, t)
+		}
+		sort.Sort(dotTermsById(terms))
+		for _, t := range terms {
+			fmt.Fprintf(out, "    %s -> [%d]\n", TermToString(t), st.transitions[t].id)
+		}
+		for _, pr := range st.reductions {
+			fmt.Fprintf(out, "    reduce %s\n", ProductionRuleToString(pr))
+		}
+	}
+	return nil
+}
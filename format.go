@@ -0,0 +1,358 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// FormatBuilder builds a Formatter from layouts for the production rules of a
+// grammar.  A layout lists the children of a node with the text and breaks
+// between them:  Line is a space and SoftLine is nothing while the enclosing
+// group fits in the width, and both break the line when it does not.  Newline
+// always breaks, and so breaks every group around it.  Indent and Group open
+// sections closed by End; the lines broken in an Indent section are indented
+// by n more columns.
+//
+// A node whose production has no layout prints its children separated by
+// spaces, and a token prints its literal.  Trivia are not printed; Unparse
+// reproduces the input exactly.
+type FormatBuilder interface {
+	Rule(pr ProductionRule) FormatBuilder
+	Child(idx int) FormatBuilder
+	Text(s string) FormatBuilder
+	Space() FormatBuilder
+	Line() FormatBuilder
+	SoftLine() FormatBuilder
+	Newline() FormatBuilder
+	Indent(n int) FormatBuilder
+	Group() FormatBuilder
+	End() FormatBuilder
+	Build() (Formatter, error)
+	MustBuild() Formatter
+}
+
+// Formatter prints parse trees of its grammar in the layouts of a
+// FormatBuilder, breaking lines to keep them within width columns where the
+// layouts allow.
+type Formatter interface {
+	Grammar() Grammar
+	Format(node ParseTreeNode, width int, out io.Writer) error
+}
+
+func OpenFormatBuilder(g Grammar) FormatBuilder {
+	return &stdFormatBuilder{
+		grammar: g,
+		layouts: make(map[uint32]*formatDoc),
+	}
+}
+
+///
+
+type formatDocType uint8
+
+const (
+	formatText formatDocType = iota
+	formatLine
+	formatNewline
+	formatChild
+	formatConcat
+	formatNest
+	formatGroup
+)
+
+// formatDoc is a layout, or a document made from a layout and the documents
+// of the children of a node.  Lines print text when they do not break.
+type formatDoc struct {
+	kind     formatDocType
+	text     string
+	child    int
+	indent   int
+	children []*formatDoc
+}
+
+type stdFormatBuilder struct {
+	grammar  Grammar
+	layouts  map[uint32]*formatDoc
+	openRule ProductionRule
+	open     []*formatDoc
+	errs     []string
+}
+
+type stdFormatter struct {
+	grammar Grammar
+	layouts map[uint32]*formatDoc
+}
+
+type formatMode uint8
+
+const (
+	formatBreak formatMode = iota
+	formatFlat
+)
+
+type formatCommand struct {
+	indent int
+	mode   formatMode
+	doc    *formatDoc
+}
+
+func (fb *stdFormatBuilder) closeRule() {
+	if fb.openRule != nil && len(fb.open) > 1 {
+		fb.errs = append(fb.errs, fmt.Sprintf("layout of %s has %d sections without End()",
+			ProductionRuleToString(fb.openRule), len(fb.open)-1))
+	}
+	fb.openRule, fb.open = nil, nil
+}
+
+func (fb *stdFormatBuilder) add(name string, doc *formatDoc) {
+	if fb.openRule == nil {
+		panic(name + "() called before Rule()")
+	}
+	top := fb.open[len(fb.open)-1]
+	top.children = append(top.children, doc)
+}
+
+func (fb *stdFormatBuilder) Rule(pr ProductionRule) FormatBuilder {
+	fb.closeRule()
+	if pr.Grammar() != fb.grammar {
+		fb.errs = append(fb.errs, "layout for "+ProductionRuleToString(pr)+" of another grammar")
+	}
+	layout := &formatDoc{kind: formatConcat}
+	fb.layouts[pr.Id()] = layout
+	fb.openRule, fb.open = pr, []*formatDoc{layout}
+	return fb
+}
+
+func (fb *stdFormatBuilder) Child(idx int) FormatBuilder {
+	fb.add("Child", &formatDoc{kind: formatChild, child: idx})
+	if idx < 0 || idx >= fb.openRule.RhsLen() {
+		fb.errs = append(fb.errs, fmt.Sprintf("layout of %s prints child %d of %d",
+			ProductionRuleToString(fb.openRule), idx, fb.openRule.RhsLen()))
+	}
+	return fb
+}
+
+func (fb *stdFormatBuilder) Text(s string) FormatBuilder {
+	fb.add("Text", &formatDoc{kind: formatText, text: s})
+	return fb
+}
+
+func (fb *stdFormatBuilder) Space() FormatBuilder {
+	fb.add("Space", &formatDoc{kind: formatText, text: " "})
+	return fb
+}
+
+func (fb *stdFormatBuilder) Line() FormatBuilder {
+	fb.add("Line", &formatDoc{kind: formatLine, text: " "})
+	return fb
+}
+
+func (fb *stdFormatBuilder) SoftLine() FormatBuilder {
+	fb.add("SoftLine", &formatDoc{kind: formatLine})
+	return fb
+}
+
+func (fb *stdFormatBuilder) Newline() FormatBuilder {
+	fb.add("Newline", &formatDoc{kind: formatNewline})
+	return fb
+}
+
+func (fb *stdFormatBuilder) Indent(n int) FormatBuilder {
+	doc := &formatDoc{kind: formatNest, indent: n}
+	fb.add("Indent", doc)
+	fb.open = append(fb.open, doc)
+	return fb
+}
+
+func (fb *stdFormatBuilder) Group() FormatBuilder {
+	doc := &formatDoc{kind: formatGroup}
+	fb.add("Group", doc)
+	fb.open = append(fb.open, doc)
+	return fb
+}
+
+func (fb *stdFormatBuilder) End() FormatBuilder {
+	if len(fb.open) < 2 {
+		panic("End() called without an open Indent() or Group()")
+	}
+	fb.open = fb.open[:len(fb.open)-1]
+	return fb
+}
+
+func (fb *stdFormatBuilder) Build() (Formatter, error) {
+	fb.closeRule()
+	if len(fb.errs) > 0 {
+		return nil, errors.New(strings.Join(fb.errs, "\n"))
+	}
+	return &stdFormatter{
+		grammar: fb.grammar,
+		layouts: fb.layouts,
+	}, nil
+}
+
+func (fb *stdFormatBuilder) MustBuild() Formatter {
+	f, err := fb.Build()
+	if err != nil {
+		panic(err.Error())
+	}
+	return f
+}
+
+func (f *stdFormatter) Grammar() Grammar {
+	return f.grammar
+}
+
+// Format prints node in at most width columns where its layouts allow, using
+// Wadler's algorithm: a group is printed flat if it fits in the rest of the
+// line up to the next break outside it, and otherwise its lines break.
+func (f *stdFormatter) Format(node ParseTreeNode, width int, out io.Writer) error {
+	if pr := node.Production(); pr != nil && pr.Grammar() != f.grammar {
+		return errors.New("formatted tree is not of the formatter's grammar")
+	}
+	bout := bufio.NewWriter(out)
+	stack := []formatCommand{{0, formatBreak, f.document(node)}}
+	column, pending := 0, -1
+	for len(stack) > 0 {
+		cmd := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch cmd.doc.kind {
+		case formatText:
+			if cmd.doc.text == "" {
+				continue
+			}
+			if pending >= 0 {
+				bout.WriteString(strings.Repeat(" ", pending))
+				column, pending = pending, -1
+			}
+			bout.WriteString(cmd.doc.text)
+			column += utf8.RuneCountInString(cmd.doc.text)
+		case formatLine, formatNewline:
+			if cmd.doc.kind == formatLine && cmd.mode == formatFlat {
+				stack = append(stack, formatCommand{cmd.indent, cmd.mode, &formatDoc{kind: formatText, text: cmd.doc.text}})
+				continue
+			}
+			bout.WriteByte('\n')
+			column, pending = 0, cmd.indent
+		case formatConcat:
+			for i := len(cmd.doc.children) - 1; i >= 0; i-- {
+				stack = append(stack, formatCommand{cmd.indent, cmd.mode, cmd.doc.children[i]})
+			}
+		case formatNest:
+			stack = append(stack, formatCommand{cmd.indent + cmd.doc.indent, cmd.mode,
+				&formatDoc{kind: formatConcat, children: cmd.doc.children}})
+		case formatGroup:
+			mode := cmd.mode
+			inner := &formatDoc{kind: formatConcat, children: cmd.doc.children}
+			if mode == formatBreak {
+				start := column
+				if pending >= 0 {
+					start = pending
+				}
+				if formatFits(width-start, formatCommand{cmd.indent, formatFlat, inner}, stack) {
+					mode = formatFlat
+				}
+			}
+			stack = append(stack, formatCommand{cmd.indent, mode, inner})
+		}
+	}
+	return bout.Flush()
+}
+
+// formatFits returns true if cmd and the commands after it on rest fit in
+// room columns up to the first line which breaks.
+func formatFits(room int, cmd formatCommand, rest []formatCommand) bool {
+	cmds := []formatCommand{cmd}
+	for room >= 0 {
+		if len(cmds) == 0 {
+			if len(rest) == 0 {
+				return true
+			}
+			cmds = append(cmds, rest[len(rest)-1])
+			rest = rest[:len(rest)-1]
+		}
+		c := cmds[len(cmds)-1]
+		cmds = cmds[:len(cmds)-1]
+		switch c.doc.kind {
+		case formatText:
+			room -= utf8.RuneCountInString(c.doc.text)
+		case formatLine:
+			if c.mode == formatBreak {
+				return true
+			}
+			room -= utf8.RuneCountInString(c.doc.text)
+		case formatNewline:
+			return c.mode == formatBreak
+		default:
+			for i := len(c.doc.children) - 1; i >= 0; i-- {
+				cmds = append(cmds, formatCommand{c.indent, c.mode, c.doc.children[i]})
+			}
+		}
+	}
+	return false
+}
+
+// document returns the document of node, its layout with the documents of
+// its children in place of Child.
+func (f *stdFormatter) document(node ParseTreeNode) *formatDoc {
+	pr := node.Production()
+	if pr == nil {
+		if tok := node.Token(); tok != nil {
+			return &formatDoc{kind: formatText, text: tok.Literal()}
+		}
+		return &formatDoc{kind: formatConcat}
+	}
+	children := parseTreeNodeChildren(node)
+	layout, has := f.layouts[pr.Id()]
+	if !has {
+		doc := &formatDoc{kind: formatConcat}
+		for _, c := range children {
+			cd := f.document(c)
+			if formatEmpty(cd) {
+				continue
+			}
+			if len(doc.children) > 0 {
+				doc.children = append(doc.children, &formatDoc{kind: formatText, text: " "})
+			}
+			doc.children = append(doc.children, cd)
+		}
+		return doc
+	}
+	var fill func(ld *formatDoc) *formatDoc
+	fill = func(ld *formatDoc) *formatDoc {
+		switch ld.kind {
+		case formatChild:
+			if ld.child < len(children) {
+				return f.document(children[ld.child])
+			}
+			return &formatDoc{kind: formatConcat}
+		case formatConcat, formatNest, formatGroup:
+			doc := &formatDoc{kind: ld.kind, indent: ld.indent}
+			for _, c := range ld.children {
+				doc.children = append(doc.children, fill(c))
+			}
+			return doc
+		}
+		return ld
+	}
+	return fill(layout)
+}
+
+// formatEmpty returns true if doc prints nothing.
+func formatEmpty(doc *formatDoc) bool {
+	switch doc.kind {
+	case formatText:
+		return doc.text == ""
+	case formatLine, formatNewline:
+		return false
+	}
+	for _, c := range doc.children {
+		if !formatEmpty(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	ast, err := parseBnf0Text("<a> := B <c> | D\n<c>   :=\n E\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	g := ast.Production().Grammar()
+	rules := make(map[string]ProductionRule)
+	for i := 0; i < g.NumProductionRule(); i++ {
+		rules[ProductionRuleToString(g.ProductionRule(i))] = g.ProductionRule(i)
+	}
+	fb := OpenFormatBuilder(g)
+	fb.Rule(rules["<bnf0> := <decl>"]).Child(0).Newline()
+	fb.Rule(rules["<bnf0> := <decl> <bnf0>"]).Child(0).Newline().Child(1)
+	fb.Rule(rules["<decl> := <nt> EQDEF <optlist>"]).
+		Group().Child(0).Space().Child(1).Indent(4).Line().Child(2).End().End()
+	fb.Rule(rules["<optlist> := <opt> PIPE <optlist>"]).Child(0).Line().Child(1).Space().Child(2)
+	fb.Rule(rules["<nt> := LT ID RT"]).Child(0).Child(1).Child(2)
+	f, err := fb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for width, expect := range map[int]string{
+		80: "<a> := B <c> | D\n<c> := E\n",
+		16: "<a> := B <c> | D\n<c> := E\n",
+		15: "<a> :=\n    B <c>\n    | D\n<c> := E\n",
+	} {
+		var buf bytes.Buffer
+		if err := f.Format(ast, width, &buf); err != nil {
+			t.Error(err)
+			continue
+		}
+		if buf.String() != expect {
+			t.Errorf("format in width %d gave %q, expected %q", width, buf.String(), expect)
+		}
+	}
+
+	if _, err := OpenFormatBuilder(g).Rule(rules["<nt> := LT ID RT"]).Child(3).Build(); err == nil {
+		t.Error("expected an error for a layout printing a child the rule does not have")
+	}
+	if _, err := OpenFormatBuilder(g).Rule(rules["<nt> := LT ID RT"]).Group().Child(0).Build(); err == nil {
+		t.Error("expected an error for a layout with an open group")
+	}
+}
@@ -85,7 +85,7 @@ func (sg *stdGrammar) NumNonterminal() int {
 }
 
 func (sg *stdGrammar) Nonterminal(idx int) Term {
-	if idx < 0 || idx >= len(sg.terminals) {
+	if idx < 0 || idx >= len(sg.nonterminals) {
 		panic("nonterminal index out of range")
 	}
 	return sg.nonterminals[idx]
@@ -23,3 +23,46 @@ func TestGrammar(t *testing.T) {
 		fmt.Printf("%d: %s\n", t.Id(), t.Name())
 	}
 }
+
+func TestFirstFollow(t *testing.T) {
+	g := GetIndexedGrammar(GenerateBnf0Grammar())
+	idxIf, err := g.GetIndex(GrammarIndexTypeTerm)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	termIndex := idxIf.(TermGrammarIndex)
+	idxIf, err = g.GetIndex(GrammarIndexTypeFirstFollow)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ffIndex := idxIf.(FirstFollowGrammarIndex)
+	names := func(terms []Term) string {
+		var buf []byte
+		for _, t := range terms {
+			buf = append(buf, TermToString(t)...)
+			buf = append(buf, ' ')
+		}
+		return string(buf)
+	}
+	expect := map[string][2]string{
+		"bnf0":    {"AST LT ", "`. "},
+		"decl":    {"AST LT ", "`. AST LT "},
+		"nt":      {"AST LT ", "`. AST BOT EPS EQDEF ID LT PIPE "},
+		"optlist": {"AST BOT EPS ID LT ", "`. AST LT "},
+	}
+	for ntName, sets := range expect {
+		nt, err := termIndex.GetNonterminal(ntName)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		first, follow := names(ffIndex.First(nt)), names(ffIndex.Follow(nt))
+		fmt.Printf("<%s> FIRST = { %s} FOLLOW = { %s}\n", ntName, first, follow)
+		if first != sets[0] || follow != sets[1] {
+			t.Errorf("<%s>: got FIRST { %s} FOLLOW { %s}, expected FIRST { %s} FOLLOW { %s}",
+				ntName, first, follow, sets[0], sets[1])
+		}
+	}
+}
@@ -43,6 +43,17 @@ type NullabilityGrammarIndex interface {
 	GetNullableNonterminals() []Term
 }
 
+var GrammarIndexTypeFirstFollow GrammarIndexType = reflect.TypeOf([]*firstFollowGrammarIndex{}).Elem()
+
+// FirstFollowGrammarIndex holds the FIRST and FOLLOW sets of a grammar.
+// FIRST sets never contain `e; use the nullability index to test whether a
+// term derives the empty string.
+type FirstFollowGrammarIndex interface {
+	GrammarIndex
+	First(t Term) []Term
+	Follow(nt Term) []Term
+}
+
 type GrammarIndexType reflect.Type
 
 type IndexedGrammar interface {
@@ -140,13 +151,11 @@ func (idx *termGrammarIndex) Initialize(g Grammar) error {
 	for i := 0; i < g.NumTerminal(); i++ {
 		t := g.Terminal(i)
 		idx.terminalsByName[t.Name()] = t
-		fmt.Println(" ----- terminal " + t.Name())
 	}
 	for i := 0; i < g.NumNonterminal(); i++ {
 		nt := g.Nonterminal(i)
 		idx.nonterminalsByName[nt.Name()] = nt
 	}
-	fmt.Println("term index init finished!")
 	return nil
 }
 
@@ -301,7 +310,6 @@ func (pnt *productionNTGrammarIndex) Initialize(g Grammar) error {
 		copy(sp, ps)
 		sort.Sort(sp)
 		pnt.productionsByLhs[k] = sp
-		fmt.Printf("index: %d productions for ID %d\n", len(sp), k)
 	}
 	if pnt.initial == nil {
 		return errors.New("no initial production in grammar")
@@ -399,3 +407,124 @@ func (ni *nullabilityGrammarIndex) GetNullableNonterminals() []Term {
 	}
 	return ret
 }
+
+type firstFollowGrammarIndex struct {
+	g      Grammar
+	first  map[uint32]map[uint32]Term
+	follow map[uint32]map[uint32]Term
+}
+
+func (ffi *firstFollowGrammarIndex) Name() string {
+	return "first-follow-index"
+}
+
+func (ffi *firstFollowGrammarIndex) Grammar() Grammar {
+	return ffi.g
+}
+
+func (ffi *firstFollowGrammarIndex) Initialize(g Grammar) error {
+	if ffi.g != nil {
+		return errors.New("index already initialized")
+	}
+	ig, ok := g.(IndexedGrammar)
+	if !ok {
+		return errors.New("first/follow index requires an indexed grammar")
+	}
+	idxIf, err := ig.GetIndex(GrammarIndexTypeNullability)
+	if err != nil {
+		return err
+	}
+	nullIndex := idxIf.(NullabilityGrammarIndex)
+	ffi.g = g
+	ffi.first = make(map[uint32]map[uint32]Term)
+	ffi.follow = make(map[uint32]map[uint32]Term)
+	for i := 0; i < g.NumNonterminal(); i++ {
+		ffi.first[g.Nonterminal(i).Id()] = make(map[uint32]Term)
+		ffi.follow[g.Nonterminal(i).Id()] = make(map[uint32]Term)
+	}
+	ffi.first[g.Asterisk().Id()] = make(map[uint32]Term)
+	ffi.follow[g.Asterisk().Id()] = make(map[uint32]Term)
+	addAll := func(dst, src map[uint32]Term) bool {
+		changed := false
+		for id, t := range src {
+			if _, has := dst[id]; !has {
+				dst[id] = t
+				changed = true
+			}
+		}
+		return changed
+	}
+	firstOf := func(t Term) map[uint32]Term {
+		if t.Id() == g.Epsilon().Id() {
+			return nil
+		}
+		if nf, has := ffi.first[t.Id()]; has {
+			return nf
+		}
+		return map[uint32]Term{t.Id(): t}
+	}
+	changed := true
+	for changed {
+		changed = false
+		for i := 0; i < g.NumProductionRule(); i++ {
+			pr := g.ProductionRule(i)
+			lhsFirst := ffi.first[pr.Lhs().Id()]
+			for j := 0; j < pr.RhsLen(); j++ {
+				if addAll(lhsFirst, firstOf(pr.Rhs(j))) {
+					changed = true
+				}
+				if !nullIndex.IsNullable(pr.Rhs(j)) {
+					break
+				}
+			}
+		}
+	}
+	changed = true
+	for changed {
+		changed = false
+		for i := 0; i < g.NumProductionRule(); i++ {
+			pr := g.ProductionRule(i)
+			// trailer accumulates FIRST of the suffix right of position j.
+			trailer := make(map[uint32]Term)
+			addAll(trailer, ffi.follow[pr.Lhs().Id()])
+			for j := pr.RhsLen() - 1; j >= 0; j-- {
+				t := pr.Rhs(j)
+				if nf, has := ffi.follow[t.Id()]; has {
+					if addAll(nf, trailer) {
+						changed = true
+					}
+				}
+				if nullIndex.IsNullable(t) {
+					addAll(trailer, firstOf(t))
+				} else {
+					trailer = make(map[uint32]Term)
+					addAll(trailer, firstOf(t))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func sortedTermSet(set map[uint32]Term) []Term {
+	ret := make([]Term, 0, len(set))
+	for _, t := range set {
+		ret = append(ret, t)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id() < ret[j].Id() })
+	return ret
+}
+
+func (ffi *firstFollowGrammarIndex) First(t Term) []Term {
+	if t.Id() == ffi.g.Epsilon().Id() {
+		return []Term{}
+	}
+	if nf, has := ffi.first[t.Id()]; has {
+		return sortedTermSet(nf)
+	}
+	return []Term{t}
+}
+
+func (ffi *firstFollowGrammarIndex) Follow(nt Term) []Term {
+	return sortedTermSet(ffi.follow[nt.Id()])
+}
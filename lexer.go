@@ -17,7 +17,17 @@ type LexerState interface {
 	CurrentLine() int
 	CurrentColumn() int
 	CurrentPosition() int
-	// ExpectTokens() []Term
+}
+
+// ContextAwareLexerState is implemented by lexer states which can choose
+// among tokens by the terminals a parser accepts next.  When ContextAware is
+// true, parsers which support it call SetExpectTokens with the terminals they
+// accept before each call to HasMoreTokens.  A nil set expects any terminal.
+type ContextAwareLexerState interface {
+	LexerState
+	ContextAware() bool
+	SetExpectTokens(terms []Term)
+	ExpectTokens() []Term
 }
 
 type Token interface {
@@ -31,3 +41,14 @@ type Token interface {
 	Terminal() Term
 	Literal() string
 }
+
+// TriviaToken is implemented by tokens which carry the input a lexer ignored
+// around them, such as whitespace and comments, as trivia tokens.  Trailing
+// trivia follow the token on the line it ends, up to and including the first
+// trivia token holding a line break; leading trivia are the rest of the
+// ignored input before the token.  Unparse writes trivia with their tokens.
+type TriviaToken interface {
+	Token
+	LeadingTrivia() []Token
+	TrailingTrivia() []Token
+}
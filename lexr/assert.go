@@ -0,0 +1,138 @@
+package lexr
+
+// An Assertion is a zero-width condition on the input around a position.
+type Assertion uint8
+const (
+	// AssertLineStart holds at the start of the stream and after a newline.
+	AssertLineStart Assertion = iota
+	// AssertLineEnd holds at the end of the stream and before a newline.
+	AssertLineEnd
+	// AssertStreamStart holds at the start of the stream.
+	AssertStreamStart
+	// AssertStreamEnd holds at the end of the stream.
+	AssertStreamEnd
+	// AssertWordBoundary holds between a word character [0-9A-Za-z_] and
+	// anything else, including the start or end of the stream.
+	AssertWordBoundary
+	// AssertNotWordBoundary holds wherever AssertWordBoundary does not.
+	AssertNotWordBoundary
+)
+
+// A Context classifies the runes before and after a position, which is all
+// an Assertion depends on.  Lexer DFAs take a context transition at each
+// position before consuming the next rune.
+type Context uint8
+
+// NumContexts is the number of distinct contexts.
+const NumContexts = 16
+
+const (
+	contextBoundary = iota
+	contextNewline
+	contextWord
+	contextOther
+)
+
+func contextClass(c rune) int {
+	switch {
+		case c < 0: return contextBoundary
+		case c == '\n': return contextNewline
+		case c == '_' || (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'): return contextWord
+	}
+	return contextOther
+}
+
+// ContextAt returns the context between the runes prev and next, either of
+// which is negative at the start or end of the stream.
+func ContextAt(prev, next rune) Context {
+	return Context(contextClass(prev)*4 + contextClass(next))
+}
+
+func (a Assertion) Holds(ctx Context) bool {
+	prev, next := int(ctx)/4, int(ctx)%4
+	switch(a) {
+		case AssertLineStart: return prev == contextBoundary || prev == contextNewline
+		case AssertLineEnd: return next == contextBoundary || next == contextNewline
+		case AssertStreamStart: return prev == contextBoundary
+		case AssertStreamEnd: return next == contextBoundary
+		case AssertWordBoundary: return (prev == contextWord) != (next == contextWord)
+		case AssertNotWordBoundary: return (prev == contextWord) == (next == contextWord)
+	}
+	return false
+}
+
+// String returns the pattern syntax of the assertion.
+func (a Assertion) String() string {
+	switch(a) {
+		case AssertLineStart: return "^"
+		case AssertLineEnd: return "$"
+		case AssertStreamStart: return "\\A"
+		case AssertStreamEnd: return "\\z"
+		case AssertWordBoundary: return "\\b"
+		case AssertNotWordBoundary: return "\\B"
+	}
+	return "?"
+}
+
+type assertionExpression struct {
+	assertion Assertion
+}
+
+func AssertionExpression(a Assertion) Expression {
+	return &assertionExpression{assertion: a}
+}
+
+func (ae *assertionExpression) Type() ExpressionType {
+	switch(ae.assertion) {
+		case AssertStreamStart: return MatchStart
+		case AssertStreamEnd: return LexlMatchEnd
+	}
+	return MatchAssertion
+}
+
+// TestMatch tests the assertion at the start of str, taken as the start of
+// the stream.
+func (ae *assertionExpression) TestMatch(str string) (bool, []int) {
+	next := rune(-1)
+	for _, c := range str {
+		next = c
+		break
+	}
+	if ae.assertion.Holds(ContextAt(-1, next)) {
+		return true, []int{0}
+	}
+	return false, []int{}
+}
+
+func (ae *assertionExpression) GenerateNdfaNodes(firstId uint32) ([]NdfaNode,int) {
+	s := newExpressionNdfaNode(firstId)
+	r := newExpressionNdfaNode(firstId+1)
+	s.initial = true
+	r.accepting = true
+	s.assertions = map[Assertion][]*expressionNdfaNode{ae.assertion: []*expressionNdfaNode{r}}
+	return []NdfaNode{s,r}, 1
+}
+
+// ndfaNodeContextClosure returns the nodes reachable from nodes through
+// epsilon transitions and the assertion transitions which hold in ctx.
+func ndfaNodeContextClosure(nodes []NdfaNode, ctx Context) []NdfaNode {
+	seen := make(map[uint32]bool)
+	var res []NdfaNode
+	work := append([]NdfaNode{}, nodes...)
+	for len(work) > 0 {
+		nn := work[len(work)-1]
+		work = work[:len(work)-1]
+		if seen[nn.Id()] {
+			continue
+		}
+		seen[nn.Id()] = true
+		res = append(res, nn)
+		work = append(work, nn.EpsilonTransitions()...)
+		for _, a := range nn.Assertions() {
+			if a.Holds(ctx) {
+				work = append(work, nn.AssertionTransitions(a)...)
+			}
+		}
+	}
+	return res
+}
@@ -4,6 +4,8 @@ import (
 	"sort"
 	"errors"
 	"math"
+	"sync"
+	"unicode"
 	"github.com/dtromb/parser"
 )
 
@@ -13,15 +15,29 @@ type DomainBuilder interface {
 	Include(blockName string) DomainBuilder
 	Ignore(expr Expression) DomainBuilder
 	ToBlock(blockName string) DomainBuilder
+	PushBlock(blockName string) DomainBuilder
+	PopBlock() DomainBuilder
+	FoldCase() DomainBuilder
 	DefaultToBlock(blockName string) DomainBuilder
 	Build() (Domain, error)
 	MustBuild() Domain
 }
 
+// CharacterClassBuilder builds a CharacterClass.  The named classes are
+// expanded into ranges when they are added; an unknown name is reported by
+// Build.  Intersect and Subtract apply to the runes added so far, FoldCase
+// and Negate to the whole class when it is built, folding first.
 type CharacterClassBuilder interface {
 	Negate() CharacterClassBuilder
+	FoldCase() CharacterClassBuilder
 	AddCharacter(rune) CharacterClassBuilder
 	AddRange(least, greatest rune) CharacterClassBuilder
+	AddRangeTable(table *unicode.RangeTable) CharacterClassBuilder
+	AddUnicodeCategory(name string) CharacterClassBuilder
+	AddUnicodeScript(name string) CharacterClassBuilder
+	AddPosixClass(name string) CharacterClassBuilder
+	Intersect(cc CharacterClass) CharacterClassBuilder
+	Subtract(cc CharacterClass) CharacterClassBuilder
 	Build() (CharacterClass, error)
 	MustBuild() CharacterClass
 }
@@ -77,6 +93,7 @@ type stdDomainTermdefInfo struct {
 	name string
 	nextBlock string
 	hasNextBlock bool
+	action BlockAction
 	expr Expression
 }
 
@@ -101,6 +118,7 @@ type stdDomainTermdef struct {
 	index int
 	terminal parser.Term
 	nextBlock *stdDomainBlock
+	action BlockAction
 	expr Expression
 }
 
@@ -173,6 +191,47 @@ func (db *domainBuilder) ToBlock(blockName string) DomainBuilder {
 	return db
 }
 
+// PushBlock makes the last termdef push the block it is read in onto the block
+// stack and continue in the named block.
+func (db *domainBuilder) PushBlock(blockName string) DomainBuilder {
+	if len(db.currentTermdefInfos) == 0 {
+		panic("PushBlock() called before Termdef()")
+	}
+	td := db.currentTermdefInfos[len(db.currentTermdefInfos)-1]
+	if td.hasNextBlock {
+		panic("PushBlock() called twice after same termdef")
+	}
+	td.hasNextBlock = true
+	td.nextBlock = blockName
+	td.action = BlockPush
+	return db
+}
+
+// PopBlock makes the last termdef continue in the block popped from the block
+// stack.
+func (db *domainBuilder) PopBlock() DomainBuilder {
+	if len(db.currentTermdefInfos) == 0 {
+		panic("PopBlock() called before Termdef()")
+	}
+	td := db.currentTermdefInfos[len(db.currentTermdefInfos)-1]
+	if td.hasNextBlock {
+		panic("PopBlock() called twice after same termdef")
+	}
+	td.hasNextBlock = true
+	td.action = BlockPop
+	return db
+}
+
+// FoldCase makes the last termdef match its expression case-insensitively.
+func (db *domainBuilder) FoldCase() DomainBuilder {
+	if len(db.currentTermdefInfos) == 0 {
+		panic("FoldCase() called before Termdef()")
+	}
+	td := db.currentTermdefInfos[len(db.currentTermdefInfos)-1]
+	td.expr = CaseFoldExpression(td.expr)
+	return db
+}
+
 func (db *domainBuilder) Include(blockName string) DomainBuilder {
 	if !db.hasBlock {
 		panic("Include() called before Block()")
@@ -249,6 +308,7 @@ func (db *domainBuilder) Build() (Domain, error) {
 				index: j,
 				terminal: term,
 				nextBlock: nextBlock,
+				action: blockInfo.termdefs[j].action,
 				expr: blockInfo.termdefs[j].expr,
 			}
 			block.termdefs[j] = termdef
@@ -256,7 +316,7 @@ func (db *domainBuilder) Build() (Domain, error) {
 		for j := 0; j < len(block.includeBlocks); j++ {
 			includeInfo, has := db.blockInfosByName[blockInfo.includeBlockNames[j]]
 			if !has {
-				return nil, errors.New("include of non-existant block '"+blockInfo.termdefs[j].nextBlock+"'")
+				return nil, errors.New("include of non-existant block '"+blockInfo.includeBlockNames[j]+"'")
 			}
 			block.includeBlocks[j] = domain.blocks[includeInfo.index]
 		}
@@ -311,6 +371,7 @@ func cloneDomain(d Domain) (*stdDomain,error) {
 			td := &stdDomainTermdef{
 				block: newBlock,
 				terminal: t,
+				action: oldTd.BlockAction(),
 				expr: oldTd.Expression(),
 			}
 			if oldTd.HasNextBlock() {
@@ -420,10 +481,20 @@ func (dt *stdDomainTermdef) HasNextBlock() bool {
 	return dt.nextBlock != nil
 }
 
+func (dt *stdDomainTermdef) BlockAction() BlockAction {
+	return dt.action
+}
+
+func (dt *stdDomainTermdef) CaseFolded() bool {
+	return dt.expr.Type() == MatchCaseFold
+}
+
 type characterClassBuilder struct {
 	negated bool
+	folded bool
 	literals map[rune]bool
 	ranges [][]rune
+	err error
 }
 
 func (ccb *characterClassBuilder) Negate() CharacterClassBuilder {
@@ -431,6 +502,117 @@ func (ccb *characterClassBuilder) Negate() CharacterClassBuilder {
 	return ccb
 }
 
+func (ccb *characterClassBuilder) FoldCase() CharacterClassBuilder {
+	ccb.folded = true
+	return ccb
+}
+
+func (ccb *characterClassBuilder) Intersect(cc CharacterClass) CharacterClassBuilder {
+	ccb.setIntervals(intersectIntervals(ccb.intervals(), classIntervals(cc)))
+	return ccb
+}
+
+func (ccb *characterClassBuilder) Subtract(cc CharacterClass) CharacterClassBuilder {
+	ccb.setIntervals(intersectIntervals(ccb.intervals(), invertRegularizedIntervals(classIntervals(cc))))
+	return ccb
+}
+
+// intervals returns the runes added so far as regularized intervals.
+func (ccb *characterClassBuilder) intervals() []*characterRange {
+	var ranges []*characterRange
+	for _, r := range ccb.ranges {
+		ranges = append(ranges, &characterRange{r[0], r[1]})
+	}
+	for c, _ := range ccb.literals {
+		ranges = append(ranges, &characterRange{c, c})
+	}
+	return normalizeIntervals(ranges)
+}
+
+func (ccb *characterClassBuilder) setIntervals(ranges []*characterRange) {
+	ccb.literals = make(map[rune]bool)
+	ccb.ranges = ccb.ranges[:0]
+	for _, r := range ranges {
+		if r.least == r.greatest {
+			ccb.literals[r.least] = true
+		} else {
+			ccb.ranges = append(ccb.ranges, []rune{r.least, r.greatest})
+		}
+	}
+}
+
+// normalizeIntervals regularizes ranges in which a negative bound or
+// math.MaxInt32 stands for an open end.
+func normalizeIntervals(ranges []*characterRange) []*characterRange {
+	var res []*characterRange
+	for _, r := range ranges {
+		nr := &characterRange{r.least, r.greatest}
+		if nr.least < 0 {
+			nr.least = 0
+		}
+		if nr.greatest == math.MaxInt32 {
+			nr.greatest = -1
+		}
+		res = append(res, nr)
+	}
+	return regularizeBoundedIntervals(res)
+}
+
+// classSetIntervals returns the literals and ranges of cc as regularized
+// intervals, ignoring its negation.
+func classSetIntervals(cc CharacterClass) []*characterRange {
+	var ranges []*characterRange
+	for _, c := range cc.Literals() {
+		ranges = append(ranges, &characterRange{c, c})
+	}
+	for _, r := range cc.Ranges() {
+		ranges = append(ranges, &characterRange{r.Least(), r.Greatest()})
+	}
+	return normalizeIntervals(ranges)
+}
+
+// classIntervals returns the runes matched by cc as regularized intervals.
+func classIntervals(cc CharacterClass) []*characterRange {
+	if cc.Negated() {
+		return invertRegularizedIntervals(classSetIntervals(cc))
+	}
+	return classSetIntervals(cc)
+}
+
+func intersectIntervals(a, b []*characterRange) []*characterRange {
+	union := append(invertRegularizedIntervals(a), invertRegularizedIntervals(b)...)
+	return invertRegularizedIntervals(normalizeIntervals(union))
+}
+
+var caseFoldRunesOnce sync.Once
+var caseFoldRunes []rune
+
+// foldIntervals adds the simple case folds of the runes in ranges.
+func foldIntervals(ranges []*characterRange) []*characterRange {
+	caseFoldRunesOnce.Do(func() {
+		for _, cr := range unicode.CaseRanges {
+			for c := rune(cr.Lo); c <= rune(cr.Hi); c++ {
+				if unicode.SimpleFold(c) != c {
+					caseFoldRunes = append(caseFoldRunes, c)
+				}
+			}
+		}
+	})
+	res := append([]*characterRange{}, ranges...)
+	for _, c := range caseFoldRunes {
+		n := sort.Search(len(ranges), func(i int) bool {
+			return ranges[i].greatest < 0 || ranges[i].greatest >= c
+		})
+		if n == len(ranges) || ranges[n].least > c {
+			continue
+		}
+		for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+			res = append(res, &characterRange{f, f})
+		}
+	}
+	return normalizeIntervals(res)
+}
+
 func (ccb *characterClassBuilder) AddCharacter(c rune) CharacterClassBuilder {
 	ccb.literals[c] = true
 	return ccb
@@ -444,7 +626,121 @@ func (ccb *characterClassBuilder) AddRange(least, greatest rune) CharacterClassB
 	return ccb
 }
 
+func (ccb *characterClassBuilder) AddRangeTable(table *unicode.RangeTable) CharacterClassBuilder {
+	return ccb.addRangeTable(table, false)
+}
+
+// addRangeTable adds the runes of table, or all other runes if negated.
+func (ccb *characterClassBuilder) addRangeTable(table *unicode.RangeTable, negated bool) CharacterClassBuilder {
+	var ranges []*characterRange
+	for _, r := range table.R16 {
+		ranges = appendStridedRange(ranges, rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+	for _, r := range table.R32 {
+		ranges = appendStridedRange(ranges, rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+	ranges = regularizeBoundedIntervals(ranges)
+	if negated {
+		ranges = invertRegularizedIntervals(ranges)
+	}
+	for _, r := range ranges {
+		if r.least == r.greatest {
+			ccb.literals[r.least] = true
+		} else {
+			ccb.ranges = append(ccb.ranges, []rune{r.least, r.greatest})
+		}
+	}
+	return ccb
+}
+
+func appendStridedRange(ranges []*characterRange, lo, hi, stride rune) []*characterRange {
+	if stride == 1 {
+		return append(ranges, &characterRange{lo, hi})
+	}
+	for c := lo; c <= hi; c += stride {
+		ranges = append(ranges, &characterRange{c, c})
+	}
+	return ranges
+}
+
+func (ccb *characterClassBuilder) AddUnicodeCategory(name string) CharacterClassBuilder {
+	table, has := unicode.Categories[name]
+	if !has {
+		ccb.setError("unknown unicode category '"+name+"'")
+		return ccb
+	}
+	return ccb.AddRangeTable(table)
+}
+
+func (ccb *characterClassBuilder) AddUnicodeScript(name string) CharacterClassBuilder {
+	table, has := unicode.Scripts[name]
+	if !has {
+		ccb.setError("unknown unicode script '"+name+"'")
+		return ccb
+	}
+	return ccb.AddRangeTable(table)
+}
+
+func (ccb *characterClassBuilder) AddPosixClass(name string) CharacterClassBuilder {
+	table, has := posixClasses[name]
+	if !has {
+		ccb.setError("unknown posix class '"+name+"'")
+		return ccb
+	}
+	return ccb.AddRangeTable(table)
+}
+
+func (ccb *characterClassBuilder) setError(msg string) {
+	if ccb.err == nil {
+		ccb.err = errors.New(msg)
+	}
+}
+
+// lookupUnicodeClass finds a unicode category or script by name, as named by
+// \p{name} in patterns.
+func lookupUnicodeClass(name string) (*unicode.RangeTable, bool) {
+	if table, has := unicode.Categories[name]; has {
+		return table, true
+	}
+	table, has := unicode.Scripts[name]
+	return table, has
+}
+
+// posixClasses are the ASCII classes named by [:name:] in patterns.
+var posixClasses = map[string]*unicode.RangeTable{
+	"alnum": asciiTable('0', '9', 'A', 'Z', 'a', 'z'),
+	"alpha": asciiTable('A', 'Z', 'a', 'z'),
+	"ascii": asciiTable(0, 0x7f),
+	"blank": asciiTable('\t', '\t', ' ', ' '),
+	"cntrl": asciiTable(0, 0x1f, 0x7f, 0x7f),
+	"digit": asciiTable('0', '9'),
+	"graph": asciiTable('!', '~'),
+	"lower": asciiTable('a', 'z'),
+	"print": asciiTable(' ', '~'),
+	"punct": asciiTable('!', '/', ':', '@', '[', '`', '{', '~'),
+	"space": asciiTable('\t', '\r', ' ', ' '),
+	"upper": asciiTable('A', 'Z'),
+	"word": asciiTable('0', '9', 'A', 'Z', '_', '_', 'a', 'z'),
+	"xdigit": asciiTable('0', '9', 'A', 'F', 'a', 'f'),
+}
+
+// asciiTable makes a range table of the ranges given as consecutive
+// least, greatest pairs in increasing order.
+func asciiTable(bounds ...uint16) *unicode.RangeTable {
+	table := &unicode.RangeTable{}
+	for i := 0; i < len(bounds); i += 2 {
+		table.R16 = append(table.R16, unicode.Range16{Lo: bounds[i], Hi: bounds[i+1], Stride: 1})
+	}
+	return table
+}
+
 func (ccb *characterClassBuilder) Build() (CharacterClass, error) {
+	if ccb.err != nil {
+		return nil, ccb.err
+	}
+	if ccb.folded {
+		ccb.setIntervals(foldIntervals(ccb.intervals()))
+	}
 	ranges := make([]*characterRange, 0, len(ccb.ranges) + len(ccb.literals))
 	for _, r := range ccb.ranges {
 		if r[0] < 0 {
@@ -502,6 +798,7 @@ func (cc *stdCharacterClass) Literals() []rune {
 	for _, c := range cc.literals {
 		res = append(res, c)
 	}
+	sort.Sort(runeSort(res))
 	return res
 }
 
@@ -555,14 +852,16 @@ func regularizeBoundedIntervals(ranges []*characterRange) []*characterRange {
 			greatest: lSort[lidx].greatest,
 		}
 		//fmt.Printf("%d: (%d,%d)\n", lidx, lRange.least, lRange.greatest)
-		for lidx < len(lSort) && lSort[lidx].least-1 <= lRange.greatest {
+		for lidx < len(lSort) && (lRange.greatest < 0 || lSort[lidx].least-1 <= lRange.greatest) {
 			// The intervals overlap; merge them.
 			//if lidx < len(lSort)-1 {
 			//	fmt.Printf("merged, next is (%d,%d)\n", lSort[lidx+1].least, lSort[lidx+1].greatest)
 			//} else {
 			//	fmt.Printf("merged, at end of list\n")
 			//}
-			lRange.greatest = lSort[lidx].greatest
+			if lRange.greatest >= 0 && (lSort[lidx].greatest < 0 || lSort[lidx].greatest > lRange.greatest) {
+				lRange.greatest = lSort[lidx].greatest
+			}
 			lidx++
 		}
 		//fmt.Printf("done merging, printing (%d,%d)\n", lRange.least, lRange.greatest)
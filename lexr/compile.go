@@ -0,0 +1,513 @@
+package lexr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// perlClasses are the classes named by the \d, \w and \s escapes.
+var perlClasses = map[rune]*unicode.RangeTable{
+	'd': posixClasses["digit"],
+	'w': posixClasses["word"],
+	's': asciiTable('\t', '\n', '\f', '\r', ' ', ' '),
+}
+
+type expressionCompiler struct {
+	pattern []rune
+	pos int
+}
+
+// CompileExpression compiles a pattern in the syntax written by
+// WriteExpression, which is also the match syntax of lexr0:
+//
+//	c        a literal character other than .[]{}()\*+?|^$
+//	.        any character
+//	[...]    a character class of literals, ranges a-z, the classes below and
+//	         POSIX classes [:alpha:] or [:^alpha:]; [^...] negates it, and a
+//	         range with no upper bound (a-]) extends to the last rune
+//	e? e* e+ e{m} e{m,} e{,n} e{m,n}
+//	         quantifiers
+//	(e)      grouping
+//	(?<name>e)
+//	         a capture group, numbered from 1 in the order of its opening
+//	         parenthesis; see Token
+//	e|f      alternation
+//	(?i)e (?i:e)
+//	         case-insensitive matching of e, which is the rest of the pattern
+//	         or group after (?i)
+//	[c&&[d]] [c--[d]]
+//	         the intersection and difference of the classes c and d, where c
+//	         is everything before the operator
+//	\n \t \r \f \0
+//	         control characters
+//	\xNNNN   the code point with four decimal digits NNNN
+//	\d \w \s digits [0-9], word characters [0-9A-Za-z_] and whitespace
+//	         [\t\n\f\r ]; \D \W \S match any other character
+//	\pN \p{Name}
+//	         the unicode category or script Name, such as L, Lu or Greek;
+//	         \PN and \P{Name} match any other character
+//	^ $      the start and end of a line
+//	\A \z    the start and end of the stream
+//	\b \B    a word boundary and a position which is not one
+//	\_       never matches
+//	\c       the character c
+//
+// Assertions match no input.  Inside a class, $ and a ^ which is not first
+// are characters.
+func CompileExpression(pattern string) (Expression, error) {
+	ec := &expressionCompiler{pattern: []rune(pattern)}
+	expr, err := ec.compileAlternation()
+	if err != nil {
+		return nil, err
+	}
+	if ec.pos < len(ec.pattern) {
+		return nil, ec.unexpected()
+	}
+	return expr, nil
+}
+
+// MustCompileExpression is like CompileExpression but panics if the pattern
+// does not compile.
+func MustCompileExpression(pattern string) Expression {
+	expr, err := CompileExpression(pattern)
+	if err != nil {
+		panic(err.Error())
+	}
+	return expr
+}
+
+func (ec *expressionCompiler) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("pattern '%s' at %d: ", string(ec.pattern), ec.pos) + fmt.Sprintf(format, args...))
+}
+
+func (ec *expressionCompiler) unexpected() error {
+	if ec.pos >= len(ec.pattern) {
+		return ec.errorf("unexpected end of pattern")
+	}
+	return ec.errorf("unexpected '%c'", ec.pattern[ec.pos])
+}
+
+func (ec *expressionCompiler) peek() rune {
+	if ec.pos >= len(ec.pattern) {
+		return -1
+	}
+	return ec.pattern[ec.pos]
+}
+
+// hasPrefix reports whether the pattern continues with prefix.
+func (ec *expressionCompiler) hasPrefix(prefix string) bool {
+	rs := []rune(prefix)
+	if ec.pos+len(rs) > len(ec.pattern) {
+		return false
+	}
+	for i, r := range rs {
+		if ec.pattern[ec.pos+i] != r {
+			return false
+		}
+	}
+	return true
+}
+
+func (ec *expressionCompiler) compileAlternation() (Expression, error) {
+	if ec.hasPrefix("(?i)") {
+		ec.pos += 4
+		expr, err := ec.compileAlternation()
+		if err != nil {
+			return nil, err
+		}
+		return CaseFoldExpression(expr), nil
+	}
+	var alts []Expression
+	for {
+		seq, err := ec.compileSequence()
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, seq)
+		if ec.peek() != '|' {
+			break
+		}
+		ec.pos++
+	}
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+	return AlternationExpression(alts...), nil
+}
+
+func (ec *expressionCompiler) compileSequence() (Expression, error) {
+	var seq []Expression
+	for c := ec.peek(); c >= 0 && c != '|' && c != ')'; c = ec.peek() {
+		expr, err := ec.compileSuffixed()
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, expr)
+	}
+	switch len(seq) {
+		case 0: return nil, ec.unexpected()
+		case 1: return seq[0], nil
+	}
+	return SequenceExpression(seq...), nil
+}
+
+func (ec *expressionCompiler) compileSuffixed() (Expression, error) {
+	expr, err := ec.compileAtom()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch ec.peek() {
+			case '*': {
+				ec.pos++
+				expr = StarExpression(expr)
+			}
+			case '+': {
+				ec.pos++
+				expr = PlusExpression(expr)
+			}
+			case '?': {
+				ec.pos++
+				expr = QuantifiedExpression(expr, 0, 1)
+			}
+			case '{': {
+				ec.pos++
+				if expr, err = ec.compileQuantifier(expr); err != nil {
+					return nil, err
+				}
+			}
+			default: {
+				return expr, nil
+			}
+		}
+	}
+}
+
+// compileQuantifier compiles the remainder of {m}, {m,}, {,n} or {m,n}.
+// Whitespace between the braces is ignored.
+func (ec *expressionCompiler) compileQuantifier(expr Expression) (Expression, error) {
+	skipSpace := func() {
+		for c := ec.peek(); c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'; c = ec.peek() {
+			ec.pos++
+		}
+	}
+	readNum := func() (int, bool) {
+		skipSpace()
+		start := ec.pos
+		for c := ec.peek(); c >= '0' && c <= '9'; c = ec.peek() {
+			ec.pos++
+		}
+		if start == ec.pos {
+			return -1, false
+		}
+		n, err := strconv.Atoi(string(ec.pattern[start:ec.pos]))
+		if err != nil {
+			return -1, false
+		}
+		skipSpace()
+		return n, true
+	}
+	min, hasMin := readNum()
+	max := min
+	if ec.peek() == ',' {
+		ec.pos++
+		max, _ = readNum()
+	} else if !hasMin {
+		return nil, ec.unexpected()
+	}
+	if ec.peek() != '}' {
+		return nil, ec.unexpected()
+	}
+	ec.pos++
+	if max == 0 || (max > 0 && max < min) || (min < 0 && max < 0) {
+		return nil, ec.errorf("invalid quantifier")
+	}
+	return QuantifiedExpression(expr, min, max), nil
+}
+
+func (ec *expressionCompiler) compileAtom() (Expression, error) {
+	c := ec.peek()
+	switch c {
+		case '.': {
+			ec.pos++
+			return AlwaysMatchExpression(), nil
+		}
+		case '(': {
+			ec.pos++
+			fold := ec.hasPrefix("?i:")
+			name := ""
+			switch {
+				case fold: ec.pos += 3
+				case ec.hasPrefix("?<"): {
+					ec.pos += 2
+					start := ec.pos
+					for ec.pos < len(ec.pattern) && ec.pattern[ec.pos] != '>' {
+						c := ec.pattern[ec.pos]
+						if c != '_' && !unicode.IsLetter(c) && (ec.pos == start || !unicode.IsDigit(c)) {
+							return nil, ec.errorf("invalid group name character '%c'", c)
+						}
+						ec.pos++
+					}
+					if ec.pos == start || ec.peek() != '>' {
+						return nil, ec.errorf("a capture group must be named, as in (?<name>e)")
+					}
+					name = string(ec.pattern[start:ec.pos])
+					ec.pos++
+				}
+				case ec.peek() == '?': {
+					return nil, ec.errorf("group flags must be (?i:e) or (?<name>e), or (?i) at the start of a group")
+				}
+			}
+			expr, err := ec.compileAlternation()
+			if err != nil {
+				return nil, err
+			}
+			if ec.peek() != ')' {
+				return nil, ec.unexpected()
+			}
+			ec.pos++
+			if fold {
+				return CaseFoldExpression(expr), nil
+			}
+			if name != "" {
+				return SubmatchExpression(name, expr), nil
+			}
+			return expr, nil
+		}
+		case '[': {
+			ec.pos++
+			return ec.compileClass()
+		}
+		case '\\': {
+			ccb := OpenCharacterClassBuilder().(*characterClassBuilder)
+			if ok, err := ec.compileClassEscape(ccb); ok || err != nil {
+				if err != nil {
+					return nil, err
+				}
+				return CharacterClassExpression(ccb.MustBuild()), nil
+			}
+			ec.pos++
+			switch ec.peek() {
+				case '_': {
+					ec.pos++
+					return NeverMatchExpression(), nil
+				}
+				case 'A', 'z', 'b', 'B': {
+					a := map[rune]Assertion{
+						'A': AssertStreamStart,
+						'z': AssertStreamEnd,
+						'b': AssertWordBoundary,
+						'B': AssertNotWordBoundary,
+					}[ec.peek()]
+					ec.pos++
+					return AssertionExpression(a), nil
+				}
+			}
+			r, err := ec.compileEscape()
+			if err != nil {
+				return nil, err
+			}
+			return CharacterLiteralExpression(r), nil
+		}
+		case '^': {
+			ec.pos++
+			return AssertionExpression(AssertLineStart), nil
+		}
+		case '$': {
+			ec.pos++
+			return AssertionExpression(AssertLineEnd), nil
+		}
+		case ']', '{', '}', ')', '*', '+', '?', '|', -1: {
+			return nil, ec.unexpected()
+		}
+	}
+	ec.pos++
+	return CharacterLiteralExpression(c), nil
+}
+
+// compileEscape compiles the character following a backslash.
+func (ec *expressionCompiler) compileEscape() (rune, error) {
+	c := ec.peek()
+	if c < 0 {
+		return -1, ec.unexpected()
+	}
+	ec.pos++
+	switch c {
+		case 'n': return '\n', nil
+		case 't': return '\t', nil
+		case 'r': return '\r', nil
+		case 'f': return '\f', nil
+		case '0': return 0, nil
+		case 'x': {
+			if ec.pos+4 > len(ec.pattern) {
+				return -1, ec.errorf("\\x needs four decimal digits")
+			}
+			for _, d := range ec.pattern[ec.pos:ec.pos+4] {
+				if d < '0' || d > '9' {
+					return -1, ec.errorf("\\x needs four decimal digits")
+				}
+			}
+			n, _ := strconv.Atoi(string(ec.pattern[ec.pos:ec.pos+4]))
+			ec.pos += 4
+			return rune(n), nil
+		}
+	}
+	return c, nil
+}
+
+// compileClass compiles a character class after its opening bracket.
+func (ec *expressionCompiler) compileClass() (Expression, error) {
+	ccb := OpenCharacterClassBuilder().(*characterClassBuilder)
+	if ec.peek() == '^' {
+		ec.pos++
+		ccb.Negate()
+	}
+	readChar := func() (rune, error) {
+		c := ec.peek()
+		switch c {
+			case -1: return -1, ec.unexpected()
+			case '\\': {
+				ec.pos++
+				return ec.compileEscape()
+			}
+		}
+		ec.pos++
+		return c, nil
+	}
+	first := true
+	for ec.peek() != ']' {
+		if !first && (ec.hasPrefix("&&[") || ec.hasPrefix("--[")) {
+			subtract := ec.peek() == '-'
+			ec.pos += 3
+			operand, err := ec.compileClass()
+			if err != nil {
+				return nil, err
+			}
+			if subtract {
+				ccb.Subtract(operand.(*characterClassExpression).class)
+			} else {
+				ccb.Intersect(operand.(*characterClassExpression).class)
+			}
+			continue
+		}
+		if ok, err := ec.compileClassEscape(ccb); ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			first = false
+			continue
+		}
+		if ok, err := ec.compilePosixClass(ccb); ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			first = false
+			continue
+		}
+		if first && ec.peek() == '-' {
+			ec.pos++
+			ccb.AddCharacter('-')
+			first = false
+			continue
+		}
+		first = false
+		least, err := readChar()
+		if err != nil {
+			return nil, err
+		}
+		if ec.peek() != '-' {
+			ccb.AddCharacter(least)
+			continue
+		}
+		ec.pos++
+		if ec.peek() == ']' {
+			ccb.AddRange(least, -1)
+			continue
+		}
+		greatest, err := readChar()
+		if err != nil {
+			return nil, err
+		}
+		if greatest < least {
+			return nil, ec.errorf("invalid range %q-%q", least, greatest)
+		}
+		ccb.AddRange(least, greatest)
+	}
+	ec.pos++
+	cc, err := ccb.Build()
+	if err != nil {
+		return nil, ec.errorf("%s", err.Error())
+	}
+	return CharacterClassExpression(cc), nil
+}
+
+// compileClassEscape adds the class named by a \d, \w, \s or \p escape at the
+// current position to ccb, and reports whether there was one.
+func (ec *expressionCompiler) compileClassEscape(ccb *characterClassBuilder) (bool, error) {
+	if ec.peek() != '\\' || ec.pos+1 >= len(ec.pattern) {
+		return false, nil
+	}
+	c := ec.pattern[ec.pos+1]
+	negated := unicode.IsUpper(c)
+	switch unicode.ToLower(c) {
+		case 'd', 'w', 's': {
+			ec.pos += 2
+			ccb.addRangeTable(perlClasses[unicode.ToLower(c)], negated)
+			return true, nil
+		}
+		case 'p': {
+			ec.pos += 2
+			var name string
+			if ec.peek() == '{' {
+				end := ec.pos+1
+				for end < len(ec.pattern) && ec.pattern[end] != '}' {
+					end++
+				}
+				if end >= len(ec.pattern) {
+					return false, ec.errorf("unterminated unicode class name")
+				}
+				name = string(ec.pattern[ec.pos+1:end])
+				ec.pos = end+1
+			} else if ec.peek() >= 0 {
+				name = string(ec.pattern[ec.pos])
+				ec.pos++
+			}
+			table, has := lookupUnicodeClass(name)
+			if !has {
+				return false, ec.errorf("unknown unicode category or script '%s'", name)
+			}
+			ccb.addRangeTable(table, negated)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compilePosixClass adds the class named by a [:name:] or [:^name:] at the
+// current position to ccb, and reports whether there was one.
+func (ec *expressionCompiler) compilePosixClass(ccb *characterClassBuilder) (bool, error) {
+	if ec.peek() != '[' || ec.pos+1 >= len(ec.pattern) || ec.pattern[ec.pos+1] != ':' {
+		return false, nil
+	}
+	end := ec.pos+2
+	for end+1 < len(ec.pattern) && !(ec.pattern[end] == ':' && ec.pattern[end+1] == ']') {
+		end++
+	}
+	if end+1 >= len(ec.pattern) {
+		return false, nil
+	}
+	name := string(ec.pattern[ec.pos+2:end])
+	negated := len(name) > 0 && name[0] == '^'
+	if negated {
+		name = name[1:]
+	}
+	table, has := posixClasses[name]
+	if !has {
+		return false, ec.errorf("unknown posix class '%s'", name)
+	}
+	ec.pos = end+2
+	ccb.addRangeTable(table, negated)
+	return true, nil
+}
@@ -0,0 +1,134 @@
+package lexr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dtromb/parser"
+)
+
+// WriteNdfaDot writes an NDFA as a GraphViz DOT graph.  Epsilon transitions
+// are drawn dashed; terminal nodes are double circles labelled with their
+// block and termdef, as in WriteNdfaNode.
+func WriteNdfaDot(ndfa Ndfa, out io.Writer) error {
+	bout := bufio.NewWriter(out)
+	bout.WriteString("digraph ndfa {\n")
+	bout.WriteString("  rankdir=LR;\n")
+	for i := 0; i < ndfa.NumNodes(); i++ {
+		nn := ndfa.Node(i)
+		label := fmt.Sprintf("%d", nn.Id())
+		if dnn, ok := nn.(DomainNdfaNode); ok && dnn.Block() != nil {
+			if dnn.Termdef() != nil {
+				label += fmt.Sprintf("\n%s/%s", dnn.Block().Name(), dnn.Termdef().Terminal().Name())
+			} else if dnn.IsIgnore() {
+				label += fmt.Sprintf("\n%s/_", dnn.Block().Name())
+			} else {
+				label += fmt.Sprintf("\n%s", dnn.Block().Name())
+			}
+		}
+		shape := "circle"
+		if nn.IsTerminal() {
+			shape = "doublecircle"
+		}
+		bout.WriteString(fmt.Sprintf("  n%d [label=%s shape=%s];\n", nn.Id(), parser.DotQuote(label), shape))
+		lits := nn.Literals()
+		sort.Sort(runeSort(lits))
+		for _, c := range lits {
+			for _, tr := range nn.LiteralTransitions(c) {
+				bout.WriteString(fmt.Sprintf("  n%d -> n%d [label=%s];\n", nn.Id(), tr.Id(),
+					parser.DotQuote(matchEscapeCharacterLiteral(c, false))))
+			}
+		}
+		for _, r := range nn.CharacterRanges() {
+			for _, tr := range nn.CharacterRangeTransitions(r) {
+				bout.WriteString(fmt.Sprintf("  n%d -> n%d [label=%s];\n", nn.Id(), tr.Id(),
+					parser.DotQuote(dotRangeLabel([]CharacterRange{r}))))
+			}
+		}
+		for _, tr := range nn.EpsilonTransitions() {
+			bout.WriteString(fmt.Sprintf("  n%d -> n%d [style=dashed];\n", nn.Id(), tr.Id()))
+		}
+	}
+	bout.WriteString("}\n")
+	return bout.Flush()
+}
+
+// WriteDfaDot writes a DFA as a GraphViz DOT graph.  All character ranges
+// leading to the same state are merged into one edge labelled as a
+// character class.  Accepting states are double circles labelled with their
+// accepted terminal, with a dotted edge to the AcceptTermNext() state.
+func WriteDfaDot(dfa Dfa, out io.Writer) error {
+	bout := bufio.NewWriter(out)
+	bout.WriteString("digraph dfa {\n")
+	bout.WriteString("  rankdir=LR;\n")
+	for i := 0; i < dfa.NumStates(); i++ {
+		dn := dfa.State(i)
+		label := fmt.Sprintf("%d", dn.Id())
+		shape := "circle"
+		if term, ok := dn.AcceptTerm(); ok {
+			shape = "doublecircle"
+			label += "\n" + parser.TermToString(term)
+		}
+		bout.WriteString(fmt.Sprintf("  s%d [label=%s shape=%s];\n", dn.Id(), parser.DotQuote(label), shape))
+		var targets []DfaNode
+		edges := make(map[int][]CharacterRange)
+		c := rune(0)
+		for {
+			r := dn.TransitionRange(c)
+			if tx, has := dn.TransitionLookup(r); has {
+				if _, seen := edges[tx.Id()]; !seen {
+					targets = append(targets, tx)
+				}
+				edges[tx.Id()] = append(edges[tx.Id()], r)
+			}
+			if r.Greatest() < 0 || r.Greatest() >= math.MaxInt32 {
+				break
+			}
+			c = r.Greatest() + 1
+		}
+		for _, tx := range targets {
+			bout.WriteString(fmt.Sprintf("  s%d -> s%d [label=%s];\n", dn.Id(), tx.Id(),
+				parser.DotQuote(dotRangeLabel(edges[tx.Id()]))))
+		}
+		if nxt, ok := dn.AcceptTermNext(); ok {
+			bout.WriteString(fmt.Sprintf("  s%d -> s%d [style=dotted];\n", dn.Id(), nxt.Id()))
+		}
+	}
+	bout.WriteString("}\n")
+	return bout.Flush()
+}
+
+type runeSort []rune
+
+func (rs runeSort) Len() int           { return len(rs) }
+func (rs runeSort) Less(i, j int) bool { return rs[i] < rs[j] }
+func (rs runeSort) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+
+func dotRangeLabel(ranges []CharacterRange) string {
+	if len(ranges) == 1 {
+		r := ranges[0]
+		if r.Least() == r.Greatest() {
+			return matchEscapeCharacterLiteral(r.Least(), false)
+		}
+		if r.Least() <= 0 && (r.Greatest() < 0 || r.Greatest() >= math.MaxInt32) {
+			return "."
+		}
+	}
+	var parts []string
+	for _, r := range ranges {
+		switch {
+		case r.Least() == r.Greatest():
+			parts = append(parts, matchEscapeCharacterLiteral(r.Least(), true))
+		case r.Greatest() < 0 || r.Greatest() >= math.MaxInt32:
+			parts = append(parts, matchEscapeCharacterLiteral(r.Least(), true)+"-")
+		default:
+			parts = append(parts, matchEscapeCharacterLiteral(r.Least(), true)+"-"+
+				matchEscapeCharacterLiteral(r.Greatest(), true))
+		}
+	}
+	return "[" + strings.Join(parts, "") + "]"
+}
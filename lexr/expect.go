@@ -0,0 +1,93 @@
+package lexr
+
+import (
+	"github.com/dtromb/parser"
+)
+
+// ContextAwareLexer is implemented by lexers created by CreateLexrLexer and
+// LoadLexrLexer.  The states of a context aware lexer ask parsers for the
+// terminals they expect, through parser.ContextAwareLexerState.  A state with
+// expected terminals reads the longest input accepted by a termdef for an
+// expected terminal, and of the termdefs accepting that input takes the first
+// whose terminal is expected.  Ignored input is always expected, and input no
+// expected termdef accepts is lexed as if nothing were expected.
+type ContextAwareLexer interface {
+	SetContextAware(aware bool)
+	ContextAware() bool
+}
+
+// acceptAlt is a termdef accepted by a DFA state after the state's own
+// accept term, which a state expecting terminals may take instead.
+type acceptAlt struct {
+	term parser.Term
+	block Block
+	next *stdDfaNode
+	action BlockAction
+	slot int
+	groups []string
+}
+
+func (ll *lexrLexer) SetContextAware(aware bool) {
+	ll.aware = aware
+}
+
+func (ll *lexrLexer) ContextAware() bool {
+	return ll.aware
+}
+
+func (ls *lexrState) ContextAware() bool {
+	return ls.aware
+}
+
+// SetExpectTokens sets the terminals expected from the next token read.
+func (ls *lexrState) SetExpectTokens(terms []parser.Term) {
+	if terms == nil {
+		ls.expectTerms, ls.expect = nil, nil
+		return
+	}
+	ls.expectTerms = make([]parser.Term, len(terms))
+	copy(ls.expectTerms, terms)
+	ls.expect = make(map[uint32]bool)
+	for _, t := range terms {
+		ls.expect[t.Id()] = true
+	}
+}
+
+func (ls *lexrState) ExpectTokens() []parser.Term {
+	if ls.expectTerms == nil {
+		return nil
+	}
+	terms := make([]parser.Term, len(ls.expectTerms))
+	copy(terms, ls.expectTerms)
+	return terms
+}
+
+// expects reports whether dn accepts an expected terminal.
+func (ls *lexrState) expects(dn DfaNode) bool {
+	term, ok := dn.AcceptTerm()
+	if !ok {
+		return false
+	}
+	if ls.expect == nil || term == term.Grammar().Epsilon() || ls.expect[term.Id()] {
+		return true
+	}
+	return ls.expectedAlt(dn) != nil
+}
+
+// expectedAlt returns the first alternative accepted by dn whose terminal is
+// expected, or nil when dn takes its own accept term.
+func (ls *lexrState) expectedAlt(dn DfaNode) *acceptAlt {
+	sdn, ok := dn.(*stdDfaNode)
+	if !ok || ls.expect == nil || sdn.acceptTerm == nil {
+		return nil
+	}
+	if sdn.acceptTerm == sdn.acceptTerm.Grammar().Epsilon() || ls.expect[sdn.acceptTerm.Id()] {
+		return nil
+	}
+	for _, alt := range sdn.acceptAlts {
+		if ls.expect[alt.term.Id()] {
+			return alt
+		}
+	}
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"reflect"
 	"math"
 	"github.com/dtromb/parser"
-	"strconv"
 	"unicode"
 	"fmt"
 	"io"
@@ -16,6 +15,9 @@ type expressionNdfaNode struct {
 	literals map[rune][]*expressionNdfaNode
 	ranges map[uint64][]*expressionNdfaNode
 	epsilons []NdfaNode
+	assertions map[Assertion][]*expressionNdfaNode
+	group *submatchExpression
+	groupEnd bool
 	terminal parser.Term
 	accepting bool
 	initial bool
@@ -226,7 +228,7 @@ func (se *sequenceExpression) TestMatch(str string) (bool,[]int) {
 	}
 	res := make([]int, 0, len(positions))
 	for _, p := range positions {
-		res[p] = p
+		res = append(res, p)
 	}
 	sort.Ints(res)
 	return true, res
@@ -375,7 +377,7 @@ func (pe *plusExpression) TestMatch(str string) (bool, []int) {
 	}
 	res := make([]int, 0, len(allPositions))
 	for _, p := range allPositions {
-		res[p] = p
+		res = append(res, p)
 	}
 	sort.Ints(res)
 	return true, res
@@ -445,7 +447,7 @@ func (se *starExpression) TestMatch(str string) (bool, []int) {
 	}
 	res := make([]int, 0, len(allPositions))
 	for _, p := range allPositions {
-		res[p] = p
+		res = append(res, p)
 	}
 	sort.Ints(res)
 	return true, res
@@ -561,99 +563,164 @@ func (qe *quantifiedExpression) TestMatch(str string) (bool, []int) {
 }
 
 func (qe *quantifiedExpression) GenerateNdfaNodes(firstId uint32) ([]NdfaNode,int) {
-	nextId := firstId
-	s := newExpressionNdfaNode(nextId)
-	nextId++
-	r := newExpressionNdfaNode(nextId)
-	nextId++
-	s.initial = true
-	r.accepting = true
+	// The subexpression is repeated max times (or max(min,1) times with a
+	// loop on the last copy if unbounded).  Copies after the first min-1
+	// may leave for the accepting node r.
 	qexpr, ok := qe.expr.(NdfaNodeGenerator)
 	if !ok {
 		panic("quantified subexpression type "+reflect.TypeOf(qe.expr).String()+" does not receive NdfaNodeGenerator")
 	}
-	inits, accLen := qexpr.GenerateNdfaNodes(nextId)
-	nextId = inits[len(inits)-1].Id()+1
-	init, ok := inits[0].(*expressionNdfaNode)
-	if !ok {
-		panic("quantified subexpression node was not an *expressionNdfaNode")
-	}
-	init.initial = false
-	work := make([]NdfaNode, len(inits))
-	for k, n := range inits {
-		work[k] = n
+	unbounded := qe.max < 0 || qe.max == math.MaxInt32
+	copies := qe.max
+	if unbounded {
+		copies = qe.min
+		if copies < 1 {
+			copies = 1
+		}
 	}
-	s.epsilons = append(s.epsilons, init)
-	if qe.min <= 0 {
-		s.epsilons = append(s.epsilons, r)
-	} else {
-		for i := 0; i < qe.min; i++ {
-			next, accNext := qexpr.GenerateNdfaNodes(nextId)
-			nextId = next[len(next)-1].Id()+1
-			nextInit, ok := next[0].(*expressionNdfaNode)
+	s := newExpressionNdfaNode(firstId)
+	s.initial = true
+	work := []NdfaNode{s}
+	nextId := firstId+1
+	var prevAccepts []*expressionNdfaNode
+	var exits []*expressionNdfaNode
+	var init *expressionNdfaNode
+	for i := 1; i <= copies; i++ {
+		next, accCount := qexpr.GenerateNdfaNodes(nextId)
+		nextId = next[len(next)-1].Id()+1
+		init, ok = next[0].(*expressionNdfaNode)
+		if !ok {
+			panic("quantified subexpression node was not an *expressionNdfaNode")
+		}
+		init.initial = false
+		if i == 1 {
+			s.epsilons = append(s.epsilons, init)
+		}
+		for _, acc := range prevAccepts {
+			acc.epsilons = append(acc.epsilons, init)
+		}
+		prevAccepts = prevAccepts[0:0]
+		for k := len(next)-accCount; k < len(next); k++ {
+			acc, ok := next[k].(*expressionNdfaNode)
 			if !ok {
 				panic("quantified subexpression node was not an *expressionNdfaNode")
 			}
-			init = nextInit
-			for k := len(work)-accLen; k < len(work); k++ {
-				acc, ok := work[k].(*expressionNdfaNode)
-				if !ok {
-					panic("quantified subexpression node was not an *expressionNdfaNode")
-				}
-				acc.accepting = false
-				acc.epsilons = append(acc.epsilons, nextInit)
+			acc.accepting = false
+			prevAccepts = append(prevAccepts, acc)
+			if i >= qe.min {
+				exits = append(exits, acc)
 			}
-			work = append(work, next...)
-			accLen = accNext
 		}
+		work = append(work, next...)
 	}
-	if qe.max < 0 || qe.max == math.MaxInt32 {
-		for k := len(work)-accLen; k < len(work); k++ {
-			acc, ok := work[k].(*expressionNdfaNode)
-			if !ok {
-				panic("quantified subexpression node was not an *expressionNdfaNode")
-			}
-			acc.accepting = false
-			acc.epsilons = append(acc.epsilons, r)
+	if unbounded {
+		for _, acc := range prevAccepts {
 			acc.epsilons = append(acc.epsilons, init)
 		}
-		work = append(work, r)
-		return work, 1
-	} else {
-		if qe.min == qe.max {
-			for k := len(work)-accLen; k < len(work); k++ {
-				acc, ok := work[k].(*expressionNdfaNode)
-				if !ok {
-					panic("quantified subexpression node was not an *expressionNdfaNode")
-				}
-				acc.accepting = false
-				acc.epsilons = append(acc.epsilons, r)
-				work = append(work, r)
-				return work, 1
+	}
+	r := newExpressionNdfaNode(nextId)
+	r.accepting = true
+	if qe.min <= 0 {
+		s.epsilons = append(s.epsilons, r)
+	}
+	for _, acc := range exits {
+		acc.epsilons = append(acc.epsilons, r)
+	}
+	work = append(work, r)
+	return work, 1
+}
+
+type caseFoldExpression struct {
+	expr Expression
+	folded Expression
+}
+
+// CaseFoldExpression matches the input matched by expr with its letters in
+// any case, by simple unicode case folding.
+func CaseFoldExpression(expr Expression) Expression {
+	if expr.Type() == MatchCaseFold {
+		return expr
+	}
+	return &caseFoldExpression{
+		expr: expr,
+		folded: foldExpression(expr),
+	}
+}
+
+func (cfe *caseFoldExpression) Type() ExpressionType {
+	return MatchCaseFold
+}
+
+func (cfe *caseFoldExpression) TestMatch(str string) (bool, []int) {
+	return cfe.folded.TestMatch(str)
+}
+
+func (cfe *caseFoldExpression) GenerateNdfaNodes(firstId uint32) ([]NdfaNode,int) {
+	gen, ok := cfe.folded.(NdfaNodeGenerator)
+	if !ok {
+		panic("case folded subexpression type "+reflect.TypeOf(cfe.folded).String()+" does not receive NdfaNodeGenerator")
+	}
+	return gen.GenerateNdfaNodes(firstId)
+}
+
+// foldExpression rewrites expr so that each literal and class also matches
+// the case folds of its characters.  A negated class is folded before it is
+// negated, so [^a] matches neither a nor A.
+func foldExpression(expr Expression) Expression {
+	switch(expr.Type()) {
+		case MatchCharacterLiteral: {
+			c := expr.(*characterLiteralExpression).literal
+			if unicode.SimpleFold(c) == c {
+				return expr
+			}
+			ccb := OpenCharacterClassBuilder().AddCharacter(c)
+			for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+				ccb.AddCharacter(f)
 			}
+			return CharacterClassExpression(ccb.MustBuild())
 		}
-		for i := 0; i < qe.max-qe.min; i++ {
-			next, accNext := qexpr.GenerateNdfaNodes(nextId)
-			nextId = next[len(next)-1].Id()+1
-			nextInit, ok := next[0].(*expressionNdfaNode)
-			if !ok {
-				panic("quantified subexpression node was not an *expressionNdfaNode")
+		case MatchCharset: {
+			cc := expr.(*characterClassExpression).class
+			ccb := OpenCharacterClassBuilder().(*characterClassBuilder)
+			ccb.setIntervals(foldIntervals(classSetIntervals(cc)))
+			if cc.Negated() {
+				ccb.Negate()
 			}
-			for k := len(work)-accLen; k < len(work); k++ {
-				acc, ok := work[k].(*expressionNdfaNode)
-				if !ok {
-					panic("quantified subexpression node was not an *expressionNdfaNode")
-				}
-				acc.accepting = false
-				acc.epsilons = append(acc.epsilons, r)
-				acc.epsilons = append(acc.epsilons, nextInit)
-				work = append(work, next...)
-				accLen = accNext
+			return CharacterClassExpression(ccb.MustBuild())
+		}
+		case MatchSequence: {
+			var exprs []Expression
+			for _, e := range expr.(*sequenceExpression).exprs {
+				exprs = append(exprs, foldExpression(e))
 			}
+			return SequenceExpression(exprs...)
+		}
+		case MatchAlternation: {
+			var exprs []Expression
+			for _, e := range expr.(*alternationExpression).exprs {
+				exprs = append(exprs, foldExpression(e))
+			}
+			return AlternationExpression(exprs...)
+		}
+		case MatchStar: {
+			return StarExpression(foldExpression(expr.(*starExpression).expr))
+		}
+		case MatchPlus: {
+			return PlusExpression(foldExpression(expr.(*plusExpression).expr))
+		}
+		case MatchQuantified: {
+			qe := expr.(*quantifiedExpression)
+			return QuantifiedExpression(foldExpression(qe.expr), qe.min, qe.max)
+		}
+		case MatchCaseFold: {
+			return expr.(*caseFoldExpression).folded
+		}
+		case MatchSubmatch: {
+			se := expr.(*submatchExpression)
+			return SubmatchExpression(se.name, foldExpression(se.expr))
 		}
 	}
-	work = append(work, r)
-	return work, 1
+	return expr
 }
 
 func (nn *expressionNdfaNode) Id() uint32 {
@@ -709,6 +776,23 @@ func (nn *expressionNdfaNode) EpsilonTransitions() []NdfaNode {
 	return res
 }
 
+func (nn *expressionNdfaNode) Assertions() []Assertion {
+	var res []Assertion
+	for a, _ := range nn.assertions {
+		res = append(res, a)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func (nn *expressionNdfaNode) AssertionTransitions(a Assertion) []NdfaNode {
+	res := make([]NdfaNode, len(nn.assertions[a]))
+	for i, node := range nn.assertions[a] {
+		res[i] = node
+	}
+	return res
+}
+
 func (nn *expressionNdfaNode) IsTerminal() bool {
 	return nn.accepting
 }
@@ -757,6 +841,9 @@ func invertRegularizedIntervals(ranges []*characterRange) []*characterRange {
 	var res []*characterRange
 	r := &characterRange{}
 	if ranges[0].least <= 0 {
+		if ranges[0].greatest < 0 {
+			return nil
+		}
 		r.least = ranges[0].greatest + 1
 		lidx = 1
 	} else {
@@ -814,12 +901,27 @@ func matchEscapeCharacterLiteral(c rune, inCharset bool) string {
 		case '\f': return "\\f"
 		case 0: return "\\0"
 	}
-	if !unicode.IsPrint(c) {
-		return "\\x"+strconv.Itoa(int(c))
+	if c == '-' && inCharset {
+		return "\\-"
+	}
+	if !unicode.IsPrint(c) && c <= 9999 {
+		return fmt.Sprintf("\\x%04d", c)
 	}
 	return string([]rune{c})
 }
 
+// writeGroupedExpression writes e, enclosed in a group if it is a sequence or
+// alternation and so would otherwise bind more loosely than its context.
+func writeGroupedExpression(e Expression, out io.Writer) {
+	if e.Type() == MatchSequence || e.Type() == MatchAlternation {
+		out.Write([]byte{'('})
+		WriteExpression(e, out)
+		out.Write([]byte{')'})
+		return
+	}
+	WriteExpression(e, out)
+}
+
 func WriteExpression(e Expression, out io.Writer) {
 	switch(e.Type()) {
 		case MatchNever: {
@@ -832,35 +934,31 @@ func WriteExpression(e Expression, out io.Writer) {
 			cl := e.(*characterLiteralExpression)
 			out.Write([]byte(matchEscapeCharacterLiteral(cl.literal, false)))
 		}
-		case MatchStart: {
-			out.Write([]byte{'^'})
-		}
-		case LexlMatchEnd: {
-			out.Write([]byte{'$'})
+		case MatchStart, LexlMatchEnd, MatchAssertion: {
+			out.Write([]byte(e.(*assertionExpression).assertion.String()))
 		}
 		case MatchSubmatch: {
-			panic("submatch expressions unimplemented")
+			se := e.(*submatchExpression)
+			out.Write([]byte("(?<" + se.name + ">"))
+			WriteExpression(se.expr, out)
+			out.Write([]byte{')'})
 		}
 		case MatchOptional: {
 			panic("optional expressions unimplemented")
 		}
 		case MatchStar: {
-			// XXX - Somewhere we should check that there is never a serial (ie.
-			// sequence or alternation) expression as the argument to a suffixed
-			// (star, plus, optional, quantified) one - that breaks operator 
-			// precedence.  They must be grouped into a submatch.
 			se := e.(*starExpression)
-			WriteExpression(se.expr, out)
+			writeGroupedExpression(se.expr, out)
 			out.Write([]byte{'*'})
 		}
 		case MatchPlus: {
 			pe := e.(*plusExpression)
-			WriteExpression(pe.expr, out)
+			writeGroupedExpression(pe.expr, out)
 			out.Write([]byte{'+'})
 		}
 		case MatchQuantified: {
 			pq := e.(*quantifiedExpression)
-			WriteExpression(pq.expr, out)
+			writeGroupedExpression(pq.expr, out)
 			if pq.min == pq.max {
 				out.Write([]byte(fmt.Sprintf("{%d}", pq.max)))
 			} else {
@@ -896,7 +994,11 @@ func WriteExpression(e Expression, out io.Writer) {
 		case MatchSequence: {
 			se := e.(*sequenceExpression)
 			for _, expr := range se.exprs {
-				WriteExpression(expr, out)
+				if expr.Type() == MatchAlternation {
+					writeGroupedExpression(expr, out)
+				} else {
+					WriteExpression(expr, out)
+				}
 			}
 		}
 		case MatchAlternation: {
@@ -908,6 +1010,11 @@ func WriteExpression(e Expression, out io.Writer) {
 				}
 			}
 		}
+		case MatchCaseFold: {
+			out.Write([]byte("(?i:"))
+			WriteExpression(e.(*caseFoldExpression).expr, out)
+			out.Write([]byte{')'})
+		}
 		default: {
 			panic("unknown expression type")
 		}
@@ -20,6 +20,8 @@ type NdfaNode interface {
 	CharacterRanges() []CharacterRange
 	CharacterRangeTransitions(cr CharacterRange) []NdfaNode
 	EpsilonTransitions() []NdfaNode	
+	Assertions() []Assertion
+	AssertionTransitions(a Assertion) []NdfaNode
 	IsTerminal() bool
 	Query(c rune) []NdfaNode
 }
@@ -47,6 +49,9 @@ type DfaNode interface{
 	TransitionRange(c rune) CharacterRange
 	TransitionLookup(cr CharacterRange) (DfaNode, bool)
 	TransitionQuery(c rune) (DfaNode, bool)
+	// ContextTransition returns the state to take before consuming input in
+	// context ctx, if it is not this state.
+	ContextTransition(ctx Context) (DfaNode, bool)
 	IsInitial() bool
 	IsAccepting() bool
 	AcceptTerm() (parser.Term, bool)
@@ -88,6 +93,11 @@ func WriteDfaState(dn DfaNode, out io.Writer) {
 			break
 		}
 	}
+	for ctx := Context(0); ctx < NumContexts; ctx++ {
+		if tx, has := dn.ContextTransition(ctx); has {
+			out.Write([]byte(fmt.Sprintf("  <%d> -> (%d)\n", ctx, tx.Id())))
+		}
+	}
 	if dn.IsAccepting() {
 		var termName string
 		if term, ok := dn.AcceptTerm(); ok {
@@ -157,6 +167,17 @@ func WriteNdfaNode(nn NdfaNode, out io.Writer) {
 		}
 		out.Write([]byte("]\n"))
 	}
+	for _, a := range nn.Assertions() {
+		trs := nn.AssertionTransitions(a)
+		out.Write([]byte(fmt.Sprintf("     %s -> [", a.String())))
+		for i, tr := range trs {
+			out.Write([]byte(fmt.Sprintf("[%d]", tr.Id())))
+			if i < len(trs)-1 {
+				out.Write([]byte{','})
+			}
+		}
+		out.Write([]byte("]\n"))
+	}
 	eps := nn.EpsilonTransitions()
 	if len(eps) > 0 {
 		out.Write([]byte("     `e -> ["))
@@ -3,7 +3,13 @@ package lexr
 import (
 	"fmt"
 	"bytes"
+	"encoding"
+	"encoding/binary"
+	"sort"
+	"strings"
 	"testing"
+	"unicode"
+	"github.com/dtromb/parser"
 )
 
 var input string = `
@@ -113,6 +119,164 @@ classescape:{{
 }}
 `
 
+func transitionRangesString(trs []*dfaTransitionInfo) string {
+	var parts []string
+	for _, tr := range trs {
+		var states []int
+		for s := range tr.toStates {
+			states = append(states, s)
+		}
+		sort.Ints(states)
+		parts = append(parts, fmt.Sprintf("%c-%c:%v", tr.lowerBound, tr.upperBound, states))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestResolveTransitionsMerging(t *testing.T) {
+	// The input order must not matter.
+	res, err := resolveTransitionsMerging([]*dfaTransitionInfo{
+		{lowerBound: 'x', upperBound: 'z', toStates: map[int]NdfaNode{1: nil}},
+		{lowerBound: 'a', upperBound: 'c', toStates: map[int]NdfaNode{2: nil}},
+		{lowerBound: 'd', upperBound: 'f', toStates: map[int]NdfaNode{2: nil}},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if actual, expect := transitionRangesString(res), "a-f:[2] x-z:[1]"; actual != expect {
+		t.Errorf("merged transitions %s, expected %s", actual, expect)
+	}
+
+	// Overlapping ranges are split at every boundary.
+	res, err = resolveTransitionsMerging([]*dfaTransitionInfo{
+		{lowerBound: 'x', upperBound: 'z', toStates: map[int]NdfaNode{1: nil}},
+		{lowerBound: 'a', upperBound: 'c', toStates: map[int]NdfaNode{2: nil}},
+		{lowerBound: 'b', upperBound: 'y', toStates: map[int]NdfaNode{3: nil}},
+		{lowerBound: 'c', upperBound: 'c', toStates: map[int]NdfaNode{4: nil}},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if actual, expect := transitionRangesString(res), "a-a:[2] b-b:[2 3] c-c:[2 3 4] d-w:[3] x-y:[1 3] z-z:[1]"; actual != expect {
+		t.Errorf("merged transitions %s, expected %s", actual, expect)
+	}
+
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("KW").Terminal("HEX").Terminal("ID")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(db.Block("0").
+		Ignore(CharacterLiteralExpression(' ')).
+		Termdef("KW", SequenceExpression(CharacterLiteralExpression('i'), CharacterLiteralExpression('f'))).
+		Termdef("HEX", PlusExpression(CharacterClassExpression(OpenCharacterClassBuilder().AddRange('a', 'f').MustBuild()))).
+		Termdef("ID", PlusExpression(CharacterClassExpression(OpenCharacterClassBuilder().AddRange('c', 'z').MustBuild()))).MustBuild())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := lexTokenString(lexer, "if abc cafe ifx zed ")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect := "<<KW if>><<HEX abc>><<HEX cafe>><<ID ifx>><<ID zed>>"; actual != expect {
+		t.Errorf("overlapping classes lexed %s, expected %s", actual, expect)
+	}
+}
+
+func TestQuantifiedExpression(t *testing.T) {
+	// a{3} starts with its initial node and numbers its nodes in order: the
+	// initial node, three copies of a and the accepting node.
+	nodes, _ := QuantifiedExpression(CharacterLiteralExpression('a'), 3, 3).(NdfaNodeGenerator).GenerateNdfaNodes(10)
+	for i, n := range nodes {
+		if n.Id() != uint32(10+i) || len(nodes) != 8 {
+			t.Errorf("a{3} generated %d NDFA nodes, node %d has id %d", len(nodes), i, n.Id())
+			return
+		}
+	}
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("A").Terminal("B").Terminal("C")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(db.Block("0").
+		Ignore(CharacterLiteralExpression(' ')).
+		Termdef("A", QuantifiedExpression(CharacterLiteralExpression('a'), 2, 3)).
+		Termdef("B", QuantifiedExpression(CharacterLiteralExpression('b'), 3, 3)).
+		Termdef("C", QuantifiedExpression(CharacterLiteralExpression('c'), 2, -1)).MustBuild())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := lexTokenString(lexer, "aa aaa aaaaa bbb cc ccccc ")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect := "<<A aa>><<A aaa>><<A aaa>><<A aa>><<B bbb>><<C cc>><<C ccccc>>"; actual != expect {
+		t.Errorf("quantified expressions lexed %s, expected %s", actual, expect)
+	}
+	for _, bad := range []string{"a ", "bb ", "bbbb ", "c "} {
+		if _, err := lexTokenString(lexer, bad); err == nil {
+			t.Errorf("expected an error lexing %q", bad)
+		}
+	}
+}
+
+func TestEndOfInput(t *testing.T) {
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("ID")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(db.Block("0").
+		Ignore(PlusExpression(CharacterLiteralExpression(' '))).
+		Termdef("ID", PlusExpression(CharacterClassExpression(OpenCharacterClassBuilder().AddRange('a', 'z').MustBuild()))).MustBuild())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// A token or ignored input pending at the end of the input is accepted.
+	for in, expect := range map[string]string{
+		"ab cd":   "<<ID ab>><<ID cd>>",
+		"ab cd  ": "<<ID ab>><<ID cd>>",
+		"x":       "<<ID x>>",
+		"":        "",
+	} {
+		actual, err := lexTokenString(lexer, in)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if actual != expect {
+			t.Errorf("%q lexed %s, expected %s", in, actual, expect)
+		}
+	}
+}
+
 func TestLexer(t *testing.T) {
 	
 	lexr0Grammar := GenerateLexr0Grammar()
@@ -142,4 +306,1594 @@ func TestLexer(t *testing.T) {
 		}
 		fmt.Println("<<"+tok.Terminal().Name()+" "+tok.Literal()+">>")
 	}
-}
\ No newline at end of file
+}
+func lexTokenString(lexer parser.Lexer, text string) (string, error) {
+	lex, err := lexer.Open(bytes.NewReader([]byte(text)))
+	if err != nil {
+		return "", err
+	}
+	var buf []byte
+	for {
+		more, err := lex.HasMoreTokens()
+		if err != nil {
+			return "", err
+		}
+		if !more { break }
+		tok, err := lex.NextToken()
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, "<<"+tok.Terminal().Name()+" "+tok.Literal()+">>"...)
+	}
+	return string(buf), nil
+}
+
+func TestLexerTables(t *testing.T) {
+	lexr0Grammar := GenerateLexr0Grammar()
+	lexer, err := CreateLexrLexer(GenerateLexr0Domain(lexr0Grammar))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := lexer.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded, err := LoadLexrLexer(lexr0Grammar, data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expect, err := lexTokenString(lexer, input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := lexTokenString(loaded, input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect != actual {
+		t.Error("loaded lexer tables do not lex as the original lexer")
+	}
+	if _, err = LoadLexrLexer(parser.GenerateBnf0Grammar(), data); err == nil {
+		t.Error("lexer tables loaded against the wrong grammar")
+	}
+}
+
+func TestCorruptLexerTables(t *testing.T) {
+	lexr0Grammar := GenerateLexr0Grammar()
+	lexer, err := CreateLexrLexer(GenerateLexr0Domain(lexr0Grammar))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := lexer.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := LoadLexrLexer(lexr0Grammar, data[:n]); err == nil {
+			t.Errorf("lexer tables truncated to %d of %d bytes loaded", n, len(data))
+			return
+		}
+	}
+	// magic, version and grammar fingerprint
+	header := data[:len(lexrTableMagic)+1+32]
+	for _, count := range []uint64{0xFFFFFFF0, uint64(len(data))} {
+		huge := binary.AppendUvarint(append([]byte{}, header...), count)
+		if _, err := LoadLexrLexer(lexr0Grammar, huge); err == nil {
+			t.Errorf("lexer tables with %d dfas loaded", count)
+		}
+		huge = binary.AppendUvarint(append(append([]byte{}, header...), 1), count)
+		if _, err := LoadLexrLexer(lexr0Grammar, huge); err == nil {
+			t.Errorf("lexer tables with %d states loaded", count)
+		}
+	}
+}
+
+var lexr0ExpressionInput string = `// expression forms
+0:{{
+    _ /[\s]+/
+    NUM /[0-9]+(\.[0-9]{1,3})?/
+    ID /[a-z_][-a-z0-9_]*/
+    CTL /\x0001|x\x0031{2,}|wy{,4}|z{3}/
+    OPT /(ab|c)+d?/
+    Q /"/ {str}
+}}
+str:{{
+    ESC /\\[nrt\/\-]/
+    CHAR /[^"\\]+/
+    Q /"/ {0}
+}}
+other:{{
+    {str}
+    {{0}}
+}}
+`
+
+func writeDomainString(d Domain) string {
+	var buf bytes.Buffer
+	WriteDomainLexr0(&buf, d)
+	return buf.String()
+}
+
+func TestParseLexr0(t *testing.T) {
+	lexr0Grammar := GenerateLexr0Grammar()
+	lexr0Domain := GenerateLexr0Domain(lexr0Grammar)
+	for _, text := range []string{input, lexr0ExpressionInput, writeDomainString(lexr0Domain)} {
+		d, err := ParseLexr0(bytes.NewReader([]byte(text)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		written := writeDomainString(d)
+		d, err = ParseLexr0(bytes.NewReader([]byte(written)))
+		if err != nil {
+			t.Error(err)
+			fmt.Println(written)
+			return
+		}
+		if rewritten := writeDomainString(d); rewritten != written {
+			t.Error("lexr0 domain does not round-trip")
+			fmt.Println(written)
+			fmt.Println(rewritten)
+		}
+	}
+	
+	d, err := ParseLexr0ForGrammar(lexr0Grammar, bytes.NewReader([]byte(writeDomainString(lexr0Domain))))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	original, err := CreateLexrLexer(lexr0Domain)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	parsed, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expect, err := lexTokenString(original, input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := lexTokenString(parsed, input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect != actual {
+		t.Error("parsed lexr0 domain does not lex as the original domain")
+	}
+	
+	for _, bad := range []string{
+		"0:{{ A /a/ {nowhere} }}",
+		"0:{{ A /(a/ }}",
+		"0:{{ A /a{0}/ }}",
+		"0:{{ A /a/ A /b/ }}",
+		"0:{{ A /a/ }} 0:{{ B /b/ }}",
+	} {
+		if _, err := ParseLexr0(bytes.NewReader([]byte(bad))); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func writeExpressionString(e Expression) string {
+	var buf bytes.Buffer
+	WriteExpression(e, &buf)
+	return buf.String()
+}
+
+func TestCompileExpression(t *testing.T) {
+	for _, pattern := range []string{
+		"abc", "a.c", "[a-z_][-a-z0-9_]*", "[^\"\\\\]+", "[\\s]+|\\s", "[x-]",
+		"(ab|c)+d?", "x{2}y{2,}z{,4}w{1, 3}", "\\x0001\\n\\t\\r\\f\\0\\.\\/", "a|\\_", "((a))",
+	} {
+		e, err := CompileExpression(pattern)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		written := writeExpressionString(e)
+		e, err = CompileExpression(written)
+		if err != nil {
+			t.Errorf("rewriting %q: %s", pattern, err.Error())
+			continue
+		}
+		if rewritten := writeExpressionString(e); rewritten != written {
+			t.Errorf("expression %q does not round-trip: %q, %q", pattern, written, rewritten)
+		}
+	}
+
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("NUM").Terminal("ID").Terminal("OPT").Terminal("SEP")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(d.Block("0").
+		Ignore(MustCompileExpression("[ \\t]+")).
+		Termdef("NUM", MustCompileExpression("[0-9]+(\\.[0-9]{1,3})?")).
+		Termdef("OPT", MustCompileExpression("(ab|c)+d?")).
+		Termdef("ID", MustCompileExpression("[a-z_][-a-z0-9_]*")).
+		Termdef("SEP", MustCompileExpression("[,;]|\\x0033")).MustBuild())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := lexTokenString(lexer, "12.5 abcd, x-1;cab !")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect := "<<NUM 12.5>><<OPT abcd>><<SEP ,>><<ID x-1>><<SEP ;>><<OPT cab>><<SEP !>>"; actual != expect {
+		t.Errorf("compiled expressions lexed %s, expected %s", actual, expect)
+	}
+
+	for _, bad := range []string{"", "(a", "a)", "[a", "[]", "*a", "a{0}", "a{3,2}", "a{x}", "a|", "[z-a]", "a\\",
+		"\\x", "\\x12", "a\\x12a4", "[\\x003]"} {
+		if _, err := CompileExpression(bad); err == nil {
+			t.Errorf("expected an error compiling %q", bad)
+		}
+	}
+}
+
+func TestMinimizeDfa(t *testing.T) {
+	d, err := ParseLexr0(bytes.NewReader([]byte(`0:{{
+    _ /[ ]+/
+    KW /for|if|int|of/
+    X /xa|ya/
+    Y /za/
+    Q /"/ {str}
+    P /'/ {0}
+}}
+str:{{
+    CHAR /[^"]+/
+    Q /"/ {0}
+}}
+`)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	unminimized, minimized := lexer.(DfaStatistics).StateCounts()
+	if minimized >= unminimized {
+		t.Errorf("minimization did not reduce %d dfa states", unminimized)
+	}
+	ll := lexer.(*lexrLexer)
+	for _, dfa := range ll.dfas {
+		sd := dfa.(*stdDfa)
+		info := make([]*dfaStateInfo, len(sd.nodes))
+		for i, dn := range sd.nodes {
+			info[i] = &dfaStateInfo{canAccept: dn.acceptTerm != nil}
+			if dn.acceptTerm != nil && dn.acceptTerm != dn.acceptTerm.Grammar().Epsilon() {
+				info[i].acceptTerm = dn.acceptTerm
+				for j, next := range ll.dfas {
+					if next.(*stdDfa) == dn.acceptNext.dfa {
+						info[i].forwardToBlock = d.Block(j)
+					}
+				}
+			}
+		}
+		again, _, err := MinimizeDomainDfa(dfa, info, sd.nodes[0].index)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if again.NumStates() != dfa.NumStates() {
+			t.Errorf("minimized dfa of %d states minimizes to %d states", dfa.NumStates(), again.NumStates())
+		}
+	}
+	actual, err := lexTokenString(lexer, `for ya za if "of" int'of`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect := `<<KW for>><<X ya>><<Y za>><<KW if>><<Q ">><<CHAR of>><<Q ">><<KW int>><<P '>><<KW of>>`; actual != expect {
+		t.Errorf("minimized lexer lexed %s, expected %s", actual, expect)
+	}
+}
+
+func TestUnicodeClasses(t *testing.T) {
+	for _, test := range []struct {
+		builder CharacterClassBuilder
+		in string
+		out string
+	}{
+		{OpenCharacterClassBuilder().AddUnicodeCategory("Lu"), "AÄΩЖ", "aä1_"},
+		{OpenCharacterClassBuilder().AddUnicodeScript("Greek"), "αλΩ", "aЖ1"},
+		{OpenCharacterClassBuilder().AddPosixClass("xdigit").AddCharacter('_'), "09afAF_", "gG-"},
+		{OpenCharacterClassBuilder().AddRangeTable(unicode.Nd).Negate(), "a_ ", "09٣"},
+	} {
+		e := CharacterClassExpression(test.builder.MustBuild())
+		for _, c := range test.in {
+			if ok, _ := e.TestMatch(string(c)); !ok {
+				t.Errorf("class %s does not match %q", writeExpressionString(e), c)
+			}
+		}
+		for _, c := range test.out {
+			if ok, _ := e.TestMatch(string(c)); ok {
+				t.Errorf("class %s matches %q", writeExpressionString(e), c)
+			}
+		}
+	}
+	for _, ccb := range []CharacterClassBuilder{
+		OpenCharacterClassBuilder().AddUnicodeCategory("Xx"),
+		OpenCharacterClassBuilder().AddUnicodeScript("Klingon"),
+		OpenCharacterClassBuilder().AddPosixClass("alpha").AddPosixClass("letter"),
+	} {
+		if _, err := ccb.Build(); err == nil {
+			t.Error("expected an error building a class with an unknown name")
+		}
+	}
+
+	d, err := ParseLexr0(bytes.NewReader([]byte(`0:{{
+    _ /\s+/
+    ID /[\p{L}_][\p{L}\pN_]*/
+    NUM /\d+/
+    UP /[[:upper:]]\P{Lu}*!/
+    OP /[^\w\s]/
+}}
+`)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := lexTokenString(lexer, "größe = λ2 + _x3 * 42 Nö!")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect := "<<ID größe>><<OP =>><<ID λ2>><<OP +>><<ID _x3>><<OP *>><<NUM 42>><<UP Nö!>>"; actual != expect {
+		t.Errorf("unicode classes lexed %s, expected %s", actual, expect)
+	}
+	written := writeDomainString(d)
+	if _, err = ParseLexr0(bytes.NewReader([]byte(written))); err != nil {
+		t.Error(err)
+	}
+
+	for _, bad := range []string{`\p{Klingon}`, `\p`, `\p{L`, `[[:letter:]]`} {
+		if _, err := CompileExpression(bad); err == nil {
+			t.Errorf("expected an error compiling %q", bad)
+		}
+	}
+}
+
+func TestCaseFoldingAndClassOperations(t *testing.T) {
+	lower := OpenCharacterClassBuilder().AddRange('a', 'z').MustBuild()
+	vowels := OpenCharacterClassBuilder().AddCharacter('a').AddCharacter('e').AddCharacter('i').
+		AddCharacter('o').AddCharacter('u').MustBuild()
+	for _, test := range []struct {
+		expr Expression
+		in string
+		out string
+	}{
+		{CharacterClassExpression(OpenCharacterClassBuilder().AddRange('a', 'c').FoldCase().MustBuild()), "abcABC", "dD"},
+		{CharacterClassExpression(OpenCharacterClassBuilder().AddCharacter('k').FoldCase().MustBuild()), "kKK", "j"},
+		{CharacterClassExpression(OpenCharacterClassBuilder().AddRange('a', 'z').Subtract(vowels).MustBuild()), "bcz", "aeA"},
+		{CharacterClassExpression(OpenCharacterClassBuilder().AddRange('c', 'f').AddCharacter('z').Intersect(vowels).MustBuild()), "e", "cfzau"},
+		{CharacterClassExpression(OpenCharacterClassBuilder().AddRange('a', 'f').Intersect(lower).Negate().MustBuild()), "gA", "af"},
+		{CaseFoldExpression(CharacterLiteralExpression('σ')), "σΣς", "s"},
+		{MustCompileExpression("(?i)[^a]"), "bB", "aA"},
+		{MustCompileExpression("[a-z&&[^aeiou]]"), "bz", "aA"},
+		{MustCompileExpression("[\\w--[\\d_]]"), "aZ", "1_"},
+	} {
+		for _, c := range test.in {
+			if ok, _ := test.expr.TestMatch(string(c)); !ok {
+				t.Errorf("expression %s does not match %q", writeExpressionString(test.expr), c)
+			}
+		}
+		for _, c := range test.out {
+			if ok, _ := test.expr.TestMatch(string(c)); ok {
+				t.Errorf("expression %s matches %q", writeExpressionString(test.expr), c)
+			}
+		}
+	}
+	if _, err := OpenCharacterClassBuilder().AddCharacter('a').Subtract(vowels).Build(); err == nil {
+		t.Error("expected an error building an empty class")
+	}
+
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("SELECT").Terminal("FROM").Terminal("ID")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d := db.Block("0").
+		Ignore(MustCompileExpression("\\s+")).
+		Termdef("SELECT", MustCompileExpression("select")).FoldCase().
+		Termdef("FROM", MustCompileExpression("(?i)from")).
+		Termdef("ID", MustCompileExpression("[a-z&&[^aeiou]][a-z]*")).MustBuild()
+	if !d.Block(0).Termdef(0).CaseFolded() || !d.Block(0).Termdef(1).CaseFolded() || d.Block(0).Termdef(2).CaseFolded() {
+		t.Error("termdefs report the wrong case folding")
+	}
+	for _, domain := range []Domain{d, nil} {
+		if domain == nil {
+			if domain, err = ParseLexr0ForGrammar(g, bytes.NewReader([]byte(writeDomainString(d)))); err != nil {
+				t.Error(err)
+				return
+			}
+			if written := writeDomainString(domain); written != writeDomainString(d) {
+				t.Errorf("case folded domain does not round-trip:\n%s", written)
+			}
+		}
+		lexer, err := CreateLexrLexer(domain)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		actual, err := lexTokenString(lexer, "SELECT name From tbl sElEcT")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if expect := "<<SELECT SELECT>><<ID name>><<FROM From>><<ID tbl>><<SELECT sElEcT>>"; actual != expect {
+			t.Errorf("case folded domain lexed %s, expected %s", actual, expect)
+		}
+	}
+
+	for _, bad := range []string{"(?x)a", "a(?i)b", "[a&&[b]]", "[a&&[]]"} {
+		if _, err := CompileExpression(bad); err == nil {
+			t.Errorf("expected an error compiling %q", bad)
+		}
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		in string
+		out string
+	}{
+		{"^a", "a", ""},
+		{"\\Aa", "a", ""},
+		{"\\ba", "a", ""},
+		{"\\Ba", "", "a"},
+		{"a$", "a", "b"},
+		{"[\\$\\^]", "$^", "b"},
+	} {
+		expr, err := CompileExpression(test.pattern)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if written := writeExpressionString(expr); written != test.pattern {
+			t.Errorf("pattern %s was written as %s", test.pattern, written)
+		}
+		for _, c := range test.in {
+			if ok, _ := expr.TestMatch(string(c)); !ok {
+				t.Errorf("expression %s does not match %q", test.pattern, c)
+			}
+		}
+		for _, c := range test.out {
+			if ok, _ := expr.TestMatch(string(c)); ok {
+				t.Errorf("expression %s matches %q", test.pattern, c)
+			}
+		}
+	}
+	if !AssertWordBoundary.Holds(ContextAt('a', ' ')) || AssertWordBoundary.Holds(ContextAt('a', 'b')) ||
+		!AssertLineEnd.Holds(ContextAt('a', '\n')) || AssertLineStart.Holds(ContextAt('a', '\n')) {
+		t.Error("assertions hold in the wrong contexts")
+	}
+
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("COMMENT").Terminal("HASH").Terminal("IF").Terminal("ID").
+		Terminal("LAST").Terminal("STOP").Terminal("DOT")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d := db.Block("0").
+		Ignore(MustCompileExpression("\\s+")).
+		Termdef("COMMENT", MustCompileExpression("^#[^\\n]*")).
+		Termdef("HASH", MustCompileExpression("#")).
+		Termdef("IF", MustCompileExpression("\\bif\\b")).
+		Termdef("LAST", MustCompileExpression("[a-z]+$")).
+		Termdef("ID", MustCompileExpression("[a-z]+")).
+		Termdef("STOP", MustCompileExpression("\\.\\z")).
+		Termdef("DOT", MustCompileExpression("\\.")).MustBuild()
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := lexer.(*lexrLexer).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded, err := LoadLexrLexer(g, data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	input := "# one\nif iffy # two\n  #x\nif.b."
+	expect := "<<COMMENT # one>><<IF if>><<ID iffy>><<HASH #>><<LAST two>><<HASH #>><<LAST x>>" +
+		"<<IF if>><<DOT .>><<ID b>><<STOP .>>"
+	for _, l := range []parser.Lexer{lexer, loaded} {
+		actual, err := lexTokenString(l, input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if actual != expect {
+			t.Errorf("assertions lexed %s, expected %s", actual, expect)
+		}
+	}
+}
+
+type traceFunc func(ev *parser.TraceEvent)
+
+func (tf traceFunc) Trace(ev *parser.TraceEvent) {
+	tf(ev)
+}
+
+func TestLongestMatchBacktracking(t *testing.T) {
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("FLOAT").Terminal("NUM").Terminal("ELLIPSIS").Terminal("DOT").Terminal("ID")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(db.Block("0").
+		Ignore(MustCompileExpression("\\s+")).
+		Termdef("FLOAT", MustCompileExpression("[0-9]+\\.[0-9]+")).
+		Termdef("NUM", MustCompileExpression("[0-9]+")).
+		Termdef("ELLIPSIS", MustCompileExpression("\\.\\.\\.")).
+		Termdef("DOT", MustCompileExpression("\\.")).
+		Termdef("ID", MustCompileExpression("[a-zé]+")).MustBuild())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var events []string
+	lexer.(parser.Traceable).SetTracer(traceFunc(func(ev *parser.TraceEvent) {
+		if ev.Type == parser.TraceBacktrack {
+			events = append(events, fmt.Sprintf("%d:%d(%d)", ev.Line, ev.Column, ev.Position))
+		}
+	}))
+	lex, err := lexer.Open(bytes.NewReader([]byte("1.\né2.5 3..x...1.")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var actual []string
+	for {
+		more, err := lex.HasMoreTokens()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !more { break }
+		tok, err := lex.NextToken()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		actual = append(actual, fmt.Sprintf("%s %s %d:%d(%d)-%d:%d(%d)", tok.Terminal().Name(), tok.Literal(),
+			tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition(), tok.LastLine(), tok.LastColumn(), tok.LastPosition()))
+	}
+	expect := []string{
+		"NUM 1 1:1(0)-1:2(1)",
+		"DOT . 1:2(1)-1:3(2)",
+		"ID é 2:1(3)-2:2(5)",
+		"FLOAT 2.5 2:2(5)-2:5(8)",
+		"NUM 3 2:6(9)-2:7(10)",
+		"DOT . 2:7(10)-2:8(11)",
+		"DOT . 2:8(11)-2:9(12)",
+		"ID x 2:9(12)-2:10(13)",
+		"ELLIPSIS ... 2:10(13)-2:13(16)",
+		"NUM 1 2:13(16)-2:14(17)",
+		"DOT . 2:14(17)-2:15(18)",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("longest match lexed\n%s\nexpected\n%s", strings.Join(actual, "\n"), strings.Join(expect, "\n"))
+	}
+	if expect := "1:2(1) 2:7(10) 2:8(11) 2:14(17)"; strings.Join(events, " ") != expect {
+		t.Errorf("backtracked at %s, expected %s", strings.Join(events, " "), expect)
+	}
+}
+
+func TestCaptureGroups(t *testing.T) {
+	for _, pattern := range []string{"\"(?<body>([^\"\\\\]|\\\\.)*)\"", "(?<a>x(?<b>y)*)|(?i:(?<c>z))"} {
+		if written := writeExpressionString(MustCompileExpression(pattern)); written != pattern {
+			t.Errorf("pattern %s was written as %s", pattern, written)
+		}
+	}
+	for _, bad := range []string{"(?<>a)", "(?<1a>b)", "(?<a b)", "(?<a"} {
+		if _, err := CompileExpression(bad); err == nil {
+			t.Errorf("expected an error compiling %q", bad)
+		}
+	}
+
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("STR").Terminal("NUM").Terminal("DOT").Terminal("KV").Terminal("ID")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d := db.Block("0").
+		Ignore(MustCompileExpression("\\s+")).
+		Termdef("STR", MustCompileExpression("\"(?<body>([^\"\\\\]|\\\\.)*)\"")).
+		Termdef("NUM", SequenceExpression(
+			SubmatchExpression("int", MustCompileExpression("[0-9]+")),
+			MustCompileExpression("(\\.(?<frac>[0-9]+))?"))).
+		Termdef("DOT", MustCompileExpression("\\.")).
+		Termdef("KV", MustCompileExpression("\\b(?<key>[a-z]+)=(?<val>[a-z]*)")).
+		Termdef("ID", MustCompileExpression("(?<w>[a-z]+)")).FoldCase().MustBuild()
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := lexer.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded, err := LoadLexrLexer(g, data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expect := []string{
+		"STR \"a\\\"é\" body=a\\\"é[1,6]",
+		"NUM 12.5 int=12[8,10] frac=5[11,12]",
+		"NUM 7 int=7[13,14] frac=[-1,-1]",
+		"DOT .",
+		"KV k= key=k[15,16] val=[17,17]",
+		"ID Hello w=Hello[18,23]",
+	}
+	for _, l := range []parser.Lexer{lexer, loaded} {
+		lex, err := l.Open(bytes.NewReader([]byte("\"a\\\"é\" 12.5 7.k= Hello")))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var actual []string
+		for {
+			more, err := lex.HasMoreTokens()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !more { break }
+			tok, err := lex.NextToken()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lt, ok := tok.(Token)
+			if !ok {
+				t.Error("lexr token does not implement Token")
+				return
+			}
+			desc := tok.Terminal().Name() + " " + lt.Group(0)
+			for i := 1; i <= lt.NumGroups(); i++ {
+				first, last := lt.GroupSpan(i)
+				desc += fmt.Sprintf(" %s=%s[%d,%d]", lt.GroupName(i), lt.Group(i), first, last)
+			}
+			actual = append(actual, desc)
+		}
+		if strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+			t.Errorf("capture groups lexed\n%s\nexpected\n%s", strings.Join(actual, "\n"), strings.Join(expect, "\n"))
+		}
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("NUM").Terminal("ID").Terminal("STR")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(db.Block("0").
+		Ignore(MustCompileExpression("\\s+")).
+		Termdef("NUM", MustCompileExpression("[0-9]+")).
+		Termdef("ID", MustCompileExpression("[a-z]+")).
+		Termdef("STR", MustCompileExpression("\"[^\"]*\"")).MustBuild())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if et := ErrorTerm(g); et.Name() != "ERROR" || !et.Terminal() || !et.Special() || et.Grammar() != g {
+		t.Errorf("unexpected error term %s", et.Name())
+	}
+	lexAll := func(input string) ([]string, error) {
+		lex, err := lexer.Open(bytes.NewReader([]byte(input)))
+		if err != nil {
+			return nil, err
+		}
+		var actual []string
+		for {
+			more, err := lex.HasMoreTokens()
+			if err != nil {
+				return actual, err
+			}
+			if !more { break }
+			tok, err := lex.NextToken()
+			if err != nil {
+				return actual, err
+			}
+			actual = append(actual, fmt.Sprintf("%s %q %d:%d(%d)-%d:%d(%d)", tok.Terminal().Name(), tok.Literal(),
+				tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition(), tok.LastLine(), tok.LastColumn(), tok.LastPosition()))
+		}
+		return actual, nil
+	}
+	input := "ab 12#$x %%9\n\"open"
+	if _, err := lexAll(input); err == nil {
+		t.Error("expected an error lexing without recovery")
+	}
+	for _, c := range []struct {
+		mode ErrorRecovery
+		expect []string
+	}{
+		{RecoverSkipRune, []string{
+			"ID \"ab\" 1:1(0)-1:3(2)",
+			"NUM \"12\" 1:4(3)-1:6(5)",
+			"ERROR \"#\" 1:6(5)-1:7(6)",
+			"ERROR \"$\" 1:7(6)-1:8(7)",
+			"ID \"x\" 1:8(7)-1:9(8)",
+			"ERROR \"%\" 1:10(9)-1:11(10)",
+			"ERROR \"%\" 1:11(10)-1:12(11)",
+			"NUM \"9\" 1:12(11)-1:13(12)",
+			"ERROR \"\\\"\" 2:1(13)-2:2(14)",
+			"ID \"open\" 2:2(14)-2:6(18)",
+		}},
+		{RecoverResync, []string{
+			"ID \"ab\" 1:1(0)-1:3(2)",
+			"NUM \"12\" 1:4(3)-1:6(5)",
+			"ERROR \"#$x\" 1:6(5)-1:9(8)",
+			"ERROR \"%%9\" 1:10(9)-1:13(12)",
+			"ERROR \"\\\"open\" 2:1(13)-2:6(18)",
+		}},
+	} {
+		lexer.(ErrorRecoveryLexer).SetErrorRecovery(c.mode)
+		actual, err := lexAll(input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if strings.Join(actual, "\n") != strings.Join(c.expect, "\n") {
+			t.Errorf("recovery mode %d lexed\n%s\nexpected\n%s", c.mode, strings.Join(actual, "\n"), strings.Join(c.expect, "\n"))
+		}
+	}
+}
+
+func TestBlockStack(t *testing.T) {
+	source := `0:{{
+    _ /[\t\n\f\r ]+/
+    QUOTE /"/ {+str}
+    LBRACE /\{/ {+0}
+    RBRACE /\}/ {-}
+    ID /[a-z]+/
+}}
+str:{{
+    QUOTE /"/ {-}
+    INTERP /\$\{/ {+0}
+    TEXT /([^"\$]|\$[^"\{])+/
+}}
+`
+	d, err := ParseLexr0(bytes.NewReader([]byte(source)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if written := writeDomainString(d); written != source {
+		t.Errorf("block stack domain was written as\n%s", written)
+	}
+	for _, bad := range []string{"0:{{\n    {+0}\n}}\n", "0:{{\n    A /a/ {-} {-}\n}}\n", "0:{{\n    A /a/ {+x}\n}}\n"} {
+		if _, err := ParseLexr0(bytes.NewReader([]byte(bad))); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := lexer.(*lexrLexer).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded, err := LoadLexrLexer(d.Grammar(), data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// The block and stack each token leaves the lexer in.
+	expect := []string{
+		"QUOTE 1 [0]", "TEXT 1 [0]", "INTERP 0 [0 1]", "QUOTE 1 [0 1 0]", "TEXT 1 [0 1 0]", "INTERP 0 [0 1 0 1]",
+		"ID 0 [0 1 0 1]", "RBRACE 1 [0 1 0]", "QUOTE 0 [0 1]", "RBRACE 1 [0]", "TEXT 1 [0]", "QUOTE 0 []",
+		"LBRACE 0 [0]", "ID 0 [0]", "RBRACE 0 []",
+	}
+	for _, l := range []parser.Lexer{lexer, loaded} {
+		lex, err := l.Open(bytes.NewReader([]byte(`"a ${ "b ${c}" } d" {x}`)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var actual []string
+		for {
+			more, err := lex.HasMoreTokens()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !more { break }
+			tok, err := lex.NextToken()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			bss := lex.(BlockStackState)
+			actual = append(actual, fmt.Sprintf("%s %d %v", tok.Terminal().Name(), bss.CurrentBlock(), bss.BlockStack()))
+		}
+		if strings.Join(actual, ", ") != strings.Join(expect, ", ") {
+			t.Errorf("block stack lexed\n%s\nexpected\n%s", strings.Join(actual, ", "), strings.Join(expect, ", "))
+		}
+	}
+	lex, err := lexer.Open(bytes.NewReader([]byte("x }")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for {
+		more, err := lex.HasMoreTokens()
+		if err != nil {
+			if err.Error() != "RBRACE at 1:3(2) pops an empty block stack" {
+				t.Errorf("unexpected error %s", err.Error())
+			}
+			break
+		}
+		if !more {
+			t.Error("expected an error popping an empty block stack")
+			break
+		}
+		lex.NextToken()
+	}
+}
+
+func TestContextAwareLexing(t *testing.T) {
+	bnf := "`* := <stmt> `.\n<stmt> := GET ID EQ GT ID | ID ARROW ID\n"
+	g, err := parser.ParseBnf0(bytes.NewReader([]byte(bnf)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := ParseLexr0ForGrammar(g, bytes.NewReader([]byte("0:{{\n    _ /\\s+/\n    GET /get/\n    ARROW /=>/\n    EQ /=/\n    GT />/\n    ID /[a-z]+/\n}}\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p, err := NewPipeline(d, g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := p.Parse(bytes.NewReader([]byte("get get=>x"))); err == nil {
+		t.Error("expected an error parsing without context aware lexing")
+	}
+	p.Lexer().(ContextAwareLexer).SetContextAware(true)
+	other, err := parser.ParseBnf0(bytes.NewReader([]byte(bnf)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	op, err := parser.GenerateEarleyParser(other)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			// Expected terminals pass through the pipeline's terminal map.
+			if err := p.SetParser(op); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		for input, expect := range map[string]string{
+			"get get=>x": "GET:get ID:get EQ:= GT:> ID:x `.:",
+			"getx=>get": "ID:getx ARROW:=> ID:get `.:",
+		} {
+			ast, err := p.Parse(bytes.NewReader([]byte(input)))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			var leaves []string
+			var walk func(n parser.ParseTreeNode)
+			walk = func(n parser.ParseTreeNode) {
+				if n.Token() != nil {
+					leaves = append(leaves, n.Token().Terminal().Name()+":"+n.Token().Literal())
+				}
+				for _, c := range n.Children() {
+					walk(c)
+				}
+			}
+			walk(ast)
+			if strings.Join(leaves, " ") != expect {
+				t.Errorf("context aware parse of %q gave %s, expected %s", input, strings.Join(leaves, " "), expect)
+			}
+		}
+	}
+
+	data, err := p.Lexer().(*lexrLexer).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded, err := LoadLexrLexer(g, data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lex, err := loaded.Open(bytes.NewReader([]byte("get")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	id, _ := parser.GetIndexedGrammar(g).GetIndex(parser.GrammarIndexTypeTerm)
+	idTerm, _ := id.(parser.TermGrammarIndex).GetTerminal("ID")
+	cl := lex.(parser.ContextAwareLexerState)
+	cl.SetExpectTokens([]parser.Term{idTerm})
+	if len(cl.ExpectTokens()) != 1 || cl.ExpectTokens()[0] != idTerm {
+		t.Error("lexer state did not keep its expected terminals")
+	}
+	if tok, err := lex.NextToken(); err != nil || tok.Terminal().Name() != "ID" {
+		t.Errorf("loaded lexer expecting ID lexed %v, %v", tok, err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	g, err := parser.ParseBnf0(bytes.NewReader([]byte("`* := <list> `.\n<list> := ID | ID SEP <list>\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := ParseLexr0ForGrammar(g, bytes.NewReader([]byte("0:{{\n    _ /\\s+/\n    ID /[a-z]+/\n    SEP /,/\n}}\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if lexer.(BottomTokenLexer).BottomToken() {
+		t.Error("lexer sends a bottom token by default")
+	}
+	lexer.(BottomTokenLexer).SetBottomToken(true)
+	actual, err := lexTokenString(lexer, "ab, cd\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expect := "<<ID ab>><<SEP ,>><<ID cd>><<`. >>"; actual != expect {
+		t.Errorf("lexer with bottom token lexed %s, expected %s", actual, expect)
+	}
+
+	p, err := NewPipeline(d, g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ep, err := parser.GenerateEarleyParser(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := ep.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded, err := parser.LoadEarleyParser(g, data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			if err := p.SetParser(loaded); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		ast, err := p.Parse(bytes.NewReader([]byte("ab, cd\n")))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var buf bytes.Buffer
+		if err := parser.WriteTreeSexpr(ast, &buf); err != nil {
+			t.Error(err)
+			return
+		}
+		if !strings.Contains(buf.String(), "(ID :literal \"cd\"") || !strings.Contains(buf.String(), "(`. :literal \"\" :first (2 1 7) :last (2 1 7))") {
+			t.Errorf("pipeline parsed\n%s", buf.String())
+		}
+	}
+	if _, err := p.Parse(bytes.NewReader([]byte("ab,"))); err == nil {
+		t.Error("expected an error parsing incomplete input")
+	}
+
+	other, err := parser.ParseBnf0(bytes.NewReader([]byte("`* := <list> `.\n<list> := ID | ID <list>\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	op, err := parser.GenerateEarleyParser(other)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := p.SetParser(op); err == nil {
+		t.Error("expected an error using a parser without the SEP terminal")
+	}
+
+	// Error tokens take the ERROR terminal of the parser grammar.
+	eg, err := parser.ParseBnf0(bytes.NewReader([]byte("`* := <list> `.\n<list> := <item> | <item> SEP <list>\n<item> := ID | ERROR\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ep2, err := NewPipeline(d, eg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ep2.Lexer().(ErrorRecoveryLexer).SetErrorRecovery(RecoverResync)
+	ast, err := ep2.Parse(bytes.NewReader([]byte("ab, #$ , cd")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := parser.WriteTreeSexpr(ast, &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(buf.String(), "(ERROR :literal \"#$\"") {
+		t.Errorf("pipeline with error recovery parsed\n%s", buf.String())
+	}
+}
+
+func TestScannerless(t *testing.T) {
+	lower := OpenCharacterClassBuilder().AddRange('a', 'z').MustBuild()
+	cgb := OpenCharacterGrammarBuilder()
+	cgb.Rule("prog").Nonterminal("stmt")
+	cgb.Rule("prog").Nonterminal("stmt").Literal(";").Nonterminal("prog")
+	cgb.Rule("stmt").Literal("if ").Nonterminal("id")
+	cgb.Rule("stmt").Nonterminal("id").Literal("=").Nonterminal("id")
+	cgb.Rule("id").Nonterminal("idchars")
+	cgb.Rule("idchars").Class(lower)
+	cgb.Rule("idchars").Class(lower).Nonterminal("idchars")
+	cgb.Reject("id", "if").Follow("id", lower)
+	cg, err := cgb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p, err := GenerateScannerlessParser(cg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	parse := func(p parser.Parser, cg CharacterGrammar, input string) (parser.ParseTreeNode, error) {
+		ls, err := NewRuneLexer(cg).Open(bytes.NewReader([]byte(input)))
+		if err != nil {
+			return nil, err
+		}
+		ps, err := p.Open(ls)
+		if err != nil {
+			return nil, err
+		}
+		return ps.Parse()
+	}
+	ast, err := parse(p, cg, "if x;ab=c;ifx=y")
+	if err != nil {
+		t.Error(err)
+	} else {
+		var leaves []string
+		var walk func(n parser.ParseTreeNode)
+		walk = func(n parser.ParseTreeNode) {
+			if n.Token() != nil {
+				leaves = append(leaves, n.Token().Terminal().Name())
+			}
+			for _, c := range n.Children() {
+				walk(c)
+			}
+		}
+		walk(ast)
+		if strings.Join(leaves[:4], " ") != "C-69 C-66 C-20 C-6A-7A" {
+			t.Errorf("scannerless parse gave terminals %s", strings.Join(leaves, " "))
+		}
+	}
+	if _, err := parse(p, cg, "if=b"); err == nil {
+		t.Error("expected the reserved word to be rejected as an identifier")
+	}
+	if _, err := parse(p, cg, "a=b?"); err == nil || !strings.Contains(err.Error(), "no character class") {
+		t.Errorf("expected a rune lexer error, got %v", err)
+	}
+
+	// Without separators, identifiers only end where the follow restriction
+	// allows them to.
+	for _, follow := range []bool{false, true} {
+		sgb := OpenCharacterGrammarBuilder()
+		sgb.Rule("prog").Nonterminal("stmt")
+		sgb.Rule("prog").Nonterminal("stmt").Nonterminal("prog")
+		sgb.Rule("stmt").Nonterminal("id").Literal("=").Nonterminal("id")
+		sgb.Rule("id").Class(lower)
+		sgb.Rule("id").Class(lower).Nonterminal("id")
+		if follow {
+			sgb.Follow("id", lower)
+		}
+		scg := sgb.MustBuild()
+		sp, err := GenerateScannerlessParser(scg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := parse(sp, scg, "a=bc=d"); (err == nil) == follow {
+			t.Errorf("parse of \"a=bc=d\" with follow restriction %v gave %v", follow, err)
+		}
+	}
+}
+
+func TestReparse(t *testing.T) {
+	g, err := parser.ParseBnf0(bytes.NewReader([]byte("`* := <list> `.\n<list> := <item> | <item> SEP <list>\n<item> := ID\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := ParseLexr0ForGrammar(g, bytes.NewReader([]byte("0:{{\n    _ /\\s+/\n    ID /[a-z]+/\n    SEP /,/\n}}\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p, err := NewPipeline(d, g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	leaves := func(n parser.ParseTreeNode) []parser.Token {
+		var toks []parser.Token
+		var walk func(n parser.ParseTreeNode)
+		walk = func(n parser.ParseTreeNode) {
+			if n.Token() != nil {
+				toks = append(toks, n.Token())
+			}
+			for _, c := range n.Children() {
+				walk(c)
+			}
+		}
+		walk(n)
+		return toks
+	}
+	tokenString := func(toks []parser.Token) string {
+		var buf []string
+		for _, tok := range toks {
+			buf = append(buf, fmt.Sprintf("%s:%s@%d:%d(%d)-%d:%d(%d)", tok.Terminal().Name(), tok.Literal(),
+				tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition(), tok.LastLine(), tok.LastColumn(), tok.LastPosition()))
+		}
+		return strings.Join(buf, " ")
+	}
+	text := "ab, cd,\nef, gh"
+	ast, err := p.Parse(bytes.NewReader([]byte(text)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, c := range []struct{
+		edit Edit
+		expect string
+	}{
+		{Edit{4, 2, "xyz"}, "ab, xyz,\nef, gh"},
+		{Edit{4, 3, "uvw"}, "ab, uvw,\nef, gh"},
+		{Edit{0, 0, "\n  "}, "\n  ab, uvw,\nef, gh"},
+		{Edit{11, 1, " "}, "\n  ab, uvw, ef, gh"},
+		{Edit{18, 0, "i"}, "\n  ab, uvw, ef, ghi"},
+	} {
+		text = text[:c.edit.Offset] + c.edit.Text + text[c.edit.Offset+c.edit.Length:]
+		if text != c.expect {
+			t.Errorf("test edit gave %q, expected %q", text, c.expect)
+			return
+		}
+		reparsed, err := p.Reparse(ast, c.edit)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fresh, err := p.Parse(bytes.NewReader([]byte(text)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if actual, expect := tokenString(leaves(reparsed)), tokenString(leaves(fresh)); actual != expect {
+			t.Errorf("reparse of %q gave tokens\n%s\nexpected\n%s", text, actual, expect)
+		}
+		before, after := leaves(ast), leaves(reparsed)
+		if before[0] != after[0] && c.edit.Offset > 0 {
+			t.Errorf("reparse of %q did not keep the first token", text)
+		}
+		if before[len(before)-2].(*lexrToken).state != after[len(after)-2].(*lexrToken).state && c.edit.Offset < 18 {
+			t.Errorf("reparse of %q lexed the last token again", text)
+		}
+		ast = reparsed
+	}
+
+	// Subtrees deriving unchanged tokens are reused.
+	last := func(n parser.ParseTreeNode) parser.ParseTreeNode {
+		n = n.Child(0)
+		for n.NumChildren() > 1 {
+			n = n.Child(2)
+		}
+		return n
+	}
+	reparsed, err := p.Reparse(ast, Edit{7, 3, "xyz"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last(reparsed) != last(ast) || reparsed.Child(0).Child(0) != ast.Child(0).Child(0) {
+		t.Error("reparse did not reuse the subtrees around a same length edit")
+	}
+	if reparsed.Child(0).Child(2) == ast.Child(0).Child(2) {
+		t.Error("reparse reused a subtree holding the edit")
+	}
+
+	// Subtrees after an edit changing the length of the input are reused with
+	// their tokens moved.
+	doc, err := p.Parse(bytes.NewReader([]byte("ab, cd, ef, gh")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, c := range []struct{
+		edit Edit
+		expect string
+	}{
+		{Edit{0, 2, "xyz"}, "xyz, cd, ef, gh"},
+		{Edit{0, 2, "x"}, "x, cd, ef, gh"},
+		{Edit{3, 0, "\n"}, "ab,\n cd, ef, gh"},
+	} {
+		reparsed, err := p.Reparse(doc, c.edit)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fresh, err := p.Parse(bytes.NewReader([]byte(c.expect)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if actual, expect := tokenString(leaves(reparsed)), tokenString(leaves(fresh)); actual != expect {
+			t.Errorf("reparse of %q gave tokens\n%s\nexpected\n%s", c.expect, actual, expect)
+		}
+		tail := func(n parser.ParseTreeNode) parser.ParseTreeNode {
+			return unmovedNode(n.Child(0).Child(2).Child(2))
+		}
+		if unmovedNode(last(reparsed)) != unmovedNode(last(doc)) || tail(reparsed) != tail(doc) {
+			t.Errorf("reparse of %q did not reuse the subtrees after the edit", c.expect)
+		}
+		// Moved tokens are moved again by a later edit.
+		again, err := p.Reparse(reparsed, Edit{0, 0, "\n"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if fresh, err = p.Parse(bytes.NewReader([]byte("\n" + c.expect))); err != nil {
+			t.Error(err)
+			return
+		}
+		if actual, expect := tokenString(leaves(again)), tokenString(leaves(fresh)); actual != expect {
+			t.Errorf("second reparse of %q gave tokens\n%s\nexpected\n%s", c.expect, actual, expect)
+		}
+		if unmovedNode(last(again)) != unmovedNode(last(doc)) || tail(again) != tail(doc) {
+			t.Errorf("second reparse of %q did not reuse the moved subtrees", c.expect)
+		}
+	}
+
+	if _, err := p.Reparse(ast, Edit{7, 3, ",,"}); err == nil {
+		t.Error("expected an error reparsing invalid input")
+	}
+	if _, err := p.Reparse(ast, Edit{19, 10, ""}); err == nil {
+		t.Error("expected an error for an edit outside the document")
+	}
+	if _, err := p.Reparse(ast.Child(0), Edit{0, 0, ""}); err == nil {
+		t.Error("expected an error reparsing a subtree")
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	g, err := parser.ParseBnf0(bytes.NewReader([]byte("`* := <list> `.\n<list> := ID | ID SEP <list>\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := ParseLexr0ForGrammar(g, bytes.NewReader([]byte("0:{{\n    _ /\\s+|#[^\\n]*/\n    ID /[a-z]+/\n    SEP /,/\n}}\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p, err := NewPipeline(d, g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p.Lexer().(TriviaLexer).SetTrivia(true)
+	literals := func(toks []parser.Token) string {
+		var buf []string
+		for _, tok := range toks {
+			buf = append(buf, fmt.Sprintf("%q@%d:%d(%d)", tok.Literal(), tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition()))
+		}
+		return strings.Join(buf, " ")
+	}
+	trivia := func(n parser.ParseTreeNode) string {
+		var buf []string
+		var walk func(n parser.ParseTreeNode)
+		walk = func(n parser.ParseTreeNode) {
+			if tt, ok := n.Token().(parser.TriviaToken); ok {
+				buf = append(buf, fmt.Sprintf("[%s] %s [%s]", literals(tt.LeadingTrivia()), tt.Literal(), literals(tt.TrailingTrivia())))
+			}
+			for _, c := range n.Children() {
+				walk(c)
+			}
+		}
+		walk(n)
+		return strings.Join(buf, "\n")
+	}
+	text := "  # lead\nab, # one\n  cd ,\n\tef  # end\n"
+	ast, err := p.Parse(bytes.NewReader([]byte(text)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expect := `["  "@1:1(0) "# lead"@1:3(2) "\n"@1:9(8)] ab []
+[] , [" "@2:4(12) "# one"@2:5(13) "\n  "@2:10(18)]
+[] cd [" "@3:5(23)]
+[] , ["\n\t"@3:7(25)]
+[] ef ["  "@4:4(29) "# end"@4:6(31) "\n"@4:11(36)]
+[]  []`
+	if actual := trivia(ast); actual != expect {
+		t.Errorf("trivia of parse were\n%s\nexpected\n%s", actual, expect)
+	}
+	var buf bytes.Buffer
+	if err := parser.Unparse(ast, &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != text {
+		t.Errorf("unparse gave %q, expected %q", buf.String(), text)
+	}
+
+	// Reparsing keeps the trivia of the edited text.
+	for _, edit := range []Edit{{15, 3, "two\n"}, {0, 2, ""}, {7, 0, "xy, "}, {32, 0, ", gh"}} {
+		text = text[:edit.Offset] + edit.Text + text[edit.Offset+edit.Length:]
+		reparsed, err := p.Reparse(ast, edit)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fresh, err := p.Parse(bytes.NewReader([]byte(text)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if actual, expect := trivia(reparsed), trivia(fresh); actual != expect {
+			t.Errorf("trivia of reparse of %q were\n%s\nexpected\n%s", text, actual, expect)
+		}
+		buf.Reset()
+		if err := parser.Unparse(reparsed, &buf); err != nil {
+			t.Error(err)
+			return
+		}
+		if buf.String() != text {
+			t.Errorf("unparse of reparse gave %q, expected %q", buf.String(), text)
+		}
+		ast = reparsed
+	}
+
+	// Without a bottom token, the trivia at the end trail the last token.
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer.(TriviaLexer).SetTrivia(true)
+	ls, err := lexer.Open(bytes.NewReader([]byte("ab # end\n\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tok, err := ls.NextToken()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if more, err := ls.HasMoreTokens(); more || err != nil {
+		t.Errorf("lexer of trivia had more tokens: %v, %v", more, err)
+	}
+	if actual := literals(tok.(parser.TriviaToken).TrailingTrivia()); actual != `" "@1:3(2) "# end"@1:4(3) "\n\n"@1:9(8)` {
+		t.Errorf("trailing trivia at the end were %s", actual)
+	}
+}
+
+func TestDot(t *testing.T) {
+	d, err := ParseLexr0(bytes.NewReader([]byte("0:{{\n    _ /[ ]+/\n    Q /\"\\\\\\n/\n    ID /[a-c]+/\n}}\n")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ndfas, err := d.GenerateNdfas()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := WriteNdfaDot(ndfas[0], &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	out := buf.String()
+	if strings.Count(out, "shape=doublecircle") != 3 || !strings.Contains(out, `\n0/Q" shape=circle];`) {
+		t.Errorf("ndfa graph is missing terminal nodes:\n%s", out)
+	}
+	// Quotes, backslashes and line breaks in transitions are escaped.
+	for _, label := range []string{`[label="\""];`, `[label="\\\\"];`, `[label="\\n"];`, `[label="[a-c]"];`} {
+		if !strings.Contains(out, label) {
+			t.Errorf("ndfa graph has no edge %s:\n%s", label, out)
+		}
+	}
+
+	lexer, err := CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buf.Reset()
+	if err := WriteDfaDot(lexer.(*lexrLexer).dfas[0], &buf); err != nil {
+		t.Error(err)
+		return
+	}
+	expect := `digraph dfa {
+  rankdir=LR;
+  s0 [label="0" shape=circle];
+  s0 -> s1 [label=" "];
+  s0 -> s2 [label="\""];
+  s0 -> s3 [label="[a-c]"];
+  s1 [label="1\n` + "`" + `e" shape=doublecircle];
+  s1 -> s1 [label=" "];
+  s1 -> s0 [style=dotted];
+  s2 [label="2" shape=circle];
+  s2 -> s4 [label="\\\\"];
+  s3 [label="3\nID" shape=doublecircle];
+  s3 -> s3 [label="[a-c]"];
+  s3 -> s0 [style=dotted];
+  s4 [label="4" shape=circle];
+  s4 -> s5 [label="\\n"];
+  s5 [label="5\nQ" shape=doublecircle];
+  s5 -> s0 [style=dotted];
+}
+`
+	if buf.String() != expect {
+		t.Errorf("dfa graph was\n%s\nexpected\n%s", buf.String(), expect)
+	}
+}
+
+func TestTraceEvents(t *testing.T) {
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("token").Terminal("NUM").Terminal("DOT").Terminal("FLOAT")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lexer, err := CreateLexrLexer(db.Block("0").
+		Ignore(MustCompileExpression(" +")).
+		Termdef("FLOAT", MustCompileExpression("[0-9]+\\.[0-9]+")).
+		Termdef("NUM", MustCompileExpression("[0-9]+")).
+		Termdef("DOT", MustCompileExpression("\\.")).MustBuild())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var out bytes.Buffer
+	lexer.(parser.Traceable).SetTracer(parser.NewTextTracer(&out))
+	lex, err := lexer.Open(bytes.NewReader([]byte("1. 2")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for {
+		more, err := lex.HasMoreTokens()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !more { break }
+		if _, err := lex.NextToken(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	expect := strings.Join([]string{
+		"transition (0) '1' -> (3) at 1:1(0)",
+		"transition (3) '.' -> (4) at 1:2(1)",
+		"backtrack (4) -> (3) at 1:2(1)",
+		"accept (3) NUM '1' -> (0) at 1:1(0)",
+		"transition (0) '.' -> (2) at 1:2(1)",
+		"accept (2) DOT '.' -> (0) at 1:2(1)",
+		"transition (0) ' ' -> (1) at 1:3(2)",
+		"ignore (1) -> (0) at 1:3(2)",
+		"transition (0) '2' -> (3) at 1:4(3)",
+		"accept (3) NUM '2' -> (0) at 1:4(3)",
+	}, "\n") + "\n"
+	if out.String() != expect {
+		t.Errorf("traced\n%s\nexpected\n%s", out.String(), expect)
+	}
+}
@@ -6,9 +6,9 @@ import (
 	"strconv"
 	"sort"
 	"errors"
-	"os"
 	"fmt"
 	"io"
+	"sync"
 	"github.com/dtromb/parser"
 )
 
@@ -39,6 +39,8 @@ type Termdef interface {
 	Expression() Expression
 	NextBlock() Block
 	HasNextBlock() bool
+	BlockAction() BlockAction
+	CaseFolded() bool
 }
 
 type Expression interface {
@@ -77,6 +79,12 @@ const (
 	MatchSequence
 	// MatchAlternation matches iff exactly one of the child submatches match the current input.
 	MatchAlternation
+	// MatchCaseFold matches iff the specified submatch matches the current input with letters
+	// compared under simple unicode case folding.
+	MatchCaseFold
+	// MatchAssertion matches the empty string iff a line or word boundary assertion holds at the
+	// current position.
+	MatchAssertion
 )
 
 type CharacterClass interface {
@@ -102,8 +110,14 @@ func WriteDomainLexr0(out io.Writer, d Domain) {
 	writeDomainTermdef := func (t Termdef) {
 		out.Write([]byte(fmt.Sprintf("    %s ", t.Terminal().Name())))
 		writeDomainExpression(t.Expression())
-		if t.HasNextBlock() {
-			out.Write([]byte(fmt.Sprintf(" {%s}", t.NextBlock().Name())))
+		switch(t.BlockAction()) {
+			case BlockPush: out.Write([]byte(fmt.Sprintf(" {+%s}", t.NextBlock().Name())))
+			case BlockPop: out.Write([]byte(" {-}"))
+			default: {
+				if t.HasNextBlock() {
+					out.Write([]byte(fmt.Sprintf(" {%s}", t.NextBlock().Name())))
+				}
+			}
 		}
 		out.Write([]byte{'\n'})
 	}
@@ -211,7 +225,11 @@ func normalizeDomain(d Domain) (Domain,error) {
 		for j := 0; j < len(termdefs[i]); j++ {
 			td := termdefs[i][j]
 			nb.Termdef(td.Terminal().Name(), td.Expression())
-			if td.HasNextBlock() {
+			if td.BlockAction() == BlockPush {
+				nb.PushBlock(td.NextBlock().Name())
+			} else if td.BlockAction() == BlockPop {
+				nb.PopBlock()
+			} else if td.HasNextBlock() {
 				nb.ToBlock(td.NextBlock().Name())
 			} else if sd.blocks[i].HasDefaultForward() {
 				nb.ToBlock(sd.blocks[i].DefaultForward().Name())
@@ -268,6 +286,14 @@ func (dbn *domainBlockNdfaNode) EpsilonTransitions() []NdfaNode	{
 	return res
 }
 
+func (dbn *domainBlockNdfaNode) Assertions() []Assertion {
+	return []Assertion{}
+}
+
+func (dbn *domainBlockNdfaNode) AssertionTransitions(a Assertion) []NdfaNode {
+	return []NdfaNode{}
+}
+
 func (dbn *domainBlockNdfaNode) IsTerminal() bool {
 	return false
 }
@@ -281,8 +307,6 @@ func (d *stdDomain) GenerateNdfas() ([]Ndfa,error) {
 	if err != nil {
 		return nil, err
 	}
-	//fmt.Println("NORMALIZED DOMAIN:")
-	WriteDomainLexr0(os.Stdout, nd)
 	ndfas := make([]Ndfa, d.NumBlocks())
 	nextId := uint32(100)
 	ndfaZeros := make([]*domainBlockNdfaNode, len(ndfas))
@@ -378,6 +402,8 @@ func (dti *dfaTransitionInfo) clone() *dfaTransitionInfo {
 
 type stdDfa struct {
 	nodes []*stdDfaNode
+	numTags int
+	entryTagOps []tagOp
 }
 
 type stdDfaNode struct {
@@ -387,8 +413,15 @@ type stdDfaNode struct {
 	ranges []CharacterRange
 	transitions []*stdDfaNode
 	transitionIndex map[uint64]*stdDfaNode
+	contexts []*stdDfaNode
+	tagOps [][]tagOp
+	contextTagOps [][]tagOp
 	acceptTerm parser.Term
 	acceptNext *stdDfaNode
+	acceptAction BlockAction
+	acceptSlot int
+	acceptGroups []string
+	acceptAlts []*acceptAlt
 }
 
 func intSetToString(s map[int]bool) string {
@@ -451,7 +484,6 @@ func (dn *stdDfaNode) TransitionQuery(c rune) (DfaNode, bool) {
 	n := sort.Search(len(dn.rangeRights), func(i int) bool {
 		return dn.rangeRights[i] >= int(c)
 	})
-	fmt.Printf("   --- query (%d) with %d -> bucket %d [%d-%d]\n", dn.Id(), c, n, dn.ranges[n].Least(), dn.ranges[n].Greatest())
 	if n == len(dn.rangeRights) {
 		panic("search value out of range")
 	}
@@ -461,6 +493,13 @@ func (dn *stdDfaNode) TransitionQuery(c rune) (DfaNode, bool) {
 	return dn.transitions[n], true
 }
 
+func (dn *stdDfaNode) ContextTransition(ctx Context) (DfaNode, bool) {
+	if dn.contexts == nil || dn.contexts[ctx] == nil {
+		return nil, false
+	}
+	return dn.contexts[ctx], true
+}
+
 func (dn *stdDfaNode) IsInitial() bool {
 	return dn.index == 0
 }
@@ -504,6 +543,10 @@ func eqTSets(a, b map[int]NdfaNode) bool {
 	return true
 }
 
+// resolveTransitionsMerging splits possibly overlapping transition ranges at
+// every range boundary, so that each resulting range carries the union of the
+// target states of all input ranges covering it.  Adjacent ranges with the
+// same targets are merged, and input not covered by any range is omitted.
 func resolveTransitionsMerging(transitions []*dfaTransitionInfo) ([]*dfaTransitionInfo,error) {
 	if len(transitions) == 0 {
 		return transitions, nil
@@ -511,79 +554,56 @@ func resolveTransitionsMerging(transitions []*dfaTransitionInfo) ([]*dfaTransiti
 	trSet := trleftset(make([]*dfaTransitionInfo, len(transitions)))
 	copy(trSet, transitions)
 	sort.Sort(trSet)
-	res := make([]*dfaTransitionInfo, 1, len(transitions))
-	rCollapse := func() {
-		if len(res) < 2 {
-			return
-		}
-		//return
-		ll := res[len(res)-2]
-		lr := res[len(res)-1]
-		if ll.upperBound != lr.lowerBound - 1 {
-			return
-		}
-		if eqTSets(ll.toStates, lr.toStates) {
-			res = res[0:len(res)-1]
-			ll.upperBound = lr.upperBound
+	boundSet := make(map[int64]bool)
+	for _, tr := range trSet {
+		if tr.upperBound < tr.lowerBound {
+			return nil, errors.New(fmt.Sprintf("invalid transition range %d-%d", tr.lowerBound, tr.upperBound))
 		}
+		boundSet[int64(tr.lowerBound)] = true
+		boundSet[int64(tr.upperBound)+1] = true
 	}
-	res[0] = transitions[0]
-	for i := 1; i < len(trSet); i++ {
-		lt := res[len(res)-1]
-		rt := trSet[i]
-		res = res[0:len(res)-1]
-		if lt.upperBound < rt.lowerBound {
-			res = append(res,lt)
-			res = append(res,rt)
-			rCollapse()
-			continue
-		}
-		// lt.upperBound >= rt.lowerBound
-		lMid := rt.lowerBound
-		uMid := lt.upperBound
-		if rt.upperBound < uMid {
-			uMid = rt.upperBound
+	bounds := make([]int64, 0, len(boundSet))
+	for b, _ := range boundSet {
+		bounds = append(bounds, b)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	var res []*dfaTransitionInfo
+	var active []*dfaTransitionInfo
+	next := 0
+	for i := 0; i < len(bounds)-1; i++ {
+		lower, upper := bounds[i], bounds[i+1]-1
+		for next < len(trSet) && int64(trSet[next].lowerBound) == lower {
+			active = append(active, trSet[next])
+			next++
 		}
-		if lt.lowerBound < lMid {
-			lInit := &dfaTransitionInfo{
-				lowerBound: lt.lowerBound,
-				upperBound: lMid-1,
-				toStates: lt.toStates,
+		live := active[0:0]
+		for _, tr := range active {
+			if int64(tr.upperBound) >= lower {
+				live = append(live, tr)
 			}
-			res = append(res, lInit)
-			rCollapse()
-		}
-		mid := &dfaTransitionInfo{
-			lowerBound: lMid,
-			upperBound: uMid,
-			toStates: make(map[int]NdfaNode),
 		}
-		for s, _ := range lt.toStates {
-			mid.toStates[s] = lt.toStates[s]
+		active = live
+		if len(active) == 0 {
+			continue
 		}
-		for s, _ := range rt.toStates {
-			mid.toStates[s] = rt.toStates[s]
+		piece := &dfaTransitionInfo{
+			lowerBound: rune(lower),
+			upperBound: rune(upper),
+			toStates: make(map[int]NdfaNode),
 		}
-		res = append(res, mid)
-		rCollapse()
-		if mid.upperBound < rt.upperBound {
-			rFinal := &dfaTransitionInfo{
-				lowerBound: mid.upperBound+1,
-				upperBound: rt.upperBound,
-				toStates: rt.toStates,
+		for _, tr := range active {
+			for k, nn := range tr.toStates {
+				piece.toStates[k] = nn
 			}
-			res = append(res, rFinal)
-			rCollapse()
 		}
-		if mid.upperBound < lt.upperBound {
-			rFinal := &dfaTransitionInfo{
-				lowerBound: mid.upperBound+1,
-				upperBound: lt.upperBound,
-				toStates: lt.toStates,
+		if len(res) > 0 {
+			last := res[len(res)-1]
+			if int64(last.upperBound) == lower-1 && eqTSets(last.toStates, piece.toStates) {
+				last.upperBound = piece.upperBound
+				continue
 			}
-			res = append(res, rFinal)
-			rCollapse()
 		}
+		res = append(res, piece)
 	}
 	return res, nil
 }
@@ -593,9 +613,12 @@ type dfaStateInfo struct {
 	states []int
 	hc uint64
 	transitions []*dfaTransitionInfo
+	contexts []*dfaStateInfo
 	canAccept bool
 	acceptTerm parser.Term
 	forwardToBlock Block
+	blockAction BlockAction
+	alternatives []Termdef
 }
 
 func (si *dfaStateInfo) Equals(o *dfaStateInfo) bool {
@@ -718,6 +741,7 @@ func GenerateDomainDfaFromNdfa(ndfa Ndfa, idOffset int, grammar parser.Grammar)
 		})
 		minPri := math.MaxInt64
 		var minTermdef Termdef
+		var accepted []Termdef
 		for _, stid := range ci.states {
 			nn := ndfaNodeIndex[uint32(stid)]
 			for _, c := range nn.Literals() {
@@ -768,6 +792,7 @@ func GenerateDomainDfaFromNdfa(ndfa Ndfa, idOffset int, grammar parser.Grammar)
 							minPri = dnn.Termdef().Index()
 							minTermdef  = dnn.Termdef()
 						}
+						accepted = append(accepted, dnn.Termdef())
 					}
 				} else {
 					return nil, nil, errors.New("terminal ndfa node was not a DomainNdfaNode")
@@ -804,11 +829,53 @@ func GenerateDomainDfaFromNdfa(ndfa Ndfa, idOffset int, grammar parser.Grammar)
 			}
 		}
 		ci.transitions = trset
+		// States with assertion transitions take a context transition to the
+		// closure over the assertions which hold, where that is larger.
+		var nodes []NdfaNode
+		hasAssertions := false
+		for _, stid := range ci.states {
+			nn := ndfaNodeIndex[uint32(stid)]
+			nodes = append(nodes, nn)
+			hasAssertions = hasAssertions || len(nn.Assertions()) > 0
+		}
+		if hasAssertions {
+			ci.contexts = make([]*dfaStateInfo, NumContexts)
+			for ctx := Context(0); ctx < NumContexts; ctx++ {
+				cl := ndfaNodeContextClosure(nodes, ctx)
+				if len(cl) == len(nodes) {
+					continue
+				}
+				ctxInfo := &dfaStateInfo{
+					states: make([]int, 0, len(cl)),
+				}
+				for _, nn := range cl {
+					ctxInfo.states = append(ctxInfo.states, int(nn.Id()))
+					ndfaNodeIndex[nn.Id()] = nn
+				}
+				sort.Ints(ctxInfo.states)
+				if !seenDfaInfo(ctxInfo) {
+					ctxInfo = canonicalizeDfaInfo(ctxInfo)
+					stack = append(stack, ctxInfo)
+				} else {
+					ctxInfo = canonicalizeDfaInfo(ctxInfo)
+				}
+				ci.contexts[ctx] = ctxInfo
+			}
+		}
 		if minPri < math.MaxInt64 {
 			ci.canAccept = true
 			if minTermdef != nil {
 				ci.acceptTerm = minTermdef.Terminal()
 				ci.forwardToBlock = minTermdef.NextBlock()
+				ci.blockAction = minTermdef.BlockAction()
+				// The other termdefs accepted, for context aware lexing.
+				sort.Slice(accepted, func(a, b int) bool { return accepted[a].Index() < accepted[b].Index() })
+				for _, td := range accepted {
+					n := len(ci.alternatives)
+					if td != minTermdef && (n == 0 || ci.alternatives[n-1] != td) {
+						ci.alternatives = append(ci.alternatives, td)
+					}
+				}
 			} else {
 				
 			}
@@ -829,14 +896,6 @@ func GenerateDomainDfaFromNdfa(ndfa Ndfa, idOffset int, grammar parser.Grammar)
 	}
 	for i, cn := range dfaNodes {
 		info := allDfaInfos[i]
-		fmt.Printf("     (%d): [", i+idOffset)
-		for k, st := range info.states {
-			fmt.Printf("[%d]", st)
-			if k < len(info.states)-1 {
-				fmt.Print(",")
-			}
-		}
-		fmt.Println("]")
 		var ranges []*characterRange
 		var trs []*stdDfaNode
 		tridx := 0 
@@ -865,7 +924,7 @@ func GenerateDomainDfaFromNdfa(ndfa Ndfa, idOffset int, grammar parser.Grammar)
 			}
 			//fmt.Printf("     -- finished\n")
 			ranges = append(ranges, rng)
-			if nxtId > 0 {
+			if nxtId >= 0 {
 				trs = append(trs, dfaNodes[nxtId])
 			} else {
 				trs = append(trs, nil)
@@ -880,14 +939,32 @@ func GenerateDomainDfaFromNdfa(ndfa Ndfa, idOffset int, grammar parser.Grammar)
 			cn.transitions[i] = trs[i]
 			cn.transitionIndex[r.Hash()] = trs[i]
 		}
+		if info.contexts != nil {
+			cn.contexts = make([]*stdDfaNode, NumContexts)
+			for ctx, ctxInfo := range info.contexts {
+				if ctxInfo != nil {
+					cn.contexts[ctx] = dfaNodes[ctxInfo.id]
+				}
+			}
+		}
 		if info.canAccept {
 			if info.acceptTerm != nil {
 				cn.acceptTerm = info.acceptTerm
+				for _, td := range info.alternatives {
+					cn.acceptAlts = append(cn.acceptAlts, &acceptAlt{
+						term: td.Terminal(),
+						block: td.NextBlock(),
+						action: td.BlockAction(),
+					})
+				}
 			} else {
 				cn.acceptTerm = grammar.Epsilon()
 			}
 		}
 	}
+	if tagger := newDfaTagger(ndfa); tagger.numTags > 0 {
+		tagger.tagDfa(dfa.(*stdDfa), allDfaInfos, ndfaNodeIndex, ndfa.Node(0))
+	}
 	return dfa, allDfaInfos, nil
 }
 
@@ -919,6 +996,14 @@ type stdDfa struct {
 type lexrLexer struct {
 	grammar parser.Grammar
 	dfas []Dfa
+	unminimizedStates int
+	bottom bool
+	aware bool
+	recovery ErrorRecovery
+	trivia bool
+	ignoreOnce sync.Once
+	ignoreStates map[*stdDfaNode]bool
+	tracer parser.Tracer
 }
 
 type lexrState struct {
@@ -931,10 +1016,43 @@ type lexrState struct {
 	la rune
 	hasLa bool
 	laBytes int
+	prev rune
+	pushback []lexrRune
+	consumed []lexrRune
+	tags []int
 	eof bool
 	lastError error
 	hasToken bool
 	nextToken *lexrToken
+	stack []int
+	bottom bool
+	aware bool
+	expect map[uint32]bool
+	expectTerms []parser.Term
+	recovery ErrorRecovery
+	reach int
+	trivia bool
+	pendingTrivia []parser.Token
+	lastToken *lexrToken
+	tracer parser.Tracer
+}
+
+// lexrRune is a rune read by a lexer with its encoded length, so that it can
+// be pushed back when the lexer backtracks.
+type lexrRune struct {
+	r rune
+	bytes int
+}
+
+// lexrMark records the last accepting state reached while reading a token.
+type lexrMark struct {
+	state DfaNode
+	consumed int
+	line int
+	column int
+	position int
+	prev rune
+	tags []int
 }
 
 type lexrToken struct {
@@ -947,6 +1065,10 @@ type lexrToken struct {
 	lcol int
 	terminal parser.Term
 	literal string
+	groupNames []string
+	groupSpans []int
+	resume *lexrResume
+	trivia *lexrTrivia
 }
 
 func CreateLexrLexer(lexrDomain Domain) (parser.Lexer, error) {
@@ -962,15 +1084,20 @@ func CreateLexrLexer(lexrDomain Domain) (parser.Lexer, error) {
 		if !ok {
 			return nil, errors.New("generated ndfa was not a *stdDomainNdfa")
 		}
-		sdn = sdn
 		ndfaMap[sdn.Block().Name()] = i
 	}
 	offset := 0
+	unminimized := 0
 	for i, ndfa := range ndfas {
 		dfa, info, err := GenerateDomainDfaFromNdfa(ndfa, offset, lexrDomain.Grammar())
 		if err != nil {
 			return nil, err
 		}
+		unminimized += len(info)
+		dfa, info, err = MinimizeDomainDfa(dfa, info, offset)
+		if err != nil {
+			return nil, err
+		}
 		offset += len(info)
 		dfas[i] = dfa
 		infos[i] = info
@@ -992,13 +1119,15 @@ func CreateLexrLexer(lexrDomain Domain) (parser.Lexer, error) {
 					if !ok {
 						return nil, errors.New("unknown forward block '"+fwdBlock.Name()+"' in dfa info for accpting dfa state")
 					}
-					term, _ := dfaState.AcceptTerm()
-					fmt.Printf("(%d) ACCEPT %s -> (%d) {%s}\n", 
-						dfaState.Id(),
-						term.Name(),
-						dfas[fwdBlockId].State(0).Id(),
-						fwdBlock.Name())
 					dfaState.(*stdDfaNode).acceptNext = dfas[fwdBlockId].State(0).(*stdDfaNode)
+					dfaState.(*stdDfaNode).acceptAction = infos[i][j].blockAction
+				}
+				for _, alt := range dfaState.(*stdDfaNode).acceptAlts {
+					altBlockId, ok := ndfaMap[alt.block.Name()]
+					if !ok {
+						return nil, errors.New("unknown forward block '"+alt.block.Name()+"' in dfa info for accepting dfa state")
+					}
+					alt.next = dfas[altBlockId].State(0).(*stdDfaNode)
 				}
 			}
 		}
@@ -1006,10 +1135,28 @@ func CreateLexrLexer(lexrDomain Domain) (parser.Lexer, error) {
 	lexer := &lexrLexer{
 		grammar: lexrDomain.Grammar(),
 		dfas: dfas,
+		unminimizedStates: unminimized,
 	}
 	return lexer, nil
 }
 
+// DfaStatistics is implemented by lexers created by CreateLexrLexer and
+// LoadLexrLexer.  StateCounts returns the total number of DFA states before
+// and after minimization; for loaded lexers they are the same.
+type DfaStatistics interface {
+	StateCounts() (unminimized int, minimized int)
+}
+
+func (ll *lexrLexer) StateCounts() (unminimized int, minimized int) {
+	for _, dfa := range ll.dfas {
+		minimized += dfa.NumStates()
+	}
+	if ll.unminimizedStates == 0 {
+		return minimized, minimized
+	}
+	return ll.unminimizedStates, minimized
+}
+
 func (ll *lexrLexer) Grammar() parser.Grammar {
 	return ll.grammar
 }
@@ -1027,10 +1174,49 @@ func (ll *lexrLexer) Open(in io.Reader) (parser.LexerState, error) {
 		line: 1,
 		column: 1,
 		dfaState: ll.dfas[0].State(0),
+		prev: -1,
+		bottom: ll.bottom,
+		aware: ll.aware,
+		recovery: ll.recovery,
+		trivia: ll.trivia,
+		tracer: ll.tracer,
 	}
 	return state, nil
 }
 
+// BottomTokenLexer is implemented by lexers created by CreateLexrLexer and
+// LoadLexrLexer.  When SetBottomToken is on, the states the lexer opens end
+// their input with a token for the grammar's Bottom() term, as the initial
+// rule of an Earley parser requires.
+type BottomTokenLexer interface {
+	SetBottomToken(emit bool)
+	BottomToken() bool
+}
+
+func (ll *lexrLexer) SetBottomToken(emit bool) {
+	ll.bottom = emit
+}
+
+func (ll *lexrLexer) BottomToken() bool {
+	return ll.bottom
+}
+
+func (ll *lexrLexer) SetTracer(tracer parser.Tracer) {
+	ll.tracer = tracer
+}
+
+func (ll *lexrLexer) Tracer() parser.Tracer {
+	return ll.tracer
+}
+
+func (ls *lexrState) SetTracer(tracer parser.Tracer) {
+	ls.tracer = tracer
+}
+
+func (ls *lexrState) Tracer() parser.Tracer {
+	return ls.tracer
+}
+
 func (ls *lexrState) Lexer() parser.Lexer {
 	return ls.lexer
 }
@@ -1047,6 +1233,11 @@ func (ls *lexrState) ateof() bool {
 }
 
 func (ls *lexrState) peek() rune {
+	if !ls.hasLa && len(ls.pushback) > 0 {
+		ls.la, ls.laBytes = ls.pushback[0].r, ls.pushback[0].bytes
+		ls.pushback = ls.pushback[1:]
+		ls.hasLa = true
+	}
 	if !ls.hasLa {
 		if ls.eof {
 			return rune(0)
@@ -1057,30 +1248,26 @@ func (ls *lexrState) peek() rune {
 		if err != nil {
 			ls.eof = true
 			ls.lastError = err
+			// Finding the end of the input also reads past it.
+			if ls.position >= ls.reach {
+				ls.reach = ls.position + 1
+			}
 			return rune(0)
 		}
 		ls.hasLa = true		
 		ls.laBytes = bytes
+		if ls.position + bytes > ls.reach {
+			ls.reach = ls.position + bytes
+		}
 	}
 	return ls.la
 }
 
 func (ls *lexrState) read() rune {
-	if ls.eof {
+	if ls.peek(); !ls.hasLa {
 		return rune(0)
 	}
-	var err error
-	var bytes int
-	if !ls.hasLa {
-		ls.la, bytes, err = ls.in.ReadRune()
-		if err != nil {
-			ls.eof = true
-			ls.lastError = err
-			return rune(0)
-		}
-		ls.hasLa = true	
-		ls.laBytes = bytes	
-	}
+	ls.consumed = append(ls.consumed, lexrRune{ls.la, ls.laBytes})
 	ls.position += ls.laBytes
 	if ls.la == rune('\n') {
 		ls.line++
@@ -1089,41 +1276,222 @@ func (ls *lexrState) read() rune {
 		ls.column++
 	}
 	ls.hasLa = false
+	ls.prev = ls.la
 	return ls.la
 }
 
+func (ls *lexrState) consumedLiteral() string {
+	buf := make([]rune, len(ls.consumed))
+	for i, lr := range ls.consumed {
+		buf[i] = lr.r
+	}
+	return string(buf)
+}
 
+// mark returns a mark for the current state and input position.
+func (ls *lexrState) mark() *lexrMark {
+	return &lexrMark{
+		state: ls.dfaState,
+		consumed: len(ls.consumed),
+		line: ls.line,
+		column: ls.column,
+		position: ls.position,
+		prev: ls.prev,
+		tags: ls.tags,
+	}
+}
+
+// reset returns to a mark, pushing back the runes consumed since it was taken.
+func (ls *lexrState) reset(m *lexrMark) {
+	var back []lexrRune
+	back = append(back, ls.consumed[m.consumed:]...)
+	if ls.hasLa {
+		back = append(back, lexrRune{ls.la, ls.laBytes})
+		ls.hasLa = false
+	}
+	ls.pushback = append(back, ls.pushback...)
+	ls.consumed = ls.consumed[:m.consumed]
+	ls.dfaState = m.state
+	ls.line, ls.column, ls.position, ls.prev = m.line, m.column, m.position, m.prev
+	ls.tags = m.tags
+}
+
+// enterTags sets the tag registers at the start of a token.
+func (ls *lexrState) enterTags() {
+	ls.tags = nil
+	if dn, ok := ls.dfaState.(*stdDfaNode); ok && dn.dfa.numTags > 0 {
+		ls.applyTags(dn.dfa.entryTagOps)
+	}
+}
+
+// applyTags replaces the tag registers by the result of ops.  Registers hold
+// rune offsets into the token; they are never modified in place, so a mark
+// may share them.
+func (ls *lexrState) applyTags(ops []tagOp) {
+	if ops == nil {
+		return
+	}
+	n := ls.dfaState.(*stdDfaNode).dfa.numTags
+	tags := make([]int, len(ops)*n)
+	for j, op := range ops {
+		for k := 0; k < n; k++ {
+			tags[j*n+k] = -1
+			if op.src >= 0 {
+				tags[j*n+k] = ls.tags[op.src*n+k]
+			}
+		}
+		for _, k := range op.set {
+			tags[j*n+k] = len(ls.consumed)
+		}
+	}
+	ls.tags = tags
+}
+
+// groupSpans returns the byte offsets in the token of the groups in tag slot
+// slot of the current state.
+func (ls *lexrState) groupSpans(slot int, groups []string) []int {
+	dn, ok := ls.dfaState.(*stdDfaNode)
+	if !ok || len(groups) == 0 {
+		return nil
+	}
+	offsets := make([]int, len(ls.consumed)+1)
+	for i, lr := range ls.consumed {
+		offsets[i+1] = offsets[i] + lr.bytes
+	}
+	n := dn.dfa.numTags
+	spans := make([]int, 2*len(groups))
+	for g, _ := range groups {
+		first, last := ls.tags[slot*n+2*g], ls.tags[slot*n+2*g+1]
+		if first < 0 || last < first {
+			spans[2*g], spans[2*g+1] = -1, -1
+			continue
+		}
+		spans[2*g], spans[2*g+1] = offsets[first], offsets[last]
+	}
+	return spans
+}
+
+
+// readToken reads the longest input accepted by the current block DFA,
+// backtracking to the last accepting state when the DFA stops in a state
+// which does not accept.
 func (ls *lexrState) readToken() (bool, error) {
 	fpos, fline, fcol := ls.position, ls.line, ls.column
-	var buf []rune
+	ls.consumed = ls.consumed[:0]
+	ls.enterTags()
+	start := ls.mark()
+	var last, expected *lexrMark
 	for {
 		r := ls.peek()
-		fmt.Printf("State (%d) next-read: %c (%d)\n", ls.dfaState.Id(), r, r)
-		if r == rune(0) {
-			if ls.eof && ls.lastError == io.EOF {
-				return false, nil
-			}
-			if ls.eof {
+		atEof := false
+		if !ls.hasLa && ls.eof {
+			if ls.lastError != io.EOF {
 				return false, ls.lastError
 			}
+			if len(ls.consumed) == 0 {
+				if !ls.bottom {
+					return false, nil
+				}
+				// Send the bottom token once, at the end of the input.
+				ls.bottom = false
+				ls.hasToken = true
+				ls.nextToken = &lexrToken{
+					state: ls,
+					fpos: ls.position,
+					lpos: ls.position,
+					fline: ls.line,
+					lline: ls.line,
+					fcol: ls.column,
+					lcol: ls.column,
+					terminal: ls.lexer.grammar.Bottom(),
+				}
+				return true, nil
+			}
+			// Accept or ignore the pending input at end of stream.
+			atEof = true
+		}
+		next := r
+		if atEof {
+			next = -1
+		}
+		ctx := ContextAt(ls.prev, next)
+		if cn, ok := ls.dfaState.ContextTransition(ctx); ok {
+			if dn, ok := ls.dfaState.(*stdDfaNode); ok && dn.contextTagOps != nil {
+				ops := dn.contextTagOps[ctx]
+				ls.dfaState = cn
+				ls.applyTags(ops)
+			} else {
+				ls.dfaState = cn
+			}
+		}
+		if ls.dfaState.IsAccepting() {
+			last = ls.mark()
+			if ls.expects(ls.dfaState) {
+				expected = last
+			}
+		}
+		var nn DfaNode
+		ok := false
+		if !atEof {
+			nn, ok = ls.dfaState.TransitionQuery(r)
+		}
+		// Prefer the longest input accepting an expected terminal.
+		backtrack, accepting := last, ls.dfaState.IsAccepting()
+		if expected != nil {
+			backtrack, accepting = expected, ls.expects(ls.dfaState)
+		}
+		if !ok && !accepting && backtrack != nil {
+			// Return to the longest accepted input and scan the rest again.
+			prev := ls.dfaState
+			ls.reset(backtrack)
+			if ls.tracer != nil {
+				ls.tracer.Trace(&parser.TraceEvent{
+					Type: parser.TraceBacktrack,
+					State: prev.Id(),
+					NextState: ls.dfaState.Id(),
+					Line: ls.line,
+					Column: ls.column,
+					Position: ls.position,
+				})
+			}
 		}
-		nn, ok := ls.dfaState.TransitionQuery(r)
 		if !ok {
-			fmt.Println("  -- no transition")
 			// Cannot consume rune; ignore/accept if possible
 			if ls.dfaState.IsAccepting() {
 				var ok bool
 				accept, _ := ls.dfaState.AcceptTerm()
 				if accept == accept.Grammar().Epsilon() {
+					prev := ls.dfaState
 					ls.dfaState, ok = ls.dfaState.AcceptTermNext()
 					if !ok {
 						panic("invalid AcceptTermNext() result")
 					}
-					fmt.Println("  -- ignore")
+					if ls.tracer != nil {
+						ls.tracer.Trace(&parser.TraceEvent{
+							Type: parser.TraceIgnore,
+							State: prev.Id(),
+							NextState: ls.dfaState.Id(),
+							Line: fline,
+							Column: fcol,
+							Position: fpos,
+						})
+					}
+					if ls.trivia {
+						ls.ignoreTrivia(fpos, fline, fcol)
+					}
 					fpos, fline, fcol = ls.position, ls.line, ls.column
-					buf = buf[0:0]
+					ls.consumed = ls.consumed[:0]
+					ls.enterTags()
+					start = ls.mark()
+					last, expected = nil, nil
 					continue
 				}
+				dn := ls.dfaState.(*stdDfaNode)
+				slot, groups := dn.acceptSlot, dn.acceptGroups
+				alt := ls.expectedAlt(dn)
+				if alt != nil {
+					accept, slot, groups = alt.term, alt.slot, alt.groups
+				}
 				ls.hasToken = true
 				ls.nextToken = &lexrToken{
 					state: ls,
@@ -1134,13 +1502,34 @@ func (ls *lexrState) readToken() (bool, error) {
 					fcol: fcol,
 					lcol: ls.column,
 					terminal: accept,
-					literal: string(buf),
+					literal: ls.consumedLiteral(),
+					groupNames: groups,
+					groupSpans: ls.groupSpans(slot, groups),
+				}
+				prev := ls.dfaState
+				if ls.dfaState, ok = ls.acceptNext(prev, alt); !ok {
+					ls.hasToken, ls.nextToken = false, nil
+					ls.eof = true
+					ls.lastError = errors.New(fmt.Sprintf("%s at %d:%d(%d) pops an empty block stack", accept.Name(), fline, fcol, fpos))
+					return false, ls.lastError
 				}
-				fmt.Println("  -- accept "+accept.Name())
-				ls.dfaState, _ = ls.dfaState.AcceptTermNext()
+				if ls.tracer != nil {
+					ls.tracer.Trace(&parser.TraceEvent{
+						Type: parser.TraceAccept,
+						State: prev.Id(),
+						NextState: ls.dfaState.Id(),
+						Term: accept,
+						Token: ls.nextToken,
+						Line: fline,
+						Column: fcol,
+						Position: fpos,
+					})
+				}
+				return true, nil
+			} else if ls.recovery != RecoverNone {
+				ls.recoverToken(start, fpos, fline, fcol)
 				return true, nil
 			} else {
-				fmt.Println("  -- not accept state; fail")
 				// Cannot ignore/accept, and no transition for rune - fail lex.
 				ls.eof = true
 				ls.lastError = errors.New(fmt.Sprintf("invalid runes at %d:%d(%d)", ls.CurrentLine(), ls.CurrentColumn(), ls.CurrentPosition()))
@@ -1148,9 +1537,24 @@ func (ls *lexrState) readToken() (bool, error) {
 			}
 		}
 		// Consume the rune and transition.
-		fmt.Printf("  --  push rune, new state is %d\n", nn.Id())
-		buf = append(buf, ls.read())
+		if ls.tracer != nil {
+			ls.tracer.Trace(&parser.TraceEvent{
+				Type: parser.TraceTransition,
+				State: ls.dfaState.Id(),
+				NextState: nn.Id(),
+				Rune: r,
+				Line: ls.line,
+				Column: ls.column,
+				Position: ls.position,
+			})
+		}
+		var ops []tagOp
+		if dn, ok := ls.dfaState.(*stdDfaNode); ok {
+			ops = dn.transitionTagOps(r)
+		}
+		ls.read()
 		ls.dfaState = nn
+		ls.applyTags(ops)
 	}
 }
 
@@ -1180,9 +1584,35 @@ type Token interface {
 	Literal() string
 */
 
+// scanToken reads a token, recording the state it was scanned from and the
+// trivia around it.
+func (ls *lexrState) scanToken() (bool, error) {
+	resume := &lexrResume{
+		position: ls.position,
+		line: ls.line,
+		column: ls.column,
+		state: ls.dfaState,
+		stack: append([]int(nil), ls.stack...),
+		prev: ls.prev,
+	}
+	ok, err := ls.readToken()
+	if ls.hasToken {
+		resume.reach = ls.reach
+		ls.nextToken.resume = resume
+	}
+	if ls.trivia {
+		if ls.hasToken {
+			ls.attachTrivia(ls.nextToken)
+		} else if len(ls.pendingTrivia) > 0 {
+			ls.attachTrivia(nil)
+		}
+	}
+	return ok, err
+}
+
 func (ls *lexrState) HasMoreTokens() (bool, error) {
 	if !ls.hasToken {
-		ok, err := ls.readToken()
+		ok, err := ls.scanToken()
 		if err != nil {
 			if err == io.EOF {
 				return false, nil
@@ -1196,7 +1626,7 @@ func (ls *lexrState) HasMoreTokens() (bool, error) {
 
 func (ls *lexrState) NextToken() (parser.Token, error) {
 	if !ls.hasToken {
-		_, err := ls.readToken()
+		_, err := ls.scanToken()
 		if err != nil {
 			return nil, err
 		}
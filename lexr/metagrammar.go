@@ -15,6 +15,8 @@ func GenerateLexr0Grammar() parser.Grammar {
 	g.Rule("terminalDef").Nonterminal("optws").Terminal("IDENT").Nonterminal("optws").Terminal("FS").Nonterminal("MATCH").Terminal("FS")
 	g.Rule("terminalDef").Nonterminal("optws").Terminal("LC").Nonterminal("optws").Terminal("LABEL").Nonterminal("optws").Terminal("RC")
 	g.Rule("terminalDef").Nonterminal("optWs").Terminal("LC").Terminal("LC").Terminal("LABEL").Nonterminal("optws").Terminal("RC").Terminal("RC")
+	g.Rule("terminalDef").Nonterminal("optws").Terminal("LC").Terminal("PLUS").Terminal("LABEL").Nonterminal("optws").Terminal("RC")
+	g.Rule("terminalDef").Nonterminal("optws").Terminal("LC").Terminal("MINUS").Nonterminal("optws").Terminal("RC")
 	g.Rule("optws").Terminal("WS")
 	g.Rule("optWs").Terminal("`e")
 	g.Rule("match").Nonterminal("nonalt")
@@ -50,6 +52,7 @@ func GenerateLexr0Grammar() parser.Grammar {
 	g.Rule("escape").Terminal("BS").Nonterminal("special")
 	g.Rule("escape").Terminal("BS").Terminal("CPOINT")
 	g.Rule("escape").Terminal("BS").Terminal("CHARLIT")
+	g.Rule("escape").Terminal("BS").Terminal("CHARLIT").Terminal("LC").Terminal("NAME").Terminal("RC")
 	g.Rule("special").Terminal("NL")
 	g.Rule("special").Terminal("FF")
 	g.Rule("special").Terminal("RT")
@@ -119,6 +122,8 @@ func GenerateLexr0Domain(lexr0Grammar parser.Grammar) Domain {
 									
 			Block("transition"). 
 				Termdef("LABEL", PlusExpression(CharacterClassExpression(ccLabel))). 
+				Termdef("PLUS", CharacterLiteralExpression('+')). 
+				Termdef("MINUS", CharacterLiteralExpression('-')). 
 				Termdef("LC", CharacterLiteralExpression('{')).ToBlock("inclusion"). 
 				Termdef("RC", CharacterLiteralExpression('}')).ToBlock("matchset"). 
 				
@@ -163,6 +168,7 @@ func GenerateLexr0Domain(lexr0Grammar parser.Grammar) Domain {
 			Block("quantifier"). 
 				Termdef("RC", CharacterLiteralExpression('}')).ToBlock("match"). 
 				Termdef("COMMA", CharacterLiteralExpression(',')). 
+				Termdef("NAME", PlusExpression(CharacterClassExpression(ccLabel))). 
 				Termdef("NUM", AlternationExpression(
 								CharacterLiteralExpression('0'),
 								SequenceExpression(
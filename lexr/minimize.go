@@ -0,0 +1,253 @@
+package lexr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MinimizeDomainDfa returns the minimal DFA equivalent to a DFA generated by
+// GenerateDomainDfaFromNdfa, using Hopcroft's partition refinement.  States
+// are only merged if they accept the same term and forward to the same block.
+// The states of the result are indexed from idOffset, and the initial state
+// remains state 0.  DFAs with capture group tags are returned unchanged.
+func MinimizeDomainDfa(dfa Dfa, dfaInfo []*dfaStateInfo, idOffset int) (Dfa, []*dfaStateInfo, error) {
+	sd, ok := dfa.(*stdDfa)
+	if !ok {
+		return nil, nil, errors.New("dfa to minimize was not a *stdDfa")
+	}
+	n := len(sd.nodes)
+	if n != len(dfaInfo) {
+		return nil, nil, errors.New("dfa state info does not match dfa")
+	}
+	if sd.numTags > 0 {
+		// The states of a DFA with tags hold registers for each of their
+		// NDFA nodes, so they cannot be merged.
+		return dfa, dfaInfo, nil
+	}
+	local := make(map[*stdDfaNode]int)
+	for i, dn := range sd.nodes {
+		local[dn] = i
+	}
+
+	// The alphabet is the set of intervals between the range bounds of all
+	// states, so each state has a single transition on each interval.  Missing
+	// transitions go to an extra sink state n.
+	rightSet := make(map[int]bool)
+	for _, dn := range sd.nodes {
+		for _, r := range dn.rangeRights {
+			rightSet[r] = true
+		}
+	}
+	var rights []int
+	for r, _ := range rightSet {
+		rights = append(rights, r)
+	}
+	sort.Ints(rights)
+	// Each context is a further symbol, on which a state without a context
+	// transition stays where it is.
+	sink := n
+	numSymbols := len(rights) + NumContexts
+	inverse := make([][][]int, numSymbols)
+	for k := 0; k < numSymbols; k++ {
+		inverse[k] = make([][]int, n+1)
+	}
+	for s := 0; s <= n; s++ {
+		for k, r := range rights {
+			t := sink
+			if s < n {
+				if nxt, has := sd.nodes[s].TransitionQuery(rune(r)); has {
+					t = local[nxt.(*stdDfaNode)]
+				}
+			}
+			inverse[k][t] = append(inverse[k][t], s)
+		}
+		for ctx := Context(0); ctx < NumContexts; ctx++ {
+			t := s
+			if s < n {
+				if nxt, has := sd.nodes[s].ContextTransition(ctx); has {
+					t = local[nxt.(*stdDfaNode)]
+				}
+			}
+			k := len(rights) + int(ctx)
+			inverse[k][t] = append(inverse[k][t], s)
+		}
+	}
+
+	// The initial partition separates states by what they accept.
+	blockOf := make([]int, n+1)
+	var blocks [][]int
+	keyBlocks := make(map[string]int)
+	for s := 0; s <= n; s++ {
+		key := "-"
+		if s < n && dfaInfo[s].canAccept {
+			key = "_"
+			if dfaInfo[s].acceptTerm != nil {
+				key = fmt.Sprintf("%d", dfaInfo[s].acceptTerm.Id())
+			}
+			if dfaInfo[s].forwardToBlock != nil {
+				key += "/" + dfaInfo[s].forwardToBlock.Name()
+			}
+			key += fmt.Sprintf("/%d", dfaInfo[s].blockAction)
+			for _, td := range dfaInfo[s].alternatives {
+				key += fmt.Sprintf(",%d/%s/%d", td.Terminal().Id(), td.NextBlock().Name(), td.BlockAction())
+			}
+		}
+		b, has := keyBlocks[key]
+		if !has {
+			b = len(blocks)
+			keyBlocks[key] = b
+			blocks = append(blocks, nil)
+		}
+		blockOf[s] = b
+		blocks[b] = append(blocks[b], s)
+	}
+
+	var work []int
+	inWork := make([]bool, len(blocks))
+	for b, _ := range blocks {
+		work = append(work, b)
+		inWork[b] = true
+	}
+	for len(work) > 0 {
+		a := work[len(work)-1]
+		work = work[:len(work)-1]
+		inWork[a] = false
+		splitter := append([]int{}, blocks[a]...)
+		for k := 0; k < numSymbols; k++ {
+			marked := make(map[int][]int)
+			for _, t := range splitter {
+				for _, s := range inverse[k][t] {
+					marked[blockOf[s]] = append(marked[blockOf[s]], s)
+				}
+			}
+			for y, xs := range marked {
+				if len(xs) == len(blocks[y]) {
+					continue
+				}
+				in := make(map[int]bool)
+				for _, s := range xs {
+					in[s] = true
+				}
+				var rest []int
+				for _, s := range blocks[y] {
+					if !in[s] {
+						rest = append(rest, s)
+					}
+				}
+				z := len(blocks)
+				blocks[y] = rest
+				blocks = append(blocks, xs)
+				inWork = append(inWork, false)
+				for _, s := range xs {
+					blockOf[s] = z
+				}
+				switch {
+					case inWork[y], len(xs) <= len(rest): {
+						work = append(work, z)
+						inWork[z] = true
+					}
+					default: {
+						work = append(work, y)
+						inWork[y] = true
+					}
+				}
+			}
+		}
+	}
+
+	// Number the blocks in order of their first state, keeping the initial
+	// state first.  States equivalent to the sink are dropped unless the
+	// initial state is one of them.
+	for _, b := range blocks {
+		sort.Ints(b)
+	}
+	deadBlock := blockOf[sink]
+	var order []int
+	for b, members := range blocks {
+		if len(members) > 0 && (b != deadBlock || blockOf[0] == deadBlock) {
+			order = append(order, b)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return blocks[order[i]][0] < blocks[order[j]][0]
+	})
+	newIndex := make([]int, len(blocks))
+	for i, _ := range newIndex {
+		newIndex[i] = -1
+	}
+	for i, b := range order {
+		newIndex[b] = i
+	}
+
+	minDfa := &stdDfa{
+		nodes: make([]*stdDfaNode, len(order)),
+	}
+	minInfo := make([]*dfaStateInfo, len(order))
+	for i, _ := range order {
+		minDfa.nodes[i] = &stdDfaNode{
+			dfa: minDfa,
+			index: i + idOffset,
+			transitionIndex: make(map[uint64]*stdDfaNode),
+		}
+	}
+	for i, b := range order {
+		rep := sd.nodes[blocks[b][0]]
+		info := dfaInfo[blocks[b][0]]
+		cn := minDfa.nodes[i]
+		var ranges []*characterRange
+		var trs []*stdDfaNode
+		for j, r := range rep.ranges {
+			var nxt *stdDfaNode
+			if rep.transitions[j] != nil {
+				if tb := blockOf[local[rep.transitions[j]]]; tb != deadBlock {
+					nxt = minDfa.nodes[newIndex[tb]]
+				}
+			}
+			if len(ranges) > 0 && trs[len(trs)-1] == nxt {
+				ranges[len(ranges)-1].greatest = r.Greatest()
+				continue
+			}
+			ranges = append(ranges, &characterRange{r.Least(), r.Greatest()})
+			trs = append(trs, nxt)
+		}
+		cn.rangeRights = make([]int, len(ranges))
+		cn.ranges = make([]CharacterRange, len(ranges))
+		cn.transitions = trs
+		for j, r := range ranges {
+			cn.ranges[j] = r
+			cn.rangeRights[j] = int(r.Greatest())
+			cn.transitionIndex[r.Hash()] = trs[j]
+		}
+		// A context transition within the block is equivalent to staying.
+		for ctx, nxt := range rep.contexts {
+			if nxt == nil || blockOf[local[nxt]] == b || blockOf[local[nxt]] == deadBlock {
+				continue
+			}
+			if cn.contexts == nil {
+				cn.contexts = make([]*stdDfaNode, NumContexts)
+			}
+			cn.contexts[ctx] = minDfa.nodes[newIndex[blockOf[local[nxt]]]]
+		}
+		cn.acceptTerm = rep.acceptTerm
+		cn.acceptAlts = rep.acceptAlts
+		var states []int
+		for _, s := range blocks[b] {
+			if s == sink {
+				continue
+			}
+			states = append(states, dfaInfo[s].states...)
+		}
+		sort.Ints(states)
+		minInfo[i] = &dfaStateInfo{
+			id: i,
+			states: states,
+			canAccept: info.canAccept,
+			acceptTerm: info.acceptTerm,
+			forwardToBlock: info.forwardToBlock,
+			blockAction: info.blockAction,
+			alternatives: info.alternatives,
+		}
+	}
+	return minDfa, minInfo, nil
+}
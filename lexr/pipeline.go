@@ -0,0 +1,200 @@
+package lexr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"github.com/dtromb/parser"
+)
+
+// A Pipeline lexes input with a lexer for a domain and parses the tokens with
+// a parser whose grammar names the same terminals as the domain's grammar.
+// The lexer ends the input with a bottom token, and token terminals are
+// mapped by name onto the parser's grammar when the grammars differ, as are
+// the terminals a context aware lexer is told to expect.
+type Pipeline interface {
+	Domain() Domain
+	Lexer() parser.Lexer
+	Parser() parser.Parser
+	SetParser(p parser.Parser) error
+	Open(in io.Reader) (parser.ParserState, error)
+	Parse(in io.Reader) (parser.ParseTreeNode, error)
+	Reparse(old parser.ParseTreeNode, edit Edit) (parser.ParseTreeNode, error)
+	SetTracer(tracer parser.Tracer)
+	Tracer() parser.Tracer
+}
+
+type stdPipeline struct {
+	domain Domain
+	lexer parser.Lexer
+	parser parser.Parser
+	terms map[uint32]parser.Term
+	lexTerms map[uint32]parser.Term
+	tracer parser.Tracer
+}
+
+type pipelineLexerState struct {
+	parser.LexerState
+	terms map[uint32]parser.Term
+	lexTerms map[uint32]parser.Term
+	expectTerms []parser.Term
+}
+
+// NewPipeline creates a pipeline from a lexer for domain to an Earley parser
+// for g.  SetParser replaces the parser with one from any other backend.
+func NewPipeline(domain Domain, g parser.Grammar) (Pipeline, error) {
+	lexer, err := CreateLexrLexer(domain)
+	if err != nil {
+		return nil, err
+	}
+	lexer.(BottomTokenLexer).SetBottomToken(true)
+	p, err := parser.GenerateEarleyParser(g)
+	if err != nil {
+		return nil, err
+	}
+	sp := &stdPipeline{
+		domain: domain,
+		lexer: lexer,
+	}
+	if err := sp.SetParser(p); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func (sp *stdPipeline) Domain() Domain {
+	return sp.domain
+}
+
+func (sp *stdPipeline) Lexer() parser.Lexer {
+	return sp.lexer
+}
+
+func (sp *stdPipeline) Parser() parser.Parser {
+	return sp.parser
+}
+
+// SetParser makes p the parser of the pipeline.  Each terminal of the domain
+// grammar must be named in the grammar of p.  Error tokens map to ErrorTerm of
+// the grammar of p.
+func (sp *stdPipeline) SetParser(p parser.Parser) error {
+	lg, pg := sp.lexer.Grammar(), p.Grammar()
+	var terms, lexTerms map[uint32]parser.Term
+	if lg != pg {
+		names := make(map[string]parser.Term)
+		for i := 0; i < pg.NumTerminal(); i++ {
+			names[pg.Terminal(i).Name()] = pg.Terminal(i)
+		}
+		terms = map[uint32]parser.Term{
+			lg.Bottom().Id(): pg.Bottom(),
+			ErrorTerm(lg).Id(): ErrorTerm(pg),
+		}
+		lexTerms = map[uint32]parser.Term{pg.Bottom().Id(): lg.Bottom()}
+		for i := 0; i < lg.NumTerminal(); i++ {
+			t, has := names[lg.Terminal(i).Name()]
+			if !has {
+				return errors.New("parser grammar has no terminal '" + lg.Terminal(i).Name() + "'")
+			}
+			terms[lg.Terminal(i).Id()] = t
+			lexTerms[t.Id()] = lg.Terminal(i)
+		}
+	}
+	sp.parser, sp.terms, sp.lexTerms = p, terms, lexTerms
+	sp.applyTracer()
+	return nil
+}
+
+func (sp *stdPipeline) SetTracer(tracer parser.Tracer) {
+	sp.tracer = tracer
+	sp.applyTracer()
+}
+
+func (sp *stdPipeline) Tracer() parser.Tracer {
+	return sp.tracer
+}
+
+func (sp *stdPipeline) applyTracer() {
+	for _, x := range []interface{}{sp.lexer, sp.parser} {
+		if tr, ok := x.(parser.Traceable); ok {
+			tr.SetTracer(sp.tracer)
+		}
+	}
+}
+
+// Open opens a parser state over the tokens of in.
+func (sp *stdPipeline) Open(in io.Reader) (parser.ParserState, error) {
+	lex, err := sp.lexer.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	if sp.terms != nil {
+		lex = &pipelineLexerState{
+			LexerState: lex,
+			terms: sp.terms,
+			lexTerms: sp.lexTerms,
+		}
+	}
+	return sp.parser.Open(lex)
+}
+
+// Parse parses in, returning a tree which holds the input for Reparse.
+func (sp *stdPipeline) Parse(in io.Reader) (parser.ParseTreeNode, error) {
+	var source bytes.Buffer
+	ps, err := sp.Open(io.TeeReader(in, &source))
+	if err != nil {
+		return nil, err
+	}
+	ast, err := ps.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return &documentTree{ParseTreeNode: ast, source: source.Bytes()}, nil
+}
+
+func (pls *pipelineLexerState) NextToken() (parser.Token, error) {
+	tok, err := pls.LexerState.NextToken()
+	if err != nil {
+		return nil, err
+	}
+	lt, ok := tok.(*lexrToken)
+	if !ok {
+		return nil, errors.New("pipeline lexer token was not a lexr token")
+	}
+	t, has := pls.terms[lt.terminal.Id()]
+	if !has {
+		return nil, errors.New("parser grammar has no terminal '" + lt.terminal.Name() + "'")
+	}
+	mapped := *lt
+	mapped.terminal = t
+	return &mapped, nil
+}
+
+func (pls *pipelineLexerState) ContextAware() bool {
+	cl, ok := pls.LexerState.(parser.ContextAwareLexerState)
+	return ok && cl.ContextAware()
+}
+
+// SetExpectTokens passes the expected terminals of the parser grammar on to
+// the lexer as the terminals of the domain grammar with the same names.
+func (pls *pipelineLexerState) SetExpectTokens(terms []parser.Term) {
+	cl, ok := pls.LexerState.(parser.ContextAwareLexerState)
+	if !ok {
+		return
+	}
+	pls.expectTerms = terms
+	if terms == nil {
+		cl.SetExpectTokens(nil)
+		return
+	}
+	lexTerms := make([]parser.Term, 0, len(terms))
+	for _, t := range terms {
+		if lt, has := pls.lexTerms[t.Id()]; has {
+			lexTerms = append(lexTerms, lt)
+		}
+	}
+	cl.SetExpectTokens(lexTerms)
+}
+
+func (pls *pipelineLexerState) ExpectTokens() []parser.Term {
+	return pls.expectTerms
+}
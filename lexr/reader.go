@@ -0,0 +1,363 @@
+package lexr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"github.com/dtromb/parser"
+)
+
+var lexr0LexerOnce sync.Once
+var lexr0Lexer parser.Lexer
+var lexr0LexerError error
+
+type lexr0Reader struct {
+	toks []parser.Token
+	pos int
+}
+
+type lexr0Block struct {
+	name string
+	line int
+	column int
+	defaultTo string
+	ignore Expression
+	termdefs []*lexr0Termdef
+	includes []string
+}
+
+type lexr0Termdef struct {
+	name string
+	expr Expression
+	next string
+	action BlockAction
+}
+
+// ParseLexr0 reads a domain written in the lexr0 metalanguage, as written by
+// WriteDomainLexr0.  The domain grammar is synthesized from the source: it has
+// a terminal for each name defined, in order of first definition, and a
+// nonterminal "token" deriving each of them.
+func ParseLexr0(in io.Reader) (Domain, error) {
+	blocks, err := readLexr0(in)
+	if err != nil {
+		return nil, err
+	}
+	gb := parser.NewGrammarBuilder()
+	defined := make(map[string]bool)
+	for _, b := range blocks {
+		for _, td := range b.termdefs {
+			if !defined[td.name] {
+				defined[td.name] = true
+				gb.Rule("token").Terminal(td.name)
+			}
+		}
+	}
+	if len(defined) == 0 {
+		return nil, errors.New("lexr0 domain defines no terminals")
+	}
+	g, err := gb.Build()
+	if err != nil {
+		return nil, err
+	}
+	return buildLexr0Domain(g, blocks)
+}
+
+// ParseLexr0ForGrammar reads a domain written in the lexr0 metalanguage whose
+// terminals are those of g.
+func ParseLexr0ForGrammar(g parser.Grammar, in io.Reader) (Domain, error) {
+	blocks, err := readLexr0(in)
+	if err != nil {
+		return nil, err
+	}
+	return buildLexr0Domain(g, blocks)
+}
+
+func readLexr0(in io.Reader) ([]*lexr0Block, error) {
+	lexr0LexerOnce.Do(func() {
+		lexr0Lexer, lexr0LexerError = CreateLexrLexer(GenerateLexr0Domain(GenerateLexr0Grammar()))
+	})
+	if lexr0LexerError != nil {
+		return nil, lexr0LexerError
+	}
+	lex, err := lexr0Lexer.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	lr := &lexr0Reader{}
+	for {
+		more, err := lex.HasMoreTokens()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+		tok, err := lex.NextToken()
+		if err != nil {
+			return nil, err
+		}
+		lr.toks = append(lr.toks, tok)
+	}
+	var blocks []*lexr0Block
+	for lr.peek() != "" {
+		switch lr.peek() {
+			case "COMMENT_OPEN": {
+				lr.next()
+				if lr.peek() == "COMMENT" {
+					lr.next()
+				}
+				if lr.peek() == "NL" {
+					lr.next()
+				}
+			}
+			case "LABEL": {
+				b, err := lr.readBlock()
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, b)
+			}
+			default: {
+				return nil, lr.unexpected()
+			}
+		}
+	}
+	return blocks, nil
+}
+
+func buildLexr0Domain(g parser.Grammar, blocks []*lexr0Block) (Domain, error) {
+	ig := parser.GetIndexedGrammar(g)
+	tiIf, err := ig.GetIndex(parser.GrammarIndexTypeTerm)
+	if err != nil {
+		return nil, err
+	}
+	termIndex := tiIf.(parser.TermGrammarIndex)
+	byName := make(map[string]*lexr0Block)
+	for _, b := range blocks {
+		if _, has := byName[b.name]; has {
+			return nil, errors.New(fmt.Sprintf("lexr0 %d:%d: duplicate block '%s'", b.line, b.column, b.name))
+		}
+		byName[b.name] = b
+	}
+	checkBlock := func(b *lexr0Block, name string) error {
+		if _, has := byName[name]; !has {
+			return errors.New(fmt.Sprintf("lexr0 %d:%d: block '%s' refers to undefined block '%s'", b.line, b.column, b.name, name))
+		}
+		return nil
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("lexr0 domain has no blocks")
+	}
+	db, err := OpenDomainBuilder(g)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		db.Block(b.name)
+		if b.defaultTo != "" {
+			if err := checkBlock(b, b.defaultTo); err != nil {
+				return nil, err
+			}
+			db.DefaultToBlock(b.defaultTo)
+		}
+		if b.ignore != nil {
+			db.Ignore(b.ignore)
+		}
+		names := make(map[string]bool)
+		for _, td := range b.termdefs {
+			if names[td.name] {
+				return nil, errors.New(fmt.Sprintf("lexr0 %d:%d: duplicate definition of '%s' in block '%s'", b.line, b.column, td.name, b.name))
+			}
+			names[td.name] = true
+			if _, err := termIndex.GetTerminal(td.name); err != nil {
+				return nil, errors.New(fmt.Sprintf("lexr0 %d:%d: grammar has no terminal '%s'", b.line, b.column, td.name))
+			}
+			db.Termdef(td.name, td.expr)
+			if td.action == BlockPop {
+				db.PopBlock()
+			} else if td.next != "" {
+				if err := checkBlock(b, td.next); err != nil {
+					return nil, err
+				}
+				if td.action == BlockPush {
+					db.PushBlock(td.next)
+				} else {
+					db.ToBlock(td.next)
+				}
+			}
+		}
+		for _, inc := range b.includes {
+			if err := checkBlock(b, inc); err != nil {
+				return nil, err
+			}
+			db.Include(inc)
+		}
+	}
+	return db.Build()
+}
+
+func (lr *lexr0Reader) peek() string {
+	if lr.pos >= len(lr.toks) {
+		return ""
+	}
+	return lr.toks[lr.pos].Terminal().Name()
+}
+
+func (lr *lexr0Reader) next() parser.Token {
+	tok := lr.toks[lr.pos]
+	lr.pos++
+	return tok
+}
+
+func (lr *lexr0Reader) unexpected() error {
+	if lr.pos >= len(lr.toks) {
+		return errors.New("lexr0: unexpected end of input")
+	}
+	tok := lr.toks[lr.pos]
+	return errors.New(fmt.Sprintf("lexr0 %d:%d: unexpected %s '%s'", tok.FirstLine(), tok.FirstColumn(), tok.Terminal().Name(), tok.Literal()))
+}
+
+func (lr *lexr0Reader) expect(name string) (parser.Token, error) {
+	if lr.peek() != name {
+		return nil, lr.unexpected()
+	}
+	return lr.next(), nil
+}
+
+// readBlock reads a block definition.  A transition {name} following a
+// termdef on the same line is the termdef's next block; on a line of its own
+// it is the block's default forward.  A termdef may instead be followed by
+// {+name}, pushing its block and continuing in block name, or by {-},
+// popping the block to continue in.
+func (lr *lexr0Reader) readBlock() (*lexr0Block, error) {
+	label := lr.next()
+	b := &lexr0Block{
+		name: label.Literal(),
+		line: label.FirstLine(),
+		column: label.FirstColumn(),
+	}
+	if _, err := lr.expect("COLON"); err != nil {
+		return nil, err
+	}
+	if _, err := lr.expect("MOPEN"); err != nil {
+		return nil, err
+	}
+	var lastTd *lexr0Termdef
+	for {
+		switch lr.peek() {
+			case "MCLOSE": {
+				lr.next()
+				return b, nil
+			}
+			case "WS": {
+				if strings.ContainsRune(lr.next().Literal(), '\n') {
+					lastTd = nil
+				}
+			}
+			case "IDENT": {
+				name := lr.next().Literal()
+				if lr.peek() == "WS" {
+					lr.next()
+				}
+				fs, err := lr.expect("FS")
+				if err != nil {
+					return nil, err
+				}
+				expr, err := lr.readPattern(fs)
+				if err != nil {
+					return nil, err
+				}
+				if name == "_" {
+					if b.ignore != nil {
+						return nil, errors.New(fmt.Sprintf("lexr0 %d:%d: block '%s' has more than one ignore expression", b.line, b.column, b.name))
+					}
+					b.ignore = expr
+					lastTd = nil
+				} else {
+					lastTd = &lexr0Termdef{name: name, expr: expr}
+					b.termdefs = append(b.termdefs, lastTd)
+				}
+			}
+			case "LC": {
+				lr.next()
+				if lr.peek() == "LC" {
+					lr.next()
+					inc, err := lr.expect("LABEL")
+					if err != nil {
+						return nil, err
+					}
+					if _, err = lr.expect("RC"); err != nil {
+						return nil, err
+					}
+					if _, err = lr.expect("RC"); err != nil {
+						return nil, err
+					}
+					b.includes = append(b.includes, inc.Literal())
+					lastTd = nil
+					continue
+				}
+				if lr.peek() == "PLUS" || lr.peek() == "MINUS" {
+					op := lr.next()
+					if lastTd == nil || lastTd.next != "" || lastTd.action != BlockForward {
+						return nil, errors.New(fmt.Sprintf("lexr0 %d:%d: block stack transition does not follow a termdef", op.FirstLine(), op.FirstColumn()))
+					}
+					if op.Terminal().Name() == "PLUS" {
+						next, err := lr.expect("LABEL")
+						if err != nil {
+							return nil, err
+						}
+						lastTd.next = next.Literal()
+						lastTd.action = BlockPush
+					} else {
+						lastTd.action = BlockPop
+					}
+					if _, err := lr.expect("RC"); err != nil {
+						return nil, err
+					}
+					lastTd = nil
+					continue
+				}
+				next, err := lr.expect("LABEL")
+				if err != nil {
+					return nil, err
+				}
+				if _, err = lr.expect("RC"); err != nil {
+					return nil, err
+				}
+				if lastTd != nil && lastTd.next == "" && lastTd.action == BlockForward {
+					lastTd.next = next.Literal()
+				} else {
+					if b.defaultTo != "" {
+						return nil, errors.New(fmt.Sprintf("lexr0 %d:%d: block '%s' has more than one default forward", b.line, b.column, b.name))
+					}
+					b.defaultTo = next.Literal()
+				}
+				lastTd = nil
+			}
+			default: {
+				return nil, lr.unexpected()
+			}
+		}
+	}
+}
+
+// readPattern reads the tokens of a match up to its closing slash and
+// compiles their text.  The tokens of the match blocks are the characters of
+// the pattern, except for whitespace in quantifiers, which is ignored anyway.
+func (lr *lexr0Reader) readPattern(open parser.Token) (Expression, error) {
+	var buf strings.Builder
+	for lr.peek() != "FS" {
+		if lr.peek() == "" {
+			return nil, lr.unexpected()
+		}
+		buf.WriteString(lr.next().Literal())
+	}
+	lr.next()
+	expr, err := CompileExpression(buf.String())
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("lexr0 %d:%d: %s", open.FirstLine(), open.FirstColumn(), err.Error()))
+	}
+	return expr, nil
+}
@@ -0,0 +1,153 @@
+package lexr
+
+import (
+	"math"
+	"github.com/dtromb/parser"
+)
+
+// ErrorRecovery selects what a lexer does with input that no termdef or
+// ignore expression of the current block matches.
+type ErrorRecovery uint8
+const (
+	// RecoverNone fails the lex with an error.
+	RecoverNone ErrorRecovery = iota
+	// RecoverSkipRune sends the first unmatched rune as an error token and
+	// lexes on from the next rune.
+	RecoverSkipRune
+	// RecoverResync sends the unmatched input up to the next rune which
+	// starts input the block ignores, or to the end of input, as an error
+	// token.
+	RecoverResync
+)
+
+// ErrorRecoveryLexer is implemented by lexers created by CreateLexrLexer
+// and LoadLexrLexer.  With a recovery mode other than RecoverNone, the states
+// the lexer opens send error tokens for unmatched input and continue.  The
+// terminal of an error token is ErrorTerm of the lexer's grammar; its literal
+// and positions are those of the unmatched input.
+type ErrorRecoveryLexer interface {
+	SetErrorRecovery(mode ErrorRecovery)
+	ErrorRecovery() ErrorRecovery
+}
+
+// errorTermId is the id of the error term of grammars without an ERROR
+// terminal.
+const errorTermId = math.MaxUint32
+
+type errorTerm struct {
+	grammar parser.Grammar
+}
+
+// ErrorTerm returns the terminal of error tokens for g: the terminal of g
+// named ERROR if there is one, so that rules may match errors, and otherwise
+// a special terminal outside g.
+func ErrorTerm(g parser.Grammar) parser.Term {
+	for i := 0; i < g.NumTerminal(); i++ {
+		if g.Terminal(i).Name() == "ERROR" {
+			return g.Terminal(i)
+		}
+	}
+	return &errorTerm{grammar: g}
+}
+
+func (et *errorTerm) Grammar() parser.Grammar {
+	return et.grammar
+}
+
+func (et *errorTerm) HashCode() uint32 {
+	return errorTermId
+}
+
+func (et *errorTerm) Equals(o interface{}) bool {
+	if k, ok := o.(parser.Term); ok {
+		return k.Id() == errorTermId && k.Grammar() == et.grammar
+	}
+	return false
+}
+
+func (et *errorTerm) Name() string {
+	return "ERROR"
+}
+
+func (et *errorTerm) Id() uint32 {
+	return errorTermId
+}
+
+func (et *errorTerm) Terminal() bool {
+	return true
+}
+
+func (et *errorTerm) Special() bool {
+	return true
+}
+
+func (ll *lexrLexer) SetErrorRecovery(mode ErrorRecovery) {
+	ll.recovery = mode
+}
+
+func (ll *lexrLexer) ErrorRecovery() ErrorRecovery {
+	return ll.recovery
+}
+
+// ignoreReachable returns the DFA states from which an ignore accepting state
+// can be reached.
+func (ll *lexrLexer) ignoreReachable() map[*stdDfaNode]bool {
+	ll.ignoreOnce.Do(func() {
+		ll.ignoreStates = make(map[*stdDfaNode]bool)
+		epsilon := ll.grammar.Epsilon()
+		for changed := true; changed; {
+			changed = false
+			for _, dfa := range ll.dfas {
+				for _, dn := range dfa.(*stdDfa).nodes {
+					if ll.ignoreStates[dn] {
+						continue
+					}
+					reaches := dn.acceptTerm == epsilon
+					for _, nxt := range dn.transitions {
+						reaches = reaches || (nxt != nil && ll.ignoreStates[nxt])
+					}
+					for _, nxt := range dn.contexts {
+						reaches = reaches || (nxt != nil && ll.ignoreStates[nxt])
+					}
+					if reaches {
+						ll.ignoreStates[dn] = true
+						changed = true
+					}
+				}
+			}
+		}
+	})
+	return ll.ignoreStates
+}
+
+// recoverToken returns to the token start m and reads unmatched input into an
+// error token, as the recovery mode of the state selects.
+func (ls *lexrState) recoverToken(m *lexrMark, fpos, fline, fcol int) {
+	ls.reset(m)
+	ls.read()
+	if ls.recovery == RecoverResync {
+		ignorable := ls.lexer.ignoreReachable()
+		for {
+			r := ls.peek()
+			if !ls.hasLa {
+				break
+			}
+			if nn, ok := ls.dfaState.TransitionQuery(r); ok && ignorable[nn.(*stdDfaNode)] {
+				break
+			}
+			ls.read()
+		}
+	}
+	ls.hasToken = true
+	ls.nextToken = &lexrToken{
+		state: ls,
+		fpos: fpos,
+		lpos: ls.position,
+		fline: fline,
+		lline: ls.line,
+		fcol: fcol,
+		lcol: ls.column,
+		terminal: ErrorTerm(ls.lexer.grammar),
+		literal: ls.consumedLiteral(),
+	}
+}
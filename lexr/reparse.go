@@ -0,0 +1,504 @@
+package lexr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"github.com/dtromb/parser"
+)
+
+// Edit replaces Length bytes of a document at byte offset Offset with Text.
+type Edit struct {
+	Offset int
+	Length int
+	Text string
+}
+
+// lexrResume is the state a lexer scanned a token from, with the end of the
+// input it had read when the token was scanned.  Scanning from the same state
+// over the same input after position reads the same tokens.
+type lexrResume struct {
+	position int
+	line int
+	column int
+	state DfaNode
+	stack []int
+	prev rune
+	reach int
+}
+
+// documentTree is the root of a tree returned by Pipeline.Parse or Reparse,
+// holding the input it was parsed from.
+type documentTree struct {
+	parser.ParseTreeNode
+	source []byte
+}
+
+// reparsedNode is a node of a reparsed tree which is not reused from the tree
+// that was edited.
+type reparsedNode struct {
+	parser parser.Parser
+	token parser.Token
+	rule parser.ProductionRule
+	children []parser.ParseTreeNode
+}
+
+// movedNode is a subtree reused from the tree that was edited whose tokens
+// were moved by edits.  It derives the tokens of node, the subtree as it was
+// first parsed, as their moved copies in moved.
+type movedNode struct {
+	node parser.ParseTreeNode
+	moved map[parser.Token]parser.Token
+}
+
+// reparseLexerState sends the tokens before an edit, then the tokens lexed
+// from the edited input until the lexer returns to the state it scanned a
+// token after the edit from, and then that token and those following it,
+// moved by the change in length of the input.
+type reparseLexerState struct {
+	pipeline *stdPipeline
+	in io.Reader
+	live *lexrState
+	liveState parser.LexerState
+	pending []parser.Token
+	last parser.Token
+	old []*lexrToken
+	movedFrom map[parser.Token]int
+	resumeAt map[int]int
+	editEnd int
+	delta int
+}
+
+type treeSpan struct {
+	rule parser.ProductionRule
+	first int
+	last int
+}
+
+// Reparse parses the input of old, a tree returned by Parse or Reparse, after
+// edit.  Tokens before the edit whose scan did not read the edited input are
+// kept, and lexing stops as soon as the lexer is back in the state it scanned a
+// token after the edit from, sending the rest of the old tokens moved to their
+// new positions; a context aware lexer lexes the rest of the input.  Subtrees
+// of old deriving the same kept tokens by the same rule are reused in the new
+// tree, those after the edit by way of nodes deriving the moved tokens.  The
+// parser is not incremental: it parses every token of the edited input again,
+// and only the tree it builds shares the subtrees of old.
+func (sp *stdPipeline) Reparse(old parser.ParseTreeNode, edit Edit) (parser.ParseTreeNode, error) {
+	doc, ok := old.(*documentTree)
+	if !ok {
+		return nil, errors.New("reparsed tree was not returned by Pipeline.Parse or Reparse")
+	}
+	if edit.Offset < 0 || edit.Length < 0 || edit.Offset + edit.Length > len(doc.source) {
+		return nil, errors.New(fmt.Sprintf("edit of %d bytes at %d is outside the %d byte document", edit.Length, edit.Offset, len(doc.source)))
+	}
+	ll, ok := sp.lexer.(*lexrLexer)
+	if !ok {
+		return nil, errors.New("pipeline lexer is not a lexr lexer")
+	}
+	source := make([]byte, 0, len(doc.source) - edit.Length + len(edit.Text))
+	source = append(source, doc.source[:edit.Offset]...)
+	source = append(source, edit.Text...)
+	source = append(source, doc.source[edit.Offset + edit.Length:]...)
+
+	var tokens []*lexrToken
+	oldIndex := make(map[parser.Token]int)
+	// moved maps tokens as they were first parsed to their moved copies.
+	moved := make(map[parser.Token]parser.Token)
+	oldNodes := make(map[treeSpan]parser.ParseTreeNode)
+	var index func(n parser.ParseTreeNode) (int, int, error)
+	index = func(n parser.ParseTreeNode) (int, int, error) {
+		if n.Production() == nil {
+			lt, ok := n.Token().(*lexrToken)
+			if !ok || lt.resume == nil || lt.state.lexer != ll {
+				return 0, 0, errors.New("reparsed tree holds a token not read by the pipeline lexer")
+			}
+			oldIndex[lt] = len(tokens)
+			if first := unmovedNode(n).Token(); first != lt {
+				moved[first] = lt
+			}
+			oldNodes[treeSpan{nil, len(tokens), len(tokens)}] = n
+			tokens = append(tokens, lt)
+			return len(tokens) - 1, len(tokens) - 1, nil
+		}
+		first, last := len(tokens), len(tokens) - 1
+		for _, c := range n.Children() {
+			if _, cl, err := index(c); err != nil {
+				return 0, 0, err
+			} else {
+				last = cl
+			}
+		}
+		oldNodes[treeSpan{n.Production(), first, last}] = n
+		return first, last, nil
+	}
+	if _, _, err := index(doc.ParseTreeNode); err != nil {
+		return nil, err
+	}
+
+	// Relex from the first token whose scan read the edited input.
+	k := 0
+	for k < len(tokens) && tokens[k].resume.reach <= edit.Offset {
+		k++
+	}
+	resume := &lexrResume{line: 1, column: 1, state: ll.dfas[0].State(0), prev: -1}
+	if k < len(tokens) {
+		resume = tokens[k].resume
+	} else {
+		k = 0
+	}
+	ls, _ := ll.Open(bytes.NewReader(source[resume.position:]))
+	live := ls.(*lexrState)
+	live.position, live.line, live.column = resume.position, resume.line, resume.column
+	live.dfaState, live.prev = resume.state, resume.prev
+	live.stack = append([]int(nil), resume.stack...)
+	live.reach = resume.position
+	rs := &reparseLexerState{
+		pipeline: sp,
+		in: live.Reader(),
+		live: live,
+		liveState: live,
+		old: tokens,
+		movedFrom: make(map[parser.Token]int),
+		editEnd: edit.Offset + len(edit.Text),
+		delta: len(edit.Text) - edit.Length,
+	}
+	if sp.terms != nil {
+		rs.liveState = &pipelineLexerState{
+			LexerState: live,
+			terms: sp.terms,
+			lexTerms: sp.lexTerms,
+		}
+	}
+	for _, t := range tokens[:k] {
+		rs.pending = append(rs.pending, t)
+	}
+	if live.trivia && k > 0 {
+		// The trailing trivia of the last token kept are read again.
+		pt := *tokens[k-1]
+		pt.trivia = &lexrTrivia{leading: tokens[k-1].LeadingTrivia()}
+		rs.pending[k-1], live.lastToken = &pt, &pt
+	}
+	if !live.aware {
+		rs.resumeAt = make(map[int]int)
+		for j := len(tokens) - 1; j >= k; j-- {
+			if tokens[j].resume.position >= edit.Offset + edit.Length {
+				rs.resumeAt[tokens[j].resume.position] = j
+			}
+		}
+	}
+
+	ps, err := sp.parser.Open(rs)
+	if err != nil {
+		return nil, err
+	}
+	ast, err := ps.Parse()
+	if err != nil {
+		return nil, err
+	}
+	// Reuse the subtrees of old deriving consecutive old tokens, moving those
+	// which derive tokens moved by the edit.
+	for mt, i := range rs.movedFrom {
+		moved[unmovedNode(oldNodes[treeSpan{nil, i, i}]).Token()] = mt
+	}
+	reuse := func(on parser.ParseTreeNode, isMoved bool) parser.ParseTreeNode {
+		if !isMoved {
+			return on
+		}
+		return &movedNode{node: unmovedNode(on), moved: moved}
+	}
+	var rebuild func(n parser.ParseTreeNode) (parser.ParseTreeNode, int, int, bool, bool)
+	rebuild = func(n parser.ParseTreeNode) (parser.ParseTreeNode, int, int, bool, bool) {
+		if n.Production() == nil {
+			if i, has := oldIndex[n.Token()]; has {
+				return oldNodes[treeSpan{nil, i, i}], i, i, true, false
+			}
+			if i, has := rs.movedFrom[n.Token()]; has {
+				return reuse(oldNodes[treeSpan{nil, i, i}], true), i, i, true, true
+			}
+			return n, 0, 0, false, false
+		}
+		rn := &reparsedNode{
+			parser: n.Parser(),
+			token: n.Token(),
+			rule: n.Production(),
+		}
+		first, last, kept, anyMoved := -1, -1, true, false
+		for _, c := range n.Children() {
+			rc, cf, cl, ck, cm := rebuild(c)
+			rn.children = append(rn.children, rc)
+			if kept = kept && ck && (last < 0 || cf == last + 1); kept {
+				if first < 0 {
+					first = cf
+				}
+				last = cl
+				anyMoved = anyMoved || cm
+			}
+		}
+		if kept && first >= 0 {
+			if on, has := oldNodes[treeSpan{n.Production(), first, last}]; has {
+				return reuse(on, anyMoved), first, last, true, anyMoved
+			}
+		}
+		return rn, 0, 0, false, false
+	}
+	root, _, _, _, _ := rebuild(ast)
+	return &documentTree{ParseTreeNode: root, source: source}, nil
+}
+
+func (rs *reparseLexerState) Lexer() parser.Lexer {
+	return rs.pipeline.lexer
+}
+
+func (rs *reparseLexerState) Reader() io.Reader {
+	return rs.in
+}
+
+// sync switches to the old tokens when the live lexer is between tokens in
+// the state it scanned one of them from.
+func (rs *reparseLexerState) sync() {
+	ls := rs.live
+	if ls == nil || ls.hasToken || rs.resumeAt == nil || ls.position < rs.editEnd {
+		return
+	}
+	j, has := rs.resumeAt[ls.position - rs.delta]
+	if !has {
+		return
+	}
+	r := rs.old[j].resume
+	if r.state != ls.dfaState || r.prev != ls.prev || len(r.stack) != len(ls.stack) {
+		return
+	}
+	for i, b := range r.stack {
+		if ls.stack[i] != b {
+			return
+		}
+	}
+	m := &tokenMove{
+		line: r.line,
+		delta: rs.delta,
+		lineDelta: ls.line - r.line,
+		columnDelta: ls.column - r.column,
+	}
+	if ls.lastToken != nil && j > 0 {
+		ls.lastToken.trivia.trailing = m.moveTrivia(rs.old[j-1].TrailingTrivia())
+	}
+	for i, t := range rs.old[j:] {
+		mt := m.move(t)
+		if mt != t {
+			rs.movedFrom[mt] = j + i
+		}
+		rs.pending = append(rs.pending, mt)
+	}
+	rs.live, rs.liveState = nil, nil
+}
+
+// tokenMove moves tokens after an edit by its change in length and lines, and
+// by its change in columns on line, the old line it ends on.
+type tokenMove struct {
+	line int
+	delta int
+	lineDelta int
+	columnDelta int
+}
+
+func (m *tokenMove) move(t *lexrToken) *lexrToken {
+	if m.delta == 0 && m.lineDelta == 0 && m.columnDelta == 0 {
+		return t
+	}
+	mt := *t
+	mt.fpos, mt.lpos = mt.fpos + m.delta, mt.lpos + m.delta
+	if mt.fline == m.line {
+		mt.fcol += m.columnDelta
+	}
+	if mt.lline == m.line {
+		mt.lcol += m.columnDelta
+	}
+	mt.fline, mt.lline = mt.fline + m.lineDelta, mt.lline + m.lineDelta
+	if t.resume != nil {
+		mr := *t.resume
+		mr.position, mr.reach = mr.position + m.delta, mr.reach + m.delta
+		if mr.line == m.line {
+			mr.column += m.columnDelta
+		}
+		mr.line += m.lineDelta
+		mt.resume = &mr
+	}
+	if t.trivia != nil {
+		mt.trivia = &lexrTrivia{
+			leading: m.moveTrivia(t.trivia.leading),
+			trailing: m.moveTrivia(t.trivia.trailing),
+		}
+	}
+	return &mt
+}
+
+func (m *tokenMove) moveTrivia(trivia []parser.Token) []parser.Token {
+	if m.delta == 0 && m.lineDelta == 0 && m.columnDelta == 0 {
+		return trivia
+	}
+	moved := make([]parser.Token, len(trivia))
+	for i, t := range trivia {
+		moved[i] = m.move(t.(*lexrToken))
+	}
+	return moved
+}
+
+func (rs *reparseLexerState) HasMoreTokens() (bool, error) {
+	if len(rs.pending) == 0 {
+		rs.sync()
+	}
+	if len(rs.pending) > 0 {
+		return true, nil
+	}
+	if rs.liveState == nil {
+		return false, nil
+	}
+	return rs.liveState.HasMoreTokens()
+}
+
+func (rs *reparseLexerState) NextToken() (parser.Token, error) {
+	if len(rs.pending) == 0 {
+		rs.sync()
+	}
+	if len(rs.pending) > 0 {
+		rs.last, rs.pending = rs.pending[0], rs.pending[1:]
+		return rs.last, nil
+	}
+	if rs.liveState == nil {
+		return nil, io.EOF
+	}
+	tok, err := rs.liveState.NextToken()
+	if err != nil {
+		return nil, err
+	}
+	rs.last = tok
+	return tok, nil
+}
+
+// lexing is true when the current position is that of the live lexer.
+func (rs *reparseLexerState) lexing() bool {
+	return rs.live != nil && len(rs.pending) == 0
+}
+
+func (rs *reparseLexerState) CurrentLine() int {
+	if rs.lexing() {
+		return rs.live.CurrentLine()
+	}
+	if rs.last == nil {
+		return 1
+	}
+	return rs.last.LastLine()
+}
+
+func (rs *reparseLexerState) CurrentColumn() int {
+	if rs.lexing() {
+		return rs.live.CurrentColumn()
+	}
+	if rs.last == nil {
+		return 1
+	}
+	return rs.last.LastColumn()
+}
+
+func (rs *reparseLexerState) CurrentPosition() int {
+	if rs.lexing() {
+		return rs.live.CurrentPosition()
+	}
+	if rs.last == nil {
+		return 0
+	}
+	return rs.last.LastPosition()
+}
+
+func (rs *reparseLexerState) ContextAware() bool {
+	cl, ok := rs.liveState.(parser.ContextAwareLexerState)
+	return ok && cl.ContextAware()
+}
+
+func (rs *reparseLexerState) SetExpectTokens(terms []parser.Term) {
+	if cl, ok := rs.liveState.(parser.ContextAwareLexerState); ok {
+		cl.SetExpectTokens(terms)
+	}
+}
+
+func (rs *reparseLexerState) ExpectTokens() []parser.Term {
+	if cl, ok := rs.liveState.(parser.ContextAwareLexerState); ok {
+		return cl.ExpectTokens()
+	}
+	return nil
+}
+
+// unmovedNode is the subtree n was reused from, as it was first parsed.
+func unmovedNode(n parser.ParseTreeNode) parser.ParseTreeNode {
+	if mn, ok := n.(*movedNode); ok {
+		return mn.node
+	}
+	return n
+}
+
+func (mn *movedNode) Parser() parser.Parser {
+	return mn.node.Parser()
+}
+
+func (mn *movedNode) Token() parser.Token {
+	tok := mn.node.Token()
+	if mt, has := mn.moved[tok]; has {
+		return mt
+	}
+	return tok
+}
+
+func (mn *movedNode) Production() parser.ProductionRule {
+	return mn.node.Production()
+}
+
+func (mn *movedNode) NumChildren() int {
+	return mn.node.NumChildren()
+}
+
+func (mn *movedNode) Child(idx int) parser.ParseTreeNode {
+	c := mn.node.Child(idx)
+	if c == nil {
+		return nil
+	}
+	return &movedNode{node: unmovedNode(c), moved: mn.moved}
+}
+
+func (mn *movedNode) Children() []parser.ParseTreeNode {
+	children := mn.node.Children()
+	for i, c := range children {
+		children[i] = &movedNode{node: unmovedNode(c), moved: mn.moved}
+	}
+	return children
+}
+
+func (rn *reparsedNode) Parser() parser.Parser {
+	return rn.parser
+}
+
+func (rn *reparsedNode) Token() parser.Token {
+	return rn.token
+}
+
+func (rn *reparsedNode) Production() parser.ProductionRule {
+	return rn.rule
+}
+
+func (rn *reparsedNode) NumChildren() int {
+	return len(rn.children)
+}
+
+func (rn *reparsedNode) Child(idx int) parser.ParseTreeNode {
+	if idx < 0 || idx >= len(rn.children) {
+		return nil
+	}
+	return rn.children[idx]
+}
+
+func (rn *reparsedNode) Children() []parser.ParseTreeNode {
+	ret := make([]parser.ParseTreeNode, len(rn.children))
+	copy(ret, rn.children)
+	return ret
+}
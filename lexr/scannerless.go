@@ -0,0 +1,527 @@
+package lexr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+	"github.com/dtromb/parser"
+)
+
+// CharacterGrammarBuilder builds a character level grammar for scannerless
+// parsing.  Rules are written as with parser.GrammarBuilder, with character
+// classes and literal strings in place of terminals; the nonterminal of the
+// first rule derives the whole input.  The runes of the classes are split
+// into disjoint intervals, each a terminal of the built grammar named C-lo or
+// C-lo-hi by its hexadecimal bounds, and a class of more than one interval is
+// derived by a nonterminal named cc-n.
+//
+// Follow and Reject restrict the derivations of a nonterminal: Follow discards
+// those followed by a rune of a class, for longest match, and Reject those
+// deriving exactly a literal, for keyword reservation.  They apply to every
+// derivation of the nonterminal, including those within its own recursions.
+type CharacterGrammarBuilder interface {
+	Rule(lhsNt string) CharacterGrammarBuilder
+	Nonterminal(nt string) CharacterGrammarBuilder
+	Class(cc CharacterClass) CharacterGrammarBuilder
+	Literal(s string) CharacterGrammarBuilder
+	Follow(nt string, cc CharacterClass) CharacterGrammarBuilder
+	Reject(nt string, literal string) CharacterGrammarBuilder
+	Build() (CharacterGrammar, error)
+	MustBuild() CharacterGrammar
+}
+
+// CharacterGrammar is a grammar built by a CharacterGrammarBuilder.  Terminal
+// returns the terminal of a rune, if it is in a class of the grammar, and
+// CompletionFilter applies the follow and reject restrictions of the grammar
+// in a parser.FilteringParser.
+type CharacterGrammar interface {
+	Grammar() parser.Grammar
+	Terminal(c rune) (parser.Term, bool)
+	CompletionFilter() parser.CompletionFilter
+}
+
+func OpenCharacterGrammarBuilder() CharacterGrammarBuilder {
+	return &characterGrammarBuilder{
+		follows: make(map[string][]*characterRange),
+		rejects: make(map[string]map[string]bool),
+	}
+}
+
+// NewRuneLexer creates a lexer sending a token for each rune of its input,
+// with the terminal of the rune in cg, and the bottom token at the end.
+func NewRuneLexer(cg CharacterGrammar) parser.Lexer {
+	return &runeLexer{grammar: cg}
+}
+
+// GenerateScannerlessParser creates an Earley parser for cg which applies its
+// follow and reject restrictions.  It parses the tokens of NewRuneLexer.
+func GenerateScannerlessParser(cg CharacterGrammar) (parser.Parser, error) {
+	p, err := parser.GenerateEarleyParser(cg.Grammar())
+	if err != nil {
+		return nil, err
+	}
+	p.(parser.FilteringParser).SetCompletionFilter(cg.CompletionFilter())
+	return p, nil
+}
+
+///
+
+// charSymbol is a nonterminal, or a class when nt is empty.
+type charSymbol struct {
+	nt string
+	ranges []*characterRange
+}
+
+type charRule struct {
+	lhs string
+	rhs []charSymbol
+}
+
+type characterGrammarBuilder struct {
+	rules []*charRule
+	openRule *charRule
+	follows map[string][]*characterRange
+	rejects map[string]map[string]bool
+}
+
+type stdCharacterGrammar struct {
+	grammar parser.Grammar
+	bounds []rune
+	terms []parser.Term
+	follows map[uint32][]*characterRange
+	rejects map[uint32]map[string]bool
+}
+
+type runeLexer struct {
+	grammar CharacterGrammar
+}
+
+type runeLexerState struct {
+	lexer *runeLexer
+	in *bufio.Reader
+	line int
+	column int
+	position int
+	ended bool
+	hasToken bool
+	nextToken *runeToken
+}
+
+type runeToken struct {
+	state *runeLexerState
+	fpos int
+	lpos int
+	fline int
+	lline int
+	fcol int
+	lcol int
+	terminal parser.Term
+	literal string
+}
+
+// charIntervals returns the runes of cc as intervals with closed bounds.
+func charIntervals(cc CharacterClass) []*characterRange {
+	var ranges []*characterRange
+	for _, r := range classIntervals(cc) {
+		nr := &characterRange{r.least, r.greatest}
+		if nr.greatest < 0 {
+			nr.greatest = utf8.MaxRune
+		}
+		if nr.least <= nr.greatest {
+			ranges = append(ranges, nr)
+		}
+	}
+	return ranges
+}
+
+func (cgb *characterGrammarBuilder) Rule(lhsNt string) CharacterGrammarBuilder {
+	cgb.openRule = &charRule{lhs: lhsNt}
+	cgb.rules = append(cgb.rules, cgb.openRule)
+	return cgb
+}
+
+func (cgb *characterGrammarBuilder) Nonterminal(nt string) CharacterGrammarBuilder {
+	if cgb.openRule == nil {
+		panic("Nonterminal() called before Rule()")
+	}
+	cgb.openRule.rhs = append(cgb.openRule.rhs, charSymbol{nt: nt})
+	return cgb
+}
+
+func (cgb *characterGrammarBuilder) Class(cc CharacterClass) CharacterGrammarBuilder {
+	if cgb.openRule == nil {
+		panic("Class() called before Rule()")
+	}
+	ranges := charIntervals(cc)
+	if len(ranges) == 0 {
+		panic("Class() called with an empty class")
+	}
+	cgb.openRule.rhs = append(cgb.openRule.rhs, charSymbol{ranges: ranges})
+	return cgb
+}
+
+func (cgb *characterGrammarBuilder) Literal(s string) CharacterGrammarBuilder {
+	if cgb.openRule == nil {
+		panic("Literal() called before Rule()")
+	}
+	if s == "" {
+		panic("Literal() called with an empty string")
+	}
+	for _, c := range s {
+		cgb.openRule.rhs = append(cgb.openRule.rhs, charSymbol{ranges: []*characterRange{&characterRange{c, c}}})
+	}
+	return cgb
+}
+
+// Follow discards the derivations of nt followed by a rune of cc.
+func (cgb *characterGrammarBuilder) Follow(nt string, cc CharacterClass) CharacterGrammarBuilder {
+	cgb.follows[nt] = normalizeIntervals(append(cgb.follows[nt], charIntervals(cc)...))
+	for _, r := range cgb.follows[nt] {
+		if r.greatest < 0 {
+			r.greatest = utf8.MaxRune
+		}
+	}
+	return cgb
+}
+
+// Reject discards the derivations of nt deriving exactly literal.
+func (cgb *characterGrammarBuilder) Reject(nt string, literal string) CharacterGrammarBuilder {
+	if _, has := cgb.rejects[nt]; !has {
+		cgb.rejects[nt] = make(map[string]bool)
+	}
+	cgb.rejects[nt][literal] = true
+	return cgb
+}
+
+func (cgb *characterGrammarBuilder) Build() (CharacterGrammar, error) {
+	if len(cgb.rules) == 0 {
+		return nil, errors.New("character grammar has no rules")
+	}
+	defined := make(map[string]bool)
+	for _, r := range cgb.rules {
+		if strings.HasPrefix(r.lhs, "cc-") {
+			return nil, errors.New("nonterminal name '" + r.lhs + "' is reserved for character classes")
+		}
+		defined[r.lhs] = true
+	}
+	for _, r := range cgb.rules {
+		if len(r.rhs) == 0 {
+			return nil, errors.New("rule for '" + r.lhs + "' derives no input")
+		}
+		for _, sym := range r.rhs {
+			if sym.nt != "" && !defined[sym.nt] {
+				return nil, errors.New("rule for '" + r.lhs + "' refers to undefined nonterminal '" + sym.nt + "'")
+			}
+		}
+	}
+	for nt, _ := range cgb.follows {
+		if !defined[nt] {
+			return nil, errors.New("follow restriction on undefined nonterminal '" + nt + "'")
+		}
+	}
+	for nt, _ := range cgb.rejects {
+		if !defined[nt] {
+			return nil, errors.New("reject restriction on undefined nonterminal '" + nt + "'")
+		}
+	}
+
+	// Split the runes of the classes into the intervals between bounds.
+	var points []int64
+	for _, r := range cgb.rules {
+		for _, sym := range r.rhs {
+			for _, cr := range sym.ranges {
+				points = append(points, int64(cr.least), int64(cr.greatest)+1)
+			}
+		}
+	}
+	sort.Slice(points, func(a, b int) bool { return points[a] < points[b] })
+	var bounds []rune
+	for i, p := range points {
+		if i == 0 || p != points[i-1] {
+			bounds = append(bounds, rune(p))
+		}
+	}
+	// Interval k holds the runes bounds[k]..bounds[k+1]-1; used[k] when a
+	// class includes it.
+	used := make([]bool, len(bounds))
+	intervalsOf := func(ranges []*characterRange) []int {
+		var res []int
+		for _, cr := range ranges {
+			k := sort.Search(len(bounds), func(i int) bool { return bounds[i] > cr.least }) - 1
+			for ; k+1 < len(bounds) && bounds[k+1]-1 <= cr.greatest; k++ {
+				res = append(res, k)
+			}
+		}
+		return res
+	}
+	for _, r := range cgb.rules {
+		for _, sym := range r.rhs {
+			for _, k := range intervalsOf(sym.ranges) {
+				used[k] = true
+			}
+		}
+	}
+	termName := func(k int) string {
+		lo, hi := bounds[k], bounds[k+1]-1
+		if lo == hi {
+			return fmt.Sprintf("C-%X", lo)
+		}
+		return fmt.Sprintf("C-%X-%X", lo, hi)
+	}
+
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("`*").Nonterminal(cgb.rules[0].lhs).Terminal("`.")
+	classNames := make(map[string]string)
+	var classRules [][]int
+	for _, r := range cgb.rules {
+		gb.Rule(r.lhs)
+		for _, sym := range r.rhs {
+			if sym.nt != "" {
+				gb.Nonterminal(sym.nt)
+				continue
+			}
+			ks := intervalsOf(sym.ranges)
+			if len(ks) == 1 {
+				gb.Terminal(termName(ks[0]))
+				continue
+			}
+			key := fmt.Sprint(ks)
+			name, has := classNames[key]
+			if !has {
+				name = fmt.Sprintf("cc-%d", len(classNames))
+				classNames[key] = name
+				classRules = append(classRules, ks)
+			}
+			gb.Nonterminal(name)
+		}
+	}
+	for i, ks := range classRules {
+		for _, k := range ks {
+			gb.Rule(fmt.Sprintf("cc-%d", i)).Terminal(termName(k))
+		}
+	}
+	g, err := gb.Build()
+	if err != nil {
+		return nil, err
+	}
+	ig := parser.GetIndexedGrammar(g)
+	tiIf, err := ig.GetIndex(parser.GrammarIndexTypeTerm)
+	if err != nil {
+		return nil, err
+	}
+	termIndex := tiIf.(parser.TermGrammarIndex)
+	cg := &stdCharacterGrammar{
+		grammar: g,
+		bounds: bounds,
+		terms: make([]parser.Term, len(bounds)),
+		follows: make(map[uint32][]*characterRange),
+		rejects: make(map[uint32]map[string]bool),
+	}
+	for k, u := range used {
+		if u {
+			if cg.terms[k], err = termIndex.GetTerminal(termName(k)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for nt, ranges := range cgb.follows {
+		t, err := termIndex.GetNonterminal(nt)
+		if err != nil {
+			return nil, err
+		}
+		cg.follows[t.Id()] = ranges
+	}
+	for nt, words := range cgb.rejects {
+		t, err := termIndex.GetNonterminal(nt)
+		if err != nil {
+			return nil, err
+		}
+		cg.rejects[t.Id()] = words
+	}
+	return cg, nil
+}
+
+func (cgb *characterGrammarBuilder) MustBuild() CharacterGrammar {
+	cg, err := cgb.Build()
+	if err != nil {
+		panic(err.Error())
+	}
+	return cg
+}
+
+func (cg *stdCharacterGrammar) Grammar() parser.Grammar {
+	return cg.grammar
+}
+
+func (cg *stdCharacterGrammar) Terminal(c rune) (parser.Term, bool) {
+	k := sort.Search(len(cg.bounds), func(i int) bool { return cg.bounds[i] > c }) - 1
+	if k < 0 || cg.terms[k] == nil {
+		return nil, false
+	}
+	return cg.terms[k], true
+}
+
+func (cg *stdCharacterGrammar) CompletionFilter() parser.CompletionFilter {
+	return cg
+}
+
+// Reject applies the follow and reject restrictions on the nonterminal of
+// rule.
+func (cg *stdCharacterGrammar) Reject(rule parser.ProductionRule, tokens []parser.Token, next parser.Token) bool {
+	id := rule.Lhs().Id()
+	if ranges, has := cg.follows[id]; has && next != nil && next.Literal() != "" {
+		c, _ := utf8.DecodeRuneInString(next.Literal())
+		for _, cr := range ranges {
+			if c >= cr.least && c <= cr.greatest {
+				return true
+			}
+		}
+	}
+	if words, has := cg.rejects[id]; has {
+		var buf strings.Builder
+		for _, tok := range tokens {
+			buf.WriteString(tok.Literal())
+		}
+		return words[buf.String()]
+	}
+	return false
+}
+
+func (rl *runeLexer) Grammar() parser.Grammar {
+	return rl.grammar.Grammar()
+}
+
+func (rl *runeLexer) Open(in io.Reader) (parser.LexerState, error) {
+	var reader *bufio.Reader
+	if br, ok := in.(*bufio.Reader); ok {
+		reader = br
+	} else {
+		reader = bufio.NewReader(in)
+	}
+	return &runeLexerState{
+		lexer: rl,
+		in: reader,
+		line: 1,
+		column: 1,
+	}, nil
+}
+
+func (rs *runeLexerState) Lexer() parser.Lexer {
+	return rs.lexer
+}
+
+func (rs *runeLexerState) Reader() io.Reader {
+	return rs.in
+}
+
+func (rs *runeLexerState) readToken() (bool, error) {
+	if rs.ended {
+		return false, nil
+	}
+	tok := &runeToken{
+		state: rs,
+		fpos: rs.position,
+		fline: rs.line,
+		fcol: rs.column,
+	}
+	c, n, err := rs.in.ReadRune()
+	if err == io.EOF {
+		rs.ended = true
+		tok.lpos, tok.lline, tok.lcol = rs.position, rs.line, rs.column
+		tok.terminal = rs.lexer.grammar.Grammar().Bottom()
+		rs.hasToken, rs.nextToken = true, tok
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	term, ok := rs.lexer.grammar.Terminal(c)
+	if !ok {
+		return false, errors.New(fmt.Sprintf("rune %q at %d:%d(%d) is in no character class of the grammar", c, rs.line, rs.column, rs.position))
+	}
+	rs.position += n
+	if c == '\n' {
+		rs.line++
+		rs.column = 1
+	} else {
+		rs.column++
+	}
+	tok.lpos, tok.lline, tok.lcol = rs.position, rs.line, rs.column
+	tok.terminal = term
+	tok.literal = string(c)
+	rs.hasToken, rs.nextToken = true, tok
+	return true, nil
+}
+
+func (rs *runeLexerState) HasMoreTokens() (bool, error) {
+	if rs.hasToken {
+		return true, nil
+	}
+	return rs.readToken()
+}
+
+func (rs *runeLexerState) NextToken() (parser.Token, error) {
+	if !rs.hasToken {
+		more, err := rs.readToken()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return nil, io.EOF
+		}
+	}
+	rs.hasToken = false
+	return rs.nextToken, nil
+}
+
+func (rs *runeLexerState) CurrentLine() int {
+	return rs.line
+}
+
+func (rs *runeLexerState) CurrentColumn() int {
+	return rs.column
+}
+
+func (rs *runeLexerState) CurrentPosition() int {
+	return rs.position
+}
+
+func (rt *runeToken) LexerState() parser.LexerState {
+	return rt.state
+}
+
+func (rt *runeToken) FirstPosition() int {
+	return rt.fpos
+}
+
+func (rt *runeToken) LastPosition() int {
+	return rt.lpos
+}
+
+func (rt *runeToken) FirstLine() int {
+	return rt.fline
+}
+
+func (rt *runeToken) LastLine() int {
+	return rt.lline
+}
+
+func (rt *runeToken) FirstColumn() int {
+	return rt.fcol
+}
+
+func (rt *runeToken) LastColumn() int {
+	return rt.lcol
+}
+
+func (rt *runeToken) Terminal() parser.Term {
+	return rt.terminal
+}
+
+func (rt *runeToken) Literal() string {
+	return rt.literal
+}
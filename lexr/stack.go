@@ -0,0 +1,72 @@
+package lexr
+
+// BlockAction is what accepting a termdef does to the block stack of a lexer
+// state.
+type BlockAction uint8
+const (
+	// BlockForward continues in the termdef's next block.
+	BlockForward BlockAction = iota
+	// BlockPush pushes the block the token was read in and continues in the
+	// termdef's next block.
+	BlockPush
+	// BlockPop continues in the block on top of the stack and removes it.
+	// Popping an empty stack fails the lex.
+	BlockPop
+)
+
+// BlockStackState is implemented by the lexer states of lexers created by
+// CreateLexrLexer and LoadLexrLexer.  CurrentBlock is the index of the domain
+// block the next token is read in, and BlockStack holds the indices of the
+// blocks pushed and not yet popped, innermost last.
+type BlockStackState interface {
+	CurrentBlock() int
+	BlockStack() []int
+}
+
+func (ls *lexrState) CurrentBlock() int {
+	return ls.lexer.blockIndex(ls.dfaState)
+}
+
+func (ls *lexrState) BlockStack() []int {
+	stack := make([]int, len(ls.stack))
+	copy(stack, ls.stack)
+	return stack
+}
+
+// blockIndex returns the index of the block DFA holding dn.
+func (ll *lexrLexer) blockIndex(dn DfaNode) int {
+	for i, dfa := range ll.dfas {
+		if dfa == dn.Dfa() {
+			return i
+		}
+	}
+	return -1
+}
+
+// acceptNext returns the state following the accepting state dn, or the
+// alternative alt accepted by dn when it is not nil, applying the block action
+// to the stack.  It fails when the action pops an empty stack.
+func (ls *lexrState) acceptNext(dn DfaNode, alt *acceptAlt) (DfaNode, bool) {
+	next, _ := dn.AcceptTermNext()
+	sdn, ok := dn.(*stdDfaNode)
+	if !ok {
+		return next, true
+	}
+	action := sdn.acceptAction
+	if alt != nil {
+		next, action = alt.next, alt.action
+	}
+	switch(action) {
+		case BlockPush: {
+			ls.stack = append(ls.stack, ls.lexer.blockIndex(dn))
+		}
+		case BlockPop: {
+			if len(ls.stack) == 0 {
+				return nil, false
+			}
+			next = ls.lexer.dfas[ls.stack[len(ls.stack)-1]].State(0)
+			ls.stack = ls.stack[:len(ls.stack)-1]
+		}
+	}
+	return next, true
+}
@@ -0,0 +1,545 @@
+package lexr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dtromb/parser"
+)
+
+// Compiled lexer tables use the same framing as the parser package: a magic,
+// a uvarint version and the parser.GrammarFingerprint of the lexer grammar,
+// followed by the block DFAs.  Each DFA has its number of states and capture
+// group tags, and when it has tags the tag operations entering its initial
+// state.  Each DFA state lists its character ranges (varint bounds, uvarint
+// target state + 1 or 0 for no transition), its context transitions (a
+// uvarint count of context, target state pairs) and its accept term id + 1
+// (0 when not accepting) with its block action, its alternative accepted
+// termdefs (a uvarint count of term id, block action, accept-next dfa and
+// state) and the accept-next dfa and state.  In a DFA with tags each
+// transition is followed by its tag operations, and the block action and each
+// alternative by the NDFA node holding its tags and its group names.
+
+const (
+	lexrTableMagic = "LXRT"
+	lexrTableVersion = 5
+)
+
+// LoadLexrLexer creates a lexer for g from tables previously produced by
+// MarshalBinary on a lexer returned by CreateLexrLexer.
+func LoadLexrLexer(g parser.Grammar, data []byte) (parser.Lexer, error) {
+	ll := &lexrLexer{grammar: g}
+	if err := ll.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return ll, nil
+}
+
+// appendTagOps appends a uvarint count of operations, each a uvarint source
+// + 1 and a uvarint count of tags followed by the tags.
+func appendTagOps(buf []byte, ops []tagOp) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(ops)))
+	for _, op := range ops {
+		buf = binary.AppendUvarint(buf, uint64(op.src + 1))
+		buf = binary.AppendUvarint(buf, uint64(len(op.set)))
+		for _, t := range op.set {
+			buf = binary.AppendUvarint(buf, uint64(t))
+		}
+	}
+	return buf
+}
+
+// appendAcceptGroups appends a uvarint tag slot and a uvarint count of group
+// names, each a uvarint length followed by the name.
+func appendAcceptGroups(buf []byte, slot int, groups []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(slot))
+	buf = binary.AppendUvarint(buf, uint64(len(groups)))
+	for _, name := range groups {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+	return buf
+}
+
+func (ll *lexrLexer) MarshalBinary() ([]byte, error) {
+	dfaIndex := make(map[*stdDfa]int)
+	for i, dfa := range ll.dfas {
+		sdfa, ok := dfa.(*stdDfa)
+		if !ok {
+			return nil, errors.New("lexer dfa was not a *stdDfa")
+		}
+		dfaIndex[sdfa] = i
+	}
+	fp := parser.GrammarFingerprint(ll.grammar)
+	buf := []byte(lexrTableMagic)
+	buf = binary.AppendUvarint(buf, lexrTableVersion)
+	buf = append(buf, fp[:]...)
+	buf = binary.AppendUvarint(buf, uint64(len(ll.dfas)))
+	for _, dfa := range ll.dfas {
+		sdfa := dfa.(*stdDfa)
+		buf = binary.AppendUvarint(buf, uint64(len(sdfa.nodes)))
+		buf = binary.AppendUvarint(buf, uint64(sdfa.numTags))
+		if sdfa.numTags > 0 {
+			buf = appendTagOps(buf, sdfa.entryTagOps)
+		}
+		for _, dn := range sdfa.nodes {
+			buf = binary.AppendUvarint(buf, uint64(len(dn.ranges)))
+			for i, r := range dn.ranges {
+				buf = binary.AppendVarint(buf, int64(r.Least()))
+				buf = binary.AppendVarint(buf, int64(r.Greatest()))
+				if dn.transitions[i] == nil {
+					buf = binary.AppendUvarint(buf, 0)
+				} else {
+					buf = binary.AppendUvarint(buf, uint64(dn.transitions[i].index - sdfa.nodes[0].index + 1))
+				}
+				if sdfa.numTags > 0 {
+					buf = appendTagOps(buf, dn.tagOps[i])
+				}
+			}
+			numContexts := 0
+			for _, nxt := range dn.contexts {
+				if nxt != nil {
+					numContexts++
+				}
+			}
+			buf = binary.AppendUvarint(buf, uint64(numContexts))
+			for ctx, nxt := range dn.contexts {
+				if nxt != nil {
+					buf = binary.AppendUvarint(buf, uint64(ctx))
+					buf = binary.AppendUvarint(buf, uint64(nxt.index - sdfa.nodes[0].index))
+					if sdfa.numTags > 0 {
+						buf = appendTagOps(buf, dn.contextTagOps[ctx])
+					}
+				}
+			}
+			if dn.acceptTerm == nil {
+				buf = binary.AppendUvarint(buf, 0)
+				continue
+			}
+			buf = binary.AppendUvarint(buf, uint64(dn.acceptTerm.Id()) + 1)
+			buf = binary.AppendUvarint(buf, uint64(dn.acceptAction))
+			if sdfa.numTags > 0 {
+				buf = appendAcceptGroups(buf, dn.acceptSlot, dn.acceptGroups)
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(dn.acceptAlts)))
+			for _, alt := range dn.acceptAlts {
+				altDfa, has := dfaIndex[alt.next.dfa]
+				if !has {
+					return nil, errors.New("accept-next state is not in a lexer dfa")
+				}
+				buf = binary.AppendUvarint(buf, uint64(alt.term.Id()))
+				buf = binary.AppendUvarint(buf, uint64(alt.action))
+				buf = binary.AppendUvarint(buf, uint64(altDfa))
+				buf = binary.AppendUvarint(buf, uint64(alt.next.index - alt.next.dfa.nodes[0].index))
+				if sdfa.numTags > 0 {
+					buf = appendAcceptGroups(buf, alt.slot, alt.groups)
+				}
+			}
+			if dn.acceptNext == nil {
+				buf = binary.AppendUvarint(buf, 0)
+				continue
+			}
+			nextDfa, has := dfaIndex[dn.acceptNext.dfa]
+			if !has {
+				return nil, errors.New("accept-next state is not in a lexer dfa")
+			}
+			buf = binary.AppendUvarint(buf, uint64(nextDfa + 1))
+			buf = binary.AppendUvarint(buf, uint64(dn.acceptNext.index - dn.acceptNext.dfa.nodes[0].index))
+		}
+	}
+	return buf, nil
+}
+
+func (ll *lexrLexer) UnmarshalBinary(data []byte) error {
+	if ll.grammar == nil {
+		return errors.New("lexer tables must be loaded against a grammar")
+	}
+	if len(data) < len(lexrTableMagic) || string(data[:len(lexrTableMagic)]) != lexrTableMagic {
+		return errors.New("not a lexer table encoding")
+	}
+	in := bytes.NewReader(data[len(lexrTableMagic):])
+	readUint := func() (int, error) {
+		v, err := binary.ReadUvarint(in)
+		if err != nil {
+			return 0, errors.New("lexer tables: truncated data")
+		}
+		if v > uint64(^uint32(0)) {
+			return 0, errors.New(fmt.Sprintf("lexer tables: value %d out of range", v))
+		}
+		return int(v), nil
+	}
+	// Each element of an encoded sequence takes at least one byte, so a
+	// count beyond the remaining data is corrupt and must not be allocated.
+	readCount := func() (int, error) {
+		n, err := readUint()
+		if err != nil {
+			return 0, err
+		}
+		if n > in.Len() {
+			return 0, errors.New(fmt.Sprintf("lexer tables: count %d exceeds remaining data", n))
+		}
+		return n, nil
+	}
+	readRune := func() (rune, error) {
+		v, err := binary.ReadVarint(in)
+		if err != nil {
+			return 0, errors.New("lexer tables: truncated data")
+		}
+		return rune(v), nil
+	}
+	readTagOps := func(numTags int) ([]tagOp, error) {
+		numOps, err := readCount()
+		if err != nil {
+			return nil, err
+		}
+		ops := make([]tagOp, numOps)
+		for i, _ := range ops {
+			src, err := readUint()
+			if err != nil {
+				return nil, err
+			}
+			numSet, err := readUint()
+			if err != nil {
+				return nil, err
+			}
+			ops[i].src = src - 1
+			for j := 0; j < numSet; j++ {
+				t, err := readUint()
+				if err != nil {
+					return nil, err
+				}
+				if t >= numTags {
+					return nil, errors.New(fmt.Sprintf("lexer tables: unknown tag %d", t))
+				}
+				ops[i].set = append(ops[i].set, t)
+			}
+		}
+		return ops, nil
+	}
+	readAcceptGroups := func(numTags int) (int, []string, error) {
+		slot, err := readUint()
+		if err != nil {
+			return 0, nil, err
+		}
+		numGroups, err := readUint()
+		if err != nil {
+			return 0, nil, err
+		}
+		if 2*numGroups > numTags {
+			return 0, nil, errors.New(fmt.Sprintf("lexer tables: %d groups with %d tags", numGroups, numTags))
+		}
+		var groups []string
+		for k := 0; k < numGroups; k++ {
+			n, err := readCount()
+			if err != nil {
+				return 0, nil, err
+			}
+			name := make([]byte, n)
+			if m, _ := in.Read(name); m != n {
+				return 0, nil, errors.New("lexer tables: truncated data")
+			}
+			groups = append(groups, string(name))
+		}
+		return slot, groups, nil
+	}
+	version, err := readUint()
+	if err != nil {
+		return err
+	}
+	if version != lexrTableVersion {
+		return errors.New(fmt.Sprintf("lexer tables: unsupported version %d", version))
+	}
+	var fp [32]byte
+	if n, _ := in.Read(fp[:]); n != len(fp) {
+		return errors.New("lexer tables: truncated header")
+	}
+	if fp != parser.GrammarFingerprint(ll.grammar) {
+		return errors.New("lexer tables were generated from a different grammar")
+	}
+	terms := make(map[uint32]parser.Term)
+	g := ll.grammar
+	terms[g.Epsilon().Id()] = g.Epsilon()
+	for i := 0; i < g.NumTerminal(); i++ {
+		terms[g.Terminal(i).Id()] = g.Terminal(i)
+	}
+	numDfas, err := readCount()
+	if err != nil {
+		return err
+	}
+	type acceptNextRef struct {
+		node *stdDfaNode
+		alt *acceptAlt
+		dfa int
+		state int
+	}
+	var nextRefs []acceptNextRef
+	dfas := make([]*stdDfa, numDfas)
+	offset := 0
+	for i := 0; i < numDfas; i++ {
+		numStates, err := readCount()
+		if err != nil {
+			return err
+		}
+		numTags, err := readCount()
+		if err != nil {
+			return err
+		}
+		dfa := &stdDfa{nodes: make([]*stdDfaNode, numStates), numTags: numTags}
+		if numTags > 0 {
+			if dfa.entryTagOps, err = readTagOps(numTags); err != nil {
+				return err
+			}
+		}
+		for j := 0; j < numStates; j++ {
+			dfa.nodes[j] = &stdDfaNode{
+				dfa: dfa,
+				index: j + offset,
+				transitionIndex: make(map[uint64]*stdDfaNode),
+			}
+		}
+		for _, dn := range dfa.nodes {
+			numRanges, err := readCount()
+			if err != nil {
+				return err
+			}
+			dn.ranges = make([]CharacterRange, numRanges)
+			dn.rangeRights = make([]int, numRanges)
+			dn.transitions = make([]*stdDfaNode, numRanges)
+			for k := 0; k < numRanges; k++ {
+				least, err := readRune()
+				if err != nil {
+					return err
+				}
+				greatest, err := readRune()
+				if err != nil {
+					return err
+				}
+				target, err := readUint()
+				if err != nil {
+					return err
+				}
+				if target > numStates {
+					return errors.New(fmt.Sprintf("lexer tables: transition to unknown state %d", target-1))
+				}
+				r := &characterRange{least, greatest}
+				dn.ranges[k] = r
+				dn.rangeRights[k] = int(greatest)
+				if target > 0 {
+					dn.transitions[k] = dfa.nodes[target-1]
+				}
+				dn.transitionIndex[r.Hash()] = dn.transitions[k]
+				if numTags > 0 {
+					ops, err := readTagOps(numTags)
+					if err != nil {
+						return err
+					}
+					dn.tagOps = append(dn.tagOps, ops)
+				}
+			}
+			numContexts, err := readUint()
+			if err != nil {
+				return err
+			}
+			for k := 0; k < numContexts; k++ {
+				ctx, err := readUint()
+				if err != nil {
+					return err
+				}
+				target, err := readUint()
+				if err != nil {
+					return err
+				}
+				if ctx >= NumContexts || target >= numStates {
+					return errors.New(fmt.Sprintf("lexer tables: bad context transition %d to state %d", ctx, target))
+				}
+				if dn.contexts == nil {
+					dn.contexts = make([]*stdDfaNode, NumContexts)
+				}
+				dn.contexts[ctx] = dfa.nodes[target]
+				if numTags > 0 {
+					if dn.contextTagOps == nil {
+						dn.contextTagOps = make([][]tagOp, NumContexts)
+					}
+					if dn.contextTagOps[ctx], err = readTagOps(numTags); err != nil {
+						return err
+					}
+				}
+			}
+			termId, err := readUint()
+			if err != nil {
+				return err
+			}
+			if termId == 0 {
+				continue
+			}
+			term, has := terms[uint32(termId-1)]
+			if !has {
+				return errors.New(fmt.Sprintf("lexer tables: unknown accept term %d", termId-1))
+			}
+			dn.acceptTerm = term
+			action, err := readUint()
+			if err != nil {
+				return err
+			}
+			if action > int(BlockPop) {
+				return errors.New(fmt.Sprintf("lexer tables: unknown block action %d", action))
+			}
+			dn.acceptAction = BlockAction(action)
+			if numTags > 0 {
+				if dn.acceptSlot, dn.acceptGroups, err = readAcceptGroups(numTags); err != nil {
+					return err
+				}
+			}
+			numAlts, err := readUint()
+			if err != nil {
+				return err
+			}
+			for k := 0; k < numAlts; k++ {
+				altId, err := readUint()
+				if err != nil {
+					return err
+				}
+				altTerm, has := terms[uint32(altId)]
+				if !has {
+					return errors.New(fmt.Sprintf("lexer tables: unknown accept term %d", altId))
+				}
+				altAction, err := readUint()
+				if err != nil {
+					return err
+				}
+				if altAction > int(BlockPop) {
+					return errors.New(fmt.Sprintf("lexer tables: unknown block action %d", altAction))
+				}
+				alt := &acceptAlt{term: altTerm, action: BlockAction(altAction)}
+				altDfa, err := readUint()
+				if err != nil {
+					return err
+				}
+				altState, err := readUint()
+				if err != nil {
+					return err
+				}
+				if numTags > 0 {
+					if alt.slot, alt.groups, err = readAcceptGroups(numTags); err != nil {
+						return err
+					}
+				}
+				dn.acceptAlts = append(dn.acceptAlts, alt)
+				nextRefs = append(nextRefs, acceptNextRef{alt: alt, dfa: altDfa, state: altState})
+			}
+			nextDfa, err := readUint()
+			if err != nil {
+				return err
+			}
+			if nextDfa == 0 {
+				continue
+			}
+			nextState, err := readUint()
+			if err != nil {
+				return err
+			}
+			nextRefs = append(nextRefs, acceptNextRef{node: dn, dfa: nextDfa-1, state: nextState})
+		}
+		dfas[i] = dfa
+		offset += numStates
+	}
+	if in.Len() > 0 {
+		return errors.New("lexer tables: trailing data")
+	}
+	for _, ref := range nextRefs {
+		if ref.dfa >= len(dfas) || ref.state >= len(dfas[ref.dfa].nodes) {
+			return errors.New(fmt.Sprintf("lexer tables: unknown accept-next state %d/%d", ref.dfa, ref.state))
+		}
+		if ref.alt != nil {
+			ref.alt.next = dfas[ref.dfa].nodes[ref.state]
+		} else {
+			ref.node.acceptNext = dfas[ref.dfa].nodes[ref.state]
+		}
+	}
+	if len(dfas) == 0 {
+		return errors.New("lexer tables contain no dfas")
+	}
+	ll.dfas = make([]Dfa, len(dfas))
+	for i, dfa := range dfas {
+		ll.dfas[i] = dfa
+	}
+	return nil
+}
+
+// LexrTables is the exported form of the DFAs driving a lexer created by
+// CreateLexrLexer or LoadLexrLexer, for use by code generators.  Capture
+// group tags are not exported.  States are
+// indexed locally within their block DFA; the lexer starts in state 0 of
+// the first DFA.
+type LexrTables struct {
+	Dfas [][]LexrTableState
+}
+
+// Contexts holds the local state entered on each Context before the next rune
+// is read, or -1 to stay; it is nil when the state has no context transitions.
+// AcceptAction is the block stack action of an accepting state; a popping
+// state's accept-next DFA is its own.
+type LexrTableState struct {
+	Ranges []LexrTableRange
+	Contexts []int
+	Accepting bool
+	AcceptTerm uint32
+	AcceptAction BlockAction
+	AcceptNextDfa int
+	AcceptNextState int
+}
+
+// LexrTableRange maps the runes Least..Greatest to the local state Next, or
+// to no transition when Next is negative.
+type LexrTableRange struct {
+	Least rune
+	Greatest rune
+	Next int
+}
+
+func GetLexrTables(l parser.Lexer) (*LexrTables, error) {
+	ll, ok := l.(*lexrLexer)
+	if !ok {
+		return nil, errors.New("lexer was not created by CreateLexrLexer")
+	}
+	dfaIndex := make(map[*stdDfa]int)
+	for i, dfa := range ll.dfas {
+		dfaIndex[dfa.(*stdDfa)] = i
+	}
+	tables := &LexrTables{Dfas: make([][]LexrTableState, len(ll.dfas))}
+	for i, dfa := range ll.dfas {
+		sdfa := dfa.(*stdDfa)
+		tables.Dfas[i] = make([]LexrTableState, len(sdfa.nodes))
+		for j, dn := range sdfa.nodes {
+			st := &tables.Dfas[i][j]
+			st.Ranges = make([]LexrTableRange, len(dn.ranges))
+			for k, r := range dn.ranges {
+				st.Ranges[k] = LexrTableRange{Least: r.Least(), Greatest: r.Greatest(), Next: -1}
+				if dn.transitions[k] != nil {
+					st.Ranges[k].Next = dn.transitions[k].index - sdfa.nodes[0].index
+				}
+			}
+			if dn.contexts != nil {
+				st.Contexts = make([]int, NumContexts)
+				for ctx, nxt := range dn.contexts {
+					st.Contexts[ctx] = -1
+					if nxt != nil {
+						st.Contexts[ctx] = nxt.index - sdfa.nodes[0].index
+					}
+				}
+			}
+			st.AcceptNextDfa, st.AcceptNextState = -1, -1
+			if dn.acceptTerm != nil {
+				st.Accepting = true
+				st.AcceptTerm = dn.acceptTerm.Id()
+				st.AcceptAction = dn.acceptAction
+				if dn.acceptNext != nil {
+					st.AcceptNextDfa = dfaIndex[dn.acceptNext.dfa]
+					st.AcceptNextState = dn.acceptNext.index - dn.acceptNext.dfa.nodes[0].index
+				}
+			}
+		}
+	}
+	return tables, nil
+}
@@ -0,0 +1,427 @@
+package lexr
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"github.com/dtromb/parser"
+)
+
+// Token is implemented by the tokens of lexers created by CreateLexrLexer
+// and LoadLexrLexer.  The groups of a token are the capture groups of the
+// expression which matched it, numbered from 1; group 0 is the whole token.
+// A group which took no part in the match is empty, with the span -1, -1.
+// When a group could have matched in more than one way, it reports one of
+// them.
+type Token interface {
+	parser.Token
+	NumGroups() int
+	GroupName(i int) string
+	Group(i int) string
+	GroupSpan(i int) (first int, last int)
+}
+
+type submatchExpression struct {
+	name string
+	expr Expression
+}
+
+// SubmatchExpression matches the input matched by expr, capturing it as the
+// group name of the tokens it matches.
+func SubmatchExpression(name string, expr Expression) Expression {
+	return &submatchExpression{
+		name: name,
+		expr: expr,
+	}
+}
+
+func (se *submatchExpression) Type() ExpressionType {
+	return MatchSubmatch
+}
+
+func (se *submatchExpression) TestMatch(str string) (bool, []int) {
+	return se.expr.TestMatch(str)
+}
+
+// GenerateNdfaNodes encloses the subexpression between an initial node which
+// takes the group's opening tag and an accepting node which takes its closing
+// tag.
+func (se *submatchExpression) GenerateNdfaNodes(firstId uint32) ([]NdfaNode,int) {
+	gen, ok := se.expr.(NdfaNodeGenerator)
+	if !ok {
+		panic("submatch subexpression type "+reflect.TypeOf(se.expr).String()+" does not receive NdfaNodeGenerator")
+	}
+	s := newExpressionNdfaNode(firstId)
+	s.initial = true
+	s.group = se
+	work, accCount := gen.GenerateNdfaNodes(firstId+1)
+	init, ok := work[0].(*expressionNdfaNode)
+	if !ok {
+		panic("submatch subexpression node was not an *expressionNdfaNode")
+	}
+	init.initial = false
+	s.epsilons = append(s.epsilons, init)
+	r := newExpressionNdfaNode(work[len(work)-1].Id()+1)
+	r.accepting = true
+	r.group = se
+	r.groupEnd = true
+	for i := len(work)-accCount; i < len(work); i++ {
+		acc, ok := work[i].(*expressionNdfaNode)
+		if !ok {
+			panic("submatch subexpression node was not an *expressionNdfaNode")
+		}
+		acc.accepting = false
+		acc.epsilons = append(acc.epsilons, r)
+	}
+	res := append([]NdfaNode{s}, work...)
+	return append(res, r), 1
+}
+
+// expressionGroups returns the capture groups of expr in the order of their
+// opening parentheses.
+func expressionGroups(expr Expression) []*submatchExpression {
+	var groups []*submatchExpression
+	seen := make(map[*submatchExpression]bool)
+	var walk func(e Expression)
+	walk = func(e Expression) {
+		switch(e.Type()) {
+			case MatchSubmatch: {
+				se := e.(*submatchExpression)
+				if !seen[se] {
+					seen[se] = true
+					groups = append(groups, se)
+				}
+				walk(se.expr)
+			}
+			case MatchSequence: {
+				for _, sub := range e.(*sequenceExpression).exprs {
+					walk(sub)
+				}
+			}
+			case MatchAlternation: {
+				for _, sub := range e.(*alternationExpression).exprs {
+					walk(sub)
+				}
+			}
+			case MatchStar: walk(e.(*starExpression).expr)
+			case MatchPlus: walk(e.(*plusExpression).expr)
+			case MatchQuantified: walk(e.(*quantifiedExpression).expr)
+			case MatchCaseFold: walk(e.(*caseFoldExpression).folded)
+		}
+	}
+	walk(expr)
+	return groups
+}
+
+// A tagOp builds the tag registers of one NDFA node of the DFA state being
+// entered: they are copied from the NDFA node at index src of the state left,
+// or unset if src is negative, and then the tags in set take the current
+// position.  A DFA with tags keeps registers for each NDFA node of its
+// current state, and each transition carries one tagOp for each NDFA node of
+// its target.
+type tagOp struct {
+	src int
+	set []int
+}
+
+func equalTagOps(a, b []tagOp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, op := range a {
+		if op.src != b[i].src || len(op.set) != len(b[i].set) {
+			return false
+		}
+		for j, t := range op.set {
+			if b[i].set[j] != t {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dfaTagger computes the tag operations of a DFA generated from an NDFA with
+// capture groups.  Group g (from 0) of a termdef has the opening tag 2g and
+// the closing tag 2g+1.  When an NDFA node can be reached in more than one
+// way, it takes its registers from the first NDFA node of the state left
+// which reaches it.
+type dfaTagger struct {
+	numTags int
+	groups map[Termdef]map[*submatchExpression]int
+	names map[Termdef][]string
+}
+
+func newDfaTagger(ndfa Ndfa) *dfaTagger {
+	dt := &dfaTagger{
+		groups: make(map[Termdef]map[*submatchExpression]int),
+		names: make(map[Termdef][]string),
+	}
+	for i := 0; i < ndfa.NumNodes(); i++ {
+		en, ok := ndfa.Node(i).(*expressionNdfaNode)
+		if !ok || en.termdef == nil {
+			continue
+		}
+		if _, has := dt.groups[en.termdef]; has {
+			continue
+		}
+		index := make(map[*submatchExpression]int)
+		var names []string
+		for g, se := range expressionGroups(en.termdef.Expression()) {
+			index[se] = g
+			names = append(names, se.name)
+		}
+		dt.groups[en.termdef] = index
+		dt.names[en.termdef] = names
+		if 2*len(names) > dt.numTags {
+			dt.numTags = 2*len(names)
+		}
+	}
+	return dt
+}
+
+func (dt *dfaTagger) withTag(set []int, nn NdfaNode) []int {
+	en, ok := nn.(*expressionNdfaNode)
+	if !ok || en.group == nil || en.termdef == nil {
+		return set
+	}
+	g, has := dt.groups[en.termdef][en.group]
+	if !has {
+		return set
+	}
+	tag := 2*g
+	if en.groupEnd {
+		tag++
+	}
+	res := make([]int, len(set), len(set)+1)
+	copy(res, set)
+	return append(res, tag)
+}
+
+type tagPath struct {
+	node NdfaNode
+	set []int
+}
+
+// assign gives each target NDFA node first reached from the paths in queue
+// the registers of src, following the edges returned by next.
+func (dt *dfaTagger) assign(queue []tagPath, src int, index map[uint32]int, ops []tagOp, done []bool, next func(NdfaNode) []NdfaNode) {
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		j, has := index[p.node.Id()]
+		if !has || done[j] {
+			continue
+		}
+		done[j] = true
+		ops[j] = tagOp{src: src, set: p.set}
+		for _, nn := range next(p.node) {
+			queue = append(queue, tagPath{nn, dt.withTag(p.set, nn)})
+		}
+	}
+}
+
+func newTagOps(to []int) ([]tagOp, map[uint32]int, []bool) {
+	ops := make([]tagOp, len(to))
+	index := make(map[uint32]int)
+	for j, id := range to {
+		ops[j].src = -1
+		index[uint32(id)] = j
+	}
+	return ops, index, make([]bool, len(to))
+}
+
+func epsilonEdges(nn NdfaNode) []NdfaNode {
+	return nn.EpsilonTransitions()
+}
+
+// entryOps returns the operations entering the initial state to of a DFA
+// from its NDFA start node.
+func (dt *dfaTagger) entryOps(start NdfaNode, to []int) []tagOp {
+	ops, index, done := newTagOps(to)
+	dt.assign([]tagPath{{start, dt.withTag(nil, start)}}, -1, index, ops, done, epsilonEdges)
+	return ops
+}
+
+// stepOps returns the operations of the transition on c from the NDFA nodes
+// from to the state to.
+func (dt *dfaTagger) stepOps(from []NdfaNode, c rune, to []int) []tagOp {
+	ops, index, done := newTagOps(to)
+	for i, nn := range from {
+		var queue []tagPath
+		for _, m := range nn.Query(c) {
+			queue = append(queue, tagPath{m, dt.withTag(nil, m)})
+		}
+		dt.assign(queue, i, index, ops, done, epsilonEdges)
+	}
+	return ops
+}
+
+// contextOps returns the operations of the context transition in ctx from
+// the NDFA nodes from to the state to, which keeps the registers of from.
+func (dt *dfaTagger) contextOps(from []NdfaNode, ctx Context, to []int) []tagOp {
+	ops, index, done := newTagOps(to)
+	for i, nn := range from {
+		j := index[nn.Id()]
+		done[j] = true
+		ops[j].src = i
+	}
+	next := func(nn NdfaNode) []NdfaNode {
+		res := nn.EpsilonTransitions()
+		for _, a := range nn.Assertions() {
+			if a.Holds(ctx) {
+				res = append(res, nn.AssertionTransitions(a)...)
+			}
+		}
+		return res
+	}
+	for i, nn := range from {
+		var queue []tagPath
+		for _, m := range next(nn) {
+			queue = append(queue, tagPath{m, dt.withTag(nil, m)})
+		}
+		dt.assign(queue, i, index, ops, done, next)
+	}
+	return ops
+}
+
+// tagDfa adds tag operations to the states of dfa, generated from the NDFA
+// with start node start.  Ranges are split where the operations of their
+// transitions differ.
+func (dt *dfaTagger) tagDfa(dfa *stdDfa, infos []*dfaStateInfo, nodeIndex map[uint32]NdfaNode, start NdfaNode) {
+	dfa.numTags = dt.numTags
+	dfa.entryTagOps = dt.entryOps(start, infos[0].states)
+	local := func(dn *stdDfaNode) int {
+		return dn.index - dfa.nodes[0].index
+	}
+	for i, cn := range dfa.nodes {
+		var from []NdfaNode
+		for _, id := range infos[i].states {
+			from = append(from, nodeIndex[uint32(id)])
+		}
+		boundSet := map[int64]bool{0: true, math.MaxInt32+1: true}
+		for _, nn := range from {
+			for _, c := range nn.Literals() {
+				boundSet[int64(c)] = true
+				boundSet[int64(c)+1] = true
+			}
+			for _, r := range nn.CharacterRanges() {
+				boundSet[int64(r.Least())] = true
+				if r.Greatest() >= 0 {
+					boundSet[int64(r.Greatest())+1] = true
+				}
+			}
+		}
+		for _, r := range cn.ranges {
+			boundSet[int64(r.Least())] = true
+		}
+		var bounds []int64
+		for b, _ := range boundSet {
+			if b >= 0 && b <= math.MaxInt32+1 {
+				bounds = append(bounds, b)
+			}
+		}
+		sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+		var ranges []*characterRange
+		var trs []*stdDfaNode
+		var ops [][]tagOp
+		for k := 0; k < len(bounds)-1; k++ {
+			lo, hi := rune(bounds[k]), rune(bounds[k+1]-1)
+			var nxt *stdDfaNode
+			var nops []tagOp
+			if t, ok := cn.TransitionQuery(lo); ok {
+				nxt = t.(*stdDfaNode)
+				nops = dt.stepOps(from, lo, infos[local(nxt)].states)
+			}
+			if n := len(ranges); n > 0 && trs[n-1] == nxt && equalTagOps(ops[n-1], nops) {
+				ranges[n-1].greatest = hi
+				continue
+			}
+			ranges = append(ranges, &characterRange{lo, hi})
+			trs = append(trs, nxt)
+			ops = append(ops, nops)
+		}
+		cn.rangeRights = make([]int, len(ranges))
+		cn.ranges = make([]CharacterRange, len(ranges))
+		cn.transitions = trs
+		cn.transitionIndex = make(map[uint64]*stdDfaNode)
+		cn.tagOps = ops
+		for j, r := range ranges {
+			cn.ranges[j] = r
+			cn.rangeRights[j] = int(r.greatest)
+			cn.transitionIndex[r.Hash()] = trs[j]
+		}
+		if cn.contexts != nil {
+			cn.contextTagOps = make([][]tagOp, NumContexts)
+			for ctx, t := range cn.contexts {
+				if t != nil {
+					cn.contextTagOps[ctx] = dt.contextOps(from, Context(ctx), infos[local(t)].states)
+				}
+			}
+		}
+		if infos[i].acceptTerm == nil {
+			continue
+		}
+		// Each accepted term takes the tags of its first terminal node.
+		slotted := make(map[parser.Term]bool)
+		for j, nn := range from {
+			dnn, ok := nn.(DomainNdfaNode)
+			if !ok || !nn.IsTerminal() || dnn.IsIgnore() || slotted[dnn.Termdef().Terminal()] {
+				continue
+			}
+			slotted[dnn.Termdef().Terminal()] = true
+			if dnn.Termdef().Terminal() == infos[i].acceptTerm {
+				cn.acceptSlot = j
+				cn.acceptGroups = dt.names[dnn.Termdef()]
+			}
+			for _, alt := range cn.acceptAlts {
+				if dnn.Termdef().Terminal() == alt.term {
+					alt.slot = j
+					alt.groups = dt.names[dnn.Termdef()]
+				}
+			}
+		}
+	}
+}
+
+// transitionTagOps returns the tag operations of the transition on c.
+func (dn *stdDfaNode) transitionTagOps(c rune) []tagOp {
+	if dn.tagOps == nil {
+		return nil
+	}
+	n := sort.Search(len(dn.rangeRights), func(i int) bool {
+		return dn.rangeRights[i] >= int(c)
+	})
+	return dn.tagOps[n]
+}
+
+func (lt *lexrToken) NumGroups() int {
+	return len(lt.groupNames)
+}
+
+func (lt *lexrToken) GroupName(i int) string {
+	if i < 1 || i > len(lt.groupNames) {
+		return ""
+	}
+	return lt.groupNames[i-1]
+}
+
+func (lt *lexrToken) Group(i int) string {
+	if i == 0 {
+		return lt.literal
+	}
+	if i < 1 || i > len(lt.groupNames) || lt.groupSpans[2*i-2] < 0 {
+		return ""
+	}
+	return lt.literal[lt.groupSpans[2*i-2]:lt.groupSpans[2*i-1]]
+}
+
+func (lt *lexrToken) GroupSpan(i int) (int, int) {
+	if i == 0 {
+		return lt.fpos, lt.lpos
+	}
+	if i < 1 || i > len(lt.groupNames) || lt.groupSpans[2*i-2] < 0 {
+		return -1, -1
+	}
+	return lt.fpos + lt.groupSpans[2*i-2], lt.fpos + lt.groupSpans[2*i-1]
+}
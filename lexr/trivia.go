@@ -0,0 +1,85 @@
+package lexr
+
+import (
+	"strings"
+	"github.com/dtromb/parser"
+)
+
+// TriviaLexer is implemented by lexers created by CreateLexrLexer and
+// LoadLexrLexer.  When SetTrivia is on, the states the lexer opens keep the
+// input they ignore as trivia tokens, whose terminal is the grammar's
+// Epsilon() term, and send tokens implementing parser.TriviaToken, so that
+// parser.Unparse reproduces the input of a tree exactly.  Ignored input after
+// the last token is trailing trivia of that token, or leading trivia of the
+// bottom token when the lexer sends one.
+type TriviaLexer interface {
+	SetTrivia(keep bool)
+	Trivia() bool
+}
+
+// lexrTrivia is shared by a token and the copies a pipeline makes of it, as
+// the trailing trivia of a token are only known once the next is read.
+type lexrTrivia struct {
+	leading []parser.Token
+	trailing []parser.Token
+}
+
+func (ll *lexrLexer) SetTrivia(keep bool) {
+	ll.trivia = keep
+}
+
+func (ll *lexrLexer) Trivia() bool {
+	return ll.trivia
+}
+
+func (lt *lexrToken) LeadingTrivia() []parser.Token {
+	if lt.trivia == nil {
+		return nil
+	}
+	return lt.trivia.leading
+}
+
+func (lt *lexrToken) TrailingTrivia() []parser.Token {
+	if lt.trivia == nil {
+		return nil
+	}
+	return lt.trivia.trailing
+}
+
+// ignoreTrivia keeps the input just ignored as a trivia token.
+func (ls *lexrState) ignoreTrivia(fpos, fline, fcol int) {
+	ls.pendingTrivia = append(ls.pendingTrivia, &lexrToken{
+		state: ls,
+		fpos: fpos,
+		lpos: ls.position,
+		fline: fline,
+		lline: ls.line,
+		fcol: fcol,
+		lcol: ls.column,
+		terminal: ls.lexer.grammar.Epsilon(),
+		literal: ls.consumedLiteral(),
+	})
+}
+
+// attachTrivia divides the trivia read since the last token between its
+// trailing trivia and the leading trivia of tok, or gives them all to the last
+// token when tok is nil at the end of the input.
+func (ls *lexrState) attachTrivia(tok *lexrToken) {
+	trivia := ls.pendingTrivia
+	ls.pendingTrivia = nil
+	if prev := ls.lastToken; prev != nil {
+		n := 0
+		for n < len(trivia) && (tok == nil || trivia[n].FirstLine() == prev.lline) {
+			n++
+			if tok != nil && strings.Contains(trivia[n-1].Literal(), "\n") {
+				break
+			}
+		}
+		prev.trivia.trailing = trivia[:n]
+		trivia = trivia[n:]
+	}
+	if tok != nil {
+		tok.trivia = &lexrTrivia{leading: trivia}
+		ls.lastToken = tok
+	}
+}
@@ -1,5 +1,7 @@
 package parser
 
+import "fmt"
+
 type Parser interface {
 	Grammar() Grammar
 	Open(lexState LexerState) (ParserState, error)
@@ -11,6 +13,20 @@ type ParserState interface {
 	Parse() (ParseTreeNode, error)
 }
 
+// A CompletionFilter discards derivations while a parser runs.  Reject is
+// called when rule has derived tokens and next is the token following them,
+// and returns true to discard the derivation.
+type CompletionFilter interface {
+	Reject(rule ProductionRule, tokens []Token, next Token) bool
+}
+
+// FilteringParser is implemented by parsers which consult a CompletionFilter.
+// Parser states use the filter of their parser when they are opened.
+type FilteringParser interface {
+	SetCompletionFilter(filter CompletionFilter)
+	CompletionFilter() CompletionFilter
+}
+
 type ParseTreeNode interface {
 	Parser() Parser
 	Token() Token
@@ -19,3 +35,54 @@ type ParseTreeNode interface {
 	Child(idx int) ParseTreeNode
 	Children() []ParseTreeNode
 }
+
+// ParseError is returned by ParserState.Parse when the input is not in the
+// language of the grammar.  Position is the 1-based index of the offending
+// token; Token is nil if the input ended early.  Expected lists the terminals
+// the parser could have accepted at that point, ordered by id.
+type ParseError struct {
+	Position int
+	Token    Token
+	Expected []Term
+}
+
+func (pe *ParseError) Error() string {
+	var buf []byte
+	if pe.Token == nil {
+		buf = []byte("unexpected end of input")
+	} else {
+		buf = []byte(fmt.Sprintf("parse error at token %d (%s '%s' at %d:%d)", pe.Position,
+			TermToString(pe.Token.Terminal()), pe.Token.Literal(), pe.Token.FirstLine(), pe.Token.FirstColumn()))
+	}
+	if len(pe.Expected) > 0 {
+		buf = append(buf, ", expected "...)
+		for i, t := range pe.Expected {
+			if i > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = append(buf, TermToString(t)...)
+		}
+	}
+	return string(buf)
+}
+
+// AmbiguityError is returned by ParserState.Parse when the input is in the
+// language of the grammar but has more than one derivation of Nonterminal.
+// Rules lists the competing productions if they are known.
+type AmbiguityError struct {
+	Nonterminal Term
+	Rules       []ProductionRule
+}
+
+func (ae *AmbiguityError) Error() string {
+	buf := []byte("ambiguous derivation of " + TermToString(ae.Nonterminal))
+	for i, pr := range ae.Rules {
+		if i == 0 {
+			buf = append(buf, ": "...)
+		} else {
+			buf = append(buf, " | "...)
+		}
+		buf = append(buf, ProductionRuleToString(pr)...)
+	}
+	return string(buf)
+}
@@ -1,7 +1,10 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -73,10 +76,174 @@ func TestParser(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	g2 = g2
+	_ = g2
 	fmt.Println("OK")
 }
 
+// wordLexer lexes space separated names of the terminals of its grammar, and
+// ends the input with a bottom token if bottom is set.
+type wordLexer struct {
+	grammar Grammar
+	bottom  bool
+}
+
+type wordLexerState struct {
+	lexer  *wordLexer
+	in     io.Reader
+	tokens []Token
+}
+
+type wordToken struct {
+	state   *wordLexerState
+	column  int
+	term    Term
+	literal string
+}
+
+func (wl *wordLexer) Grammar() Grammar {
+	return wl.grammar
+}
+
+func (wl *wordLexer) Open(in io.Reader) (LexerState, error) {
+	text, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	ls := &wordLexerState{lexer: wl, in: in}
+	column := 1
+	for _, word := range strings.Split(string(text), " ") {
+		if word != "" {
+			var term Term
+			for i := 0; i < wl.grammar.NumTerminal(); i++ {
+				if wl.grammar.Terminal(i).Name() == word {
+					term = wl.grammar.Terminal(i)
+				}
+			}
+			if term == nil {
+				return nil, errors.New("no terminal " + word)
+			}
+			ls.tokens = append(ls.tokens, &wordToken{state: ls, column: column, term: term, literal: word})
+		}
+		column += len(word) + 1
+	}
+	if wl.bottom {
+		ls.tokens = append(ls.tokens, &wordToken{state: ls, column: len(text) + 1, term: wl.grammar.Bottom()})
+	}
+	return ls, nil
+}
+
+func (ls *wordLexerState) Lexer() Lexer                 { return ls.lexer }
+func (ls *wordLexerState) Reader() io.Reader            { return ls.in }
+func (ls *wordLexerState) HasMoreTokens() (bool, error) { return len(ls.tokens) > 0, nil }
+func (ls *wordLexerState) CurrentLine() int             { return 1 }
+func (ls *wordLexerState) CurrentColumn() int           { return 1 }
+func (ls *wordLexerState) CurrentPosition() int         { return 0 }
+
+func (ls *wordLexerState) NextToken() (Token, error) {
+	if len(ls.tokens) == 0 {
+		return nil, io.EOF
+	}
+	tok := ls.tokens[0]
+	ls.tokens = ls.tokens[1:]
+	return tok, nil
+}
+
+func (wt *wordToken) LexerState() LexerState { return wt.state }
+func (wt *wordToken) FirstPosition() int     { return wt.column - 1 }
+func (wt *wordToken) LastPosition() int      { return wt.column - 1 + len(wt.literal) }
+func (wt *wordToken) FirstLine() int         { return 1 }
+func (wt *wordToken) LastLine() int          { return 1 }
+func (wt *wordToken) FirstColumn() int       { return wt.column }
+func (wt *wordToken) LastColumn() int        { return wt.column + len(wt.literal) }
+func (wt *wordToken) Terminal() Term         { return wt.term }
+func (wt *wordToken) Literal() string        { return wt.literal }
+
+func TestParseError(t *testing.T) {
+	gb := NewGrammarBuilder()
+	gb.Rule("`*").Nonterminal("e").Terminal("`.")
+	gb.Rule("e").Terminal("ID").Terminal("PLUS").Nonterminal("e")
+	gb.Rule("e").Terminal("ID")
+	gb.Rule("e").Terminal("LP").Nonterminal("a").Terminal("RP")
+	gb.Rule("e").Terminal("LP").Nonterminal("b").Terminal("RP")
+	gb.Rule("a").Terminal("ID")
+	gb.Rule("b").Terminal("ID")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p, err := GenerateEarleyParser(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	parse := func(in string, bottom bool) error {
+		lex, err := (&wordLexer{grammar: g, bottom: bottom}).Open(strings.NewReader(in))
+		if err != nil {
+			return err
+		}
+		ps, err := p.Open(lex)
+		if err != nil {
+			return err
+		}
+		_, err = ps.Parse()
+		return err
+	}
+	for _, c := range []struct {
+		in       string
+		bottom   bool
+		position int
+		token    string
+		expected string
+		message  string
+	}{
+		{"ID PLUS PLUS", true, 3, "PLUS 9", "ID LP", "parse error at token 3 (PLUS 'PLUS' at 1:9), expected ID LP"},
+		{"PLUS", true, 1, "PLUS 1", "ID LP", "parse error at token 1 (PLUS 'PLUS' at 1:1), expected ID LP"},
+		{"LP ID ID", true, 3, "ID 7", "RP", "parse error at token 3 (ID 'ID' at 1:7), expected RP"},
+		{"ID PLUS", true, 3, "`. 8", "ID LP", "parse error at token 3 (`. '' at 1:8), expected ID LP"},
+		{"ID PLUS", false, 3, "", "ID LP", "unexpected end of input, expected ID LP"},
+		{"ID", false, 2, "", "`. PLUS", "unexpected end of input, expected `. PLUS"},
+		{"", false, 1, "", "ID LP", "unexpected end of input, expected ID LP"},
+	} {
+		err := parse(c.in, c.bottom)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("parsing '%s' returned %v, expected a *ParseError", c.in, err)
+			continue
+		}
+		token := ""
+		if pe.Token != nil {
+			token = fmt.Sprintf("%s %d", pe.Token.Terminal().Name(), pe.Token.FirstColumn())
+		}
+		var expected []string
+		for _, term := range pe.Expected {
+			expected = append(expected, term.Name())
+		}
+		if pe.Position != c.position || token != c.token || strings.Join(expected, " ") != c.expected {
+			t.Errorf("parsing '%s' failed at %d (%s) expecting %s, expected %d (%s) expecting %s", c.in,
+				pe.Position, token, strings.Join(expected, " "), c.position, c.token, c.expected)
+		}
+		if pe.Error() != c.message {
+			t.Errorf("parsing '%s' failed with '%s', expected '%s'", c.in, pe.Error(), c.message)
+		}
+	}
+	if err := parse("ID PLUS ID PLUS ID", true); err != nil {
+		t.Error(err)
+	}
+	err = parse("ID PLUS LP ID RP", true)
+	ae, ok := err.(*AmbiguityError)
+	if !ok {
+		t.Errorf("parsing an ambiguous group returned %v, expected an *AmbiguityError", err)
+		return
+	}
+	if ae.Nonterminal.Name() != "e" {
+		t.Errorf("ambiguity reported in %s, expected e", ae.Nonterminal.Name())
+	}
+	if !strings.HasPrefix(ae.Error(), "ambiguous derivation of <e>") {
+		t.Errorf("unexpected ambiguity message '%s'", ae.Error())
+	}
+}
+
 func printAst(n ParseTreeNode, indent int) {
 	for i := 0; i < indent; i++ {
 		fmt.Print(" ")
@@ -90,3 +257,40 @@ func printAst(n ParseTreeNode, indent int) {
 		fmt.Printf("%s '%s'\n", TermToString(n.Token().Terminal()), n.Token().Literal())
 	}
 }
+
+func TestBnf0Lexer(t *testing.T) {
+	lexer, err := NewBnf0Lexer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lex, err := lexer.Open(NewStringReader("<a> := B\n  | `*"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var actual []string
+	// Stop early rather than hang if the lexer does not advance.
+	for len(actual) < 20 {
+		more, err := lex.HasMoreTokens()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !more {
+			break
+		}
+		tok, err := lex.NextToken()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		actual = append(actual, fmt.Sprintf("%s '%s' %d:%d(%d)", tok.Terminal().Name(), tok.Literal(),
+			tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition()))
+	}
+	expect := "LT '<' 1:1(0) ID 'a' 1:2(1) RT '>' 1:3(2) EQDEF ':=' 1:5(4) ID 'B' 1:8(7) " +
+		"PIPE '|' 2:3(11) AST '`*' 2:5(13) `. '' 2:7(15)"
+	if strings.Join(actual, " ") != expect {
+		t.Errorf("bnf0 lexed %s, expected %s", strings.Join(actual, " "), expect)
+	}
+}
@@ -0,0 +1,178 @@
+// Package parsergen generates standalone Go parsers.  The generated source
+// contains static Earley parser tables (and optionally lexr DFA tables) for
+// a grammar together with a small driver, and depends only on the
+// interface types of the parser package.
+package parsergen
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/dtromb/parser"
+	"github.com/dtromb/parser/lexr"
+)
+
+// GenerateParserSource writes a Go source file for package pkgName which
+// parses the language of g.  The generated package exports Grammar(),
+// NewParser() and NewLexer(); the lexer is available only if domain is not
+// nil, in which case its DFAs are generated too.
+func GenerateParserSource(g parser.Grammar, domain lexr.Domain, pkgName string, out io.Writer) error {
+	p, err := parser.GenerateEarleyParser(g)
+	if err != nil {
+		return err
+	}
+	tables, err := parser.GetEarleyTables(p)
+	if err != nil {
+		return err
+	}
+	var lexTables *lexr.LexrTables
+	if domain != nil {
+		lexer, err := lexr.CreateLexrLexer(domain)
+		if err != nil {
+			return err
+		}
+		if lexTables, err = lexr.GetLexrTables(lexer); err != nil {
+			return err
+		}
+	}
+
+	// Terms are numbered by their index in genTerms: the special terms
+	// first, then terminals and nonterminals in grammar order.
+	var terms []parser.Term
+	termIndex := make(map[uint32]int)
+	addTerm := func(t parser.Term) int {
+		if idx, has := termIndex[t.Id()]; has {
+			return idx
+		}
+		termIndex[t.Id()] = len(terms)
+		terms = append(terms, t)
+		return len(terms) - 1
+	}
+	asterisk, epsilon, bottom := addTerm(g.Asterisk()), addTerm(g.Epsilon()), addTerm(g.Bottom())
+	terminals := make([]int, g.NumTerminal())
+	for i := 0; i < g.NumTerminal(); i++ {
+		terminals[i] = addTerm(g.Terminal(i))
+	}
+	nonterminals := make([]int, g.NumNonterminal())
+	for i := 0; i < g.NumNonterminal(); i++ {
+		nonterminals[i] = addTerm(g.Nonterminal(i))
+	}
+
+	var buf bytes.Buffer
+	bout := bufio.NewWriter(&buf)
+	fp := parser.GrammarFingerprint(g)
+	bout.WriteString("// Code generated by parsergen. DO NOT EDIT.\n\n")
+	bout.WriteString("package " + pkgName + "\n\n")
+	bout.WriteString("import (\n\t\"bufio\"\n\t\"errors\"\n\t\"fmt\"\n\t\"io\"\n\n\t\"github.com/dtromb/parser\"\n)\n\n")
+	bout.WriteString(fmt.Sprintf("// Fingerprint is the parser.GrammarFingerprint of the source grammar.\nconst Fingerprint = \"%x\"\n\n", fp[:]))
+
+	bout.WriteString("var genTerms = []genTerm{\n")
+	for _, t := range terms {
+		bout.WriteString(fmt.Sprintf("\t{%d, %s, %t, %t},\n", t.Id(), strconv.Quote(t.Name()), t.Terminal(), t.Special()))
+	}
+	bout.WriteString("}\n\n")
+	bout.WriteString(fmt.Sprintf("const (\n\tgenAsterisk = %d\n\tgenEpsilon = %d\n\tgenBottom = %d\n)\n\n", asterisk, epsilon, bottom))
+	bout.WriteString("var genTerminals = " + intSliceLiteral(terminals) + "\n\n")
+	bout.WriteString("var genNonterminals = " + intSliceLiteral(nonterminals) + "\n\n")
+
+	bout.WriteString("var genRules = []genRule{\n")
+	for i := 0; i < g.NumProductionRule(); i++ {
+		pr := g.ProductionRule(i)
+		rhs := make([]int, pr.RhsLen())
+		for j := 0; j < pr.RhsLen(); j++ {
+			rhs[j] = termIndex[pr.Rhs(j).Id()]
+		}
+		bout.WriteString(fmt.Sprintf("\t{%d, %d, %s}, // %s\n", pr.Id(), termIndex[pr.Lhs().Id()], intSliceLiteral(rhs),
+			parser.ProductionRuleToString(pr)))
+	}
+	bout.WriteString("}\n\n")
+
+	bout.WriteString(fmt.Sprintf("const genAcceptState = %d\n\n", tables.AcceptState))
+	bout.WriteString("var genParserStates = []genParserState{\n")
+	for _, st := range tables.States {
+		ids := make([]int, 0, len(st.Transitions))
+		for id := range st.Transitions {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		bout.WriteString("\t{map[uint32]int{")
+		for k, id := range ids {
+			if k > 0 {
+				bout.WriteString(", ")
+			}
+			bout.WriteString(fmt.Sprintf("%d: %d", id, st.Transitions[uint32(id)]))
+		}
+		bout.WriteString("}, " + intSliceLiteral(st.Reductions) + "},\n")
+	}
+	bout.WriteString("}\n\n")
+	bout.WriteString("var genNullable = map[uint32]bool{")
+	for k, id := range tables.Nullable {
+		if k > 0 {
+			bout.WriteString(", ")
+		}
+		bout.WriteString(fmt.Sprintf("%d: true", id))
+	}
+	bout.WriteString("}\n\n")
+
+	bout.WriteString("var genLexerDfas = [][]genLexerDfaState{\n")
+	if lexTables != nil {
+		for _, dfa := range lexTables.Dfas {
+			bout.WriteString("\t{\n")
+			for _, st := range dfa {
+				if st.Contexts != nil {
+					return errors.New("assertions are not supported in generated lexers")
+				}
+				if st.AcceptAction != lexr.BlockForward {
+					return errors.New("block stacks are not supported in generated lexers")
+				}
+				accept := -1
+				if st.Accepting {
+					idx, has := termIndex[st.AcceptTerm]
+					if !has {
+						return errors.New(fmt.Sprintf("lexer terminal %d is not in the parser grammar", st.AcceptTerm))
+					}
+					accept = idx
+				}
+				bout.WriteString("\t\t{[]genLexerRange{")
+				for k, r := range st.Ranges {
+					if k > 0 {
+						bout.WriteString(", ")
+					}
+					bout.WriteString(fmt.Sprintf("{%d, %d, %d}", r.Least, r.Greatest, r.Next))
+				}
+				bout.WriteString(fmt.Sprintf("}, %d, %d, %d},\n", accept, st.AcceptNextDfa, st.AcceptNextState))
+			}
+			bout.WriteString("\t},\n")
+		}
+	}
+	bout.WriteString("}\n")
+	bout.WriteString(runtimeSource)
+	if err := bout.Flush(); err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(src)
+	return err
+}
+
+func intSliceLiteral(x []int) string {
+	var buf []byte
+	buf = append(buf, "[]int{"...)
+	for i, v := range x {
+		if i > 0 {
+			buf = append(buf, ", "...)
+		}
+		buf = strconv.AppendInt(buf, int64(v), 10)
+	}
+	buf = append(buf, '}')
+	return string(buf)
+}
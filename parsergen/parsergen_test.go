@@ -0,0 +1,453 @@
+package parsergen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dtromb/parser"
+	"github.com/dtromb/parser/lexr"
+)
+
+func wordListGrammar() (parser.Grammar, lexr.Domain, error) {
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("`*").Nonterminal("list").Terminal("`.")
+	gb.Rule("list").Terminal("WORD")
+	gb.Rule("list").Terminal("WORD").Terminal("COMMA").Nonterminal("list")
+	g, err := gb.Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := lexr.OpenDomainBuilder(g)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := db.Block("0").
+		Termdef("WORD", lexr.PlusExpression(lexr.CharacterClassExpression(
+			lexr.OpenCharacterClassBuilder().AddRange('a', 'z').MustBuild()))).
+		Termdef("COMMA", lexr.CharacterLiteralExpression(',')).
+		Ignore(lexr.PlusExpression(lexr.CharacterClassExpression(
+			lexr.OpenCharacterClassBuilder().AddCharacter(' ').MustBuild()))).
+		Build()
+	return g, d, err
+}
+
+func TestGenerateParserSource(t *testing.T) {
+	g, d, err := wordListGrammar()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, domain := range []lexr.Domain{nil, d} {
+		var src bytes.Buffer
+		if err := GenerateParserSource(g, domain, "words", &src); err != nil {
+			t.Error(err)
+			return
+		}
+		f, err := goparser.ParseFile(token.NewFileSet(), "words.go", src.Bytes(), 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		funcs := make(map[string]bool)
+		for _, decl := range f.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+				funcs[fd.Name.Name] = true
+			}
+		}
+		for _, name := range []string{"Grammar", "NewParser", "NewLexer"} {
+			if !funcs[name] {
+				t.Errorf("generated source does not declare %s()", name)
+			}
+		}
+		for _, imp := range f.Imports {
+			if imp.Path.Value != `"github.com/dtromb/parser"` && bytes.Contains([]byte(imp.Path.Value), []byte("dtromb")) {
+				t.Errorf("generated source imports %s", imp.Path.Value)
+			}
+		}
+		fp := parser.GrammarFingerprint(g)
+		if !bytes.Contains(src.Bytes(), []byte(fmt.Sprintf("%x", fp[:]))) {
+			t.Error("generated source does not record the grammar fingerprint")
+		}
+	}
+}
+
+func TestGenerateScannerSource(t *testing.T) {
+	g := lexr.GenerateLexr0Grammar()
+	var src bytes.Buffer
+	if err := GenerateScannerSource(lexr.GenerateLexr0Domain(g), "lexr0", &src); err != nil {
+		t.Error(err)
+		return
+	}
+	f, err := goparser.ParseFile(token.NewFileSet(), "lexr0.go", src.Bytes(), 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	funcs := make(map[string]bool)
+	for _, decl := range f.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+			funcs[fd.Name.Name] = true
+		}
+	}
+	for _, name := range []string{"NewScanner", "scanStep", "scanAccept"} {
+		if !funcs[name] {
+			t.Errorf("generated scanner does not declare %s()", name)
+		}
+	}
+	if !bytes.Contains(src.Bytes(), []byte(`"COMMENT_OPEN"}`)) {
+		t.Error("generated scanner does not list the lexr0 terminals")
+	}
+}
+
+// runGenerated builds the generated packages in srcs, keyed by package name,
+// with the main package mainSrc, which imports them as "gentest/<name>", and
+// returns the output of running it.  The parser package is taken from the
+// module or GOPATH the test runs in.
+func runGenerated(t *testing.T, srcs map[string][]byte, mainSrc string) (string, error) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool to build the generated package")
+	}
+	dir := t.TempDir()
+	env := os.Environ()
+	gomod, err := exec.Command(goTool, "env", "GOMOD").Output()
+	if err != nil {
+		return "", err
+	}
+	mainDir := filepath.Join(dir, "src", "gentest")
+	if mod := strings.TrimSpace(string(gomod)); mod != "" && mod != os.DevNull {
+		mainDir = dir
+		modSrc := "module gentest\n\nrequire github.com/dtromb/parser v0.0.0\n\n" +
+			"replace github.com/dtromb/parser => " + filepath.Dir(mod) + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(modSrc), 0644); err != nil {
+			return "", err
+		}
+	} else {
+		gopath, err := exec.Command(goTool, "env", "GOPATH").Output()
+		if err != nil {
+			return "", err
+		}
+		env = append(env, "GO111MODULE=off",
+			"GOPATH="+dir+string(filepath.ListSeparator)+strings.TrimSpace(string(gopath)))
+	}
+	for pkgName, src := range srcs {
+		if err := os.MkdirAll(filepath.Join(mainDir, pkgName), 0755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(mainDir, pkgName, pkgName+".go"), src, 0644); err != nil {
+			return "", err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(mainDir, "main.go"), []byte(mainSrc), 0644); err != nil {
+		return "", err
+	}
+	cmd := exec.Command(goTool, "run", ".")
+	cmd.Dir = mainDir
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v\n%s", err, out)
+	}
+	return string(out), nil
+}
+
+func TestGeneratedEndOfInput(t *testing.T) {
+	g, d, err := wordListGrammar()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var parserSrc, scannerSrc bytes.Buffer
+	if err := GenerateParserSource(g, d, "words", &parserSrc); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := GenerateScannerSource(d, "wordscan", &scannerSrc); err != nil {
+		t.Error(err)
+		return
+	}
+	out, err := runGenerated(t, map[string][]byte{"words": parserSrc.Bytes(), "wordscan": scannerSrc.Bytes()}, `package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gentest/words"
+	"gentest/wordscan"
+	"github.com/dtromb/parser"
+)
+
+func main() {
+	scanner, err := wordscan.NewScanner(words.Grammar())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	lexer, err := words.NewLexer()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, l := range []parser.Lexer{scanner, lexer} {
+		for _, in := range []string{"ab, cd", "ab ,cd  ", "x"} {
+			ls, err := l.Open(strings.NewReader(in))
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			var toks []string
+			for {
+				more, err := ls.HasMoreTokens()
+				if err != nil {
+					toks = append(toks, err.Error())
+					break
+				}
+				if !more {
+					break
+				}
+				tok, err := ls.NextToken()
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				toks = append(toks, tok.Terminal().Name()+" '"+tok.Literal()+"'")
+			}
+			fmt.Println(strings.Join(toks, " "))
+		}
+	}
+}
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// A token pending at the end of the input is accepted; the parser's
+	// lexer follows it with a bottom token.
+	expect := "WORD 'ab' COMMA ',' WORD 'cd'\nWORD 'ab' COMMA ',' WORD 'cd'\nWORD 'x'\n" +
+		"WORD 'ab' COMMA ',' WORD 'cd' `. ''\nWORD 'ab' COMMA ',' WORD 'cd' `. ''\nWORD 'x' `. ''\n"
+	if out != expect {
+		t.Errorf("generated lexers lexed\n%s\nexpected\n%s", out, expect)
+	}
+}
+
+func TestRunGeneratedParser(t *testing.T) {
+	g, d, err := wordListGrammar()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var src bytes.Buffer
+	if err := GenerateParserSource(g, d, "words", &src); err != nil {
+		t.Error(err)
+		return
+	}
+	out, err := runGenerated(t, map[string][]byte{"words": src.Bytes()}, `package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gentest/words"
+	"github.com/dtromb/parser"
+)
+
+func leaves(node parser.ParseTreeNode, out *[]string) {
+	if node.Production() == nil {
+		tok := node.Token()
+		*out = append(*out, fmt.Sprintf("%s '%s' %d:%d(%d)", tok.Terminal().Name(), tok.Literal(),
+			tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition()))
+		return
+	}
+	for _, c := range node.Children() {
+		leaves(c, out)
+	}
+}
+
+func main() {
+	lexer, err := words.NewLexer()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, in := range []string{"apple, banana  ,cherry", "apple banana"} {
+		ls, err := lexer.Open(strings.NewReader(in))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		ps, err := words.NewParser().Open(ls)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		tree, err := ps.Parse()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		var out []string
+		leaves(tree, &out)
+		fmt.Println(strings.Join(out, " "))
+	}
+}
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expect := "WORD 'apple' 1:1(0) COMMA ',' 1:6(5) WORD 'banana' 1:8(7) COMMA ',' 1:16(15) " +
+		"WORD 'cherry' 1:17(16) `. '' 1:23(22)\n" +
+		"parse error at token 2\n\n"
+	if out != expect {
+		t.Errorf("generated parser printed\n%s\nexpected\n%s", out, expect)
+	}
+}
+
+func TestGeneratedBacktracking(t *testing.T) {
+	gb := parser.NewGrammarBuilder()
+	gb.Rule("`*").Nonterminal("list").Terminal("`.")
+	gb.Rule("list").Nonterminal("item")
+	gb.Rule("list").Nonterminal("item").Nonterminal("list")
+	gb.Rule("item").Terminal("FLOAT")
+	gb.Rule("item").Terminal("NUM")
+	gb.Rule("item").Terminal("DOT")
+	g, err := gb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db, err := lexr.OpenDomainBuilder(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := db.Block("0").
+		Ignore(lexr.MustCompileExpression(" +")).
+		Termdef("FLOAT", lexr.MustCompileExpression("[0-9]+\\.[0-9]+")).
+		Termdef("NUM", lexr.MustCompileExpression("[0-9]+")).
+		Termdef("DOT", lexr.MustCompileExpression("\\.")).
+		Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	inputs := []string{"1. 2.5", "12.34.5 6..7", "3.x"}
+
+	// The library lexer gives the expected tokens; the generated lexer of a
+	// parser package also ends its input with a bottom token.
+	lexer, err := lexr.CreateLexrLexer(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var expect []string
+	for _, bottom := range []bool{false, true} {
+		lexer.(lexr.BottomTokenLexer).SetBottomToken(bottom)
+		for _, in := range inputs {
+			ls, err := lexer.Open(strings.NewReader(in))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var toks []string
+			for {
+				more, err := ls.HasMoreTokens()
+				if err != nil {
+					toks = append(toks, err.Error())
+					break
+				}
+				if !more {
+					break
+				}
+				tok, err := ls.NextToken()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				toks = append(toks, fmt.Sprintf("%s '%s' %d:%d(%d)", tok.Terminal().Name(), tok.Literal(),
+					tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition()))
+			}
+			expect = append(expect, strings.Join(toks, " "))
+		}
+	}
+	if expect[0] != "NUM '1' 1:1(0) DOT '.' 1:2(1) FLOAT '2.5' 1:4(3)" {
+		t.Errorf("library lexer lexed %s", expect[0])
+	}
+
+	var parserSrc, scannerSrc bytes.Buffer
+	if err := GenerateParserSource(g, d, "nums", &parserSrc); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := GenerateScannerSource(d, "numscan", &scannerSrc); err != nil {
+		t.Error(err)
+		return
+	}
+	out, err := runGenerated(t, map[string][]byte{"nums": parserSrc.Bytes(), "numscan": scannerSrc.Bytes()}, `package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gentest/nums"
+	"gentest/numscan"
+	"github.com/dtromb/parser"
+)
+
+func main() {
+	scanner, err := numscan.NewScanner(nums.Grammar())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	lexer, err := nums.NewLexer()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, l := range []parser.Lexer{scanner, lexer} {
+		for _, in := range `+fmt.Sprintf("%#v", inputs)+` {
+			ls, err := l.Open(strings.NewReader(in))
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			var toks []string
+			for {
+				more, err := ls.HasMoreTokens()
+				if err != nil {
+					toks = append(toks, err.Error())
+					break
+				}
+				if !more {
+					break
+				}
+				tok, err := ls.NextToken()
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				toks = append(toks, fmt.Sprintf("%s '%s' %d:%d(%d)", tok.Terminal().Name(), tok.Literal(),
+					tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition()))
+			}
+			fmt.Println(strings.Join(toks, " "))
+		}
+	}
+}
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if actual := strings.Split(strings.TrimSuffix(out, "\n"), "\n"); strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("generated lexers lexed\n%s\nexpected\n%s", strings.Join(actual, "\n"), strings.Join(expect, "\n"))
+	}
+}
@@ -0,0 +1,775 @@
+package parsergen
+
+// runtimeSource is appended to every generated file.  It implements the
+// parser interfaces over the generated tables (genTerms, genRules,
+// genParserStates, genLexerDfas, ...) with a copy of the Earley recognizer
+// and lexr DFA driver, so generated packages need nothing from the parser
+// package beyond its interface types.
+const runtimeSource = `
+type genTerm struct {
+	id       uint32
+	name     string
+	terminal bool
+	special  bool
+}
+
+type genRule struct {
+	id  uint32
+	lhs int
+	rhs []int
+}
+
+type genParserState struct {
+	transitions map[uint32]int
+	reductions  []int
+}
+
+type genLexerRange struct {
+	least    rune
+	greatest rune
+	next     int
+}
+
+type genLexerDfaState struct {
+	ranges          []genLexerRange
+	accept          int
+	acceptNextDfa   int
+	acceptNextState int
+}
+
+type genGrammar struct {
+	terms []*genGrammarTerm
+	rules []*genGrammarRule
+	byId  map[uint32]*genGrammarTerm
+}
+
+type genGrammarTerm struct {
+	genTerm
+}
+
+type genGrammarRule struct {
+	id  uint32
+	lhs parser.Term
+	rhs []parser.Term
+}
+
+var genGrammarInstance *genGrammar
+
+func init() {
+	g := &genGrammar{
+		terms: make([]*genGrammarTerm, len(genTerms)),
+		rules: make([]*genGrammarRule, len(genRules)),
+		byId:  make(map[uint32]*genGrammarTerm),
+	}
+	for i := range genTerms {
+		g.terms[i] = &genGrammarTerm{genTerms[i]}
+		g.byId[genTerms[i].id] = g.terms[i]
+	}
+	for i, r := range genRules {
+		pr := &genGrammarRule{
+			id:  r.id,
+			lhs: g.terms[r.lhs],
+			rhs: make([]parser.Term, len(r.rhs)),
+		}
+		for j, t := range r.rhs {
+			pr.rhs[j] = g.terms[t]
+		}
+		g.rules[i] = pr
+	}
+	genGrammarInstance = g
+}
+
+func (g *genGrammar) NumTerminal() int {
+	return len(genTerminals)
+}
+
+func (g *genGrammar) Terminal(idx int) parser.Term {
+	if idx < 0 || idx >= len(genTerminals) {
+		panic("terminal index out of range")
+	}
+	return g.terms[genTerminals[idx]]
+}
+
+func (g *genGrammar) NumNonterminal() int {
+	return len(genNonterminals)
+}
+
+func (g *genGrammar) Nonterminal(idx int) parser.Term {
+	if idx < 0 || idx >= len(genNonterminals) {
+		panic("nonterminal index out of range")
+	}
+	return g.terms[genNonterminals[idx]]
+}
+
+func (g *genGrammar) Asterisk() parser.Term {
+	return g.terms[genAsterisk]
+}
+
+func (g *genGrammar) Epsilon() parser.Term {
+	return g.terms[genEpsilon]
+}
+
+func (g *genGrammar) Bottom() parser.Term {
+	return g.terms[genBottom]
+}
+
+func (g *genGrammar) NumProductionRule() int {
+	return len(g.rules)
+}
+
+func (g *genGrammar) ProductionRule(idx int) parser.ProductionRule {
+	if idx < 0 || idx >= len(g.rules) {
+		panic("production rule index out of range")
+	}
+	return g.rules[idx]
+}
+
+func (t *genGrammarTerm) Grammar() parser.Grammar {
+	return genGrammarInstance
+}
+
+func (t *genGrammarTerm) Name() string {
+	return t.name
+}
+
+func (t *genGrammarTerm) Id() uint32 {
+	return t.id
+}
+
+func (t *genGrammarTerm) Terminal() bool {
+	return t.terminal
+}
+
+func (t *genGrammarTerm) Special() bool {
+	return t.special
+}
+
+func (t *genGrammarTerm) HashCode() uint32 {
+	return t.id
+}
+
+func (t *genGrammarTerm) Equals(o interface{}) bool {
+	if k, ok := o.(parser.Term); ok {
+		return k.Id() == t.id && k.Grammar() == parser.Grammar(genGrammarInstance)
+	}
+	return false
+}
+
+func (pr *genGrammarRule) Grammar() parser.Grammar {
+	return genGrammarInstance
+}
+
+func (pr *genGrammarRule) Id() uint32 {
+	return pr.id
+}
+
+func (pr *genGrammarRule) Lhs() parser.Term {
+	return pr.lhs
+}
+
+func (pr *genGrammarRule) RhsLen() int {
+	return len(pr.rhs)
+}
+
+func (pr *genGrammarRule) Rhs(idx int) parser.Term {
+	if idx < 0 || idx >= len(pr.rhs) {
+		panic("production rule RHS index out of range")
+	}
+	return pr.rhs[idx]
+}
+
+func (pr *genGrammarRule) RhsSlice() []parser.Term {
+	ret := make([]parser.Term, len(pr.rhs))
+	copy(ret, pr.rhs)
+	return ret
+}
+
+func (pr *genGrammarRule) HashCode() uint32 {
+	return pr.id
+}
+
+func (pr *genGrammarRule) Equals(o interface{}) bool {
+	if k, ok := o.(parser.ProductionRule); ok {
+		return k.Id() == pr.id && k.Grammar() == parser.Grammar(genGrammarInstance)
+	}
+	return false
+}
+
+// Grammar returns the grammar the tables in this package were generated from.
+func Grammar() parser.Grammar {
+	return genGrammarInstance
+}
+
+// NewParser returns a parser driven by the generated tables.
+func NewParser() parser.Parser {
+	return &genParser{}
+}
+
+// NewLexer returns a lexer driven by the generated DFAs, or an error if the
+// package was generated without a lexical domain.  Its states end their input
+// with a token for the grammar's Bottom() term.
+func NewLexer() (parser.Lexer, error) {
+	if len(genLexerDfas) == 0 {
+		return nil, errors.New("no lexer tables were generated")
+	}
+	return &genLexer{}, nil
+}
+
+type genParser struct{}
+
+type genParserLink struct {
+	pred  *genParserEntry
+	cause *genParserEntry
+}
+
+type genParserEntry struct {
+	state  int
+	parent int
+	links  []*genParserLink
+	token  parser.Token
+}
+
+type genParserSet struct {
+	entries []*genParserEntry
+	index   map[uint64]int
+}
+
+type genParseState struct {
+	lexer parser.LexerState
+	sets  []*genParserSet
+}
+
+func (p *genParser) Grammar() parser.Grammar {
+	return genGrammarInstance
+}
+
+func (p *genParser) Open(lexState parser.LexerState) (parser.ParserState, error) {
+	return &genParseState{lexer: lexState}, nil
+}
+
+func (ps *genParseState) Parser() parser.Parser {
+	return &genParser{}
+}
+
+func (ps *genParseState) LexerState() parser.LexerState {
+	return ps.lexer
+}
+
+func (set *genParserSet) add(state, parent int, token parser.Token) *genParserEntry {
+	key := (uint64(state) << 32) | uint64(parent)
+	if idx, has := set.index[key]; has {
+		return set.entries[idx]
+	}
+	e := &genParserEntry{state: state, parent: parent, token: token}
+	set.index[key] = len(set.entries)
+	set.entries = append(set.entries, e)
+	return e
+}
+
+func (ps *genParseState) Parse() (parser.ParseTreeNode, error) {
+	eps := genTerms[genEpsilon].id
+	ps.sets = []*genParserSet{{index: make(map[uint64]int)}}
+	ps.sets[0].add(0, 0, nil)
+	if nk, has := genParserStates[0].transitions[eps]; has {
+		ps.sets[0].add(nk, 0, nil)
+	}
+	i := 0
+	canAccept := false
+	for {
+		hasMore, err := ps.lexer.HasMoreTokens()
+		if err != nil {
+			return nil, err
+		}
+		if !hasMore {
+			if canAccept {
+				break
+			}
+			return nil, errors.New("unexpected end of input")
+		}
+		canAccept = false
+		tok, err := ps.lexer.NextToken()
+		if err != nil {
+			return nil, err
+		}
+		next := &genParserSet{index: make(map[uint64]int)}
+		ps.sets = append(ps.sets, next)
+		canContinue := false
+		cs := ps.sets[i]
+		for j := 0; j < len(cs.entries); j++ {
+			item := cs.entries[j]
+			state := &genParserStates[item.state]
+			parent := ps.sets[item.parent]
+			if k, has := state.transitions[tok.Terminal().Id()]; has {
+				canContinue = true
+				ns := next.add(k, item.parent, tok)
+				ns.links = append(ns.links, &genParserLink{pred: item})
+				if nk, has := genParserStates[k].transitions[eps]; has {
+					next.add(nk, i+1, nil)
+				}
+			}
+			if item.parent == i {
+				continue
+			}
+			for _, r := range state.reductions {
+				a := genTerms[genRules[r].lhs].id
+				for k := 0; k < len(parent.entries); k++ {
+					pitem := parent.entries[k]
+					if item.parent == 0 && k == 0 {
+						canAccept = true
+					}
+					ks, has := genParserStates[pitem.state].transitions[a]
+					if !has {
+						continue
+					}
+					ns := cs.add(ks, pitem.parent, nil)
+					ns.links = append(ns.links, &genParserLink{pred: pitem, cause: item})
+					if nk, has := genParserStates[ks].transitions[eps]; has {
+						cs.add(nk, i, nil)
+					}
+				}
+			}
+		}
+		if !canContinue {
+			return nil, errors.New(fmt.Sprintf("parse error at token %d\n", i+1))
+		}
+		i++
+	}
+	return ps.buildTree()
+}
+
+type genParseRecord struct {
+	nt     int
+	entry  *genParserEntry
+	rule   int
+	n      int
+	x      *genParseTreeNode
+	target **genParseTreeNode
+}
+
+func (ps *genParseState) buildTree() (parser.ParseTreeNode, error) {
+	var initialEntry *genParserEntry
+	for _, e := range ps.sets[len(ps.sets)-1].entries {
+		if e.state == genAcceptState {
+			initialEntry = e
+			break
+		}
+	}
+	if initialEntry == nil {
+		return nil, errors.New("no initial entry found in final state after successful parse")
+	}
+	var ast *genParseTreeNode
+	stack := []*genParseRecord{{nt: genAsterisk, entry: initialEntry, rule: -1, target: &ast}}
+	for len(stack) > 0 {
+		ce := stack[len(stack)-1]
+		if ce.rule < 0 {
+			for _, r := range genParserStates[ce.entry.state].reductions {
+				if genRules[r].lhs != ce.nt {
+					continue
+				}
+				if ce.rule >= 0 {
+					return nil, errors.New("R/R ambiguity encountered after successful parse, ambiguity resolution not yet implemented")
+				}
+				ce.rule = r
+			}
+			if ce.rule < 0 {
+				return nil, errors.New(fmt.Sprintf("missing reduction in state after successful parse (%d,%d)\n", ce.entry.state, ce.entry.parent))
+			}
+			ce.x = &genParseTreeNode{
+				rule:     genGrammarInstance.rules[ce.rule],
+				children: make([]*genParseTreeNode, len(genRules[ce.rule].rhs)),
+			}
+		}
+		rhs := genRules[ce.rule].rhs
+		if ce.n == len(rhs) {
+			*ce.target = ce.x
+			stack = stack[0 : len(stack)-1]
+			continue
+		}
+		ce.n++
+		sym := rhs[len(rhs)-ce.n]
+		// The bottom term is scanned like a terminal.
+		if genTerms[sym].terminal || sym == genBottom {
+			ce.x.children[len(rhs)-ce.n] = &genParseTreeNode{token: ce.entry.token}
+			var pred *genParserEntry
+			for _, link := range ce.entry.links {
+				if link.cause == nil {
+					pred = link.pred
+					break
+				}
+			}
+			if pred == nil {
+				return nil, errors.New("missing predecessor link for terminal transition after successful parse")
+			}
+			ce.entry = pred
+		} else {
+			if genNullable[genTerms[sym].id] {
+				return nil, errors.New("epsilon deriviation encountered after successful parse - not yet implemented")
+			}
+			var causeLink *genParserLink
+			for _, link := range ce.entry.links {
+				if link.cause == nil {
+					continue
+				}
+				if causeLink != nil {
+					return nil, errors.New("causal ambiguity encountered after successful parse - amgiuity resolution not yet implemented")
+				}
+				causeLink = link
+			}
+			if causeLink == nil {
+				return nil, errors.New(fmt.Sprintf("missing causal link after successful parse (%d,%d)\n", ce.entry.state, ce.entry.parent))
+			}
+			stack = append(stack, &genParseRecord{
+				nt:     sym,
+				entry:  causeLink.cause,
+				rule:   -1,
+				target: &ce.x.children[len(rhs)-ce.n],
+			})
+			ce.entry = causeLink.pred
+		}
+	}
+	return ast, nil
+}
+
+type genParseTreeNode struct {
+	rule     parser.ProductionRule
+	children []*genParseTreeNode
+	token    parser.Token
+}
+
+func (pn *genParseTreeNode) Parser() parser.Parser {
+	return &genParser{}
+}
+
+func (pn *genParseTreeNode) Token() parser.Token {
+	return pn.token
+}
+
+func (pn *genParseTreeNode) Production() parser.ProductionRule {
+	return pn.rule
+}
+
+func (pn *genParseTreeNode) NumChildren() int {
+	return len(pn.children)
+}
+
+func (pn *genParseTreeNode) Child(idx int) parser.ParseTreeNode {
+	if idx < 0 || idx >= len(pn.children) {
+		return nil
+	}
+	return pn.children[idx]
+}
+
+func (pn *genParseTreeNode) Children() []parser.ParseTreeNode {
+	ret := make([]parser.ParseTreeNode, len(pn.children))
+	for i, c := range pn.children {
+		ret[i] = c
+	}
+	return ret
+}
+
+type genLexer struct{}
+
+type genLexerState struct {
+	in        *bufio.Reader
+	line      int
+	column    int
+	position  int
+	dfa       int
+	state     int
+	la        rune
+	hasLa     bool
+	laBytes   int
+	consumed  []genLexerRune
+	pushback  []genLexerRune
+	eof       bool
+	bottom    bool
+	lastError error
+	hasToken  bool
+	nextToken *genToken
+}
+
+// genLexerRune is a rune read by the lexer with its encoded length, so that
+// it can be pushed back when the lexer backtracks.
+type genLexerRune struct {
+	r     rune
+	bytes int
+}
+
+// genLexerMark records the last accepting state reached while reading a
+// token.
+type genLexerMark struct {
+	state    int
+	consumed int
+	line     int
+	column   int
+	position int
+}
+
+type genToken struct {
+	state    *genLexerState
+	fpos     int
+	lpos     int
+	fline    int
+	lline    int
+	fcol     int
+	lcol     int
+	terminal parser.Term
+	literal  string
+}
+
+func (l *genLexer) Grammar() parser.Grammar {
+	return genGrammarInstance
+}
+
+func (l *genLexer) Open(in io.Reader) (parser.LexerState, error) {
+	reader, ok := in.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(in)
+	}
+	return &genLexerState{in: reader, line: 1, column: 1, bottom: true}, nil
+}
+
+func (ls *genLexerState) Lexer() parser.Lexer {
+	return &genLexer{}
+}
+
+func (ls *genLexerState) Reader() io.Reader {
+	return ls.in
+}
+
+func (ls *genLexerState) CurrentLine() int {
+	return ls.line
+}
+
+func (ls *genLexerState) CurrentColumn() int {
+	return ls.column
+}
+
+func (ls *genLexerState) CurrentPosition() int {
+	return ls.position
+}
+
+func (ls *genLexerState) peek() rune {
+	if !ls.hasLa && len(ls.pushback) > 0 {
+		ls.la, ls.laBytes = ls.pushback[0].r, ls.pushback[0].bytes
+		ls.pushback = ls.pushback[1:]
+		ls.hasLa = true
+	}
+	if !ls.hasLa {
+		if ls.eof {
+			return rune(0)
+		}
+		var err error
+		ls.la, ls.laBytes, err = ls.in.ReadRune()
+		if err != nil {
+			ls.eof = true
+			ls.lastError = err
+			return rune(0)
+		}
+		ls.hasLa = true
+	}
+	return ls.la
+}
+
+func (ls *genLexerState) read() rune {
+	r := ls.peek()
+	if !ls.hasLa {
+		return r
+	}
+	ls.consumed = append(ls.consumed, genLexerRune{r, ls.laBytes})
+	ls.position += ls.laBytes
+	if r == '\n' {
+		ls.line++
+		ls.column = 1
+	} else {
+		ls.column++
+	}
+	ls.hasLa = false
+	return r
+}
+
+func (ls *genLexerState) literal() string {
+	buf := make([]rune, len(ls.consumed))
+	for i, lr := range ls.consumed {
+		buf[i] = lr.r
+	}
+	return string(buf)
+}
+
+// mark returns a mark for the current state and input position.
+func (ls *genLexerState) mark() *genLexerMark {
+	return &genLexerMark{
+		state:    ls.state,
+		consumed: len(ls.consumed),
+		line:     ls.line,
+		column:   ls.column,
+		position: ls.position,
+	}
+}
+
+// reset returns to a mark, pushing back the runes consumed since it was taken.
+func (ls *genLexerState) reset(m *genLexerMark) {
+	var back []genLexerRune
+	back = append(back, ls.consumed[m.consumed:]...)
+	if ls.hasLa {
+		back = append(back, genLexerRune{ls.la, ls.laBytes})
+		ls.hasLa = false
+	}
+	ls.pushback = append(back, ls.pushback...)
+	ls.consumed = ls.consumed[:m.consumed]
+	ls.state = m.state
+	ls.line, ls.column, ls.position = m.line, m.column, m.position
+}
+
+func (ls *genLexerState) transition(r rune) (int, bool) {
+	ranges := genLexerDfas[ls.dfa][ls.state].ranges
+	lo, hi := 0, len(ranges)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if ranges[mid].greatest < r {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == len(ranges) || ranges[lo].least > r || ranges[lo].next < 0 {
+		return 0, false
+	}
+	return ranges[lo].next, true
+}
+
+func (ls *genLexerState) readToken() (bool, error) {
+	fpos, fline, fcol := ls.position, ls.line, ls.column
+	ls.consumed = ls.consumed[:0]
+	var last *genLexerMark
+	for {
+		r := ls.peek()
+		atEof := false
+		if !ls.hasLa && ls.eof {
+			if ls.lastError != io.EOF {
+				return false, ls.lastError
+			}
+			if len(ls.consumed) == 0 {
+				if !ls.bottom {
+					return false, nil
+				}
+				// Send the bottom token once, at the end of the input.
+				ls.bottom = false
+				ls.hasToken = true
+				ls.nextToken = &genToken{
+					state:    ls,
+					fpos:     ls.position,
+					lpos:     ls.position,
+					fline:    ls.line,
+					lline:    ls.line,
+					fcol:     ls.column,
+					lcol:     ls.column,
+					terminal: genGrammarInstance.terms[genBottom],
+				}
+				return true, nil
+			}
+			atEof = true
+		}
+		st := &genLexerDfas[ls.dfa][ls.state]
+		if st.accept >= 0 {
+			last = ls.mark()
+		}
+		if !atEof {
+			if next, ok := ls.transition(r); ok {
+				ls.read()
+				ls.state = next
+				continue
+			}
+		}
+		if st.accept < 0 && last != nil {
+			// Return to the longest accepted input and scan the rest again.
+			ls.reset(last)
+			st = &genLexerDfas[ls.dfa][ls.state]
+		}
+		if st.accept < 0 {
+			ls.eof = true
+			ls.lastError = errors.New(fmt.Sprintf("invalid runes at %d:%d(%d)", ls.line, ls.column, ls.position))
+			return false, ls.lastError
+		}
+		if st.acceptNextDfa >= 0 {
+			ls.dfa, ls.state = st.acceptNextDfa, st.acceptNextState
+		}
+		if st.accept == genEpsilon {
+			fpos, fline, fcol = ls.position, ls.line, ls.column
+			ls.consumed = ls.consumed[:0]
+			last = nil
+			continue
+		}
+		ls.hasToken = true
+		ls.nextToken = &genToken{
+			state:    ls,
+			fpos:     fpos,
+			lpos:     ls.position,
+			fline:    fline,
+			lline:    ls.line,
+			fcol:     fcol,
+			lcol:     ls.column,
+			terminal: genGrammarInstance.terms[st.accept],
+			literal:  ls.literal(),
+		}
+		return true, nil
+	}
+}
+
+func (ls *genLexerState) HasMoreTokens() (bool, error) {
+	if !ls.hasToken {
+		return ls.readToken()
+	}
+	return true, nil
+}
+
+func (ls *genLexerState) NextToken() (parser.Token, error) {
+	if !ls.hasToken {
+		ok, err := ls.readToken()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, io.EOF
+		}
+	}
+	ls.hasToken = false
+	return ls.nextToken, nil
+}
+
+func (tok *genToken) LexerState() parser.LexerState {
+	return tok.state
+}
+
+func (tok *genToken) FirstPosition() int {
+	return tok.fpos
+}
+
+func (tok *genToken) LastPosition() int {
+	return tok.lpos
+}
+
+func (tok *genToken) FirstLine() int {
+	return tok.fline
+}
+
+func (tok *genToken) LastLine() int {
+	return tok.lline
+}
+
+func (tok *genToken) FirstColumn() int {
+	return tok.fcol
+}
+
+func (tok *genToken) LastColumn() int {
+	return tok.lcol
+}
+
+func (tok *genToken) Terminal() parser.Term {
+	return tok.terminal
+}
+
+func (tok *genToken) Literal() string {
+	return tok.literal
+}
+`
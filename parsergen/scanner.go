@@ -0,0 +1,484 @@
+package parsergen
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/dtromb/parser"
+	"github.com/dtromb/parser/lexr"
+)
+
+// GenerateScannerSource writes a Go source file for package pkgName with a
+// scanner for domain compiled to code: the block DFAs are flattened into one
+// state space, and each state's transitions become a switch on the input
+// rune.  Block switching, ignore handling and backtracking to the longest
+// accepted input follow CreateLexrLexer.  The generated package exports
+// NewScanner(g parser.Grammar), which binds the scanner to a grammar with the
+// same terminals as the domain grammar, so it can be combined with a package
+// generated by GenerateParserSource.
+func GenerateScannerSource(domain lexr.Domain, pkgName string, out io.Writer) error {
+	lexer, err := lexr.CreateLexrLexer(domain)
+	if err != nil {
+		return err
+	}
+	tables, err := lexr.GetLexrTables(lexer)
+	if err != nil {
+		return err
+	}
+	g := domain.Grammar()
+	terms := make(map[uint32]parser.Term)
+	for i := 0; i < g.NumTerminal(); i++ {
+		terms[g.Terminal(i).Id()] = g.Terminal(i)
+	}
+
+	// Flatten the block DFAs; accepted terminals are numbered by their index
+	// in scanTerms, with -1 for no accept and -2 for ignore.
+	offsets := make([]int, len(tables.Dfas))
+	numStates := 0
+	for i, dfa := range tables.Dfas {
+		offsets[i] = numStates
+		numStates += len(dfa)
+	}
+	var accepted []parser.Term
+	acceptIndex := make(map[uint32]int)
+	acceptOf := func(st *lexr.LexrTableState) (int, error) {
+		if !st.Accepting {
+			return -1, nil
+		}
+		if st.AcceptTerm == g.Epsilon().Id() {
+			return -2, nil
+		}
+		if idx, has := acceptIndex[st.AcceptTerm]; has {
+			return idx, nil
+		}
+		t, has := terms[st.AcceptTerm]
+		if !has {
+			return 0, errors.New(fmt.Sprintf("accepted term %d is not a terminal of the domain grammar", st.AcceptTerm))
+		}
+		acceptIndex[t.Id()] = len(accepted)
+		accepted = append(accepted, t)
+		return len(accepted) - 1, nil
+	}
+
+	var buf bytes.Buffer
+	bout := bufio.NewWriter(&buf)
+	bout.WriteString("// Code generated by parsergen. DO NOT EDIT.\n\n")
+	bout.WriteString("package " + pkgName + "\n\n")
+	bout.WriteString("import (\n\t\"bufio\"\n\t\"errors\"\n\t\"fmt\"\n\t\"io\"\n\n\t\"github.com/dtromb/parser\"\n)\n\n")
+
+	var acceptCases bytes.Buffer
+	bout.WriteString("func scanStep(state int, r rune) int {\n\tswitch state {\n")
+	for i, dfa := range tables.Dfas {
+		for j := range dfa {
+			st := &dfa[j]
+			id := offsets[i] + j
+			if st.Contexts != nil {
+				return errors.New("assertions are not supported in generated scanners")
+			}
+			if st.AcceptAction != lexr.BlockForward {
+				return errors.New("block stacks are not supported in generated scanners")
+			}
+			accept, err := acceptOf(st)
+			if err != nil {
+				return err
+			}
+			if accept != -1 {
+				next := -1
+				if st.AcceptNextDfa >= 0 {
+					next = offsets[st.AcceptNextDfa] + st.AcceptNextState
+				}
+				acceptCases.WriteString(fmt.Sprintf("\tcase %d:\n\t\treturn %d, %d\n", id, accept, next))
+			}
+			var targets []int
+			conds := make(map[int][]string)
+			for _, r := range st.Ranges {
+				if r.Next < 0 {
+					continue
+				}
+				next := offsets[i] + r.Next
+				if _, seen := conds[next]; !seen {
+					targets = append(targets, next)
+				}
+				conds[next] = append(conds[next], scannerRangeCondition(r.Least, r.Greatest))
+			}
+			if len(targets) == 0 {
+				continue
+			}
+			bout.WriteString(fmt.Sprintf("\tcase %d:\n\t\tswitch {\n", id))
+			for _, next := range targets {
+				bout.WriteString(fmt.Sprintf("\t\tcase %s:\n\t\t\treturn %d\n", joinConditions(conds[next]), next))
+			}
+			bout.WriteString("\t\t}\n")
+		}
+	}
+	bout.WriteString("\t}\n\treturn -1\n}\n\n")
+
+	bout.WriteString("// scanAccept returns the scanTerms index accepted in state (-1 for none,\n")
+	bout.WriteString("// -2 for ignored input) and the state to continue from (-1 to stay).\n")
+	bout.WriteString("func scanAccept(state int) (int, int) {\n\tswitch state {\n")
+	bout.Write(acceptCases.Bytes())
+	bout.WriteString("\t}\n\treturn -1, -1\n}\n\n")
+
+	bout.WriteString("var scanTerms = []struct {\n\tid   uint32\n\tname string\n}{\n")
+	for _, t := range accepted {
+		bout.WriteString(fmt.Sprintf("\t{%d, %s},\n", t.Id(), strconv.Quote(t.Name())))
+	}
+	bout.WriteString("}\n")
+	bout.WriteString(scannerRuntimeSource)
+	if err := bout.Flush(); err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(src)
+	return err
+}
+
+// WriteScannerFile generates a scanner for domain into the named file.  It
+// is meant to be called from a small program run by go generate, e.g.
+//
+//	//go:generate go run gen_scanner.go
+func WriteScannerFile(domain lexr.Domain, pkgName, filename string) error {
+	var buf bytes.Buffer
+	if err := GenerateScannerSource(domain, pkgName, &buf); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+func scannerRangeCondition(least, greatest rune) string {
+	unbounded := greatest < 0 || greatest >= math.MaxInt32
+	switch {
+	case least == greatest:
+		return "r == " + scannerRuneLiteral(least)
+	case least <= 0 && unbounded:
+		return "true"
+	case least <= 0:
+		return "r <= " + scannerRuneLiteral(greatest)
+	case unbounded:
+		return "r >= " + scannerRuneLiteral(least)
+	}
+	return "r >= " + scannerRuneLiteral(least) + " && r <= " + scannerRuneLiteral(greatest)
+}
+
+func joinConditions(conds []string) string {
+	var buf []byte
+	for i, c := range conds {
+		if i > 0 {
+			buf = append(buf, ", "...)
+		}
+		buf = append(buf, c...)
+	}
+	return string(buf)
+}
+
+func scannerRuneLiteral(r rune) string {
+	if r >= 0 && r <= utf8.MaxRune {
+		return strconv.QuoteRune(r)
+	}
+	return strconv.Itoa(int(r))
+}
+
+const scannerRuntimeSource = `
+// NewScanner returns a lexer running the generated scanner, producing tokens
+// whose terminals are the terms with the same ids and names in g.
+func NewScanner(g parser.Grammar) (parser.Lexer, error) {
+	byId := make(map[uint32]parser.Term)
+	for i := 0; i < g.NumTerminal(); i++ {
+		byId[g.Terminal(i).Id()] = g.Terminal(i)
+	}
+	sl := &scanLexer{grammar: g, terms: make([]parser.Term, len(scanTerms))}
+	for i, st := range scanTerms {
+		t, has := byId[st.id]
+		if !has || t.Name() != st.name {
+			return nil, errors.New(fmt.Sprintf("grammar has no terminal %d '%s'", st.id, st.name))
+		}
+		sl.terms[i] = t
+	}
+	return sl, nil
+}
+
+type scanLexer struct {
+	grammar parser.Grammar
+	terms   []parser.Term
+}
+
+type scanState struct {
+	lexer     *scanLexer
+	in        *bufio.Reader
+	line      int
+	column    int
+	position  int
+	state     int
+	la        rune
+	hasLa     bool
+	laBytes   int
+	consumed  []scanRune
+	pushback  []scanRune
+	eof       bool
+	lastError error
+	hasToken  bool
+	nextToken *scanToken
+}
+
+// scanRune is a rune read by the scanner with its encoded length, so that it
+// can be pushed back when the scanner backtracks.
+type scanRune struct {
+	r     rune
+	bytes int
+}
+
+// scanMark records the last accepting state reached while reading a token.
+type scanMark struct {
+	state    int
+	consumed int
+	line     int
+	column   int
+	position int
+}
+
+type scanToken struct {
+	state    *scanState
+	fpos     int
+	lpos     int
+	fline    int
+	lline    int
+	fcol     int
+	lcol     int
+	terminal parser.Term
+	literal  string
+}
+
+func (sl *scanLexer) Grammar() parser.Grammar {
+	return sl.grammar
+}
+
+func (sl *scanLexer) Open(in io.Reader) (parser.LexerState, error) {
+	reader, ok := in.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(in)
+	}
+	return &scanState{lexer: sl, in: reader, line: 1, column: 1}, nil
+}
+
+func (ss *scanState) Lexer() parser.Lexer {
+	return ss.lexer
+}
+
+func (ss *scanState) Reader() io.Reader {
+	return ss.in
+}
+
+func (ss *scanState) CurrentLine() int {
+	return ss.line
+}
+
+func (ss *scanState) CurrentColumn() int {
+	return ss.column
+}
+
+func (ss *scanState) CurrentPosition() int {
+	return ss.position
+}
+
+func (ss *scanState) peek() rune {
+	if !ss.hasLa && len(ss.pushback) > 0 {
+		ss.la, ss.laBytes = ss.pushback[0].r, ss.pushback[0].bytes
+		ss.pushback = ss.pushback[1:]
+		ss.hasLa = true
+	}
+	if !ss.hasLa {
+		if ss.eof {
+			return rune(0)
+		}
+		var err error
+		ss.la, ss.laBytes, err = ss.in.ReadRune()
+		if err != nil {
+			ss.eof = true
+			ss.lastError = err
+			return rune(0)
+		}
+		ss.hasLa = true
+	}
+	return ss.la
+}
+
+func (ss *scanState) read() rune {
+	r := ss.peek()
+	if !ss.hasLa {
+		return r
+	}
+	ss.consumed = append(ss.consumed, scanRune{r, ss.laBytes})
+	ss.position += ss.laBytes
+	if r == '\n' {
+		ss.line++
+		ss.column = 1
+	} else {
+		ss.column++
+	}
+	ss.hasLa = false
+	return r
+}
+
+func (ss *scanState) literal() string {
+	buf := make([]rune, len(ss.consumed))
+	for i, sr := range ss.consumed {
+		buf[i] = sr.r
+	}
+	return string(buf)
+}
+
+// mark returns a mark for the current state and input position.
+func (ss *scanState) mark() *scanMark {
+	return &scanMark{
+		state:    ss.state,
+		consumed: len(ss.consumed),
+		line:     ss.line,
+		column:   ss.column,
+		position: ss.position,
+	}
+}
+
+// reset returns to a mark, pushing back the runes consumed since it was taken.
+func (ss *scanState) reset(m *scanMark) {
+	var back []scanRune
+	back = append(back, ss.consumed[m.consumed:]...)
+	if ss.hasLa {
+		back = append(back, scanRune{ss.la, ss.laBytes})
+		ss.hasLa = false
+	}
+	ss.pushback = append(back, ss.pushback...)
+	ss.consumed = ss.consumed[:m.consumed]
+	ss.state = m.state
+	ss.line, ss.column, ss.position = m.line, m.column, m.position
+}
+
+func (ss *scanState) readToken() (bool, error) {
+	fpos, fline, fcol := ss.position, ss.line, ss.column
+	ss.consumed = ss.consumed[:0]
+	var last *scanMark
+	for {
+		r := ss.peek()
+		atEof := false
+		if !ss.hasLa && ss.eof {
+			if ss.lastError != io.EOF {
+				return false, ss.lastError
+			}
+			if len(ss.consumed) == 0 {
+				return false, nil
+			}
+			atEof = true
+		}
+		accept, next := scanAccept(ss.state)
+		if accept != -1 {
+			last = ss.mark()
+		}
+		if !atEof {
+			if step := scanStep(ss.state, r); step >= 0 {
+				ss.read()
+				ss.state = step
+				continue
+			}
+		}
+		if accept == -1 && last != nil {
+			// Return to the longest accepted input and scan the rest again.
+			ss.reset(last)
+			accept, next = scanAccept(ss.state)
+		}
+		if accept == -1 {
+			ss.eof = true
+			ss.lastError = errors.New(fmt.Sprintf("invalid runes at %d:%d(%d)", ss.line, ss.column, ss.position))
+			return false, ss.lastError
+		}
+		if next >= 0 {
+			ss.state = next
+		}
+		if accept == -2 {
+			fpos, fline, fcol = ss.position, ss.line, ss.column
+			ss.consumed = ss.consumed[:0]
+			last = nil
+			continue
+		}
+		ss.hasToken = true
+		ss.nextToken = &scanToken{
+			state:    ss,
+			fpos:     fpos,
+			lpos:     ss.position,
+			fline:    fline,
+			lline:    ss.line,
+			fcol:     fcol,
+			lcol:     ss.column,
+			terminal: ss.lexer.terms[accept],
+			literal:  ss.literal(),
+		}
+		return true, nil
+	}
+}
+
+func (ss *scanState) HasMoreTokens() (bool, error) {
+	if !ss.hasToken {
+		return ss.readToken()
+	}
+	return true, nil
+}
+
+func (ss *scanState) NextToken() (parser.Token, error) {
+	if !ss.hasToken {
+		ok, err := ss.readToken()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, io.EOF
+		}
+	}
+	ss.hasToken = false
+	return ss.nextToken, nil
+}
+
+func (tok *scanToken) LexerState() parser.LexerState {
+	return tok.state
+}
+
+func (tok *scanToken) FirstPosition() int {
+	return tok.fpos
+}
+
+func (tok *scanToken) LastPosition() int {
+	return tok.lpos
+}
+
+func (tok *scanToken) FirstLine() int {
+	return tok.fline
+}
+
+func (tok *scanToken) LastLine() int {
+	return tok.lline
+}
+
+func (tok *scanToken) FirstColumn() int {
+	return tok.fcol
+}
+
+func (tok *scanToken) LastColumn() int {
+	return tok.lcol
+}
+
+func (tok *scanToken) Terminal() parser.Term {
+	return tok.terminal
+}
+
+func (tok *scanToken) Literal() string {
+	return tok.literal
+}
+`
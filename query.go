@@ -0,0 +1,631 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+/*
+	Tree queries select nodes from a parse tree by path, in the manner of
+	XPath or CSS selectors.  A node is named by the LHS of its production,
+	or by its token terminal if it is a leaf.
+
+	<query> 	:= <path>
+				|  <path> COMMA <query>
+
+	<path>		:= <step>
+				|  SLASH <step>				-- anchored at the root
+				|  DSLASH <step>			-- anywhere below the root
+				|  <path> <comb> <step>
+
+	<comb>		:= GT | SLASH				-- child
+				|  DSLASH | WS				-- descendant
+				|  PLUS						-- next sibling
+				|  TILDE					-- any following sibling
+
+	<step>		:= <name> | <step> <filter>
+
+	<name>		:= ID | STAR | BQ ID
+
+	<filter>	:= LB <path> RB				-- has a match relative to the node
+				|  LB NUM RB				-- same as :nth(NUM)
+				|  COLON "nth" LP NUM RP	-- NUMth match of the step, 1-based
+				|  COLON "first"
+				|  COLON "last"
+				|  COLON "leaf"
+				|  COLON "not" LP <path> RP
+				|  COLON "text" LP STRING RP	-- leaf token literal equals STRING
+
+	An unanchored query matches anywhere in the tree, so "decl > nt > ID"
+	and "//decl/nt/ID" are equivalent.  Paths inside [] and :not() are
+	relative to the filtered node, and their first step is a child step
+	unless written with a leading //.
+*/
+
+type TreeQuery interface {
+	String() string
+	Select(root ParseTreeNode) []ParseTreeNode
+	SelectFirst(root ParseTreeNode) (ParseTreeNode, bool)
+}
+
+func CompileTreeQuery(query string) (TreeQuery, error) {
+	qp := &treeQueryParser{src: query}
+	paths, err := qp.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	return &stdTreeQuery{
+		source: query,
+		paths:  paths,
+	}, nil
+}
+
+func MustCompileTreeQuery(query string) TreeQuery {
+	tq, err := CompileTreeQuery(query)
+	if err != nil {
+		panic(err.Error())
+	}
+	return tq
+}
+
+func QueryTree(root ParseTreeNode, query string) ([]ParseTreeNode, error) {
+	tq, err := CompileTreeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return tq.Select(root), nil
+}
+
+///
+
+type treeQueryAxis uint8
+
+const (
+	treeQueryAxisChild treeQueryAxis = iota
+	treeQueryAxisDescendant
+	treeQueryAxisAdjacent
+	treeQueryAxisSibling
+)
+
+type treeQueryFilterType uint8
+
+const (
+	treeQueryFilterHas treeQueryFilterType = iota
+	treeQueryFilterNot
+	treeQueryFilterNth
+	treeQueryFilterLast
+	treeQueryFilterLeaf
+	treeQueryFilterText
+)
+
+type treeQueryFilter struct {
+	ftype treeQueryFilterType
+	path  *treeQueryPath
+	n     int
+	text  string
+}
+
+type treeQueryStep struct {
+	axis    treeQueryAxis
+	name    string
+	filters []*treeQueryFilter
+}
+
+type treeQueryPath struct {
+	steps []*treeQueryStep
+}
+
+type stdTreeQuery struct {
+	source string
+	paths  []*treeQueryPath
+}
+
+type treeQueryNodeInfo struct {
+	parent ParseTreeNode
+	index  int
+	order  int
+}
+
+type treeQueryIndex struct {
+	root  ParseTreeNode
+	nodes map[ParseTreeNode]*treeQueryNodeInfo
+}
+
+func parseTreeNodeTerm(n ParseTreeNode) Term {
+	if pr := n.Production(); pr != nil {
+		return pr.Lhs()
+	}
+	if tok := n.Token(); tok != nil {
+		return tok.Terminal()
+	}
+	return nil
+}
+
+func parseTreeNodeChildren(n ParseTreeNode) []ParseTreeNode {
+	res := make([]ParseTreeNode, 0, n.NumChildren())
+	for i := 0; i < n.NumChildren(); i++ {
+		if c := n.Child(i); c != nil {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func newTreeQueryIndex(root ParseTreeNode) *treeQueryIndex {
+	idx := &treeQueryIndex{
+		root:  root,
+		nodes: make(map[ParseTreeNode]*treeQueryNodeInfo),
+	}
+	idx.nodes[root] = &treeQueryNodeInfo{}
+	order := 1
+	stack := []ParseTreeNode{root}
+	for len(stack) > 0 {
+		cn := stack[len(stack)-1]
+		stack = stack[0 : len(stack)-1]
+		idx.nodes[cn].order = order
+		order++
+		children := parseTreeNodeChildren(cn)
+		for i := len(children) - 1; i >= 0; i-- {
+			idx.nodes[children[i]] = &treeQueryNodeInfo{
+				parent: cn,
+				index:  i,
+			}
+			stack = append(stack, children[i])
+		}
+	}
+	return idx
+}
+
+// A nil context node stands for a virtual document node whose only child is
+// the root of the tree.
+func (idx *treeQueryIndex) children(n ParseTreeNode) []ParseTreeNode {
+	if n == nil {
+		return []ParseTreeNode{idx.root}
+	}
+	return parseTreeNodeChildren(n)
+}
+
+func (idx *treeQueryIndex) descendants(n ParseTreeNode) []ParseTreeNode {
+	var res []ParseTreeNode
+	stack := idx.children(n)
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	for len(stack) > 0 {
+		cn := stack[len(stack)-1]
+		stack = stack[0 : len(stack)-1]
+		res = append(res, cn)
+		children := parseTreeNodeChildren(cn)
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, children[i])
+		}
+	}
+	return res
+}
+
+func (idx *treeQueryIndex) followingSiblings(n ParseTreeNode, adjacent bool) []ParseTreeNode {
+	if n == nil {
+		return nil
+	}
+	info := idx.nodes[n]
+	if info == nil || info.parent == nil {
+		return nil
+	}
+	siblings := parseTreeNodeChildren(info.parent)
+	if info.index+1 >= len(siblings) {
+		return nil
+	}
+	if adjacent {
+		return siblings[info.index+1 : info.index+2]
+	}
+	return siblings[info.index+1:]
+}
+
+func (idx *treeQueryIndex) selectPath(path *treeQueryPath, context []ParseTreeNode) []ParseTreeNode {
+	for _, step := range path.steps {
+		seen := make(map[ParseTreeNode]bool)
+		var next []ParseTreeNode
+		for _, cn := range context {
+			for _, m := range idx.selectStep(step, cn) {
+				if !seen[m] {
+					seen[m] = true
+					next = append(next, m)
+				}
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		sort.Sort(&treeQueryDocumentOrder{idx: idx, nodes: next})
+		context = next
+	}
+	return context
+}
+
+func (idx *treeQueryIndex) selectStep(step *treeQueryStep, context ParseTreeNode) []ParseTreeNode {
+	var candidates []ParseTreeNode
+	switch step.axis {
+	case treeQueryAxisChild:
+		candidates = idx.children(context)
+	case treeQueryAxisDescendant:
+		candidates = idx.descendants(context)
+	case treeQueryAxisAdjacent:
+		candidates = idx.followingSiblings(context, true)
+	case treeQueryAxisSibling:
+		candidates = idx.followingSiblings(context, false)
+	}
+	res := make([]ParseTreeNode, 0, len(candidates))
+	for _, c := range candidates {
+		if step.name == "" {
+			res = append(res, c)
+			continue
+		}
+		if t := parseTreeNodeTerm(c); t != nil && t.Name() == step.name {
+			res = append(res, c)
+		}
+	}
+	for _, f := range step.filters {
+		res = idx.applyFilter(f, res)
+		if len(res) == 0 {
+			break
+		}
+	}
+	return res
+}
+
+func (idx *treeQueryIndex) applyFilter(f *treeQueryFilter, nodes []ParseTreeNode) []ParseTreeNode {
+	if len(nodes) == 0 {
+		return nodes
+	}
+	switch f.ftype {
+	case treeQueryFilterNth:
+		if f.n > len(nodes) {
+			return nil
+		}
+		return nodes[f.n-1 : f.n]
+	case treeQueryFilterLast:
+		return nodes[len(nodes)-1:]
+	}
+	res := make([]ParseTreeNode, 0, len(nodes))
+	for _, n := range nodes {
+		var keep bool
+		switch f.ftype {
+		case treeQueryFilterHas:
+			keep = len(idx.selectPath(f.path, []ParseTreeNode{n})) > 0
+		case treeQueryFilterNot:
+			keep = len(idx.selectPath(f.path, []ParseTreeNode{n})) == 0
+		case treeQueryFilterLeaf:
+			keep = n.Production() == nil
+		case treeQueryFilterText:
+			keep = n.Token() != nil && n.Token().Literal() == f.text
+		}
+		if keep {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+type treeQueryDocumentOrder struct {
+	idx   *treeQueryIndex
+	nodes []ParseTreeNode
+}
+
+func (o *treeQueryDocumentOrder) Len() int { return len(o.nodes) }
+func (o *treeQueryDocumentOrder) Less(i, j int) bool {
+	return o.idx.nodes[o.nodes[i]].order < o.idx.nodes[o.nodes[j]].order
+}
+func (o *treeQueryDocumentOrder) Swap(i, j int) { o.nodes[i], o.nodes[j] = o.nodes[j], o.nodes[i] }
+
+func (tq *stdTreeQuery) String() string {
+	return tq.source
+}
+
+func (tq *stdTreeQuery) Select(root ParseTreeNode) []ParseTreeNode {
+	if root == nil {
+		return []ParseTreeNode{}
+	}
+	idx := newTreeQueryIndex(root)
+	seen := make(map[ParseTreeNode]bool)
+	res := []ParseTreeNode{}
+	for _, path := range tq.paths {
+		for _, n := range idx.selectPath(path, []ParseTreeNode{nil}) {
+			if !seen[n] {
+				seen[n] = true
+				res = append(res, n)
+			}
+		}
+	}
+	if len(tq.paths) > 1 {
+		sort.Sort(&treeQueryDocumentOrder{idx: idx, nodes: res})
+	}
+	return res
+}
+
+func (tq *stdTreeQuery) SelectFirst(root ParseTreeNode) (ParseTreeNode, bool) {
+	res := tq.Select(root)
+	if len(res) == 0 {
+		return nil, false
+	}
+	return res[0], true
+}
+
+type treeQueryParser struct {
+	src string
+	pos int
+}
+
+func (qp *treeQueryParser) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("tree query: %s at offset %d in '%s'", fmt.Sprintf(format, args...), qp.pos, qp.src))
+}
+
+func (qp *treeQueryParser) atEnd() bool {
+	return qp.pos >= len(qp.src)
+}
+
+func (qp *treeQueryParser) peek() byte {
+	if qp.atEnd() {
+		return 0
+	}
+	return qp.src[qp.pos]
+}
+
+func (qp *treeQueryParser) accept(s string) bool {
+	if len(qp.src)-qp.pos >= len(s) && qp.src[qp.pos:qp.pos+len(s)] == s {
+		qp.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (qp *treeQueryParser) expect(s string) error {
+	if !qp.accept(s) {
+		return qp.errorf("expected '%s'", s)
+	}
+	return nil
+}
+
+func (qp *treeQueryParser) skipWhitespace() bool {
+	start := qp.pos
+	for !qp.atEnd() {
+		switch qp.peek() {
+		case ' ', '\t', '\r', '\n':
+			qp.pos++
+		default:
+			return qp.pos > start
+		}
+	}
+	return qp.pos > start
+}
+
+func (qp *treeQueryParser) isNameCharacter(c byte) bool {
+	return ((c >= 'a') && (c <= 'z')) ||
+		((c >= 'A') && (c <= 'Z')) ||
+		((c >= '0') && (c <= '9')) ||
+		(c == '-') || (c == '_')
+}
+
+func (qp *treeQueryParser) parseQuery() ([]*treeQueryPath, error) {
+	var paths []*treeQueryPath
+	for {
+		path, err := qp.parsePath(false)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		qp.skipWhitespace()
+		if qp.atEnd() {
+			return paths, nil
+		}
+		if !qp.accept(",") {
+			return nil, qp.errorf("unexpected '%c'", qp.peek())
+		}
+	}
+}
+
+func (qp *treeQueryParser) parsePath(relative bool) (*treeQueryPath, error) {
+	path := &treeQueryPath{}
+	qp.skipWhitespace()
+	axis := treeQueryAxisDescendant
+	if relative {
+		axis = treeQueryAxisChild
+	}
+	if qp.accept("//") {
+		axis = treeQueryAxisDescendant
+	} else if qp.accept("/") || qp.accept(">") {
+		axis = treeQueryAxisChild
+	}
+	for {
+		qp.skipWhitespace()
+		step, err := qp.parseStep(axis)
+		if err != nil {
+			return nil, err
+		}
+		path.steps = append(path.steps, step)
+		sawWs := qp.skipWhitespace()
+		switch {
+		case qp.atEnd() || qp.peek() == ',' || qp.peek() == ']' || qp.peek() == ')':
+			return path, nil
+		case qp.accept("//"):
+			axis = treeQueryAxisDescendant
+		case qp.accept("/") || qp.accept(">"):
+			axis = treeQueryAxisChild
+		case qp.accept("+"):
+			axis = treeQueryAxisAdjacent
+		case qp.accept("~"):
+			axis = treeQueryAxisSibling
+		case sawWs:
+			axis = treeQueryAxisDescendant
+		default:
+			return nil, qp.errorf("unexpected '%c'", qp.peek())
+		}
+	}
+}
+
+func (qp *treeQueryParser) parseName() (string, error) {
+	if qp.accept("*") {
+		return "", nil
+	}
+	start := qp.pos
+	if qp.accept("`") {
+		if qp.atEnd() {
+			return "", qp.errorf("expected special term name")
+		}
+		qp.pos++
+		return qp.src[start:qp.pos], nil
+	}
+	for !qp.atEnd() && qp.isNameCharacter(qp.peek()) {
+		qp.pos++
+	}
+	if qp.pos == start {
+		if qp.atEnd() {
+			return "", qp.errorf("expected name")
+		}
+		return "", qp.errorf("expected name, found '%c'", qp.peek())
+	}
+	return qp.src[start:qp.pos], nil
+}
+
+func (qp *treeQueryParser) parseNumber() (int, error) {
+	start := qp.pos
+	for !qp.atEnd() && qp.peek() >= '0' && qp.peek() <= '9' {
+		qp.pos++
+	}
+	if start == qp.pos {
+		return 0, qp.errorf("expected number")
+	}
+	n, err := strconv.Atoi(qp.src[start:qp.pos])
+	if err != nil {
+		return 0, qp.errorf("%s", err.Error())
+	}
+	if n < 1 {
+		return 0, qp.errorf("position must be at least 1")
+	}
+	return n, nil
+}
+
+func (qp *treeQueryParser) parseString() (string, error) {
+	quote := qp.peek()
+	if quote != '"' && quote != '\'' {
+		return "", qp.errorf("expected string")
+	}
+	qp.pos++
+	var buf []byte
+	for !qp.atEnd() {
+		c := qp.peek()
+		qp.pos++
+		switch c {
+		case quote:
+			return string(buf), nil
+		case '\\':
+			if qp.atEnd() {
+				return "", qp.errorf("unterminated string")
+			}
+			c = qp.peek()
+			qp.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			}
+		}
+		buf = append(buf, c)
+	}
+	return "", qp.errorf("unterminated string")
+}
+
+func (qp *treeQueryParser) parseStep(axis treeQueryAxis) (*treeQueryStep, error) {
+	name, err := qp.parseName()
+	if err != nil {
+		return nil, err
+	}
+	step := &treeQueryStep{
+		axis: axis,
+		name: name,
+	}
+	for {
+		switch {
+		case qp.accept("["):
+			qp.skipWhitespace()
+			f := &treeQueryFilter{}
+			if c := qp.peek(); c >= '0' && c <= '9' {
+				f.ftype = treeQueryFilterNth
+				if f.n, err = qp.parseNumber(); err != nil {
+					return nil, err
+				}
+			} else {
+				f.ftype = treeQueryFilterHas
+				if f.path, err = qp.parsePath(true); err != nil {
+					return nil, err
+				}
+			}
+			qp.skipWhitespace()
+			if err = qp.expect("]"); err != nil {
+				return nil, err
+			}
+			step.filters = append(step.filters, f)
+		case qp.accept(":"):
+			f, err := qp.parsePseudo()
+			if err != nil {
+				return nil, err
+			}
+			step.filters = append(step.filters, f)
+		default:
+			return step, nil
+		}
+	}
+}
+
+func (qp *treeQueryParser) parsePseudo() (*treeQueryFilter, error) {
+	start := qp.pos
+	for !qp.atEnd() && qp.isNameCharacter(qp.peek()) {
+		qp.pos++
+	}
+	name := qp.src[start:qp.pos]
+	f := &treeQueryFilter{}
+	var err error
+	switch name {
+	case "first":
+		f.ftype = treeQueryFilterNth
+		f.n = 1
+		return f, nil
+	case "last":
+		f.ftype = treeQueryFilterLast
+		return f, nil
+	case "leaf":
+		f.ftype = treeQueryFilterLeaf
+		return f, nil
+	case "nth", "not", "text":
+	default:
+		qp.pos = start
+		return nil, qp.errorf("unknown pseudo-selector ':%s'", name)
+	}
+	if err = qp.expect("("); err != nil {
+		return nil, err
+	}
+	qp.skipWhitespace()
+	switch name {
+	case "nth":
+		f.ftype = treeQueryFilterNth
+		f.n, err = qp.parseNumber()
+	case "not":
+		f.ftype = treeQueryFilterNot
+		f.path, err = qp.parsePath(true)
+	case "text":
+		f.ftype = treeQueryFilterText
+		f.text, err = qp.parseString()
+	}
+	if err != nil {
+		return nil, err
+	}
+	qp.skipWhitespace()
+	if err = qp.expect(")"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,77 @@
+package parser
+
+import "testing"
+
+func parseBnf0Text(text string) (ParseTreeNode, error) {
+	lexer, err := NewBnf0Lexer()
+	if err != nil {
+		return nil, err
+	}
+	parser, err := GenerateEarleyParser(lexer.Grammar())
+	if err != nil {
+		return nil, err
+	}
+	lex, err := lexer.Open(NewStringReader(text))
+	if err != nil {
+		return nil, err
+	}
+	ps, err := parser.Open(lex)
+	if err != nil {
+		return nil, err
+	}
+	return ps.Parse()
+}
+
+func TestTreeQuery(t *testing.T) {
+	ast, err := parseBnf0Text(bnf1InText)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectCounts := map[string]int{
+		"decl > nt > ID":        7,
+		"//decl/nt/ID":          7,
+		"/`*/bnf0/decl/nt/AST":  1,
+		"decl > nt > AST":       1,
+		"//term[t]":             10,
+		"term[nt]":              14,
+		"term:not(t)":           14,
+		"//term[//BOT]":         1,
+		"ID:text(\"optlist\")":  3,
+		"nt:leaf":               0,
+		"*:leaf":                90,
+		"decl > nt + EQDEF":     8,
+		"decl > nt ~ optlist":   8,
+		"LT, RT":                42,
+		"decl:first > nt > ID":  0,
+		"decl:nth(2) nt > ID":   4,
+		"optlist > opt:last":    15,
+		"decl[nt/ID:text('t')]": 1,
+		"bnf0 decl:first":       8,
+		"//bnf0[2]/decl/nt/ID":  1,
+		"//*[EQDEF] > optlist":  8,
+		"opt > term + opt":      9,
+		"decl > nosuch:last":    0,
+		"decl > nosuch:first":   0,
+		"nosuch:nth(2)":         0,
+	}
+	for q, n := range expectCounts {
+		res, err := QueryTree(ast, q)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(res) != n {
+			t.Errorf("query '%s' selected %d nodes, expected %d", q, len(res), n)
+		}
+	}
+	tq := MustCompileTreeQuery("decl:nth(2) > nt > ID")
+	if n, ok := tq.SelectFirst(ast); !ok || n.Token().Literal() != "bnf1" {
+		t.Errorf("query '%s' did not select the second declaration", tq.String())
+	}
+	for _, q := range []string{"", "decl >", "decl[", "decl:bogus", "decl:nth(0)", "decl:text(x)", "a b,", "(decl)"} {
+		if _, err := CompileTreeQuery(q); err == nil {
+			t.Errorf("query '%s' compiled, expected error", q)
+		}
+	}
+}
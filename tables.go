@@ -0,0 +1,322 @@
+package parser
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Compiled parser tables are encoded as a 4-byte magic, a uvarint format
+// version, the 32-byte GrammarFingerprint of the grammar the tables were
+// generated from, and a sequence of uvarints describing the tables.  Loading
+// fails if the version is unknown or the fingerprint does not match the
+// grammar supplied by the caller.
+
+const (
+	earleyTableMagic   = "EYPT"
+	earleyTableVersion = 1
+)
+
+// GrammarFingerprint returns a SHA-256 digest of the terms and production
+// rules of g, in index order.  Two grammars with the same fingerprint assign
+// the same ids and indexes to the same terms and rules.
+func GrammarFingerprint(g Grammar) [32]byte {
+	var buf []byte
+	writeTerm := func(t Term) {
+		buf = binary.AppendUvarint(buf, uint64(t.Id()))
+		flags := uint64(0)
+		if t.Terminal() {
+			flags |= 1
+		}
+		if t.Special() {
+			flags |= 2
+		}
+		buf = binary.AppendUvarint(buf, flags)
+		buf = binary.AppendUvarint(buf, uint64(len(t.Name())))
+		buf = append(buf, t.Name()...)
+	}
+	writeTerm(g.Asterisk())
+	writeTerm(g.Epsilon())
+	writeTerm(g.Bottom())
+	buf = binary.AppendUvarint(buf, uint64(g.NumTerminal()))
+	for i := 0; i < g.NumTerminal(); i++ {
+		writeTerm(g.Terminal(i))
+	}
+	buf = binary.AppendUvarint(buf, uint64(g.NumNonterminal()))
+	for i := 0; i < g.NumNonterminal(); i++ {
+		writeTerm(g.Nonterminal(i))
+	}
+	buf = binary.AppendUvarint(buf, uint64(g.NumProductionRule()))
+	for i := 0; i < g.NumProductionRule(); i++ {
+		pr := g.ProductionRule(i)
+		buf = binary.AppendUvarint(buf, uint64(pr.Id()))
+		buf = binary.AppendUvarint(buf, uint64(pr.Lhs().Id()))
+		buf = binary.AppendUvarint(buf, uint64(pr.RhsLen()))
+		for j := 0; j < pr.RhsLen(); j++ {
+			buf = binary.AppendUvarint(buf, uint64(pr.Rhs(j).Id()))
+		}
+	}
+	return sha256.Sum256(buf)
+}
+
+// LoadEarleyParser creates a parser for g from tables previously produced by
+// MarshalBinary on a parser returned by GenerateEarleyParser.  The loaded
+// parser parses exactly as the original, but WriteEarleyParserDot cannot
+// render it since the LR(0) item sets are not retained.
+func LoadEarleyParser(g Grammar, data []byte) (Parser, error) {
+	p := &earleyParser{grammar: g}
+	if err := p.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *earleyParser) MarshalBinary() ([]byte, error) {
+	prodIndex := make(map[uint32]int)
+	for i := 0; i < p.grammar.NumProductionRule(); i++ {
+		prodIndex[p.grammar.ProductionRule(i).Id()] = i
+	}
+	fp := GrammarFingerprint(p.grammar)
+	buf := []byte(earleyTableMagic)
+	buf = binary.AppendUvarint(buf, earleyTableVersion)
+	buf = append(buf, fp[:]...)
+	buf = binary.AppendUvarint(buf, uint64(p.acceptStateIndex))
+	buf = binary.AppendUvarint(buf, uint64(len(p.dfa)))
+	for i := 0; i < len(p.dfa); i++ {
+		st := &p.dfa[i]
+		keys := make([]int, 0, len(st.transitions))
+		for k := range st.transitions {
+			keys = append(keys, k)
+		}
+		sort.Ints(keys)
+		buf = binary.AppendUvarint(buf, uint64(len(keys)))
+		for _, k := range keys {
+			buf = binary.AppendUvarint(buf, uint64(k))
+			buf = binary.AppendUvarint(buf, uint64(st.transitions[k]))
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(st.reductions)))
+		for _, pr := range st.reductions {
+			idx, has := prodIndex[pr.Id()]
+			if !has {
+				return nil, errors.New(fmt.Sprintf("reduction rule %d is not in the parser grammar", pr.Id()))
+			}
+			buf = binary.AppendUvarint(buf, uint64(idx))
+		}
+	}
+	epsIds := make([]int, 0, len(p.epsNt))
+	for id := range p.epsNt {
+		epsIds = append(epsIds, id)
+	}
+	sort.Ints(epsIds)
+	buf = binary.AppendUvarint(buf, uint64(len(epsIds)))
+	for _, id := range epsIds {
+		buf = binary.AppendUvarint(buf, uint64(id))
+	}
+	return buf, nil
+}
+
+func (p *earleyParser) UnmarshalBinary(data []byte) error {
+	if p.grammar == nil {
+		return errors.New("parser tables must be loaded against a grammar")
+	}
+	in, err := openTable(data, earleyTableMagic, earleyTableVersion, p.grammar)
+	if err != nil {
+		return err
+	}
+	acceptStateIndex, err := in.readInt()
+	if err != nil {
+		return err
+	}
+	numStates, err := in.readCount()
+	if err != nil {
+		return err
+	}
+	if acceptStateIndex >= numStates {
+		return errors.New(fmt.Sprintf("parser tables: unknown accept state %d", acceptStateIndex))
+	}
+	dfa := make([]earleyParserDfaState, numStates)
+	for i := 0; i < numStates; i++ {
+		st := &dfa[i]
+		n, err := in.readCount()
+		if err != nil {
+			return err
+		}
+		st.transitions = make(map[int]int)
+		for j := 0; j < n; j++ {
+			t, err := in.readInt()
+			if err != nil {
+				return err
+			}
+			ns, err := in.readInt()
+			if err != nil {
+				return err
+			}
+			if ns >= numStates {
+				return errors.New(fmt.Sprintf("parser tables: transition to unknown state %d", ns))
+			}
+			st.transitions[t] = ns
+		}
+		if n, err = in.readCount(); err != nil {
+			return err
+		}
+		st.reductions = make([]ProductionRule, n)
+		st.reductionIndex = make(map[int][]ProductionRule)
+		for j := 0; j < n; j++ {
+			idx, err := in.readInt()
+			if err != nil {
+				return err
+			}
+			if idx >= p.grammar.NumProductionRule() {
+				return errors.New(fmt.Sprintf("parser tables: unknown production rule index %d", idx))
+			}
+			pr := p.grammar.ProductionRule(idx)
+			st.reductions[j] = pr
+			lhs := int(pr.Lhs().Id())
+			st.reductionIndex[lhs] = append(st.reductionIndex[lhs], pr)
+		}
+	}
+	terms := grammarTermsById(p.grammar)
+	n, err := in.readInt()
+	if err != nil {
+		return err
+	}
+	epsNt := make(map[int]Term)
+	for i := 0; i < n; i++ {
+		id, err := in.readInt()
+		if err != nil {
+			return err
+		}
+		t, has := terms[uint32(id)]
+		if !has {
+			return errors.New(fmt.Sprintf("parser tables: unknown nullable nonterminal %d", id))
+		}
+		epsNt[id] = t
+	}
+	if in.Len() > 0 {
+		return errors.New("parser tables: trailing data")
+	}
+	p.dfa = dfa
+	p.acceptStateIndex = acceptStateIndex
+	p.epsNt = epsNt
+	p.generator = nil
+	return nil
+}
+
+type tableReader struct {
+	*bytes.Reader
+}
+
+func openTable(data []byte, magic string, version uint64, g Grammar) (*tableReader, error) {
+	if len(data) < len(magic) || string(data[:len(magic)]) != magic {
+		return nil, errors.New("not a parser table encoding")
+	}
+	in := &tableReader{bytes.NewReader(data[len(magic):])}
+	v, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, errors.New("parser tables: truncated header")
+	}
+	if v != version {
+		return nil, errors.New(fmt.Sprintf("parser tables: unsupported version %d", v))
+	}
+	var fp [32]byte
+	if n, _ := in.Read(fp[:]); n != len(fp) {
+		return nil, errors.New("parser tables: truncated header")
+	}
+	if fp != GrammarFingerprint(g) {
+		return nil, errors.New("parser tables were generated from a different grammar")
+	}
+	return in, nil
+}
+
+func (in *tableReader) readInt() (int, error) {
+	v, err := binary.ReadUvarint(in)
+	if err != nil {
+		return 0, errors.New("parser tables: truncated data")
+	}
+	if v > uint64(^uint32(0)) {
+		return 0, errors.New(fmt.Sprintf("parser tables: value %d out of range", v))
+	}
+	return int(v), nil
+}
+
+// readCount reads the length of an encoded sequence, each element of which
+// takes at least one byte, so that corrupt tables cannot demand more memory
+// than their own size.
+func (in *tableReader) readCount() (int, error) {
+	n, err := in.readInt()
+	if err != nil {
+		return 0, err
+	}
+	if n > in.Len() {
+		return 0, errors.New(fmt.Sprintf("parser tables: count %d exceeds remaining data", n))
+	}
+	return n, nil
+}
+
+func grammarTermsById(g Grammar) map[uint32]Term {
+	terms := make(map[uint32]Term)
+	for _, t := range []Term{g.Asterisk(), g.Epsilon(), g.Bottom()} {
+		terms[t.Id()] = t
+	}
+	for i := 0; i < g.NumTerminal(); i++ {
+		terms[g.Terminal(i).Id()] = g.Terminal(i)
+	}
+	for i := 0; i < g.NumNonterminal(); i++ {
+		terms[g.Nonterminal(i).Id()] = g.Nonterminal(i)
+	}
+	return terms
+}
+
+// EarleyTables is the exported form of the tables driving a parser created
+// by GenerateEarleyParser or LoadEarleyParser, for use by code generators.
+// Transitions are keyed by term id; reductions are production rule indexes
+// in the parser grammar.
+type EarleyTables struct {
+	AcceptState int
+	States      []EarleyTableState
+	Nullable    []uint32
+}
+
+type EarleyTableState struct {
+	Transitions map[uint32]int
+	Reductions  []int
+}
+
+func GetEarleyTables(p Parser) (*EarleyTables, error) {
+	ep, ok := p.(*earleyParser)
+	if !ok {
+		return nil, errors.New("parser was not created by GenerateEarleyParser")
+	}
+	prodIndex := make(map[uint32]int)
+	for i := 0; i < ep.grammar.NumProductionRule(); i++ {
+		prodIndex[ep.grammar.ProductionRule(i).Id()] = i
+	}
+	tables := &EarleyTables{
+		AcceptState: ep.acceptStateIndex,
+		States:      make([]EarleyTableState, len(ep.dfa)),
+	}
+	for i := 0; i < len(ep.dfa); i++ {
+		st := &tables.States[i]
+		st.Transitions = make(map[uint32]int)
+		for t, ns := range ep.dfa[i].transitions {
+			st.Transitions[uint32(t)] = ns
+		}
+		for _, pr := range ep.dfa[i].reductions {
+			st.Reductions = append(st.Reductions, prodIndex[pr.Id()])
+		}
+	}
+	for id := range ep.epsNt {
+		tables.Nullable = append(tables.Nullable, uint32(id))
+	}
+	sort.Sort(uint32Sort(tables.Nullable))
+	return tables, nil
+}
+
+type uint32Sort []uint32
+
+func (us uint32Sort) Len() int           { return len(us) }
+func (us uint32Sort) Less(i, j int) bool { return us[i] < us[j] }
+func (us uint32Sort) Swap(i, j int)      { us[i], us[j] = us[j], us[i] }
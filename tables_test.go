@@ -0,0 +1,112 @@
+package parser
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"testing"
+)
+
+func TestParserTables(t *testing.T) {
+	lexer, err := NewBnf0Lexer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p, err := GenerateEarleyParser(lexer.Grammar())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := p.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded, err := LoadEarleyParser(lexer.Grammar(), data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var trees [2]bytes.Buffer
+	for i, pp := range []Parser{p, loaded} {
+		lex, err := lexer.Open(NewStringReader(bnf1InText))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ps, err := pp.Open(lex)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ast, err := ps.Parse()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = WriteTreeJSON(ast, &trees[i]); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if trees[0].String() != trees[1].String() {
+		t.Error("loaded parser tables do not parse as the original parser")
+	}
+	data2, err := loaded.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(data, data2) {
+		t.Error("parser tables did not round-trip")
+	}
+	ast, err := parseBnf0Text(bnf1InText)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	g, err := GetGrammarFromBnf0Ast(ast)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = LoadEarleyParser(g, data); err == nil {
+		t.Error("parser tables loaded against the wrong grammar")
+	}
+}
+
+func TestCorruptParserTables(t *testing.T) {
+	lexer, err := NewBnf0Lexer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	g := lexer.Grammar()
+	p, err := GenerateEarleyParser(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := p.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := LoadEarleyParser(g, data[:n]); err == nil {
+			t.Errorf("parser tables truncated to %d of %d bytes loaded", n, len(data))
+			return
+		}
+	}
+	// magic, version and grammar fingerprint
+	header := data[:len(earleyTableMagic)+1+32]
+	hugeStates := binary.AppendUvarint(append(append([]byte{}, header...), 0), 0xFFFFFFF0)
+	if _, err := LoadEarleyParser(g, hugeStates); err == nil {
+		t.Error("parser tables with an impossible state count loaded")
+	}
+	badAccept := append(append([]byte{}, header...), 5, 2, 0, 0, 0, 0, 0)
+	if _, err := LoadEarleyParser(g, badAccept); err == nil {
+		t.Error("parser tables with an unknown accept state loaded")
+	}
+}
@@ -0,0 +1,181 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+type TraceEventType uint8
+
+const (
+	// TraceItemSet is emitted by parser generators for each new LR(0) item state.
+	TraceItemSet TraceEventType = iota
+	// TraceScan is emitted when a parser advances an item over the current token.
+	TraceScan
+	// TracePredict is emitted when a parser adds the nonkernel (`e) successor of a state.
+	TracePredict
+	// TraceComplete is emitted when a parser completes a production and advances its parent.
+	TraceComplete
+	// TraceTransition is emitted when a lexer DFA consumes a rune.
+	TraceTransition
+	// TraceIgnore is emitted when a lexer discards input matched by a block ignore expression.
+	TraceIgnore
+	// TraceAccept is emitted when a lexer accepts a token.
+	TraceAccept
+	// TraceBacktrack is emitted when a lexer returns to its last accepting state.
+	TraceBacktrack
+)
+
+var traceEventTypeNames = []string{"itemset", "scan", "predict", "complete", "transition", "ignore", "accept", "backtrack"}
+
+func (tt TraceEventType) String() string {
+	if int(tt) < len(traceEventTypeNames) {
+		return traceEventTypeNames[tt]
+	}
+	return fmt.Sprintf("trace-event-%d", tt)
+}
+
+// TraceEvent describes one step of parser generation, parsing or lexing.
+// Only the fields meaningful for the event type are set; for parser
+// events Set is the index of the Earley set and State/NextState are item
+// state ids, for lexer events State/NextState are DFA state ids and
+// Line/Column/Position locate the rune consumed or the token accepted.
+type TraceEvent struct {
+	Type      TraceEventType
+	Set       int
+	State     int
+	NextState int
+	Parent    int
+	Items     []string
+	Term      Term
+	Rule      ProductionRule
+	Token     Token
+	Rune      rune
+	Line      int
+	Column    int
+	Position  int
+}
+
+// A Tracer receives TraceEvents from parsers and lexers it is attached to.
+// Tracing is disabled by a nil Tracer, in which case no events are built.
+type Tracer interface {
+	Trace(ev *TraceEvent)
+}
+
+// Traceable is implemented by parsers, lexers and their states which can
+// emit trace events.  A tracer set on a Parser or Lexer is inherited by the
+// states it subsequently opens.
+type Traceable interface {
+	SetTracer(tracer Tracer)
+	Tracer() Tracer
+}
+
+func NewTextTracer(out io.Writer) Tracer {
+	return &textTracer{out: out}
+}
+
+func NewJSONTracer(out io.Writer) Tracer {
+	return &jsonTracer{enc: json.NewEncoder(out)}
+}
+
+///
+
+type textTracer struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func (tt *textTracer) Trace(ev *TraceEvent) {
+	var line string
+	switch ev.Type {
+	case TraceItemSet:
+		line = fmt.Sprintf("itemset [%d]", ev.State)
+		for _, item := range ev.Items {
+			line += "\n    " + item
+		}
+	case TraceScan:
+		line = fmt.Sprintf("scan <%d> (%d,%d) -> (%d,%d) %s '%s'", ev.Set, ev.State, ev.Parent, ev.NextState, ev.Parent,
+			TermToString(ev.Token.Terminal()), ev.Token.Literal())
+	case TracePredict:
+		line = fmt.Sprintf("predict <%d> (%d) -> (%d,%d)", ev.Set, ev.State, ev.NextState, ev.Parent)
+	case TraceComplete:
+		line = fmt.Sprintf("complete <%d> (%d) %s -> (%d,%d)", ev.Set, ev.State, ProductionRuleToString(ev.Rule), ev.NextState, ev.Parent)
+	case TraceTransition:
+		line = fmt.Sprintf("transition (%d) '%c' -> (%d) at %d:%d(%d)", ev.State, ev.Rune, ev.NextState, ev.Line, ev.Column, ev.Position)
+	case TraceIgnore:
+		line = fmt.Sprintf("ignore (%d) -> (%d) at %d:%d(%d)", ev.State, ev.NextState, ev.Line, ev.Column, ev.Position)
+	case TraceAccept:
+		line = fmt.Sprintf("accept (%d) %s '%s' -> (%d) at %d:%d(%d)", ev.State, TermToString(ev.Term), ev.Token.Literal(), ev.NextState,
+			ev.Line, ev.Column, ev.Position)
+	case TraceBacktrack:
+		line = fmt.Sprintf("backtrack (%d) -> (%d) at %d:%d(%d)", ev.State, ev.NextState, ev.Line, ev.Column, ev.Position)
+	default:
+		line = ev.Type.String()
+	}
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.out.Write([]byte(line + "\n"))
+}
+
+type jsonTracer struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+type jsonTraceEvent struct {
+	Event     string   `json:"event"`
+	Set       *int     `json:"set,omitempty"`
+	State     int      `json:"state"`
+	NextState *int     `json:"next,omitempty"`
+	Parent    *int     `json:"parent,omitempty"`
+	Items     []string `json:"items,omitempty"`
+	Term      string   `json:"term,omitempty"`
+	Rule      string   `json:"rule,omitempty"`
+	Literal   *string  `json:"literal,omitempty"`
+	Rune      *string  `json:"rune,omitempty"`
+	Line      int      `json:"line,omitempty"`
+	Column    int      `json:"column,omitempty"`
+	Position  *int     `json:"position,omitempty"`
+}
+
+func (jt *jsonTracer) Trace(ev *TraceEvent) {
+	je := &jsonTraceEvent{
+		Event: ev.Type.String(),
+		State: ev.State,
+		Items: ev.Items,
+	}
+	next := ev.NextState
+	switch ev.Type {
+	case TraceScan, TracePredict, TraceComplete:
+		set, parent := ev.Set, ev.Parent
+		je.Set = &set
+		je.NextState = &next
+		je.Parent = &parent
+	case TraceTransition, TraceIgnore, TraceAccept, TraceBacktrack:
+		pos := ev.Position
+		je.NextState = &next
+		je.Line, je.Column, je.Position = ev.Line, ev.Column, &pos
+		if ev.Type == TraceTransition {
+			r := string([]rune{ev.Rune})
+			je.Rune = &r
+		}
+	}
+	if ev.Term != nil {
+		je.Term = TermToString(ev.Term)
+	}
+	if ev.Rule != nil {
+		je.Rule = ProductionRuleToString(ev.Rule)
+	}
+	if ev.Token != nil {
+		lit := ev.Token.Literal()
+		je.Literal = &lit
+		if ev.Term == nil {
+			je.Term = TermToString(ev.Token.Terminal())
+		}
+	}
+	jt.lock.Lock()
+	defer jt.lock.Unlock()
+	jt.enc.Encode(je)
+}
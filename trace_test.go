@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type countingTracer struct {
+	counts map[TraceEventType]int
+}
+
+func (ct *countingTracer) Trace(ev *TraceEvent) {
+	ct.counts[ev.Type]++
+}
+
+func TestTrace(t *testing.T) {
+	lexer, err := NewBnf0Lexer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ct := &countingTracer{counts: make(map[TraceEventType]int)}
+	p, err := GenerateEarleyParserWithTracer(lexer.Grammar(), ct)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ct.counts[TraceItemSet] != len(p.(*earleyParser).generator.states) {
+		t.Errorf("expected one itemset event per state, got %d", ct.counts[TraceItemSet])
+	}
+	var jsonOut bytes.Buffer
+	p.(Traceable).SetTracer(NewJSONTracer(&jsonOut))
+	lex, err := lexer.Open(NewStringReader(bnf1InText))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ps, err := p.Open(lex)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = ps.Parse(); err != nil {
+		t.Error(err)
+		return
+	}
+	seen := make(map[string]int)
+	dec := json.NewDecoder(&jsonOut)
+	for dec.More() {
+		var ev map[string]interface{}
+		if err := dec.Decode(&ev); err != nil {
+			t.Error(err)
+			return
+		}
+		seen[ev["event"].(string)]++
+	}
+	for _, name := range []string{"scan", "predict", "complete"} {
+		if seen[name] == 0 {
+			t.Errorf("no %s events traced", name)
+		}
+	}
+	var textOut bytes.Buffer
+	p.(Traceable).SetTracer(NewTextTracer(&textOut))
+	lex, err = lexer.Open(NewStringReader("<a> := B\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ps, err = p.Open(lex); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = ps.Parse(); err != nil {
+		t.Error(err)
+		return
+	}
+	// State numbers vary between generated parsers, so only the formats,
+	// the scanned tokens and the completed rules are checked.
+	scanRe := regexp.MustCompile(`^scan <(\d+)> \(\d+,\d+\) -> \(\d+,\d+\) (\S+) '(.*)'$`)
+	predictRe := regexp.MustCompile(`^predict <\d+> \(\d+\) -> \(\d+,\d+\)$`)
+	completeRe := regexp.MustCompile(`^complete <\d+> \(\d+\) (.+) -> \(\d+,\d+\)$`)
+	var scans []string
+	completed := make(map[string]bool)
+	predicts := 0
+	for _, line := range strings.Split(strings.TrimSuffix(textOut.String(), "\n"), "\n") {
+		if m := scanRe.FindStringSubmatch(line); m != nil {
+			scans = append(scans, m[1]+" "+m[2]+" "+m[3])
+		} else if m := completeRe.FindStringSubmatch(line); m != nil {
+			completed[m[1]] = true
+		} else if predictRe.MatchString(line) {
+			predicts++
+		} else {
+			t.Errorf("unexpected text trace line %q", line)
+		}
+	}
+	if expect := "0 LT <,1 ID a,2 RT >,3 EQDEF :=,4 ID B,5 `. "; strings.Join(scans, ",") != expect {
+		t.Errorf("text trace scanned %s, expected %s", strings.Join(scans, ","), expect)
+	}
+	for _, rule := range []string{"<nt> := LT ID RT", "<t> := ID", "<decl> := <nt> EQDEF <optlist>"} {
+		if !completed[rule] {
+			t.Errorf("text trace does not complete %s", rule)
+		}
+	}
+	if predicts == 0 {
+		t.Error("text trace has no predict lines")
+	}
+}
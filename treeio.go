@@ -0,0 +1,413 @@
+package parser
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+	Parse tree serialization.  Every format records, for each interior node,
+	its nonterminal and the id and text of its production rule, and for each
+	leaf its terminal, token literal and first/last line, column and
+	position.
+
+	JSON:		{"term":"<decl>","production":{"id":104,"rule":"<decl> := ...",
+				 "lhs":"<decl>","rhs":["<nt>","EQDEF","<optlist>"]},"children":[...]}
+				{"term":"ID","token":{"literal":"x","first":{...},"last":{...}}}
+
+	S-expr:		(decl :id 104 :rule "<decl> := ..." child ...)
+				(ID :literal "x" :first (line col pos) :last (line col pos))
+
+	XML:		<nonterminal name="decl" production="104" rule="...">...</nonterminal>
+				<terminal name="ID" first-line=".." ... last-position="..">x</terminal>
+
+	Terms are written in TermToString() form in JSON, which is what allows
+	ReadTreeJSON to rebuild a detached grammar for the tree.
+*/
+
+func WriteTreeJSON(node ParseTreeNode, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newJsonParseTreeNode(node))
+}
+
+func WriteTreeSexpr(node ParseTreeNode, out io.Writer) error {
+	bout := bufio.NewWriter(out)
+	writeTreeSexprNode(node, bout, 0)
+	bout.WriteByte('\n')
+	return bout.Flush()
+}
+
+func WriteTreeXML(node ParseTreeNode, out io.Writer) error {
+	bout := bufio.NewWriter(out)
+	bout.WriteString(xml.Header)
+	if err := writeTreeXMLNode(node, bout, 0); err != nil {
+		return err
+	}
+	return bout.Flush()
+}
+
+// ReadTreeJSON reads a tree written by WriteTreeJSON.  The nodes, terms,
+// productions and tokens returned are detached: they belong to a grammar
+// reconstructed from the tree alone, and have no Parser() or LexerState().
+func ReadTreeJSON(in io.Reader) (ParseTreeNode, error) {
+	var jn jsonParseTreeNode
+	if err := json.NewDecoder(in).Decode(&jn); err != nil {
+		return nil, err
+	}
+	db := newDetachedGrammarBuilder()
+	return db.buildNode(&jn)
+}
+
+///
+
+type jsonParseTreeNode struct {
+	Term       string               `json:"term"`
+	Production *jsonProductionRule  `json:"production,omitempty"`
+	Token      *jsonToken           `json:"token,omitempty"`
+	Children   []*jsonParseTreeNode `json:"children,omitempty"`
+}
+
+type jsonProductionRule struct {
+	Id   uint32   `json:"id"`
+	Rule string   `json:"rule"`
+	Lhs  string   `json:"lhs"`
+	Rhs  []string `json:"rhs"`
+}
+
+type jsonToken struct {
+	Literal string            `json:"literal"`
+	First   jsonTokenPosition `json:"first"`
+	Last    jsonTokenPosition `json:"last"`
+}
+
+type jsonTokenPosition struct {
+	Line     int `json:"line"`
+	Column   int `json:"column"`
+	Position int `json:"position"`
+}
+
+func newJsonParseTreeNode(node ParseTreeNode) *jsonParseTreeNode {
+	jn := &jsonParseTreeNode{}
+	if t := parseTreeNodeTerm(node); t != nil {
+		jn.Term = TermToString(t)
+	}
+	if pr := node.Production(); pr != nil {
+		jn.Production = &jsonProductionRule{
+			Id:   pr.Id(),
+			Rule: ProductionRuleToString(pr),
+			Lhs:  TermToString(pr.Lhs()),
+			Rhs:  make([]string, pr.RhsLen()),
+		}
+		for i := 0; i < pr.RhsLen(); i++ {
+			jn.Production.Rhs[i] = TermToString(pr.Rhs(i))
+		}
+		for _, c := range parseTreeNodeChildren(node) {
+			jn.Children = append(jn.Children, newJsonParseTreeNode(c))
+		}
+	} else if tok := node.Token(); tok != nil {
+		jn.Token = &jsonToken{
+			Literal: tok.Literal(),
+			First: jsonTokenPosition{
+				Line:     tok.FirstLine(),
+				Column:   tok.FirstColumn(),
+				Position: tok.FirstPosition(),
+			},
+			Last: jsonTokenPosition{
+				Line:     tok.LastLine(),
+				Column:   tok.LastColumn(),
+				Position: tok.LastPosition(),
+			},
+		}
+	}
+	return jn
+}
+
+func writeTreeIndent(out *bufio.Writer, indent int) {
+	for i := 0; i < indent; i++ {
+		out.WriteString("  ")
+	}
+}
+
+func writeTreeSexprNode(node ParseTreeNode, out *bufio.Writer, indent int) {
+	name := "?"
+	if t := parseTreeNodeTerm(node); t != nil {
+		name = t.Name()
+	}
+	out.WriteByte('(')
+	out.WriteString(name)
+	if pr := node.Production(); pr != nil {
+		out.WriteString(fmt.Sprintf(" :id %d :rule %s", pr.Id(), strconv.Quote(ProductionRuleToString(pr))))
+		for _, c := range parseTreeNodeChildren(node) {
+			out.WriteByte('\n')
+			writeTreeIndent(out, indent+1)
+			writeTreeSexprNode(c, out, indent+1)
+		}
+	} else if tok := node.Token(); tok != nil {
+		out.WriteString(fmt.Sprintf(" :literal %s :first (%d %d %d) :last (%d %d %d)",
+			strconv.Quote(tok.Literal()),
+			tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition(),
+			tok.LastLine(), tok.LastColumn(), tok.LastPosition()))
+	}
+	out.WriteByte(')')
+}
+
+func writeTreeXMLEscaped(out *bufio.Writer, s string) error {
+	return xml.EscapeText(out, []byte(s))
+}
+
+func writeTreeXMLNode(node ParseTreeNode, out *bufio.Writer, indent int) error {
+	name := ""
+	if t := parseTreeNodeTerm(node); t != nil {
+		name = t.Name()
+	}
+	writeTreeIndent(out, indent)
+	if pr := node.Production(); pr != nil {
+		out.WriteString("<nonterminal name=\"")
+		if err := writeTreeXMLEscaped(out, name); err != nil {
+			return err
+		}
+		out.WriteString(fmt.Sprintf("\" production=\"%d\" rule=\"", pr.Id()))
+		if err := writeTreeXMLEscaped(out, ProductionRuleToString(pr)); err != nil {
+			return err
+		}
+		out.WriteString("\">\n")
+		for _, c := range parseTreeNodeChildren(node) {
+			if err := writeTreeXMLNode(c, out, indent+1); err != nil {
+				return err
+			}
+		}
+		writeTreeIndent(out, indent)
+		out.WriteString("</nonterminal>\n")
+		return nil
+	}
+	out.WriteString("<terminal name=\"")
+	if err := writeTreeXMLEscaped(out, name); err != nil {
+		return err
+	}
+	out.WriteByte('"')
+	tok := node.Token()
+	if tok == nil {
+		out.WriteString("/>\n")
+		return nil
+	}
+	out.WriteString(fmt.Sprintf(" first-line=\"%d\" first-column=\"%d\" first-position=\"%d\" last-line=\"%d\" last-column=\"%d\" last-position=\"%d\">",
+		tok.FirstLine(), tok.FirstColumn(), tok.FirstPosition(),
+		tok.LastLine(), tok.LastColumn(), tok.LastPosition()))
+	if err := writeTreeXMLEscaped(out, tok.Literal()); err != nil {
+		return err
+	}
+	out.WriteString("</terminal>\n")
+	return nil
+}
+
+type detachedGrammarBuilder struct {
+	grammar     *stdGrammar
+	terms       map[string]*stdTerm
+	productions map[uint32]*stdProduction
+	nextId      uint32
+}
+
+type detachedParseTreeNode struct {
+	rule     ProductionRule
+	token    Token
+	children []*detachedParseTreeNode
+}
+
+type detachedToken struct {
+	pos  [6]int
+	term Term
+	lit  string
+}
+
+func newDetachedGrammarBuilder() *detachedGrammarBuilder {
+	g := &stdGrammar{}
+	g.asterisk = &stdTerm{
+		grammar: g,
+		nonterm: true,
+		special: true,
+		name:    "`*",
+		id:      1,
+	}
+	g.epsilon = &stdTerm{
+		grammar: g,
+		special: true,
+		name:    "`e",
+		id:      2,
+	}
+	g.bottom = &stdTerm{
+		grammar: g,
+		special: true,
+		name:    "`.",
+		id:      3,
+	}
+	return &detachedGrammarBuilder{
+		grammar: g,
+		terms: map[string]*stdTerm{
+			"`*": g.asterisk,
+			"`e": g.epsilon,
+			"`.": g.bottom,
+		},
+		productions: make(map[uint32]*stdProduction),
+		nextId:      100,
+	}
+}
+
+func (db *detachedGrammarBuilder) getTerm(str string) (*stdTerm, error) {
+	if t, has := db.terms[str]; has {
+		return t, nil
+	}
+	if str == "" || str[0] == '`' {
+		return nil, errors.New("invalid term '" + str + "' in serialized tree")
+	}
+	t := &stdTerm{
+		grammar: db.grammar,
+		name:    str,
+		id:      db.nextId,
+	}
+	if strings.HasPrefix(str, "<") && strings.HasSuffix(str, ">") {
+		t.nonterm = true
+		t.name = str[1 : len(str)-1]
+		db.grammar.nonterminals = append(db.grammar.nonterminals, t)
+	} else {
+		db.grammar.terminals = append(db.grammar.terminals, t)
+	}
+	db.nextId++
+	db.terms[str] = t
+	return t, nil
+}
+
+func (db *detachedGrammarBuilder) getProduction(jp *jsonProductionRule) (*stdProduction, error) {
+	lhs, err := db.getTerm(jp.Lhs)
+	if err != nil {
+		return nil, err
+	}
+	pr := &stdProduction{
+		grammar: db.grammar,
+		id:      jp.Id,
+		lhs:     lhs,
+		rhs:     make([]Term, len(jp.Rhs)),
+	}
+	for i, r := range jp.Rhs {
+		if pr.rhs[i], err = db.getTerm(r); err != nil {
+			return nil, err
+		}
+	}
+	if epr, has := db.productions[jp.Id]; has {
+		if !epr.Equals(pr) {
+			return nil, errors.New(fmt.Sprintf("conflicting definitions of production %d in serialized tree", jp.Id))
+		}
+		return epr, nil
+	}
+	db.productions[jp.Id] = pr
+	db.grammar.productions = append(db.grammar.productions, pr)
+	return pr, nil
+}
+
+func (db *detachedGrammarBuilder) buildNode(jn *jsonParseTreeNode) (*detachedParseTreeNode, error) {
+	dn := &detachedParseTreeNode{}
+	if jn.Production != nil {
+		pr, err := db.getProduction(jn.Production)
+		if err != nil {
+			return nil, err
+		}
+		dn.rule = pr
+		if len(jn.Children) != pr.RhsLen() {
+			return nil, errors.New(fmt.Sprintf("production %d has %d children in serialized tree, expected %d", pr.id, len(jn.Children), pr.RhsLen()))
+		}
+		dn.children = make([]*detachedParseTreeNode, len(jn.Children))
+		for i, jc := range jn.Children {
+			if dn.children[i], err = db.buildNode(jc); err != nil {
+				return nil, err
+			}
+		}
+		return dn, nil
+	}
+	if jn.Token == nil {
+		return nil, errors.New("serialized tree node has neither production nor token")
+	}
+	term, err := db.getTerm(jn.Term)
+	if err != nil {
+		return nil, err
+	}
+	f, l := jn.Token.First, jn.Token.Last
+	dn.token = &detachedToken{
+		pos:  [6]int{f.Position, f.Line, f.Column, l.Position, l.Line, l.Column},
+		term: term,
+		lit:  jn.Token.Literal,
+	}
+	return dn, nil
+}
+
+func (dn *detachedParseTreeNode) Parser() Parser {
+	return nil
+}
+
+func (dn *detachedParseTreeNode) Token() Token {
+	return dn.token
+}
+
+func (dn *detachedParseTreeNode) Production() ProductionRule {
+	return dn.rule
+}
+
+func (dn *detachedParseTreeNode) NumChildren() int {
+	return len(dn.children)
+}
+
+func (dn *detachedParseTreeNode) Child(idx int) ParseTreeNode {
+	if idx < 0 || idx >= len(dn.children) {
+		return nil
+	}
+	return dn.children[idx]
+}
+
+func (dn *detachedParseTreeNode) Children() []ParseTreeNode {
+	ret := make([]ParseTreeNode, len(dn.children))
+	for i, c := range dn.children {
+		ret[i] = c
+	}
+	return ret
+}
+
+func (t *detachedToken) LexerState() LexerState {
+	return nil
+}
+
+func (t *detachedToken) FirstPosition() int {
+	return t.pos[0]
+}
+
+func (t *detachedToken) LastPosition() int {
+	return t.pos[3]
+}
+
+func (t *detachedToken) FirstLine() int {
+	return t.pos[1]
+}
+
+func (t *detachedToken) LastLine() int {
+	return t.pos[4]
+}
+
+func (t *detachedToken) FirstColumn() int {
+	return t.pos[2]
+}
+
+func (t *detachedToken) LastColumn() int {
+	return t.pos[5]
+}
+
+func (t *detachedToken) Terminal() Term {
+	return t.term
+}
+
+func (t *detachedToken) Literal() string {
+	return t.lit
+}
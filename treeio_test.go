@@ -0,0 +1,95 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+)
+
+func TestTreeSerialization(t *testing.T) {
+	ast, err := parseBnf0Text(bnf1InText)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var jsonOut bytes.Buffer
+	if err = WriteTreeJSON(ast, &jsonOut); err != nil {
+		t.Error(err)
+		return
+	}
+	detached, err := ReadTreeJSON(bytes.NewReader(jsonOut.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var jsonOut2 bytes.Buffer
+	if err = WriteTreeJSON(detached, &jsonOut2); err != nil {
+		t.Error(err)
+		return
+	}
+	if jsonOut.String() != jsonOut2.String() {
+		t.Error("JSON tree serialization did not round-trip")
+	}
+	if len(MustCompileTreeQuery("decl > nt > ID").Select(detached)) != 7 {
+		t.Error("detached tree does not have the structure of the original")
+	}
+
+	small, err := parseBnf0Text("<a> := B | `.\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var sexprOut bytes.Buffer
+	if err = WriteTreeSexpr(small, &sexprOut); err != nil {
+		t.Error(err)
+		return
+	}
+	expectSexpr := "(`* :id 115 :rule \"`* := <bnf0> `.\"\n" +
+		"  (bnf0 :id 116 :rule \"<bnf0> := <decl>\"\n" +
+		"    (decl :id 118 :rule \"<decl> := <nt> EQDEF <optlist>\"\n" +
+		"      (nt :id 125 :rule \"<nt> := LT ID RT\"\n" +
+		"        (LT :literal \"<\" :first (1 1 0) :last (1 1 0))\n" +
+		"        (ID :literal \"a\" :first (1 2 1) :last (1 2 1))\n" +
+		"        (RT :literal \">\" :first (1 3 2) :last (1 3 2)))\n" +
+		"      (EQDEF :literal \":=\" :first (1 5 4) :last (1 6 5))\n" +
+		"      (optlist :id 120 :rule \"<optlist> := <opt> PIPE <optlist>\"\n" +
+		"        (opt :id 121 :rule \"<opt> := <term>\"\n" +
+		"          (term :id 124 :rule \"<term> := <t>\"\n" +
+		"            (t :id 127 :rule \"<t> := ID\"\n" +
+		"              (ID :literal \"B\" :first (1 8 7) :last (1 8 7)))))\n" +
+		"        (PIPE :literal \"|\" :first (1 10 9) :last (1 10 9))\n" +
+		"        (optlist :id 119 :rule \"<optlist> := <opt>\"\n" +
+		"          (opt :id 121 :rule \"<opt> := <term>\"\n" +
+		"            (term :id 124 :rule \"<term> := <t>\"\n" +
+		"              (t :id 129 :rule \"<t> := BOT\"\n" +
+		"                (BOT :literal \"`.\" :first (1 12 11) :last (1 13 12)))))))))\n" +
+		"  (`. :literal \"\" :first (2 1 14) :last (2 1 14)))\n"
+	if sexprOut.String() != expectSexpr {
+		t.Errorf("unexpected S-expression output:\n%s", sexprOut.String())
+	}
+
+	var xmlOut bytes.Buffer
+	if err = WriteTreeXML(ast, &xmlOut); err != nil {
+		t.Error(err)
+		return
+	}
+	dec := xml.NewDecoder(&xmlOut)
+	elements := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			elements++
+		}
+	}
+	if elements != len(MustCompileTreeQuery("*").Select(ast)) {
+		t.Errorf("XML output has %d elements, expected one per tree node", elements)
+	}
+}
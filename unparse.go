@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"bufio"
+	"io"
+)
+
+// Unparse writes the text node was parsed from: the literals of the tokens at
+// its leaves, in order, each with its leading and trailing trivia if it is a
+// TriviaToken.  The output reproduces the input exactly when node is the
+// root of the tree and its lexer kept all ignored input as trivia.
+func Unparse(node ParseTreeNode, out io.Writer) error {
+	bout := bufio.NewWriter(out)
+	unparseNode(node, bout)
+	return bout.Flush()
+}
+
+func unparseNode(node ParseTreeNode, out *bufio.Writer) {
+	if node.Production() == nil {
+		if tok := node.Token(); tok != nil {
+			unparseToken(tok, out)
+		}
+		return
+	}
+	for _, c := range parseTreeNodeChildren(node) {
+		unparseNode(c, out)
+	}
+}
+
+func unparseToken(tok Token, out *bufio.Writer) {
+	tt, ok := tok.(TriviaToken)
+	if ok {
+		for _, t := range tt.LeadingTrivia() {
+			out.WriteString(t.Literal())
+		}
+	}
+	out.WriteString(tok.Literal())
+	if ok {
+		for _, t := range tt.TrailingTrivia() {
+			out.WriteString(t.Literal())
+		}
+	}
+}